@@ -0,0 +1,128 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/magicdb/storage"
+	"github.com/spf13/viper"
+	"github.com/tecbot/gorocksdb"
+)
+
+var errBackupUsage = errors.New("usage: magicdb backup create|list|verify|restore|purge [flags]")
+
+// runBackup manage backups of a local store. Backups are incremental, each
+// one records the raft index it corresponds to. create asks the leader,
+// through the admin api, to back its running store up into its backup.dir,
+// the other commands work on the backup directory. To restore a cluster
+// consistently, restore the same backup on every node before starting it.
+func runBackup(args []string) error {
+	if len(args) == 0 {
+		return errBackupUsage
+	}
+
+	fs := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	dbDir := fs.String("db", viper.GetString("dataDir"), "data directory of the store")
+	dir := fs.String("dir", viper.GetString("backup.dir"), "backup directory")
+	keep := fs.Uint("keep", uint(viper.GetInt("backup.retain")), "number of backups to keep, 0 keeps all")
+	id := fs.Uint("id", 0, "backup id, 0 is the latest")
+	endpoints := fs.String("endpoints", strings.Join(viper.GetStringSlice("http.endpoints"), ","), "comma separated http endpoints of the cluster, for create")
+	token := fs.String("token", os.Getenv("MAGICDB_TOKEN"), "auth token of an admin user, $MAGICDB_TOKEN by default")
+	tlsOpts := tlsFlags(fs)
+	fs.Parse(args[1:])
+
+	opts := storage.NewDefaultOptions()
+
+	switch args[0] {
+	case "create":
+		c, err := newClient(*endpoints, *token, tlsOpts)
+		if err != nil {
+			return err
+		}
+		info, err := c.Backup()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created backup %d at raft index %d\n", info.ID, info.AppliedIndex)
+
+		// the old backups are purged when the command runs on the node
+		if _, err := os.Stat(*dir); *keep > 0 && err == nil {
+			return storage.PurgeBackups(opts, *dir, uint32(*keep))
+		}
+		return nil
+
+	case "list":
+		infos, err := storage.ListBackups(opts, *dir)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tSIZE\tFILES\tRAFT INDEX")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\n", info.ID,
+				time.Unix(info.Timestamp, 0).Format(time.RFC3339),
+				info.Size, info.NumFiles, info.AppliedIndex)
+		}
+		return w.Flush()
+
+	case "verify":
+		backupID, err := resolveBackupID(opts, *dir, uint32(*id))
+		if err != nil {
+			return err
+		}
+		if err := storage.VerifyBackup(opts, *dir, backupID); err != nil {
+			return err
+		}
+		fmt.Printf("backup %d is ok\n", backupID)
+		return nil
+
+	case "restore":
+		backupID, err := resolveBackupID(opts, *dir, uint32(*id))
+		if err != nil {
+			return err
+		}
+		info, err := storage.RestoreBackup(opts, *dir, backupID, *dbDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored backup %d at raft index %d into %s\n", info.ID, info.AppliedIndex, *dbDir)
+		return nil
+
+	case "purge":
+		return storage.PurgeBackups(opts, *dir, uint32(*keep))
+	}
+	return errBackupUsage
+}
+
+// resolveBackupID return id, or the latest backup id when id is 0
+func resolveBackupID(opts *gorocksdb.Options, dir string, id uint32) (uint32, error) {
+	if id != 0 {
+		return id, nil
+	}
+	infos, err := storage.ListBackups(opts, dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(infos) == 0 {
+		return 0, storage.ErrBackupNotFound
+	}
+	return infos[len(infos)-1].ID, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/magicdb/storage"
+	"github.com/spf13/viper"
+)
+
+// runSST build a sst file offline from a jsonl or csv file, as written by
+// export. The input must be sorted by key.
+func runSST(args []string) error {
+	fs := flag.NewFlagSet("sst", flag.ExitOnError)
+	format := fs.String("format", "", "input format, jsonl or csv, default from the file extension")
+	out := fs.String("o", "", "output sst file, default <input>.sst")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: magicdb sst [flags] file")
+	}
+	input := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(input), ".")
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(input, filepath.Ext(input)) + ".sst"
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rr, err := newRecordReader(*format, f)
+	if err != nil {
+		return err
+	}
+
+	w, err := storage.NewSSTWriter(storage.NewDefaultOptions(), *out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		k, v, err := rec.decode()
+		if err != nil {
+			return err
+		}
+		if storage.IsSystemKey(k) {
+			return fmt.Errorf("key %q is in the reserved keyspace", k)
+		}
+		if err := w.Add(k, v); err != nil {
+			return fmt.Errorf("record %d: %v", w.Count()+1, err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		return err
+	}
+	log.Printf("wrote %d keys to %s", w.Count(), *out)
+	return nil
+}
+
+// runIngest ingest sst files into the cluster, every replica ingests the
+// same file at the same raft log index.
+func runIngest(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	endpoints := fs.String("endpoints", strings.Join(viper.GetStringSlice("http.endpoints"), ","), "comma separated http endpoints of the cluster")
+	token := fs.String("token", os.Getenv("MAGICDB_TOKEN"), "auth token of an admin user, $MAGICDB_TOKEN by default")
+	tlsOpts := tlsFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: magicdb ingest [flags] file.sst...")
+	}
+
+	c, err := newClient(*endpoints, *token, tlsOpts)
+	if err != nil {
+		return err
+	}
+	for _, file := range fs.Args() {
+		if err := c.IngestFile(file); err != nil {
+			return fmt.Errorf("ingest %s: %v", file, err)
+		}
+		log.Printf("ingested %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Status is the raft state of a node
+type Status struct {
+	ID         string            `json:"id"`
+	Leader     string            `json:"leader"`
+	Stats      map[string]string `json:"stats"`
+	Encryption EncryptionStatus  `json:"encryption"`
+}
+
+// EncryptionStatus is the encryption at rest of a node
+type EncryptionStatus struct {
+	Enabled   bool   `json:"enabled"`
+	ActiveKey uint32 `json:"activeKey,omitempty"`
+	// Resealing is true while the values are encrypted again with the
+	// active key
+	Resealing bool   `json:"resealing"`
+	Resealed  uint64 `json:"resealed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Member is a server of the cluster
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+}
+
+// NodeStatus is the raft progress a member reports
+type NodeStatus struct {
+	ID           string `json:"id"`
+	State        string `json:"state"`
+	Term         uint64 `json:"term"`
+	LastIndex    uint64 `json:"last_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// LastContact is when a follower last heard from the leader
+	LastContact time.Time `json:"last_contact"`
+	Addrs       []string  `json:"addrs"`
+}
+
+// MemberStatus is a member and its raft progress, Error is set instead of
+// Status when the member did not answer
+type MemberStatus struct {
+	Member
+	Status *NodeStatus `json:"status,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Cluster is the membership of the cluster seen by a node
+type Cluster struct {
+	// ID is the node which answered
+	ID      string         `json:"id"`
+	Leader  string         `json:"leader"`
+	Members []MemberStatus `json:"members"`
+}
+
+// BackupInfo describes a backup taken by Backup
+type BackupInfo struct {
+	ID           uint32
+	Timestamp    int64
+	Size         int64
+	NumFiles     int32
+	AppliedIndex uint64
+	// GroupIndexes is the applied raft index of every range
+	GroupIndexes map[uint64]uint64
+	Labels       map[string]string
+}
+
+type scanResponse struct {
+	KVs  []kv `json:"kvs"`
+	More bool `json:"more"`
+}
+
+type watchEvent struct {
+	Type  string `json:"type"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Index uint64 `json:"index"`
+}
+
+// Scan return at most limit pairs with the prefix after the key start, in
+// key order. more reports whether there are pairs left, pass the last key
+// returned as start to get them. A limit of 0 uses the server's max.
+func (c *Client) Scan(prefix, start []byte, limit int) ([]KV, bool, error) {
+	return c.scan(prefix, start, limit, url.Values{})
+}
+
+// scan is Scan with the query q
+func (c *Client) scan(prefix, start []byte, limit int, q url.Values) ([]KV, bool, error) {
+	q.Set("prefix", string(prefix))
+	q.Set("start", string(start))
+	q.Set("limit", strconv.Itoa(limit))
+	if d := c.maxStaleness(); d > 0 {
+		q.Set("max_staleness", d.String())
+	}
+
+	var sr scanResponse
+	if err := c.read("/v1/scan?"+q.Encode(), &sr); err != nil {
+		return nil, false, err
+	}
+	kvs := make([]KV, len(sr.KVs))
+	for i, p := range sr.KVs {
+		kvs[i] = KV{Key: p.Key, Value: p.Value}
+	}
+	return kvs, sr.More, nil
+}
+
+// Watch the changes of keys with the prefix on the first endpoint that
+// answers. The channel is closed when ctx is done or the connection ends.
+func (c *Client) Watch(ctx context.Context, prefix []byte) (<-chan Event, error) {
+	path := "/v1/watch?prefix=" + url.QueryEscape(string(prefix))
+	lastErr := ErrNoEndpoint
+	for _, ep := range c.endpoints {
+		req, err := c.newRequest(http.MethodGet, ep+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.hc.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := checkResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		ch := make(chan Event, watchBuffer)
+		go func() {
+			defer close(ch)
+			defer resp.Body.Close()
+			dec := json.NewDecoder(resp.Body)
+			for {
+				var we watchEvent
+				if err := dec.Decode(&we); err != nil {
+					return
+				}
+				e := Event{Type: EventPut, Key: we.Key, Value: we.Value, Index: we.Index}
+				if we.Type == "delete" {
+					e.Type = EventDelete
+				}
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+	return nil, lastErr
+}
+
+// Status return the raft state of the first endpoint that answers
+func (c *Client) Status() (*Status, error) {
+	var st Status
+	if err := c.read("/v1/status", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Members return the servers of the cluster
+func (c *Client) Members() ([]Member, error) {
+	var members []Member
+	if err := c.read("/v1/members", &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Cluster return the members and their raft progress, as seen by the
+// first endpoint that answers
+func (c *Client) Cluster() (*Cluster, error) {
+	var cl Cluster
+	if err := c.read("/v1/cluster", &cl); err != nil {
+		return nil, err
+	}
+	return &cl, nil
+}
+
+// AddMember add a voter listening on addr, /ip4/<ip>/tcp/<port>/ipfs/<id>.
+// It joins as a learner and is promoted once it caught up with the leader.
+func (c *Client) AddMember(addr string) error {
+	return c.addMember(addr, false)
+}
+
+// AddLearner add a nonvoter listening on addr, it replicates the data and
+// serves reads but never votes
+func (c *Client) AddLearner(addr string) error {
+	return c.addMember(addr, true)
+}
+
+func (c *Client) addMember(addr string, learner bool) error {
+	body, err := json.Marshal(struct {
+		Addr    string `json:"addr"`
+		Learner bool   `json:"learner"`
+	}{addr, learner})
+	if err != nil {
+		return err
+	}
+	return c.write(http.MethodPost, "/v1/members", body)
+}
+
+// RemoveMember remove the member with the peer id
+func (c *Client) RemoveMember(id string) error {
+	return c.write(http.MethodDelete, "/v1/members/"+url.PathEscape(id), nil)
+}
+
+// TransferLeader hand the leadership over to the member with the peer id
+// to, or to any voter if to is empty
+func (c *Client) TransferLeader(to string) error {
+	path := "/v1/leader/transfer"
+	if to != "" {
+		path += "?to=" + url.QueryEscape(to)
+	}
+	return c.write(http.MethodPost, path, nil)
+}
+
+// Drain the node of the first endpoint before it stops: it hands its
+// leadership over, refuses new requests and waits for the ones in flight,
+// then with leave it is removed from the cluster. The node shuts down
+// once drained. timeout bounds the wait, 0 uses the server default.
+func (c *Client) Drain(leave bool, timeout time.Duration) error {
+	if len(c.endpoints) == 0 {
+		return ErrNoEndpoint
+	}
+	q := url.Values{}
+	q.Set("leave", strconv.FormatBool(leave))
+	if timeout > 0 {
+		q.Set("timeout", timeout.String())
+	}
+	resp, err := c.send(c.endpoints[0], http.MethodPost, "/v1/drain?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Snapshot make the leader take a raft snapshot
+func (c *Client) Snapshot() error {
+	return c.write(http.MethodPost, "/v1/snapshot", nil)
+}
+
+// Backup make the leader take a backup into its configured backup dir
+func (c *Client) Backup() (*BackupInfo, error) {
+	var info BackupInfo
+	if err := c.writeResult(http.MethodPost, "/v1/backup", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Standby reports whether the cluster is a standby of a primary cluster,
+// it refuses the writes until it is promoted
+func (c *Client) Standby() (bool, error) {
+	var resp struct {
+		Standby bool `json:"standby"`
+	}
+	if err := c.read("/v1/replication", &resp); err != nil {
+		return false, err
+	}
+	return resp.Standby, nil
+}
+
+// Promote make the standby cluster take writes, it stops applying the
+// changes of its primary
+func (c *Client) Promote() error {
+	return c.write(http.MethodPost, "/v1/replication/promote", nil)
+}
+
+// read GET path from the first endpoint that answers and decode the json
+// response into out
+func (c *Client) read(path string, out interface{}) error {
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
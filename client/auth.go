@@ -0,0 +1,119 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// User is a user of the cluster
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// Permission grants Perm, one of read, write or admin, on the keys
+// starting with Prefix
+type Permission struct {
+	Prefix string `json:"prefix"`
+	Perm   string `json:"perm"`
+}
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Login get a token for the user and use it for the next requests, it
+// returns the token and when it expires
+func (c *Client) Login(user, password string) (string, time.Time, error) {
+	body, err := json.Marshal(map[string]string{"user": user, "password": password})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var resp struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := c.writeResult(http.MethodPost, "/v1/auth/token", body, &resp); err != nil {
+		return "", time.Time{}, err
+	}
+	c.SetToken(resp.Token)
+	return resp.Token, resp.Expires, nil
+}
+
+// EnableAuth create the root user with the password and turn auth on
+func (c *Client) EnableAuth(rootPassword string) error {
+	body, err := json.Marshal(map[string]string{"password": rootPassword})
+	if err != nil {
+		return err
+	}
+	return c.write(http.MethodPost, "/v1/auth/enable", body)
+}
+
+// PutUser create or update a user, an empty password keeps the current one
+func (c *Client) PutUser(name, password string, roles []string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"password": password, "roles": roles})
+	if err != nil {
+		return err
+	}
+	return c.write(http.MethodPut, "/v1/auth/users/"+url.PathEscape(name), body)
+}
+
+// DeleteUser remove a user
+func (c *Client) DeleteUser(name string) error {
+	return c.write(http.MethodDelete, "/v1/auth/users/"+url.PathEscape(name), nil)
+}
+
+// Users return the users sorted by name
+func (c *Client) Users() ([]User, error) {
+	var users []User
+	if err := c.read("/v1/auth/users", &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// PutRole create or replace a role
+func (c *Client) PutRole(role Role) error {
+	if role.Permissions == nil {
+		role.Permissions = []Permission{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"permissions": role.Permissions})
+	if err != nil {
+		return err
+	}
+	return c.write(http.MethodPut, "/v1/auth/roles/"+url.PathEscape(role.Name), body)
+}
+
+// DeleteRole remove a role
+func (c *Client) DeleteRole(name string) error {
+	return c.write(http.MethodDelete, "/v1/auth/roles/"+url.PathEscape(name), nil)
+}
+
+// Roles return the roles sorted by name
+func (c *Client) Roles() ([]Role, error) {
+	var roles []Role
+	if err := c.read("/v1/auth/roles", &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
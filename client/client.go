@@ -0,0 +1,319 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// client is the go client of magicdb
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoEndpoint is returned when no endpoint accepted the request
+	ErrNoEndpoint = errors.New("no endpoint available")
+)
+
+// batchRequest mirrors service.BatchRequest, the client does not import
+// the server side packages so it builds without rocksdb.
+type batchRequest struct {
+	Puts    []kv     `json:"puts"`
+	Deletes [][]byte `json:"deletes"`
+}
+
+type kv struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Client talks to a magicdb cluster over the http api. Reads go to any
+// endpoint, writes go to the leader of the range of their key and are
+// retried on the other endpoints until the leader accepts them.
+type Client struct {
+	endpoints []string
+	hc        *http.Client
+
+	mu     sync.Mutex
+	leader int
+	token  string
+	basic  [2]string
+	// staleness bounds the age of the data of Get and Scan, 0 is unbounded
+	staleness time.Duration
+	routes    routeTable
+}
+
+// New create a client of the cluster, endpoints are http base urls such
+// as http://127.0.0.1:8080
+func New(endpoints []string) *Client {
+	return NewWithTLS(endpoints, nil)
+}
+
+// NewWithTLS create a client of an https cluster, endpoints are https base
+// urls such as https://127.0.0.1:8080. A nil conf uses the defaults of
+// net/http, see TLSOptions to build one.
+func NewWithTLS(endpoints []string, conf *tls.Config) *Client {
+	return &Client{
+		endpoints: endpoints,
+		// no overall timeout, sst uploads may take long
+		hc: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSClientConfig:       conf,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		}},
+	}
+}
+
+// SetToken authenticate the requests with a token issued by Login
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// SetBasicAuth authenticate every request with a user name and password,
+// Login is cheaper for the servers as the password is checked only once
+func (c *Client) SetBasicAuth(user, password string) {
+	c.mu.Lock()
+	c.basic = [2]string{user, password}
+	c.mu.Unlock()
+}
+
+// SetMaxStaleness let Get and Scan read from a node, learners included,
+// only if it heard from the leader at most d ago, other nodes are tried
+// otherwise. 0 reads from any node.
+func (c *Client) SetMaxStaleness(d time.Duration) {
+	c.mu.Lock()
+	c.staleness = d
+	c.mu.Unlock()
+}
+
+// Get a key, the value is nil if the key does not exist
+func (c *Client) Get(key []byte) ([]byte, error) {
+	return c.get(key, url.Values{})
+}
+
+// get read key with the query q, nil when it does not exist
+func (c *Client) get(key []byte, q url.Values) ([]byte, error) {
+	if d := c.maxStaleness(); d > 0 {
+		q.Set("max_staleness", d.String())
+	}
+	path := kvPath(key)
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Put a key-value
+func (c *Client) Put(key, value []byte) error {
+	return c.writeKey(key, http.MethodPut, kvPath(key), value)
+}
+
+// Delete a key
+func (c *Client) Delete(key []byte) error {
+	return c.writeKey(key, http.MethodDelete, kvPath(key), nil)
+}
+
+// BatchPut put keys[i]-values[i] pairs atomically
+func (c *Client) BatchPut(keys, values [][]byte) error {
+	return c.Write(keys, values, nil)
+}
+
+// Write put keys[i]-values[i] pairs and delete dels atomically, the keys
+// must belong to the same range
+func (c *Client) Write(keys, values [][]byte, dels [][]byte) error {
+	req := batchRequest{Puts: make([]kv, len(keys)), Deletes: dels}
+	for i := range keys {
+		req.Puts[i] = kv{Key: keys[i], Value: values[i]}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(keys) > 0:
+		return c.writeKey(keys[0], http.MethodPost, "/v1/batch", body)
+	case len(dels) > 0:
+		return c.writeKey(dels[0], http.MethodPost, "/v1/batch", body)
+	}
+	return c.write(http.MethodPost, "/v1/batch", body)
+}
+
+// IngestFile upload a sst file built with `magicdb sst` and ingest it on
+// every replica. It fails with a 409 once the keyspace is split in ranges.
+func (c *Client) IngestFile(path string) error {
+	return c.writeBody(http.MethodPut, "/v1/ingest/"+url.PathEscape(filepath.Base(path)),
+		func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}, nil)
+}
+
+// write send a request starting at the last known leader, and moves on to
+// the next endpoint while the answer is "not leader".
+func (c *Client) write(method, path string, body []byte) error {
+	return c.writeResult(method, path, body, nil)
+}
+
+// writeResult is write decoding the json response into out if not nil
+func (c *Client) writeResult(method, path string, body []byte, out interface{}) error {
+	return c.writeBody(method, path, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}, out)
+}
+
+// writeBody is writeResult with a body opened again for every attempt
+func (c *Client) writeBody(method, path string, open func() (io.ReadCloser, error),
+	out interface{}) error {
+	c.mu.Lock()
+	start := c.leader
+	c.mu.Unlock()
+	return c.writeFrom(start, method, path, open, out)
+}
+
+// writeFrom is writeBody starting at the endpoint start
+func (c *Client) writeFrom(start int, method, path string, open func() (io.ReadCloser, error),
+	out interface{}) error {
+	lastErr := ErrNoEndpoint
+	for i := 0; i < len(c.endpoints); i++ {
+		idx := (start + i) % len(c.endpoints)
+		body, err := open()
+		if err != nil {
+			return err
+		}
+		resp, err := c.send(c.endpoints[idx], method, path, body)
+		body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = checkResponse(resp)
+		if err == nil && out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			lastErr = err
+			continue
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.leader = idx
+			if idx != start {
+				// the leader moved, fetch the routes again
+				c.routes.fetched = time.Time{}
+			}
+			c.mu.Unlock()
+		}
+		return err
+	}
+	return lastErr
+}
+
+// do send a request to the first endpoint that answers
+func (c *Client) do(method, path string, body []byte) (*http.Response, error) {
+	lastErr := ErrNoEndpoint
+	for i, ep := range c.endpoints {
+		resp, err := c.send(ep, method, path, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// a draining node refuses the request, the next one may serve it
+		if resp.StatusCode == http.StatusServiceUnavailable && i < len(c.endpoints)-1 {
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func (c *Client) send(endpoint, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := c.newRequest(method, endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.hc.Do(req)
+}
+
+// newRequest create a request carrying the credentials of the client
+func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	token, basic := c.token, c.basic
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basic[0] != "" {
+		req.SetBasicAuth(basic[0], basic[1])
+	}
+	return req, nil
+}
+
+func (c *Client) maxStaleness() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staleness
+}
+
+func kvPath(key []byte) string {
+	return "/v1/kv/" + url.PathEscape(string(key))
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return &StatusError{Code: resp.StatusCode, Status: resp.Status, Message: string(bytes.TrimSpace(msg))}
+}
+
+// StatusError is returned for a request the server answered with an error
+// status
+type StatusError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("magicdb: %s: %s", e.Status, e.Message)
+}
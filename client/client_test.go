@@ -0,0 +1,186 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode is an in-memory http api, followers reject writes with 503
+func fakeNode(leader bool, data map[string]string, mu *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method == http.MethodGet {
+			v, ok := data[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(v))
+			return
+		}
+		if !leader {
+			http.Error(w, "node is not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			v, _ := ioutil.ReadAll(r.Body)
+			data[key] = string(v)
+		case http.MethodDelete:
+			delete(data, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestClientWriteFindsLeader(t *testing.T) {
+	var mu sync.Mutex
+	data := make(map[string]string)
+	follower := fakeNode(false, data, &mu)
+	leader := fakeNode(true, data, &mu)
+	defer follower.Close()
+	defer leader.Close()
+
+	c := New([]string{follower.URL, leader.URL})
+	if err := c.Put([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatal("Put error ", err)
+	}
+	if c.leader != 1 {
+		t.Fatal("Client should remember the leader, but got ", c.leader)
+	}
+
+	v, err := c.Get([]byte("foo"))
+	if err != nil {
+		t.Fatal("Get error ", err)
+	}
+	if string(v) != "bar" {
+		t.Fatal("Get value excepted 'bar' but got ", string(v))
+	}
+
+	if err := c.Delete([]byte("foo")); err != nil {
+		t.Fatal("Delete error ", err)
+	}
+	v, err = c.Get([]byte("foo"))
+	if err != nil {
+		t.Fatal("Get error ", err)
+	}
+	if v != nil {
+		t.Fatal("Get deleted key excepted nil but got ", string(v))
+	}
+}
+
+func TestClientNoLeader(t *testing.T) {
+	var mu sync.Mutex
+	follower := fakeNode(false, make(map[string]string), &mu)
+	defer follower.Close()
+
+	c := New([]string{follower.URL})
+	if err := c.Put([]byte("foo"), []byte("bar")); err == nil {
+		t.Fatal("Put without leader excepted error")
+	}
+}
+
+func TestClientReadSkipsDrainingNode(t *testing.T) {
+	var mu sync.Mutex
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "node is draining", http.StatusServiceUnavailable)
+	}))
+	defer draining.Close()
+	node := fakeNode(true, map[string]string{"foo": "bar"}, &mu)
+	defer node.Close()
+
+	c := New([]string{draining.URL, node.URL})
+	v, err := c.Get([]byte("foo"))
+	if err != nil || string(v) != "bar" {
+		t.Fatal("Get excepted 'bar' from the second node but got ", string(v), err)
+	}
+
+	c = New([]string{draining.URL})
+	if _, err := c.Get([]byte("foo")); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Fatal("Get excepted the draining error but got ", err)
+	}
+}
+
+func TestClientMaxStaleness(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("max_staleness"))
+		if r.URL.Path == "/v1/scan" {
+			w.Write([]byte(`{"kvs":[],"more":false}`))
+			return
+		}
+		w.Write([]byte("bar"))
+	}))
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	if _, err := c.Get([]byte("foo")); err != nil {
+		t.Fatal("Get error ", err)
+	}
+	c.SetMaxStaleness(500 * time.Millisecond)
+	if _, err := c.Get([]byte("foo")); err != nil {
+		t.Fatal("Get error ", err)
+	}
+	if _, _, err := c.Scan([]byte("f"), nil, 0); err != nil {
+		t.Fatal("Scan error ", err)
+	}
+	if len(queries) != 3 || queries[0] != "" || queries[1] != "500ms" || queries[2] != "500ms" {
+		t.Fatal("max_staleness excepted '', 500ms, 500ms but got ", queries)
+	}
+}
+
+func TestClientRoutesWrites(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string
+	node := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/ranges":
+				w.Write([]byte(`[{"id":0,"start":null,"end":"bQ==","leader":"A"},` +
+					`{"id":7,"start":"bQ==","end":null,"leader":"B"}]`))
+				return
+			case "/v1/status":
+				w.Write([]byte(`{"id":"` + id + `"}`))
+				return
+			}
+			mu.Lock()
+			hits = append(hits, id+" "+r.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+	a, b := node("A"), node("B")
+	defer a.Close()
+	defer b.Close()
+
+	c := New([]string{a.URL, b.URL})
+	for _, key := range []string{"x", "c"} {
+		if err := c.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal("Put error ", err)
+		}
+	}
+	if len(hits) != 2 || hits[0] != "B /v1/kv/x" || hits[1] != "A /v1/kv/c" {
+		t.Fatal("writes excepted to reach the leader of their range but got ", hits)
+	}
+}
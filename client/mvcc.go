@@ -0,0 +1,82 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// tsLogicalBits are the low bits of a timestamp of the oracle, the high
+// bits are unix milliseconds
+const tsLogicalBits = 18
+
+// Pin keeps the versions read at TS from the gc until ExpireAt, in unix
+// milliseconds
+type Pin struct {
+	Name     string `json:"name"`
+	TS       uint64 `json:"ts"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+// Pins are the pins of the cluster, the reads in the past are served from
+// SafePoint on
+type Pins struct {
+	SafePoint uint64 `json:"safe_point"`
+	Pins      []Pin  `json:"pins"`
+}
+
+// TimestampOf return the timestamp of t, for the reads in the past
+func TimestampOf(t time.Time) uint64 {
+	return uint64(t.UnixNano()/int64(time.Millisecond)) << tsLogicalBits
+}
+
+// GetAt return the value key had at the timestamp ts, nil if it did not
+// exist. ts is a timestamp of the oracle or of TimestampOf, not older than
+// the safe point of the gc.
+func (c *Client) GetAt(key []byte, ts uint64) ([]byte, error) {
+	return c.get(key, url.Values{"at": {strconv.FormatUint(ts, 10)}})
+}
+
+// ScanAt is Scan at the timestamp ts, see GetAt
+func (c *Client) ScanAt(prefix, start []byte, limit int, ts uint64) ([]KV, bool, error) {
+	return c.scan(prefix, start, limit, url.Values{"at": {strconv.FormatUint(ts, 10)}})
+}
+
+// Pin keep the versions read at ts from the gc for ttl under name, such as
+// for a long scan at ts. A pin with the same name is replaced.
+func (c *Client) Pin(name string, ts uint64, ttl time.Duration) error {
+	body, err := json.Marshal(map[string]interface{}{"ts": ts, "ttl_ms": int64(ttl / time.Millisecond)})
+	if err != nil {
+		return err
+	}
+	return c.write(http.MethodPut, "/v1/pins/"+url.PathEscape(name), body)
+}
+
+// Unpin drop the pin name
+func (c *Client) Unpin(name string) error {
+	return c.write(http.MethodDelete, "/v1/pins/"+url.PathEscape(name), nil)
+}
+
+// Pins return the safe point of the gc and the pins
+func (c *Client) Pins() (*Pins, error) {
+	var pins Pins
+	if err := c.read("/v1/pins", &pins); err != nil {
+		return nil, err
+	}
+	return &pins, nil
+}
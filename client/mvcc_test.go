@@ -0,0 +1,60 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetAt(t *testing.T) {
+	var pin map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/k":
+			// the value was v1 until 100
+			if r.URL.Query().Get("at") == "50" {
+				w.Write([]byte("v1"))
+				return
+			}
+			http.NotFound(w, r)
+		case "/v1/pins/backup":
+			json.NewDecoder(r.Body).Decode(&pin)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	if v, err := c.GetAt([]byte("k"), 50); err != nil || string(v) != "v1" {
+		t.Fatal("GetAt excepted v1 but got ", string(v), err)
+	}
+	if v, err := c.GetAt([]byte("k"), 150); err != nil || v != nil {
+		t.Fatal("GetAt excepted no value but got ", string(v), err)
+	}
+	if err := c.Pin("backup", 50, time.Minute); err != nil {
+		t.Fatal("Pin error ", err)
+	}
+	if pin["ts"] != float64(50) || pin["ttl_ms"] != float64(60000) {
+		t.Fatal("Pin excepted ts 50 and ttl_ms 60000 but sent ", pin)
+	}
+	if ts := TimestampOf(time.Unix(1, 0)); ts != 1000<<tsLogicalBits {
+		t.Fatal("TimestampOf excepted ", 1000<<tsLogicalBits, " but got ", ts)
+	}
+}
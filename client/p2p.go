@@ -0,0 +1,335 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	ggio "github.com/gogo/protobuf/io"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	host "github.com/libp2p/go-libp2p-host"
+	"github.com/magicdb/pb"
+)
+
+const (
+	// KVProtocol is the libp2p protocol of the kv api, it mirrors
+	// service.KVProtocol
+	KVProtocol = "/magicdb/kv/1.0.0"
+
+	// maxMessageSize is the max size of a response
+	maxMessageSize = 64 << 20
+
+	// watchBuffer is the number of events buffered per watch
+	watchBuffer = 256
+)
+
+var (
+	// ErrClosed is returned by the calls on a closed P2PClient
+	ErrClosed = errors.New("client closed")
+)
+
+// NotLeaderError is returned when a write is sent to a follower, a new
+// client to Leader can retry it. Leader is empty if it is unknown.
+type NotLeaderError struct {
+	Leader peer.ID
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "node is not the leader"
+	}
+	return "node is not the leader, leader is " + e.Leader.Pretty()
+}
+
+// KV is a key-value pair returned by Scan
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// EventType is the kind of change of an Event
+type EventType int
+
+const (
+	// EventPut is a key set to a value
+	EventPut EventType = iota
+	// EventDelete is a key deleted
+	EventDelete
+)
+
+// Event is a change of a key received by Watch
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte
+	// Index is the raft log index of the change
+	Index uint64
+}
+
+// P2PClient talks to one magicdb node over KVProtocol. Requests are
+// multiplexed on a single stream, so it is safe for concurrent use.
+type P2PClient struct {
+	stream network.Stream
+
+	wmu sync.Mutex
+	w   ggio.WriteCloser
+
+	mu      sync.Mutex
+	token   string
+	nextID  uint64
+	pending map[uint64]chan *pb.Response
+	watches map[uint64]chan Event
+	err     error
+
+	done chan struct{}
+}
+
+// NewP2PClient open a KVProtocol stream from h to the node pid
+func NewP2PClient(ctx context.Context, h host.Host, pid peer.ID) (*P2PClient, error) {
+	stream, err := h.NewStream(ctx, pid, KVProtocol)
+	if err != nil {
+		return nil, err
+	}
+	c := &P2PClient{
+		stream:  stream,
+		w:       ggio.NewDelimitedWriter(stream),
+		pending: make(map[uint64]chan *pb.Response),
+		watches: make(map[uint64]chan Event),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// SetToken authenticate the next requests with a token issued by
+// Client.Login
+func (c *P2PClient) SetToken(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// Get a key, the value is nil if the key does not exist
+func (c *P2PClient) Get(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := c.call(ctx, &pb.Request{Op: pb.Op_GET, Key: key})
+	if err != nil || !resp.Found {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Put a key-value, the node must be the leader
+func (c *P2PClient) Put(ctx context.Context, key, value []byte) error {
+	_, err := c.call(ctx, &pb.Request{Op: pb.Op_PUT, Key: key, Value: value})
+	return err
+}
+
+// Delete a key, the node must be the leader
+func (c *P2PClient) Delete(ctx context.Context, key []byte) error {
+	_, err := c.call(ctx, &pb.Request{Op: pb.Op_DELETE, Key: key})
+	return err
+}
+
+// Scan return at most limit pairs with the prefix after the key start, in
+// key order. more reports whether there are pairs left, pass the last key
+// returned as start to get them. A limit of 0 uses the node's max.
+func (c *P2PClient) Scan(ctx context.Context, prefix, start []byte, limit int) ([]KV, bool, error) {
+	resp, err := c.call(ctx, &pb.Request{
+		Op:    pb.Op_SCAN,
+		Key:   prefix,
+		Start: start,
+		Limit: uint32(limit),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	kvs := make([]KV, len(resp.Kvs))
+	for i, p := range resp.Kvs {
+		kvs[i] = KV{Key: p.Key, Value: p.Value}
+	}
+	return kvs, resp.More, nil
+}
+
+// Watch the changes of keys with the prefix applied on the node. The
+// channel is closed when cancel is called, when the client is closed or
+// when the watch lags behind, and the caller should watch again.
+func (c *P2PClient) Watch(prefix []byte) (<-chan Event, func(), error) {
+	ch := make(chan Event, watchBuffer)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.watches[id] = ch
+	c.mu.Unlock()
+
+	if err := c.send(&pb.Request{Id: id, Op: pb.Op_WATCH, Key: prefix}); err != nil {
+		c.stopWatch(id)
+		return nil, nil, err
+	}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			if c.stopWatch(id) {
+				c.send(&pb.Request{Id: id, Op: pb.Op_CANCEL})
+			}
+		})
+	}
+	return ch, cancel, nil
+}
+
+// Close the stream, pending calls fail with ErrClosed
+func (c *P2PClient) Close() error {
+	err := c.stream.Reset()
+	<-c.done
+	return err
+}
+
+func (c *P2PClient) call(ctx context.Context, req *pb.Request) (*pb.Response, error) {
+	ch := make(chan *pb.Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	req.Id = c.nextID
+	c.pending[req.Id] = ch
+	c.mu.Unlock()
+
+	if err := c.send(req); err != nil {
+		c.forget(req.Id)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return resp, responseError(resp)
+	case <-ctx.Done():
+		c.forget(req.Id)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *P2PClient) send(req *pb.Request) error {
+	c.mu.Lock()
+	req.Token = c.token
+	c.mu.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.w.WriteMsg(req)
+}
+
+func (c *P2PClient) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// stopWatch close the channel of the watch, it reports whether the watch
+// was still running
+func (c *P2PClient) stopWatch(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.watches[id]
+	if ok {
+		delete(c.watches, id)
+		close(ch)
+	}
+	return ok
+}
+
+// readLoop dispatch the responses by id until the stream fails
+func (c *P2PClient) readLoop() {
+	defer close(c.done)
+	r := ggio.NewDelimitedReader(c.stream, maxMessageSize)
+	for {
+		resp := new(pb.Response)
+		if err := r.ReadMsg(resp); err != nil {
+			c.fail()
+			return
+		}
+
+		c.mu.Lock()
+		if ch, ok := c.pending[resp.Id]; ok {
+			delete(c.pending, resp.Id)
+			ch <- resp
+		} else if ch, ok := c.watches[resp.Id]; ok {
+			if resp.Event == nil {
+				// the node ended the watch
+				delete(c.watches, resp.Id)
+				close(ch)
+			} else {
+				select {
+				case ch <- toEvent(resp.Event):
+				default:
+					// never block the other requests on a slow watcher
+					delete(c.watches, resp.Id)
+					close(ch)
+					go c.send(&pb.Request{Id: resp.Id, Op: pb.Op_CANCEL})
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fail end every pending call and watch
+func (c *P2PClient) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ErrClosed
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		close(ch)
+	}
+	for id, ch := range c.watches {
+		delete(c.watches, id)
+		close(ch)
+	}
+}
+
+func toEvent(e *pb.Event) Event {
+	ev := Event{Type: EventPut, Key: e.Key, Value: e.Value, Index: e.Index}
+	if e.Type == pb.EventType_EVENT_DELETE {
+		ev.Type = EventDelete
+	}
+	return ev
+}
+
+func responseError(resp *pb.Response) error {
+	if resp.Error == "" {
+		return nil
+	}
+	if resp.Leader != "" {
+		leader, err := peer.IDB58Decode(resp.Leader)
+		if err != nil {
+			return fmt.Errorf("%s: bad leader %q", resp.Error, resp.Leader)
+		}
+		return &NotLeaderError{Leader: leader}
+	}
+	if resp.Error == "node is not the leader" {
+		return &NotLeaderError{}
+	}
+	return errors.New(resp.Error)
+}
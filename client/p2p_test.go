@@ -0,0 +1,125 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	ggio "github.com/gogo/protobuf/io"
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/magicdb/pb"
+)
+
+// fakeKVHandler answer GET and PUT from data, a WATCH gets one event per
+// PUT, other ops are rejected as if the node was a follower of leader
+func fakeKVHandler(data map[string]string, leader string) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		r := ggio.NewDelimitedReader(s, maxMessageSize)
+		w := ggio.NewDelimitedWriter(s)
+		var watch uint64
+		for {
+			req := new(pb.Request)
+			if err := r.ReadMsg(req); err != nil {
+				return
+			}
+			resp := &pb.Response{Id: req.Id}
+			switch req.Op {
+			case pb.Op_GET:
+				v, ok := data[string(req.Key)]
+				resp.Value, resp.Found = []byte(v), ok
+			case pb.Op_PUT:
+				data[string(req.Key)] = string(req.Value)
+				if watch != 0 {
+					w.WriteMsg(&pb.Response{Id: watch, Event: &pb.Event{Key: req.Key, Value: req.Value}})
+				}
+			case pb.Op_WATCH:
+				watch = req.Id
+				continue
+			case pb.Op_CANCEL:
+				resp.Id, watch = watch, 0
+			default:
+				resp.Error, resp.Leader = "node is not the leader", leader
+			}
+			w.WriteMsg(resp)
+		}
+	}
+}
+
+func TestP2PClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal("mocknet error ", err)
+	}
+	hosts := mn.Hosts()
+	data := make(map[string]string)
+	hosts[1].SetStreamHandler(KVProtocol, fakeKVHandler(data, hosts[0].ID().Pretty()))
+
+	c, err := NewP2PClient(ctx, hosts[0], hosts[1].ID())
+	if err != nil {
+		t.Fatal("NewP2PClient error ", err)
+	}
+	defer c.Close()
+
+	events, stop, err := c.Watch([]byte("k"))
+	if err != nil {
+		t.Fatal("Watch error ", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, k := range []string{"k1", "k2", "k3"} {
+		if err := c.Put(ctx, []byte(k), []byte("v"+k)); err != nil {
+			t.Fatal("Put error ", err)
+		}
+	}
+	wg.Add(3)
+	for _, k := range []string{"k1", "k2", "k3"} {
+		go func(k string) {
+			defer wg.Done()
+			v, err := c.Get(ctx, []byte(k))
+			if err != nil || string(v) != "v"+k {
+				t.Error("Get ", k, " excepted v", k, " got ", string(v), err)
+			}
+		}(k)
+	}
+	wg.Wait()
+
+	v, err := c.Get(ctx, []byte("missing"))
+	if err != nil || v != nil {
+		t.Fatal("Get missing excepted nil got ", v, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		e := <-events
+		if e.Type != EventPut || string(e.Key) != "k"+string('0'+rune(i)) {
+			t.Fatal("unexcepted event ", e)
+		}
+	}
+
+	err = c.Delete(ctx, []byte("k1"))
+	nl, ok := err.(*NotLeaderError)
+	if !ok || nl.Leader != hosts[0].ID() {
+		t.Fatal("Delete excepted NotLeaderError got ", err)
+	}
+
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("excepted closed watch")
+	}
+}
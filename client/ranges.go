@@ -0,0 +1,237 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// routeTTL is how long the routing table is trusted before it is fetched
+// again
+const routeTTL = 30 * time.Second
+
+// Range is a range of the keyspace, the keys from Start to End excluded,
+// replicated by a raft group of its own. An empty End is the end of the
+// keyspace.
+type Range struct {
+	ID     uint64   `json:"id"`
+	Start  []byte   `json:"start"`
+	End    []byte   `json:"end"`
+	Peers  []string `json:"peers"`
+	Leader string   `json:"leader"`
+	// Local is set when the node which answered replicates the range
+	Local bool `json:"local"`
+	// Frozen is set while the range is merged into the range before it
+	Frozen bool `json:"frozen,omitempty"`
+}
+
+// Contains reports whether key belongs to the range
+func (r *Range) Contains(key []byte) bool {
+	return bytes.Compare(key, r.Start) >= 0 && (len(r.End) == 0 || bytes.Compare(key, r.End) < 0)
+}
+
+// routeTable map the ranges to the endpoint of their leader
+type routeTable struct {
+	ranges []Range
+	// endpoints is the index of the endpoint of a peer id
+	endpoints map[string]int
+	fetched   time.Time
+}
+
+// Ranges return the ranges of the keyspace ordered by start key, as seen
+// by the first endpoint that answers
+func (c *Client) Ranges() ([]Range, error) {
+	var ranges []Range
+	if err := c.read("/v1/ranges", &ranges); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// Split the range holding key at key, the keys from key on move to the new
+// range returned
+func (c *Client) Split(key []byte) (*Range, error) {
+	var r Range
+	path := "/v1/ranges/split?key=" + url.QueryEscape(string(key))
+	if err := c.writeResult(http.MethodPost, path, nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Merge the range id into the range before it, the merged range is
+// returned
+func (c *Client) Merge(id uint64) (*Range, error) {
+	var r Range
+	path := "/v1/ranges/merge?id=" + strconv.FormatUint(id, 10)
+	if err := c.writeResult(http.MethodPost, path, nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Node is a node as known by the placement driver
+type Node struct {
+	ID       string            `json:"id"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Capacity uint64            `json:"capacity"`
+	Used     uint64            `json:"used"`
+	QPS      float64           `json:"qps"`
+	// Ranges and Leaders are the ranges the node replicates and leads
+	Ranges    []uint64  `json:"ranges"`
+	Leaders   []uint64  `json:"leaders"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Up        bool      `json:"up"`
+}
+
+// Operator is a change of the replicas of a range decided by the
+// placement driver, Kind is one of transfer-leader, add-replica,
+// remove-replica and move-replica
+type Operator struct {
+	Range uint64 `json:"range"`
+	Kind  string `json:"kind"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// Decision is an Operator of the placement driver and why
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Operator Operator  `json:"operator"`
+	Reason   string    `json:"reason"`
+}
+
+// PDNodes return the nodes known by the placement driver
+func (c *Client) PDNodes() ([]Node, error) {
+	var nodes []Node
+	if err := c.read("/v1/pd/nodes", &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// PDDecisions return the last decisions of the placement driver, newest
+// first
+func (c *Client) PDDecisions() ([]Decision, error) {
+	var decisions []Decision
+	if err := c.read("/v1/pd/decisions", &decisions); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+// route return the endpoint of the leader of the range holding key, or the
+// last endpoint which accepted a write when the routing table does not
+// know it. The table is fetched again once older than routeTTL.
+func (c *Client) route(key []byte) int {
+	if len(c.endpoints) < 2 {
+		return 0
+	}
+	c.mu.Lock()
+	stale := time.Since(c.routes.fetched) > routeTTL
+	if stale {
+		// a single fetch at a time, the others use the last table
+		c.routes.fetched = time.Now()
+	}
+	c.mu.Unlock()
+	if stale {
+		c.fetchRoutes()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.routes.ranges {
+		if r.Contains(key) {
+			if idx, ok := c.routes.endpoints[r.Leader]; ok {
+				return idx
+			}
+			break
+		}
+	}
+	return c.leader
+}
+
+// fetchRoutes read the ranges and the peer id of every endpoint, the table
+// is left as is on error
+func (c *Client) fetchRoutes() {
+	ranges, err := c.Ranges()
+	if err != nil {
+		return
+	}
+	endpoints := make(map[string]int)
+	for i, ep := range c.endpoints {
+		resp, err := c.send(ep, http.MethodGet, "/v1/status", nil)
+		if err != nil {
+			continue
+		}
+		var st Status
+		if checkResponse(resp) == nil && json.NewDecoder(resp.Body).Decode(&st) == nil {
+			endpoints[st.ID] = i
+		}
+		resp.Body.Close()
+	}
+	c.mu.Lock()
+	c.routes.ranges = ranges
+	c.routes.endpoints = endpoints
+	c.mu.Unlock()
+}
+
+// writeKey is write routed to the leader of the range of key
+func (c *Client) writeKey(key []byte, method, path string, body []byte) error {
+	return c.writeKeyResult(key, method, path, body, nil)
+}
+
+// writeKeyResult is writeKey decoding the json response into out if not
+// nil
+func (c *Client) writeKeyResult(key []byte, method, path string, body []byte, out interface{}) error {
+	start := c.route(key)
+	return c.writeFrom(start, method, path, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}, out)
+}
+
+// groupByRange split keys by the range they belong to as known by the
+// routing table, in the order of their first key. Without a table every
+// key is in one group.
+func (c *Client) groupByRange(keys [][]byte) [][][]byte {
+	c.mu.Lock()
+	ranges := c.routes.ranges
+	c.mu.Unlock()
+	var groups [][][]byte
+	index := make(map[int]int)
+	for _, k := range keys {
+		r := -1
+		for i := range ranges {
+			if ranges[i].Contains(k) {
+				r = i
+				break
+			}
+		}
+		g, ok := index[r]
+		if !ok {
+			g = len(groups)
+			index[r] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], k)
+	}
+	return groups
+}
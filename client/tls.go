@@ -0,0 +1,68 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	// ErrBadCA is returned when the CAFile holds no pem certificate
+	ErrBadCA = errors.New("no certificate in the ca file")
+)
+
+// TLSOptions are the files of a client of an https cluster
+type TLSOptions struct {
+	// CAFile verifies the server certificates, the system roots are used
+	// when empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate of a server that
+	// verifies them, its common name authenticates the user
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name the certificates are checked for
+	ServerName string
+	// InsecureSkipVerify accepts any server certificate, for tests only
+	InsecureSkipVerify bool
+}
+
+// Config load the files of o into a tls config
+func (o TLSOptions) Config() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrBadCA
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
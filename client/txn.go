@@ -0,0 +1,312 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// TxnLockTTL is how long the locks of a committing transaction are
+	// kept before the readers may roll it back
+	TxnLockTTL = 10 * time.Second
+
+	// txnBackoff is how long a read waits on a live lock before trying
+	// again
+	txnBackoff = 50 * time.Millisecond
+)
+
+var (
+	// ErrTxnConflict is returned by Commit when another transaction wrote
+	// or locked one of the keys, the transaction may be run again
+	ErrTxnConflict = errors.New("transaction conflicts with another one")
+	// ErrTxnDone is returned when a transaction is used after Commit or
+	// Rollback
+	ErrTxnDone = errors.New("transaction is already committed or rolled back")
+)
+
+// Lock is the lock of a key held by a transaction being committed
+type Lock struct {
+	Key      []byte `json:"key"`
+	Primary  []byte `json:"primary"`
+	StartTS  uint64 `json:"start_ts"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+// txnStatus mirrors server.TxnStatus
+type txnStatus struct {
+	CommitTS uint64 `json:"commit_ts"`
+	Locked   bool   `json:"locked"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+type mutation struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// prewriteRequest, txnKeysRequest and checkTxnRequest mirror the requests
+// of service
+type prewriteRequest struct {
+	Primary   []byte     `json:"primary"`
+	StartTS   uint64     `json:"start_ts"`
+	TTLMs     int64      `json:"ttl_ms"`
+	Mutations []mutation `json:"mutations"`
+}
+
+type txnKeysRequest struct {
+	StartTS  uint64   `json:"start_ts"`
+	CommitTS uint64   `json:"commit_ts,omitempty"`
+	Keys     [][]byte `json:"keys"`
+}
+
+type checkTxnRequest struct {
+	Primary []byte `json:"primary"`
+	StartTS uint64 `json:"start_ts"`
+}
+
+// Txn is a snapshot isolation transaction across ranges: its reads see
+// the transactions committed before it began, its writes are buffered and
+// committed atomically with a two-phase commit, or not at all when
+// another transaction wrote the same keys since it began. A Txn is not
+// safe for concurrent use.
+type Txn struct {
+	c       *Client
+	startTS uint64
+	writes  map[string]mutation
+	done    bool
+}
+
+// Timestamp return a timestamp of the oracle of the cluster, greater
+// than every timestamp handed out before
+func (c *Client) Timestamp() (uint64, error) {
+	return c.Timestamps(1)
+}
+
+// Timestamps return the first of n consecutive timestamps of the oracle,
+// one request for the n of them. n is at most 65536.
+func (c *Client) Timestamps(n int) (uint64, error) {
+	var res struct {
+		TS uint64 `json:"ts"`
+	}
+	path := "/v1/tso?count=" + strconv.Itoa(n)
+	if err := c.writeResult(http.MethodPost, path, nil, &res); err != nil {
+		return 0, err
+	}
+	return res.TS, nil
+}
+
+// Begin a transaction
+func (c *Client) Begin() (*Txn, error) {
+	ts, err := c.Timestamp()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{c: c, startTS: ts, writes: make(map[string]mutation)}, nil
+}
+
+// StartTS return the timestamp the transaction reads at
+func (t *Txn) StartTS() uint64 {
+	return t.startTS
+}
+
+// Get a key as of the start of the transaction, with the writes of the
+// transaction. The value is nil if the key does not exist. A key locked by
+// a transaction committing is read once it is resolved.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if m, ok := t.writes[string(key)]; ok {
+		if m.Delete {
+			return nil, nil
+		}
+		return m.Value, nil
+	}
+	path := "/v1/txn/kv/" + url.PathEscape(string(key)) + "?start_ts=" + strconv.FormatUint(t.startTS, 10)
+	for {
+		var res struct {
+			Value []byte `json:"value"`
+			Found bool   `json:"found"`
+			Lock  *Lock  `json:"lock"`
+		}
+		if err := t.c.writeKeyResult(key, http.MethodGet, path, nil, &res); err != nil {
+			return nil, err
+		}
+		if res.Lock == nil {
+			if !res.Found {
+				return nil, nil
+			}
+			return res.Value, nil
+		}
+		if err := t.c.ResolveLock(res.Lock); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Put a key-value in the transaction
+func (t *Txn) Put(key, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[string(key)] = mutation{Key: key, Value: value}
+	return nil
+}
+
+// Delete a key in the transaction
+func (t *Txn) Delete(key []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[string(key)] = mutation{Key: key, Delete: true}
+	return nil
+}
+
+// Rollback discard the writes of the transaction
+func (t *Txn) Rollback() error {
+	t.done = true
+	return nil
+}
+
+// Commit the writes of the transaction: every key is locked in its range,
+// the first key being the primary, then the primary is committed, which
+// commits the transaction, and last the other keys. A commit which fails
+// before the primary is committed rolls the locks back and returns
+// ErrTxnConflict when another transaction got in the way.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	if len(t.writes) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, len(t.writes))
+	for _, m := range t.writes {
+		keys = append(keys, m.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+	primary := keys[0]
+
+	t.c.route(primary)
+	t.c.mu.Lock()
+	known := t.c.routes.ranges != nil
+	t.c.mu.Unlock()
+	if !known {
+		t.c.fetchRoutes()
+	}
+	groups := t.c.groupByRange(keys)
+
+	for i, group := range groups {
+		muts := make([]mutation, len(group))
+		for j, k := range group {
+			muts[j] = t.writes[string(k)]
+		}
+		body, err := json.Marshal(prewriteRequest{
+			Primary:   primary,
+			StartTS:   t.startTS,
+			TTLMs:     int64(TxnLockTTL / time.Millisecond),
+			Mutations: muts,
+		})
+		if err != nil {
+			return err
+		}
+		if err := t.c.writeKey(group[0], http.MethodPost, "/v1/txn/prewrite", body); err != nil {
+			t.rollback(groups[:i+1])
+			if e, ok := err.(*StatusError); ok && e.Code == http.StatusConflict {
+				return ErrTxnConflict
+			}
+			return err
+		}
+	}
+
+	commitTS, err := t.c.Timestamp()
+	if err != nil {
+		t.rollback(groups)
+		return err
+	}
+	// the primary group holds the primary key, committing it is atomic
+	if err := t.commitKeys(groups[0], commitTS); err != nil {
+		if e, ok := err.(*StatusError); ok && e.Code == http.StatusConflict {
+			return ErrTxnConflict
+		}
+		return err
+	}
+	// the readers resolve the secondary locks left behind by a failure
+	for _, group := range groups[1:] {
+		t.commitKeys(group, commitTS)
+	}
+	return nil
+}
+
+func (t *Txn) commitKeys(keys [][]byte, commitTS uint64) error {
+	return t.c.commitKeys(t.startTS, commitTS, keys)
+}
+
+func (c *Client) commitKeys(startTS, commitTS uint64, keys [][]byte) error {
+	body, err := json.Marshal(txnKeysRequest{StartTS: startTS, CommitTS: commitTS, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return c.writeKey(keys[0], http.MethodPost, "/v1/txn/commit", body)
+}
+
+// rollback the locks of groups, the locks missed expire
+func (t *Txn) rollback(groups [][][]byte) {
+	for _, group := range groups {
+		t.c.rollbackKeys(t.startTS, group)
+	}
+}
+
+func (c *Client) rollbackKeys(startTS uint64, keys [][]byte) error {
+	body, err := json.Marshal(txnKeysRequest{StartTS: startTS, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return c.writeKey(keys[0], http.MethodPost, "/v1/txn/rollback", body)
+}
+
+// ResolveLock settle the lock l from the status of its transaction: the
+// key is committed or rolled back along with the primary key, a lock whose
+// transaction is still committing is waited for
+func (c *Client) ResolveLock(l *Lock) error {
+	body, err := json.Marshal(checkTxnRequest{Primary: l.Primary, StartTS: l.StartTS})
+	if err != nil {
+		return err
+	}
+	var st txnStatus
+	if err := c.writeKeyResult(l.Primary, http.MethodPost, "/v1/txn/check", body, &st); err != nil {
+		return err
+	}
+	switch {
+	case st.Locked:
+		wait := time.Until(time.Unix(0, st.ExpireAt*int64(time.Millisecond)))
+		if wait > txnBackoff {
+			wait = txnBackoff
+		}
+		time.Sleep(wait)
+		return nil
+	case st.CommitTS > 0:
+		return c.commitKeys(l.StartTS, st.CommitTS, [][]byte{l.Key})
+	}
+	return c.rollbackKeys(l.StartTS, [][]byte{l.Key})
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTxnNode serve the transaction api, the ranges split at "m". The
+// path of every transaction request is logged with its keys, conflict
+// makes the prewrites of a key fail.
+func fakeTxnNode(conflict string) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var log []string
+	var ts uint64
+	locked := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/ranges":
+			w.Write([]byte(`[{"id":0,"start":null,"end":"bQ==","leader":"A"},{"id":7,"start":"bQ==","end":null,"leader":"A"}]`))
+			return
+		case "/v1/status":
+			w.Write([]byte(`{"id":"A"}`))
+			return
+		case "/v1/tso":
+			n, _ := strconv.Atoi(r.URL.Query().Get("count"))
+			json.NewEncoder(w).Encode(map[string]uint64{"ts": ts + 1})
+			ts += uint64(n)
+			log = append(log, "tso")
+			return
+		case "/v1/txn/check":
+			w.Write([]byte(`{"commit_ts":9}`))
+			log = append(log, "check")
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/txn/kv/") {
+			if locked {
+				locked = false
+				w.Write([]byte(`{"found":false,"lock":{"key":"eA==","primary":"YQ==","start_ts":5}}`))
+				return
+			}
+			w.Write([]byte(`{"found":true,"value":"djE="}`))
+			return
+		}
+		var req struct {
+			Keys      []string `json:"keys"`
+			Mutations []struct {
+				Key string `json:"key"`
+			} `json:"mutations"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		keys := req.Keys
+		for _, m := range req.Mutations {
+			keys = append(keys, m.Key)
+		}
+		entry := strings.TrimPrefix(r.URL.Path, "/v1/txn/") + " " + strings.Join(keys, ",")
+		log = append(log, entry)
+		if r.URL.Path == "/v1/txn/prewrite" && strings.Contains(entry, conflict) {
+			http.Error(w, "write conflict", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return srv, &log
+}
+
+func TestTxnCommit(t *testing.T) {
+	// the keys are base64 in json, "a" is YQ== and "x" eA==
+	srv, log := fakeTxnNode("no conflict")
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	txn, err := c.Begin()
+	if err != nil {
+		t.Fatal("Begin error ", err)
+	}
+	txn.Put([]byte("x"), []byte("1"))
+	txn.Put([]byte("a"), []byte("2"))
+	if v, err := txn.Get([]byte("a")); err != nil || string(v) != "2" {
+		t.Fatal("Get excepted the buffered write but got ", string(v), err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal("Commit error ", err)
+	}
+	excepted := "tso|prewrite YQ==|prewrite eA==|tso|commit YQ==|commit eA=="
+	if got := strings.Join(*log, "|"); got != excepted {
+		t.Fatal("Commit excepted ", excepted, " but got ", got)
+	}
+	if err := txn.Put([]byte("a"), nil); err != ErrTxnDone {
+		t.Fatal("Put after Commit excepted ErrTxnDone but got ", err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	srv, log := fakeTxnNode("eA==")
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	txn, _ := c.Begin()
+	txn.Put([]byte("a"), []byte("1"))
+	txn.Delete([]byte("x"))
+	if err := txn.Commit(); err != ErrTxnConflict {
+		t.Fatal("Commit excepted ErrTxnConflict but got ", err)
+	}
+	excepted := "tso|prewrite YQ==|prewrite eA==|rollback YQ==|rollback eA=="
+	if got := strings.Join(*log, "|"); got != excepted {
+		t.Fatal("Commit excepted ", excepted, " but got ", got)
+	}
+}
+
+func TestTxnGetResolvesLock(t *testing.T) {
+	srv, log := fakeTxnNode("")
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	txn, _ := c.Begin()
+	v, err := txn.Get([]byte("x"))
+	if err != nil || string(v) != "v1" {
+		t.Fatal("Get excepted v1 but got ", string(v), err)
+	}
+	excepted := "tso|check|commit eA=="
+	if got := strings.Join(*log, "|"); got != excepted {
+		t.Fatal("Get excepted to resolve the lock with ", excepted, " but got ", got)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	srv, log := fakeTxnNode("")
+	defer srv.Close()
+
+	c := New([]string{srv.URL})
+	first, err := c.Timestamps(10)
+	if err != nil || first != 1 {
+		t.Fatal("Timestamps excepted 1 but got ", first, err)
+	}
+	// the next request starts after the batch
+	if ts, err := c.Timestamp(); err != nil || ts != 11 {
+		t.Fatal("Timestamp excepted 11 but got ", ts, err)
+	}
+	if got := strings.Join(*log, "|"); got != "tso|tso" {
+		t.Fatal("excepted one request per call but got ", got)
+	}
+}
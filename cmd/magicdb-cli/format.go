@@ -0,0 +1,384 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/magicdb/client"
+)
+
+// format is how results are printed
+type format int
+
+const (
+	// formatTable aligns columns under a header for humans
+	formatTable format = iota
+	// formatJSON prints one json document per result
+	formatJSON
+	// formatRaw prints the values verbatim, tab separated, for scripts
+	formatRaw
+)
+
+func parseFormat(s string) (format, error) {
+	switch s {
+	case "table":
+		return formatTable, nil
+	case "json":
+		return formatJSON, nil
+	case "raw":
+		return formatRaw, nil
+	}
+	return 0, fmt.Errorf("unknown output format %q, want table, json or raw", s)
+}
+
+func (f format) String() string {
+	switch f {
+	case formatJSON:
+		return "json"
+	case formatRaw:
+		return "raw"
+	}
+	return "table"
+}
+
+// record is the json form of a pair, like the export format values that
+// are not valid utf-8 are base64 encoded
+type record struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newRecord(k, v []byte) record {
+	if utf8.Valid(k) && utf8.Valid(v) {
+		return record{Key: string(k), Value: string(v)}
+	}
+	return record{
+		Key:      base64.StdEncoding.EncodeToString(k),
+		Value:    base64.StdEncoding.EncodeToString(v),
+		Encoding: "base64",
+	}
+}
+
+// display quote data which would garble a terminal
+func display(data []byte) string {
+	s := string(data)
+	if !utf8.ValidString(s) || strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// printTable print rows under header, or the rows tab separated in raw
+func (sh *shell) printTable(header []string, rows [][]string) error {
+	if sh.format == formatRaw {
+		for _, row := range rows {
+			if _, err := fmt.Fprintln(sh.out, strings.Join(row, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(sh.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (sh *shell) printJSON(v interface{}) error {
+	return json.NewEncoder(sh.out).Encode(v)
+}
+
+// printStatus print the outcome of a command without a result
+func (sh *shell) printStatus(msg string) error {
+	switch sh.format {
+	case formatJSON:
+		return sh.printJSON(map[string]string{"status": msg})
+	case formatRaw:
+		return nil
+	}
+	_, err := fmt.Fprintln(sh.out, msg)
+	return err
+}
+
+// printValue print the value of key, nil is a missing key
+func (sh *shell) printValue(key, value []byte) error {
+	switch sh.format {
+	case formatJSON:
+		if value == nil {
+			return sh.printJSON(nil)
+		}
+		return sh.printJSON(newRecord(key, value))
+	case formatRaw:
+		if value == nil {
+			return nil
+		}
+		_, err := sh.out.Write(append(value, '\n'))
+		return err
+	}
+	if value == nil {
+		_, err := fmt.Fprintln(sh.out, "(nil)")
+		return err
+	}
+	_, err := fmt.Fprintln(sh.out, display(value))
+	return err
+}
+
+func (sh *shell) printKVs(kvs []client.KV) error {
+	switch sh.format {
+	case formatJSON:
+		records := make([]record, len(kvs))
+		for i, p := range kvs {
+			records[i] = newRecord(p.Key, p.Value)
+		}
+		return sh.printJSON(records)
+	case formatRaw:
+		for _, p := range kvs {
+			line := append(append(append(append([]byte(nil), p.Key...), '\t'), p.Value...), '\n')
+			if _, err := sh.out.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rows := make([][]string, len(kvs))
+	for i, p := range kvs {
+		rows[i] = []string{display(p.Key), display(p.Value)}
+	}
+	if err := sh.printTable([]string{"KEY", "VALUE"}, rows); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(sh.out, "(%d pairs)\n", len(kvs))
+	return err
+}
+
+func (sh *shell) printEvent(e client.Event) error {
+	typ := "PUT"
+	if e.Type == client.EventDelete {
+		typ = "DELETE"
+	}
+	switch sh.format {
+	case formatJSON:
+		r := newRecord(e.Key, e.Value)
+		return sh.printJSON(struct {
+			Type  string `json:"type"`
+			Index uint64 `json:"index"`
+			record
+		}{typ, e.Index, r})
+	case formatRaw:
+		line := append([]byte(typ+"\t"), e.Key...)
+		line = append(append(append(line, '\t'), e.Value...), '\n')
+		_, err := sh.out.Write(line)
+		return err
+	}
+	_, err := fmt.Fprintf(sh.out, "%-6s %s %s (index %d)\n", typ, display(e.Key), display(e.Value), e.Index)
+	return err
+}
+
+func (sh *shell) printMembers(members []client.Member) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(members)
+	}
+	rows := make([][]string, len(members))
+	for i, m := range members {
+		role := "follower"
+		if m.Leader {
+			role = "leader"
+		}
+		rows[i] = []string{m.ID, m.Suffrage, role}
+	}
+	return sh.printTable([]string{"ID", "SUFFRAGE", "ROLE"}, rows)
+}
+
+func (sh *shell) printCluster(cl *client.Cluster) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(cl)
+	}
+	rows := make([][]string, len(cl.Members))
+	for i, m := range cl.Members {
+		st := m.Status
+		if st == nil {
+			rows[i] = []string{m.ID, m.Suffrage, "unreachable: " + m.Error, "", "", "", "", "", ""}
+			continue
+		}
+		contact := ""
+		if !st.LastContact.IsZero() && !m.Leader {
+			contact = time.Since(st.LastContact).Round(time.Millisecond).String()
+		}
+		rows[i] = []string{
+			m.ID, m.Suffrage, strings.ToLower(st.State),
+			strconv.FormatUint(st.Term, 10),
+			strconv.FormatUint(st.LastIndex, 10),
+			strconv.FormatUint(st.CommitIndex, 10),
+			strconv.FormatUint(st.AppliedIndex, 10),
+			contact, strings.Join(st.Addrs, ","),
+		}
+	}
+	return sh.printTable([]string{"ID", "SUFFRAGE", "STATE", "TERM", "LAST", "COMMIT", "APPLIED", "CONTACT", "ADDRS"}, rows)
+}
+
+func (sh *shell) printRanges(ranges []client.Range) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(ranges)
+	}
+	rows := make([][]string, len(ranges))
+	for i, r := range ranges {
+		end := display(r.End)
+		if len(r.End) == 0 {
+			end = "(end)"
+		}
+		rows[i] = []string{
+			strconv.FormatUint(r.ID, 10), display(r.Start), end, r.Leader,
+			strings.Join(r.Peers, ","),
+		}
+	}
+	return sh.printTable([]string{"ID", "START", "END", "LEADER", "PEERS"}, rows)
+}
+
+func (sh *shell) printNodes(nodes []client.Node) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(nodes)
+	}
+	rows := make([][]string, len(nodes))
+	for i, n := range nodes {
+		var labels []string
+		for k, v := range n.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		state := "up"
+		if !n.Up {
+			state = "down"
+		}
+		rows[i] = []string{
+			n.ID, state, strings.Join(labels, ","),
+			strconv.FormatUint(n.Used, 10), strconv.FormatUint(n.Capacity, 10),
+			strconv.FormatFloat(n.QPS, 'f', 1, 64),
+			strconv.Itoa(len(n.Ranges)), strconv.Itoa(len(n.Leaders)),
+			n.Heartbeat.Format(time.RFC3339),
+		}
+	}
+	return sh.printTable([]string{"ID", "STATE", "LABELS", "USED", "CAPACITY", "QPS", "RANGES", "LEADERS", "HEARTBEAT"}, rows)
+}
+
+func (sh *shell) printDecisions(decisions []client.Decision) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(decisions)
+	}
+	rows := make([][]string, len(decisions))
+	for i, d := range decisions {
+		rows[i] = []string{
+			d.Time.Format(time.RFC3339), strconv.FormatUint(d.Operator.Range, 10),
+			d.Operator.Kind, d.Operator.From, d.Operator.To, d.Reason,
+		}
+	}
+	return sh.printTable([]string{"TIME", "RANGE", "OPERATOR", "FROM", "TO", "REASON"}, rows)
+}
+
+// statusStats are the raft stats shown by status, in order
+var statusStats = []string{
+	"state", "term", "last_log_index", "commit_index", "applied_index",
+	"last_snapshot_index", "last_contact",
+}
+
+func (sh *shell) printClusterStatus(st *client.Status, members []client.Member) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(struct {
+			*client.Status
+			Members []client.Member `json:"members"`
+		}{st, members})
+	}
+	rows := [][]string{{"id", st.ID}, {"leader", st.Leader}}
+	for _, name := range statusStats {
+		if v, ok := st.Stats[name]; ok {
+			rows = append(rows, []string{name, v})
+		}
+	}
+	if enc := st.Encryption; enc.Enabled {
+		state := "done"
+		switch {
+		case enc.Error != "":
+			state = "error: " + enc.Error
+		case enc.Resealing:
+			state = "resealing"
+		}
+		rows = append(rows, []string{"encryption", fmt.Sprintf("key %d, %s", enc.ActiveKey, state)})
+	}
+	if err := sh.printTable([]string{"NODE", ""}, rows); err != nil {
+		return err
+	}
+	if sh.format == formatTable {
+		fmt.Fprintln(sh.out)
+	}
+	return sh.printMembers(members)
+}
+
+func (sh *shell) printBackup(info *client.BackupInfo) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(info)
+	}
+	var labels []string
+	for k, v := range info.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return sh.printTable([]string{"ID", "TIME", "SIZE", "FILES", "INDEX", "LABELS"}, [][]string{{
+		strconv.FormatUint(uint64(info.ID), 10),
+		time.Unix(info.Timestamp, 0).Format(time.RFC3339),
+		strconv.FormatInt(info.Size, 10),
+		strconv.FormatInt(int64(info.NumFiles), 10),
+		strconv.FormatUint(info.AppliedIndex, 10),
+		strings.Join(labels, ","),
+	}})
+}
+
+func (sh *shell) printUsers(users []client.User) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(users)
+	}
+	rows := make([][]string, len(users))
+	for i, u := range users {
+		rows[i] = []string{u.Name, strings.Join(u.Roles, ",")}
+	}
+	return sh.printTable([]string{"USER", "ROLES"}, rows)
+}
+
+func (sh *shell) printRoles(roles []client.Role) error {
+	if sh.format == formatJSON {
+		return sh.printJSON(roles)
+	}
+	rows := make([][]string, len(roles))
+	for i, r := range roles {
+		perms := make([]string, len(r.Permissions))
+		for j, p := range r.Permissions {
+			perms[j] = p.Perm + ":" + strconv.Quote(p.Prefix)
+		}
+		rows[i] = []string{r.Name, strings.Join(perms, " ")}
+	}
+	return sh.printTable([]string{"ROLE", "PERMISSIONS"}, rows)
+}
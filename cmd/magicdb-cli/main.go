@@ -0,0 +1,124 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// magicdb-cli is the command line shell of magicdb. It runs one command
+// given as arguments, the commands read from stdin, or an interactive
+// shell when stdin is a terminal.
+//
+//	magicdb-cli -endpoints http://10.0.0.1:8080 get foo
+//	magicdb-cli -o json scan user/
+//	magicdb-cli txn "put a 1" "del b"
+//	magicdb-cli -user root -password secret user list
+//	magicdb-cli -tls-ca ca.crt -endpoints 10.0.0.1:8080 status
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/magicdb/client"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// endpointsEnv overrides the default of -endpoints
+	endpointsEnv = "MAGICDB_ENDPOINTS"
+	// tokenEnv is the default of -token
+	tokenEnv = "MAGICDB_TOKEN"
+)
+
+func main() {
+	defaultEndpoints := os.Getenv(endpointsEnv)
+	if defaultEndpoints == "" {
+		defaultEndpoints = "http://127.0.0.1:8080"
+	}
+	endpoints := flag.String("endpoints", defaultEndpoints,
+		"comma separated http api addresses of the cluster, $"+endpointsEnv+" by default")
+	output := flag.String("o", "table", "output format: table, json or raw")
+	token := flag.String("token", os.Getenv(tokenEnv), "auth token, $"+tokenEnv+" by default")
+	user := flag.String("user", "", "log in as the user with -password")
+	password := flag.String("password", "", "password of -user")
+	staleness := flag.Duration("max-staleness", 0, "read from any node, learners included, which heard from the leader within this duration")
+	var tlsOpts client.TLSOptions
+	flag.StringVar(&tlsOpts.CAFile, "tls-ca", "", "ca file verifying the server certificates, endpoints default to https")
+	flag.StringVar(&tlsOpts.CertFile, "tls-cert", "", "client certificate file, it authenticates its common name as the user")
+	flag.StringVar(&tlsOpts.KeyFile, "tls-key", "", "private key file of -tls-cert")
+	flag.BoolVar(&tlsOpts.InsecureSkipVerify, "tls-insecure", false, "accept any server certificate")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: magicdb-cli [flags] [command args...]")
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		printHelp(os.Stderr)
+	}
+	flag.Parse()
+
+	f, err := parseFormat(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	conf, err := tlsOpts.Config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	secure := tlsOpts != client.TLSOptions{}
+	c := client.NewWithTLS(parseEndpoints(*endpoints, secure), conf)
+	c.SetMaxStaleness(*staleness)
+	switch {
+	case *user != "":
+		if _, _, err := c.Login(*user, *password); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	case *token != "":
+		c.SetToken(*token)
+	}
+	sh := newShell(c, os.Stdout, f)
+
+	switch {
+	case flag.NArg() > 0:
+		err = sh.exec(flag.Args())
+	case terminal.IsTerminal(int(os.Stdin.Fd())):
+		err = sh.repl(int(os.Stdin.Fd()))
+	default:
+		err = sh.script(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// parseEndpoints split a comma separated list, the default scheme is
+// http://, or https:// when secure
+func parseEndpoints(s string, secure bool) []string {
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	var eps []string
+	for _, ep := range strings.Split(s, ",") {
+		ep = strings.TrimRight(strings.TrimSpace(ep), "/")
+		if ep == "" {
+			continue
+		}
+		if !strings.Contains(ep, "://") {
+			ep = scheme + ep
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
@@ -0,0 +1,217 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	prompt    = "magicdb> "
+	txnPrompt = "magicdb(txn)> "
+
+	// historyFile is kept in the home directory
+	historyFile = ".magicdb_history"
+
+	// maxHistory is the number of lines loaded from the history file
+	maxHistory = 500
+
+	// completionLimit is the number of keys fetched to complete a key
+	completionLimit = 100
+)
+
+// termIO is the terminal's connection, it is switched from the history
+// file to the real terminal once the history is loaded
+type termIO struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (t *termIO) Read(p []byte) (int, error)  { return t.r.Read(p) }
+func (t *termIO) Write(p []byte) (int, error) { return t.w.Write(p) }
+
+// repl run the interactive shell on the terminal fd until exit or ctrl-d.
+// The terminal is raw only while a line is edited, so ctrl-c stops watch.
+func (sh *shell) repl(fd int) error {
+	tio := &termIO{r: os.Stdin, w: os.Stdout}
+	t := terminal.NewTerminal(tio, prompt)
+	histPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		histPath = filepath.Join(home, historyFile)
+		loadHistory(t, tio, histPath)
+	}
+	t.AutoCompleteCallback = sh.complete
+
+	fmt.Fprintln(os.Stdout, "magicdb-cli, type help for the commands")
+	for {
+		if w, h, err := terminal.GetSize(fd); err == nil {
+			t.SetSize(w, h)
+		}
+		if sh.pending != nil {
+			t.SetPrompt(txnPrompt)
+		} else {
+			t.SetPrompt(prompt)
+		}
+
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		line, err := t.ReadLine()
+		terminal.Restore(fd, state)
+		if err == io.EOF {
+			fmt.Fprintln(os.Stdout)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		appendHistory(histPath, line)
+		args, err := splitArgs(line)
+		if err == nil {
+			if args[0] == "exit" || args[0] == "quit" {
+				return nil
+			}
+			err = sh.exec(args)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "(error)", err)
+		}
+	}
+}
+
+// loadHistory feed the last lines of the history file to t, which keeps
+// the lines it reads as its history
+func loadHistory(t *terminal.Terminal, tio *termIO, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+
+	r, w := tio.r, tio.w
+	defer func() { tio.r, tio.w = r, w }()
+	tio.r = strings.NewReader(strings.Join(lines, "\r") + "\r")
+	tio.w = ioutil.Discard
+	for range lines {
+		if _, err := t.ReadLine(); err != nil {
+			return
+		}
+	}
+}
+
+func appendHistory(path, line string) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(line)
+	w.WriteByte('\n')
+	w.Flush()
+}
+
+// complete the word before the cursor on tab: command names, the words of
+// member, leader and output, and the keys of get, put, del, scan and watch
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	words := strings.Fields(head)
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(head, " ") {
+		word = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = commandNames()
+	case len(words) == 1 && words[0] == "member":
+		candidates = []string{"add", "list", "remove"}
+	case len(words) == 1 && words[0] == "range":
+		candidates = []string{"list", "split", "merge"}
+	case len(words) == 1 && words[0] == "pd":
+		candidates = []string{"nodes", "decisions"}
+	case len(words) == 1 && words[0] == "leader":
+		candidates = []string{"transfer"}
+	case len(words) == 1 && words[0] == "output":
+		candidates = []string{"json", "raw", "table"}
+	case (len(words) == 1 && (words[0] == "get" || words[0] == "put" ||
+		words[0] == "scan" || words[0] == "watch")) || words[0] == "del":
+		kvs, _, err := sh.c.Scan([]byte(word), nil, completionLimit)
+		if err != nil {
+			return "", 0, false
+		}
+		for _, p := range kvs {
+			// keys needing quotes are not completed
+			if !strings.ContainsAny(string(p.Key), " \t'\"") {
+				candidates = append(candidates, string(p.Key))
+			}
+		}
+	}
+
+	completion, unique := completeWord(word, candidates)
+	if len(completion) <= len(word) && !unique {
+		return "", 0, false
+	}
+	if unique {
+		completion += " "
+	}
+	newHead := head[:len(head)-len(word)] + completion
+	return newHead + line[pos:], len(newHead), true
+}
+
+// completeWord return the longest common prefix of the candidates
+// starting with word, and whether only one candidate matches
+func completeWord(word string, candidates []string) (string, bool) {
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return word, false
+	}
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix, len(matches) == 1
+}
@@ -0,0 +1,689 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicdb/client"
+)
+
+// scanPageSize is the number of pairs fetched per scan request
+const scanPageSize = 1000
+
+var (
+	errNoTxn    = errors.New("no transaction, run txn first")
+	errInTxn    = errors.New("already in a transaction, commit or abort it first")
+	errEmptyTxn = errors.New("empty transaction")
+)
+
+// command is a shell command, args[0] is its name
+type command struct {
+	name  string
+	usage string
+	help  string
+	// minArgs and maxArgs bound len(args)-1, maxArgs < 0 is unbounded
+	minArgs int
+	maxArgs int
+	run     func(sh *shell, args []string) error
+}
+
+var (
+	commands   []*command
+	commandMap = make(map[string]*command)
+)
+
+func init() {
+	commands = []*command{
+		{"get", "get <key> [at]", "get the value of a key, at a time such as -1h or 2006-01-02T15:04:05Z", 1, 2, (*shell).get},
+		{"put", "put <key> <value>", "put a key-value", 2, 2, (*shell).put},
+		{"del", "del <key>...", "delete keys atomically", 1, -1, (*shell).del},
+		{"scan", "scan [prefix] [limit]", "list the pairs with the prefix in key order", 0, 2, (*shell).scan},
+		{"watch", "watch [prefix]", "print the changes under the prefix until ctrl-c", 0, 1, (*shell).watch},
+		{"txn", "txn [statement...]", "begin a transaction, or run the quoted put/del statements as one", 0, -1, (*shell).txn},
+		{"commit", "commit", "apply the queued writes of the transaction atomically", 0, 0, (*shell).commit},
+		{"abort", "abort", "discard the transaction", 0, 0, (*shell).abort},
+		{"status", "status", "show the raft state of the node and the members", 0, 0, (*shell).status},
+		{"cluster", "cluster", "show the members with their raft progress and addresses", 0, 0, (*shell).cluster},
+		{"member", "member list|add <addr> [learner]|remove <id>", "list, add or remove members, learners never vote", 1, 3, (*shell).member},
+		{"leader", "leader transfer [id]", "hand the leadership over to id or any voter", 1, 2, (*shell).leader},
+		{"drain", "drain [leave]", "drain the first endpoint's node, which then stops; leave also removes it", 0, 1, (*shell).drain},
+		{"range", "range list|split <key>|merge <id>", "list the ranges with their leader, split the range of key at key, or merge range id into the previous one", 1, 2, (*shell).rangeCmd},
+		{"pd", "pd nodes|decisions", "list the nodes known by the placement driver, or its last decisions", 1, 1, (*shell).pd},
+		{"snapshot", "snapshot", "make the leader take a raft snapshot", 0, 0, (*shell).snapshot},
+		{"backup", "backup", "make the leader take a backup", 0, 0, (*shell).backup},
+		{"login", "login <user> <password>", "authenticate the next commands as the user", 2, 2, (*shell).login},
+		{"auth", "auth enable <root password>", "create the root user and turn auth on", 2, 2, (*shell).auth},
+		{"user", "user list|add <name> <password> [role...]|del <name>", "list, add or remove users", 1, -1, (*shell).user},
+		{"role", "role list|add <name> [perm:prefix...]|del <name>", "list, add or remove roles, perm is read, write or admin", 1, -1, (*shell).role},
+		{"output", "output [table|json|raw]", "show or set the output format", 0, 1, (*shell).output},
+		{"help", "help", "show this help", 0, 0, (*shell).help},
+	}
+	for _, c := range commands {
+		commandMap[c.name] = c
+	}
+}
+
+func printHelp(w io.Writer) {
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-36s %s\n", c.usage, c.help)
+	}
+	fmt.Fprintf(w, "  %-36s %s\n", "exit", "leave the shell")
+}
+
+// txnOp is a queued write, the last one of a key wins
+type txnOp struct {
+	value []byte
+	del   bool
+}
+
+// shell run commands against a cluster
+type shell struct {
+	c      *client.Client
+	out    io.Writer
+	format format
+
+	// pending holds the queued writes, it is nil outside of a transaction
+	pending      map[string]txnOp
+	pendingOrder []string
+}
+
+func newShell(c *client.Client, out io.Writer, f format) *shell {
+	return &shell{c: c, out: out, format: f}
+}
+
+// exec run one command
+func (sh *shell) exec(args []string) error {
+	c, ok := commandMap[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	n := len(args) - 1
+	if n < c.minArgs || (c.maxArgs >= 0 && n > c.maxArgs) {
+		return fmt.Errorf("usage: %s", c.usage)
+	}
+	return c.run(sh, args)
+}
+
+// script run the commands read from r one per line, it stops at the first
+// error. Empty lines and lines starting with # are skipped.
+func (sh *shell) script(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err == nil {
+			err = sh.exec(args)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if sh.pending != nil {
+		return errors.New("transaction not committed")
+	}
+	return nil
+}
+
+func (sh *shell) get(args []string) error {
+	key := args[1]
+	if len(args) > 2 {
+		ts, err := parseAt(args[2])
+		if err != nil {
+			return err
+		}
+		v, err := sh.c.GetAt([]byte(key), ts)
+		if err != nil {
+			return err
+		}
+		return sh.printValue([]byte(key), v)
+	}
+	if op, ok := sh.pending[key]; ok {
+		if op.del {
+			return sh.printValue([]byte(key), nil)
+		}
+		return sh.printValue([]byte(key), op.value)
+	}
+	v, err := sh.c.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	return sh.printValue([]byte(key), v)
+}
+
+// parseAt parse the time of a read in the past: a timestamp of the oracle,
+// a RFC 3339 time or a duration before now such as -1h
+func parseAt(s string) (uint64, error) {
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d < 0 {
+		return client.TimestampOf(time.Now().Add(d)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return client.TimestampOf(t), nil
+}
+
+func (sh *shell) put(args []string) error {
+	if sh.pending != nil {
+		sh.queue(args[1], txnOp{value: []byte(args[2])})
+		return sh.printStatus("QUEUED")
+	}
+	if err := sh.c.Put([]byte(args[1]), []byte(args[2])); err != nil {
+		return err
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) del(args []string) error {
+	if sh.pending != nil {
+		for _, k := range args[1:] {
+			sh.queue(k, txnOp{del: true})
+		}
+		return sh.printStatus("QUEUED")
+	}
+	keys := make([][]byte, len(args)-1)
+	for i, k := range args[1:] {
+		keys[i] = []byte(k)
+	}
+	if err := sh.c.Write(nil, nil, keys); err != nil {
+		return err
+	}
+	return sh.printStatus("OK")
+}
+
+// scan page through the prefix, a limit of 0 lists every pair
+func (sh *shell) scan(args []string) error {
+	var prefix []byte
+	if len(args) > 1 {
+		prefix = []byte(args[1])
+	}
+	limit := 0
+	if len(args) > 2 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid limit %q", args[2])
+		}
+		limit = n
+	}
+
+	var kvs []client.KV
+	var start []byte
+	for {
+		page := scanPageSize
+		if limit > 0 && limit-len(kvs) < page {
+			page = limit - len(kvs)
+		}
+		res, more, err := sh.c.Scan(prefix, start, page)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, res...)
+		if !more || len(res) == 0 || (limit > 0 && len(kvs) >= limit) {
+			break
+		}
+		start = res[len(res)-1].Key
+	}
+	return sh.printKVs(kvs)
+}
+
+// watch print events until ctrl-c or the connection ends
+func (sh *shell) watch(args []string) error {
+	var prefix []byte
+	if len(args) > 1 {
+		prefix = []byte(args[1])
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	events, err := sh.c.Watch(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for e := range events {
+		if err := sh.printEvent(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() == nil {
+		return errors.New("watch ended by the server")
+	}
+	return nil
+}
+
+// txn begin a transaction. With statements, they are queued and committed
+// at once, this is the one-shot form.
+func (sh *shell) txn(args []string) error {
+	if sh.pending != nil {
+		return errInTxn
+	}
+	sh.pending = make(map[string]txnOp)
+	sh.pendingOrder = nil
+	if len(args) == 1 {
+		return sh.printStatus("OK")
+	}
+
+	for _, stmt := range args[1:] {
+		sargs, err := splitArgs(stmt)
+		if err == nil && sargs[0] != "put" && sargs[0] != "del" {
+			err = fmt.Errorf("only put and del are allowed in txn, got %q", sargs[0])
+		}
+		if err == nil {
+			sh.queueArgs(sargs)
+		}
+		if err != nil {
+			sh.pending = nil
+			return err
+		}
+	}
+	return sh.commit(nil)
+}
+
+// queueArgs queue a put or del statement
+func (sh *shell) queueArgs(args []string) {
+	if args[0] == "put" && len(args) == 3 {
+		sh.queue(args[1], txnOp{value: []byte(args[2])})
+		return
+	}
+	for _, k := range args[1:] {
+		sh.queue(k, txnOp{del: true})
+	}
+}
+
+func (sh *shell) queue(key string, op txnOp) {
+	if _, ok := sh.pending[key]; !ok {
+		sh.pendingOrder = append(sh.pendingOrder, key)
+	}
+	sh.pending[key] = op
+}
+
+func (sh *shell) commit(args []string) error {
+	if sh.pending == nil {
+		return errNoTxn
+	}
+	ops, order := sh.pending, sh.pendingOrder
+	sh.pending, sh.pendingOrder = nil, nil
+	if len(order) == 0 {
+		return errEmptyTxn
+	}
+
+	var keys, values, dels [][]byte
+	for _, k := range order {
+		op := ops[k]
+		if op.del {
+			dels = append(dels, []byte(k))
+			continue
+		}
+		keys = append(keys, []byte(k))
+		values = append(values, op.value)
+	}
+	if err := sh.c.Write(keys, values, dels); err != nil {
+		return err
+	}
+	return sh.printStatus(fmt.Sprintf("OK, %d writes committed", len(order)))
+}
+
+func (sh *shell) abort(args []string) error {
+	if sh.pending == nil {
+		return errNoTxn
+	}
+	sh.pending, sh.pendingOrder = nil, nil
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) status(args []string) error {
+	st, err := sh.c.Status()
+	if err != nil {
+		return err
+	}
+	members, err := sh.c.Members()
+	if err != nil {
+		return err
+	}
+	return sh.printClusterStatus(st, members)
+}
+
+func (sh *shell) cluster(args []string) error {
+	cl, err := sh.c.Cluster()
+	if err != nil {
+		return err
+	}
+	return sh.printCluster(cl)
+}
+
+func (sh *shell) member(args []string) error {
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		members, err := sh.c.Members()
+		if err != nil {
+			return err
+		}
+		return sh.printMembers(members)
+	case args[1] == "add" && len(args) == 3:
+		if err := sh.c.AddMember(args[2]); err != nil {
+			return err
+		}
+	case args[1] == "add" && len(args) == 4 && args[3] == "learner":
+		if err := sh.c.AddLearner(args[2]); err != nil {
+			return err
+		}
+	case args[1] == "remove" && len(args) == 3:
+		if err := sh.c.RemoveMember(args[2]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: %s", commandMap["member"].usage)
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) leader(args []string) error {
+	if args[1] != "transfer" {
+		return fmt.Errorf("usage: %s", commandMap["leader"].usage)
+	}
+	to := ""
+	if len(args) > 2 {
+		to = args[2]
+	}
+	if err := sh.c.TransferLeader(to); err != nil {
+		return err
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) drain(args []string) error {
+	leave := false
+	if len(args) > 1 {
+		if args[1] != "leave" {
+			return fmt.Errorf("usage: %s", commandMap["drain"].usage)
+		}
+		leave = true
+	}
+	if err := sh.c.Drain(leave, 0); err != nil {
+		return err
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) rangeCmd(args []string) error {
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		ranges, err := sh.c.Ranges()
+		if err != nil {
+			return err
+		}
+		return sh.printRanges(ranges)
+	case args[1] == "split" && len(args) == 3:
+		r, err := sh.c.Split([]byte(args[2]))
+		if err != nil {
+			return err
+		}
+		return sh.printRanges([]client.Range{*r})
+	case args[1] == "merge" && len(args) == 3:
+		id, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid range id %q", args[2])
+		}
+		r, err := sh.c.Merge(id)
+		if err != nil {
+			return err
+		}
+		return sh.printRanges([]client.Range{*r})
+	}
+	return fmt.Errorf("usage: %s", commandMap["range"].usage)
+}
+
+func (sh *shell) pd(args []string) error {
+	switch args[1] {
+	case "nodes":
+		nodes, err := sh.c.PDNodes()
+		if err != nil {
+			return err
+		}
+		return sh.printNodes(nodes)
+	case "decisions":
+		decisions, err := sh.c.PDDecisions()
+		if err != nil {
+			return err
+		}
+		return sh.printDecisions(decisions)
+	}
+	return fmt.Errorf("usage: %s", commandMap["pd"].usage)
+}
+
+func (sh *shell) snapshot(args []string) error {
+	if err := sh.c.Snapshot(); err != nil {
+		return err
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) backup(args []string) error {
+	info, err := sh.c.Backup()
+	if err != nil {
+		return err
+	}
+	return sh.printBackup(info)
+}
+
+func (sh *shell) login(args []string) error {
+	_, expires, err := sh.c.Login(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	return sh.printStatus("OK, token expires " + expires.Local().Format(time.RFC3339))
+}
+
+func (sh *shell) auth(args []string) error {
+	if args[1] != "enable" {
+		return fmt.Errorf("usage: %s", commandMap["auth"].usage)
+	}
+	if err := sh.c.EnableAuth(args[2]); err != nil {
+		return err
+	}
+	return sh.printStatus("OK, login as root")
+}
+
+func (sh *shell) user(args []string) error {
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		users, err := sh.c.Users()
+		if err != nil {
+			return err
+		}
+		return sh.printUsers(users)
+	case args[1] == "add" && len(args) >= 4:
+		if err := sh.c.PutUser(args[2], args[3], args[4:]); err != nil {
+			return err
+		}
+	case args[1] == "del" && len(args) == 3:
+		if err := sh.c.DeleteUser(args[2]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: %s", commandMap["user"].usage)
+	}
+	return sh.printStatus("OK")
+}
+
+func (sh *shell) role(args []string) error {
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		roles, err := sh.c.Roles()
+		if err != nil {
+			return err
+		}
+		return sh.printRoles(roles)
+	case args[1] == "add" && len(args) >= 3:
+		role := client.Role{Name: args[2]}
+		for _, arg := range args[3:] {
+			p, err := parsePermission(arg)
+			if err != nil {
+				return err
+			}
+			role.Permissions = append(role.Permissions, p)
+		}
+		if err := sh.c.PutRole(role); err != nil {
+			return err
+		}
+	case args[1] == "del" && len(args) == 3:
+		if err := sh.c.DeleteRole(args[2]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: %s", commandMap["role"].usage)
+	}
+	return sh.printStatus("OK")
+}
+
+// parsePermission parse perm:prefix, such as read:user/ or admin: for
+// every key
+func parsePermission(s string) (client.Permission, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return client.Permission{}, fmt.Errorf("invalid permission %q, want perm:prefix", s)
+	}
+	switch perm := s[:i]; perm {
+	case "read", "write", "admin":
+		return client.Permission{Prefix: s[i+1:], Perm: perm}, nil
+	}
+	return client.Permission{}, fmt.Errorf("unknown permission %q, want read, write or admin", s[:i])
+}
+
+func (sh *shell) output(args []string) error {
+	if len(args) == 1 {
+		return sh.printStatus(sh.format.String())
+	}
+	f, err := parseFormat(args[1])
+	if err != nil {
+		return err
+	}
+	sh.format = f
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	printHelp(sh.out)
+	return nil
+}
+
+// commandNames return the names completed by the shell, in order
+func commandNames() []string {
+	names := []string{"exit", "quit"}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitArgs split a line into arguments like a shell: words are separated
+// by spaces, '...' is literal and "..." supports the escapes \" \\ \n \t
+// \r and \xHH
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur []byte
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			if inWord {
+				args = append(args, string(cur))
+				cur, inWord = nil, false
+			}
+		case ch == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			cur = append(cur, line[i+1:i+1+end]...)
+			i += end + 1
+			inWord = true
+		case ch == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] != '\\' || i+1 == len(line) {
+					cur = append(cur, line[i])
+					continue
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					cur = append(cur, '\n')
+				case 't':
+					cur = append(cur, '\t')
+				case 'r':
+					cur = append(cur, '\r')
+				case 'x':
+					if i+2 >= len(line) {
+						return nil, errors.New("invalid \\x escape")
+					}
+					b, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+					if err != nil {
+						return nil, errors.New("invalid \\x escape")
+					}
+					cur = append(cur, byte(b))
+					i += 2
+				default:
+					cur = append(cur, line[i])
+				}
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			inWord = true
+		default:
+			cur = append(cur, ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, string(cur))
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/magicdb/client"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+	}{
+		{"get foo", []string{"get", "foo"}},
+		{"  put  a   b ", []string{"put", "a", "b"}},
+		{`put 'a b' "c\td\x41\""`, []string{"put", "a b", "c\tdA\""}},
+		{`put k''v ""`, []string{"put", "kv", ""}},
+	}
+	for _, c := range cases {
+		args, err := splitArgs(c.line)
+		if err != nil || !reflect.DeepEqual(args, c.args) {
+			t.Fatal("splitArgs ", c.line, " excepted ", c.args, " got ", args, err)
+		}
+	}
+	for _, line := range []string{`get "foo`, "get 'foo", `get "\x4"`, "   "} {
+		if _, err := splitArgs(line); err == nil {
+			t.Fatal("splitArgs excepted error for ", line)
+		}
+	}
+}
+
+func TestCompleteWord(t *testing.T) {
+	names := commandNames()
+	if c, unique := completeWord("sn", names); c != "snapshot" || !unique {
+		t.Fatal("excepted snapshot got ", c, unique)
+	}
+	if c, unique := completeWord("s", names); c != "s" || unique {
+		t.Fatal("excepted s got ", c, unique)
+	}
+	if c, _ := completeWord("user/", []string{"user/1/a", "user/1/b", "users"}); c != "user/1/" {
+		t.Fatal("excepted user/1/ got ", c)
+	}
+}
+
+// fakeBatchNode record the batches written to it
+func fakeBatchNode(batches *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/batch" {
+			http.NotFound(w, r)
+			return
+		}
+		var b map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&b)
+		*batches = append(*batches, b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestTxn(t *testing.T) {
+	var batches []map[string]interface{}
+	node := fakeBatchNode(&batches)
+	defer node.Close()
+	var out bytes.Buffer
+	sh := newShell(client.New([]string{node.URL}), &out, formatTable)
+
+	for _, args := range [][]string{
+		{"txn"}, {"put", "a", "1"}, {"put", "b", "2"}, {"del", "a"}, {"get", "b"},
+	} {
+		if err := sh.exec(args); err != nil {
+			t.Fatal(args, " error ", err)
+		}
+	}
+	if len(batches) != 0 {
+		t.Fatal("excepted no write before commit")
+	}
+	if !strings.HasSuffix(out.String(), "QUEUED\n2\n") {
+		t.Fatal("unexcepted output ", out.String())
+	}
+	if err := sh.exec([]string{"commit"}); err != nil {
+		t.Fatal("commit error ", err)
+	}
+	if len(batches) != 1 || len(batches[0]["puts"].([]interface{})) != 1 ||
+		len(batches[0]["deletes"].([]interface{})) != 1 {
+		t.Fatal("unexcepted batches ", batches)
+	}
+	if err := sh.exec([]string{"commit"}); err != errNoTxn {
+		t.Fatal("excepted errNoTxn got ", err)
+	}
+
+	if err := sh.exec([]string{"txn", "put x 1", "del y z"}); err != nil {
+		t.Fatal("one-shot txn error ", err)
+	}
+	if len(batches) != 2 {
+		t.Fatal("excepted a second batch got ", batches)
+	}
+	if err := sh.exec([]string{"txn", "get x"}); err == nil || sh.pending != nil {
+		t.Fatal("excepted get to be rejected in one-shot txn")
+	}
+}
+
+func TestPrintKVs(t *testing.T) {
+	kvs := []client.KV{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte{0xff}},
+	}
+	cases := map[format]string{
+		formatTable: "KEY  VALUE\na    1\nb    \"\\xff\"\n(2 pairs)\n",
+		formatJSON:  `[{"key":"a","value":"1"},{"key":"Yg==","value":"/w==","encoding":"base64"}]` + "\n",
+		formatRaw:   "a\t1\nb\t\xff\n",
+	}
+	for f, want := range cases {
+		var out bytes.Buffer
+		sh := newShell(nil, &out, f)
+		if err := sh.printKVs(kvs); err != nil {
+			t.Fatal("printKVs error ", err)
+		}
+		if out.String() != want {
+			t.Fatalf("printKVs %s excepted %q got %q", f, want, out.String())
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	p, err := parsePermission("read:user/")
+	if err != nil || p.Perm != "read" || p.Prefix != "user/" {
+		t.Fatal("excepted read on user/ got ", p, err)
+	}
+	if p, err = parsePermission("admin:"); err != nil || p.Perm != "admin" || p.Prefix != "" {
+		t.Fatal("excepted admin on every key got ", p, err)
+	}
+	for _, s := range []string{"user/", "owner:user/"} {
+		if _, err := parsePermission(s); err == nil {
+			t.Fatalf("excepted %q to be rejected", s)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/cluster" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id":"A","leader":"A","members":[` +
+			`{"id":"A","suffrage":"Voter","leader":true,"status":{"state":"Leader","term":2,"last_index":9,"commit_index":9,"applied_index":9,"addrs":["/ip4/127.0.0.1/tcp/4001"]}},` +
+			`{"id":"B","suffrage":"Voter","error":"dial backoff"}]}`))
+	}))
+	defer node.Close()
+	var out bytes.Buffer
+	sh := newShell(client.New([]string{node.URL}), &out, formatTable)
+	if err := sh.exec([]string{"cluster"}); err != nil {
+		t.Fatal("cluster error ", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "leader") || !strings.Contains(lines[1], "/ip4/127.0.0.1/tcp/4001") ||
+		!strings.Contains(lines[2], "unreachable: dial backoff") {
+		t.Fatal("unexcepted cluster output ", out.String())
+	}
+}
+
+func TestRangeList(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/ranges" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"id":0,"end":"bQ==","peers":["A","B"],"leader":"A"},{"id":7,"start":"bQ==","peers":["A","B"],"leader":"B"}]`))
+	}))
+	defer node.Close()
+	var out bytes.Buffer
+	sh := newShell(client.New([]string{node.URL}), &out, formatTable)
+	if err := sh.exec([]string{"range", "list"}); err != nil {
+		t.Fatal("range list error ", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "m") || !strings.Contains(lines[2], "(end)") ||
+		!strings.Contains(lines[2], "B") {
+		t.Fatal("unexcepted range output ", out.String())
+	}
+	if err := sh.exec([]string{"range", "merge"}); err == nil {
+		t.Fatal("range merge excepted a usage error")
+	}
+}
+
+func TestParseAt(t *testing.T) {
+	for s, excepted := range map[string]uint64{
+		"42":                   42,
+		"1970-01-01T00:00:01Z": 1000 << 18,
+	} {
+		if ts, err := parseAt(s); err != nil || ts != excepted {
+			t.Fatal("parseAt ", s, " excepted ", excepted, " but got ", ts, err)
+		}
+	}
+	if ts, err := parseAt("-1h"); err != nil || ts == 0 {
+		t.Fatal("parseAt -1h error ", err)
+	}
+	for _, s := range []string{"1h", "yesterday"} {
+		if _, err := parseAt(s); err == nil {
+			t.Fatal("parseAt ", s, " excepted an error")
+		}
+	}
+}
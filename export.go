@@ -0,0 +1,98 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/magicdb/storage"
+	"github.com/spf13/viper"
+)
+
+// runExport write the keys under a prefix to a jsonl or csv file. The store
+// is opened read-only, so a running node can be exported, and the keys are
+// read from one snapshot so the export is consistent.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbDir := fs.String("db", viper.GetString("dataDir"), "data directory of the store")
+	prefix := fs.String("prefix", "", "export only keys with this prefix")
+	format := fs.String("format", "jsonl", "output format, jsonl or csv")
+	out := fs.String("o", "-", "output file, - is stdout")
+	encKey := fs.String("encryption-key", viper.GetString("security.encryptionKeyFile"), "encryption key file of the store")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	rw, err := newRecordWriter(*format, w)
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.NewReadOnlyKvStore(storage.NewDefaultOptions(), *dbDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *encKey != "" {
+		kr, err := storage.LoadKeyring(*encKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *encKey, err)
+		}
+		store.SetKeyring(kr)
+	}
+
+	snap, err := store.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	var count int
+	var writeErr error
+	err = snap.Iterate([]byte(*prefix), func(k, v []byte) bool {
+		if storage.IsSystemKey(k) {
+			return true
+		}
+		if writeErr = rw.Write(newRecord(k, v)); writeErr != nil {
+			return false
+		}
+		count++
+		if count%100000 == 0 {
+			log.Printf("exported %d records", count)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	log.Printf("exported %d records", count)
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicdb/client"
+	"github.com/spf13/viper"
+)
+
+// importRetries is how many times a failed batch is retried before the
+// import stops. A stopped import resumes from its progress file.
+const importRetries = 5
+
+// tlsFlags add the tls flags of the client commands to fs, https
+// endpoints are verified with the system roots by default
+func tlsFlags(fs *flag.FlagSet) *client.TLSOptions {
+	o := &client.TLSOptions{}
+	fs.StringVar(&o.CAFile, "tls-ca", viper.GetString("tls.caFile"), "ca file verifying the certificates of https endpoints")
+	fs.StringVar(&o.CertFile, "tls-cert", viper.GetString("tls.clientCertFile"), "client certificate file, for servers verifying them")
+	fs.StringVar(&o.KeyFile, "tls-key", viper.GetString("tls.clientKeyFile"), "private key file of -tls-cert")
+	return o
+}
+
+// newClient create a client of the comma separated endpoints
+func newClient(endpoints, token string, o *client.TLSOptions) (*client.Client, error) {
+	conf, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	c := client.NewWithTLS(strings.Split(endpoints, ","), conf)
+	c.SetToken(token)
+	return c, nil
+}
+
+// runImport load jsonl or csv files into the cluster with batched,
+// replicated writes. The number of records committed is saved next to each
+// file in <file>.progress after every batch, so a failed import can be run
+// again and resumes where it stopped.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	endpoints := fs.String("endpoints", strings.Join(viper.GetStringSlice("http.endpoints"), ","), "comma separated http endpoints of the cluster")
+	token := fs.String("token", os.Getenv("MAGICDB_TOKEN"), "auth token of a user with the write permission, $MAGICDB_TOKEN by default")
+	tlsOpts := tlsFlags(fs)
+	format := fs.String("format", "", "input format, jsonl or csv, default from the file extension")
+	batchSize := fs.Int("batch", 1000, "records per replicated write")
+	rate := fs.Float64("rate", 0, "max records per second, 0 is unlimited")
+	resume := fs.Bool("resume", true, "resume from the progress file of a previous run")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: magicdb import [flags] file...")
+	}
+
+	c, err := newClient(*endpoints, *token, tlsOpts)
+	if err != nil {
+		return err
+	}
+	for _, file := range fs.Args() {
+		f := *format
+		if f == "" {
+			f = strings.TrimPrefix(filepath.Ext(file), ".")
+		}
+		im := &importer{
+			client:    c,
+			file:      file,
+			format:    f,
+			batchSize: *batchSize,
+			rate:      *rate,
+			resume:    *resume,
+		}
+		if err := im.run(); err != nil {
+			return fmt.Errorf("import %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+type importer struct {
+	client    *client.Client
+	file      string
+	format    string
+	batchSize int
+	rate      float64
+	resume    bool
+
+	done       int64
+	start      time.Time
+	lastReport time.Time
+}
+
+func (im *importer) progressFile() string {
+	return im.file + ".progress"
+}
+
+func (im *importer) run() error {
+	f, err := os.Open(im.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cr := &countingReader{r: f}
+	rr, err := newRecordReader(im.format, cr)
+	if err != nil {
+		return err
+	}
+
+	var skip int64
+	if im.resume {
+		if skip, err = im.loadProgress(); err != nil {
+			return err
+		}
+		if skip > 0 {
+			log.Printf("%s: resuming after %d records", im.file, skip)
+		}
+	}
+
+	im.start = time.Now()
+	var keys, values [][]byte
+	var read int64
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %v", read+1, err)
+		}
+		read++
+		if read <= skip {
+			continue
+		}
+
+		k, v, err := rec.decode()
+		if err != nil {
+			return fmt.Errorf("record %d: %v", read, err)
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+		if len(keys) >= im.batchSize {
+			if err := im.commit(keys, values, read); err != nil {
+				return err
+			}
+			keys, values = nil, nil
+			im.report(cr.n, st.Size())
+		}
+	}
+	if len(keys) > 0 {
+		if err := im.commit(keys, values, read); err != nil {
+			return err
+		}
+	}
+	im.report(st.Size(), st.Size())
+	os.Remove(im.progressFile())
+	return nil
+}
+
+// commit write a batch and record that the first total records are in
+func (im *importer) commit(keys, values [][]byte, total int64) error {
+	im.throttle(int64(len(keys)))
+
+	var err error
+	for i := 0; i < importRetries; i++ {
+		if err = im.client.BatchPut(keys, values); err == nil {
+			break
+		}
+		log.Printf("%s: batch failed, retrying: %v", im.file, err)
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	im.done += int64(len(keys))
+	return ioutil.WriteFile(im.progressFile(), []byte(strconv.FormatInt(total, 10)), 0644)
+}
+
+// throttle sleep so that at most rate records per second are written
+func (im *importer) throttle(n int64) {
+	if im.rate <= 0 {
+		return
+	}
+	expected := time.Duration(float64(im.done+n) / im.rate * float64(time.Second))
+	if wait := expected - time.Since(im.start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (im *importer) report(read, size int64) {
+	if time.Since(im.lastReport) < 2*time.Second && read < size {
+		return
+	}
+	im.lastReport = time.Now()
+
+	percent := 100.0
+	if size > 0 {
+		percent = float64(read) * 100 / float64(size)
+	}
+	elapsed := time.Since(im.start).Seconds()
+	log.Printf("%s: %d records imported, %.1f%%, %.0f records/s",
+		im.file, im.done, percent, float64(im.done)/elapsed)
+}
+
+func (im *importer) loadProgress() (int64, error) {
+	data, err := ioutil.ReadFile(im.progressFile())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pnet "github.com/libp2p/go-libp2p-pnet"
+	raft "github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+	"github.com/spf13/viper"
+)
+
+// keyFileName is the identity key in the data directory
+const keyFileName = "node.key"
+
+// runKeygen write a new identity key and print its peer id, so the member
+// list of a cluster can be written before its nodes first start. With -psk
+// it writes a private network key to share with every node instead, with
+// -enc it adds a new active encryption key to the key file.
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("o", "", "key file to write (default node.keyFile or <dataDir>/"+keyFileName+
+		", security.swarmKeyFile with -psk, security.encryptionKeyFile with -enc)")
+	psk := fs.Bool("psk", false, "write a private network key")
+	enc := fs.Bool("enc", false, "add an encryption key, it becomes the active one")
+	fs.Parse(args)
+
+	if *enc {
+		if *out == "" {
+			*out = viper.GetString("security.encryptionKeyFile")
+		}
+		if *out == "" {
+			return errors.New("keygen -enc: no key file, set -o or security.encryptionKeyFile")
+		}
+		id, err := storage.AddDataKey(*out)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *out, err)
+		}
+		fmt.Printf("added key %d to %s, copy it to every node then reload them with SIGHUP\n", id, *out)
+		return nil
+	}
+
+	if *psk {
+		if *out == "" {
+			*out = viper.GetString("security.swarmKeyFile")
+		}
+		if *out == "" {
+			return errors.New("keygen -psk: no key file, set -o or security.swarmKeyFile")
+		}
+		return writeSwarmKey(*out)
+	}
+	if *out == "" {
+		*out = defaultKeyFile(viper.GetString("dataDir"))
+	}
+
+	sk, err := raft.GenerateKey()
+	if err != nil {
+		return err
+	}
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	if err := raft.WriteKey(*out, sk); err != nil {
+		return fmt.Errorf("%s: %v", *out, err)
+	}
+	fmt.Println(pid.Pretty())
+	return nil
+}
+
+// writeSwarmKey write a new private network key readable by the owner
+// only, an existing file is never overwritten
+func writeSwarmKey(path string) error {
+	key, err := pnet.GenerateV1PSK()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// defaultKeyFile is node.keyFile, or node.key in the data directory
+func defaultKeyFile(dbDir string) string {
+	if f := viper.GetString("node.keyFile"); f != "" {
+		return f
+	}
+	return filepath.Join(dbDir, keyFileName)
+}
@@ -20,15 +20,41 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
 	raft "github.com/magicdb/raft"
+	"github.com/magicdb/server"
+	"github.com/magicdb/service"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/spf13/viper"
 )
 
+// commands are the magicdb sub commands, run as: magicdb <command> [args]
+var commands = map[string]func(args []string) error{
+	"backup": runBackup,
+	"export": runExport,
+	"import": runImport,
+	"ingest": runIngest,
+	"keygen": runKeygen,
+	"serve":  runServe,
+	"sst":    runSST,
+}
+
 func main() {
+	loadConfig()
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	fmt.Println("handsome, raft run...")
 
 	port := flag.Int("p", 0, "wait for incoming connections")
@@ -57,18 +83,11 @@ func main() {
 		select {}
 	}
 
-	nodeAddr, err := ma.NewMultiaddr(*dest)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("nodeAddr: ", nodeAddr)
-	pid, err := nodeAddr.ValueForProtocol(ma.P_IPFS)
+	peerid, destAddr, err := parsePeerAddr(*dest)
 	if err != nil {
 		log.Fatal(err)
 	}
-	peerid, err := peer.IDB58Decode(pid)
-	destPeerAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/ipfs/%s", peerid))
-	destAddr := nodeAddr.Decapsulate(destPeerAddr)
+	fmt.Println("nodeAddr: ", destAddr)
 
 	n.Peerstore().AddAddr(peerid, destAddr, peerstore.PermanentAddrTTL)
 	log.Println("opening stream")
@@ -91,6 +110,25 @@ func main() {
 	log.Printf("read reply: %q\n", out)
 }
 
+// parsePeerAddr split a full peer address /ip4/<ip>/tcp/<port>/ipfs/<id>
+// into the peer id and its transport address.
+func parsePeerAddr(addr string) (peer.ID, ma.Multiaddr, error) {
+	nodeAddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	pid, err := nodeAddr.ValueForProtocol(ma.P_IPFS)
+	if err != nil {
+		return "", nil, err
+	}
+	peerid, err := peer.IDB58Decode(pid)
+	if err != nil {
+		return "", nil, err
+	}
+	destPeerAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/ipfs/%s", pid))
+	return peerid, nodeAddr.Decapsulate(destPeerAddr), nil
+}
+
 // do Echo reads a line of data a stream and writes it back
 func doEcho(s network.Stream) error {
 	buf := bufio.NewReader(s)
@@ -102,3 +140,57 @@ func doEcho(s network.Stream) error {
 	_, err = s.Write([]byte(str))
 	return err
 }
+
+// loadConfig read config.yaml from the working directory, a missing
+// config file is fine and the defaults are used.
+func loadConfig() {
+	viper.SetConfigName("config")
+	viper.AddConfigPath(".")
+
+	viper.SetDefault("dataDir", "/tmp/magicdb")
+	viper.SetDefault("port", 0)
+	viper.SetDefault("node.keyFile", "")
+	viper.SetDefault("node.listen", []string{})
+	viper.SetDefault("node.announce", []string{})
+	viper.SetDefault("node.labels", map[string]string{})
+	viper.SetDefault("node.capacity", "0")
+	viper.SetDefault("discovery.mdns", false)
+	viper.SetDefault("discovery.serviceTag", raft.DefaultServiceTag)
+	viper.SetDefault("discovery.bootstrap", []string{})
+	viper.SetDefault("discovery.redialInterval", "30s")
+	viper.SetDefault("security.swarmKeyFile", "")
+	viper.SetDefault("security.gate", false)
+	viper.SetDefault("security.allowlist", []string{})
+	viper.SetDefault("security.encryptionKeyFile", "")
+	viper.SetDefault("tls.certFile", "")
+	viper.SetDefault("tls.keyFile", "")
+	viper.SetDefault("tls.clientCAFile", "")
+	viper.SetDefault("tls.requireClientCert", false)
+	viper.SetDefault("tls.caFile", "")
+	viper.SetDefault("tls.clientCertFile", "")
+	viper.SetDefault("tls.clientKeyFile", "")
+	viper.SetDefault("http.addr", ":8080")
+	viper.SetDefault("http.readyMaxLag", service.DefaultReadyMaxLag)
+	viper.SetDefault("http.endpoints", []string{"http://127.0.0.1:8080"})
+	viper.SetDefault("resp.addr", ":6380")
+	viper.SetDefault("drain.timeout", "30s")
+	viper.SetDefault("raft.dir", "")
+	viper.SetDefault("raft.promoteLag", server.DefaultPromoteLag)
+	viper.SetDefault("ranges.splitSize", "64mb")
+	viper.SetDefault("ranges.splitQPS", server.DefaultSplitQPS)
+	viper.SetDefault("ranges.mergeSize", "16mb")
+	viper.SetDefault("ranges.mergeQPS", server.DefaultMergeQPS)
+	viper.SetDefault("pd.replicas", server.DefaultReplicas)
+	viper.SetDefault("mvcc.gcWindow", server.DefaultGCWindow.String())
+	viper.SetDefault("cdc.file.maxSize", "64mb")
+	viper.SetDefault("cdc.file.maxFiles", server.DefaultSinkFiles)
+	viper.SetDefault("cdc.webhook.timeout", server.DefaultWebhookTimeout.String())
+	viper.SetDefault("backup.dir", "/tmp/magicdb-backup")
+	viper.SetDefault("backup.retain", 7)
+
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			log.Fatal(err)
+		}
+	}
+}
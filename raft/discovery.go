@@ -0,0 +1,186 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	host "github.com/libp2p/go-libp2p-host"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// DefaultServiceTag is the mdns service of magicdb nodes
+	DefaultServiceTag = "_magicdb-discovery"
+
+	defaultMDNSInterval   = 10 * time.Second
+	defaultRedialInterval = 30 * time.Second
+
+	// dialTimeout bounds a dial to a discovered or bootstrap peer
+	dialTimeout = 10 * time.Second
+
+	// mdnsAddrTTL keeps the addrs found by mdns for a while after the peer
+	// stops answering, a new address replaces them as soon as it is found
+	mdnsAddrTTL = 10 * time.Minute
+)
+
+// DiscoveryConfig configures how a node finds the other members
+type DiscoveryConfig struct {
+	// MDNS enables the discovery of the nodes with the same ServiceTag on
+	// the local network
+	MDNS bool
+	// ServiceTag separates clusters sharing a network, DefaultServiceTag if
+	// empty
+	ServiceTag string
+	// MDNSInterval is how often mdns queries the network
+	MDNSInterval time.Duration
+
+	// Bootstrap are the addresses /ip4/<ip>/tcp/<port>/ipfs/<id> of peers
+	// dialed at start and dialed again every RedialInterval while they are
+	// not connected
+	Bootstrap []string
+	// RedialInterval is 30s if 0
+	RedialInterval time.Duration
+}
+
+// Discovery feed the peerstore of a host with the addresses of the other
+// members, so the raft transport can reach them after they move
+type Discovery struct {
+	host      host.Host
+	mdns      discovery.Service
+	bootstrap []peer.AddrInfo
+	interval  time.Duration
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// StartDiscovery start discovering peers for h as configured by cfg
+func StartDiscovery(h host.Host, cfg DiscoveryConfig) (*Discovery, error) {
+	d := &Discovery{
+		host:     h,
+		interval: cfg.RedialInterval,
+		closing:  make(chan struct{}),
+	}
+	if d.interval <= 0 {
+		d.interval = defaultRedialInterval
+	}
+	for _, s := range cfg.Bootstrap {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, err
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		d.bootstrap = append(d.bootstrap, *info)
+	}
+
+	if cfg.MDNS {
+		tag := cfg.ServiceTag
+		if tag == "" {
+			tag = DefaultServiceTag
+		}
+		interval := cfg.MDNSInterval
+		if interval <= 0 {
+			interval = defaultMDNSInterval
+		}
+		svc, err := discovery.NewMdnsService(context.Background(), h, interval, tag)
+		if err != nil {
+			return nil, err
+		}
+		svc.RegisterNotifee(d)
+		d.mdns = svc
+	}
+
+	if len(d.bootstrap) > 0 {
+		d.wg.Add(1)
+		go d.redialLoop()
+	}
+	return d, nil
+}
+
+// HandlePeerFound is called by mdns for every peer answering a query
+func (d *Discovery) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == d.host.ID() {
+		return
+	}
+	d.host.Peerstore().AddAddrs(info.ID, info.Addrs, mdnsAddrTTL)
+	if d.host.Network().Connectedness(info.ID) == network.Connected {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if err := d.host.Connect(ctx, info); err != nil {
+		log.Println("discovery: dial", info.ID.Pretty(), "failed:", err)
+	}
+}
+
+// redialLoop dial the bootstrap peers which are not connected, at start
+// and then every interval
+func (d *Discovery) redialLoop() {
+	defer d.wg.Done()
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		d.dialBootstrap()
+		select {
+		case <-t.C:
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+func (d *Discovery) dialBootstrap() {
+	var wg sync.WaitGroup
+	for _, info := range d.bootstrap {
+		if info.ID == d.host.ID() {
+			continue
+		}
+		// the configured addrs win over stale ones learnt elsewhere
+		d.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+		if d.host.Network().Connectedness(info.ID) == network.Connected {
+			continue
+		}
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			defer cancel()
+			if err := d.host.Connect(ctx, info); err != nil {
+				log.Println("discovery: dial bootstrap", info.ID.Pretty(), "failed:", err)
+			}
+		}(info)
+	}
+	wg.Wait()
+}
+
+// Close stop discovering, the peerstore keeps what was found
+func (d *Discovery) Close() error {
+	close(d.closing)
+	d.wg.Wait()
+	if d.mdns != nil {
+		return d.mdns.Close()
+	}
+	return nil
+}
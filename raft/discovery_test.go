@@ -0,0 +1,91 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	host "github.com/libp2p/go-libp2p-host"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func p2pAddr(h host.Host) string {
+	id, _ := ma.NewMultiaddr("/ipfs/" + h.ID().Pretty())
+	return h.Addrs()[0].Encapsulate(id).String()
+}
+
+func waitConnected(t *testing.T, h host.Host, pid peer.ID) {
+	for i := 0; i < 100; i++ {
+		if h.Network().Connectedness(pid) == network.Connected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("excepted ", h.ID().Pretty(), " connected to ", pid.Pretty())
+}
+
+func TestDiscoveryBootstrap(t *testing.T) {
+	a, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	d, err := StartDiscovery(b, DiscoveryConfig{
+		Bootstrap:      []string{p2pAddr(a), p2pAddr(b)},
+		RedialInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("StartDiscovery error ", err)
+	}
+	defer d.Close()
+	waitConnected(t, b, a.ID())
+
+	// a lost connection is dialed again
+	b.Network().ClosePeer(a.ID())
+	waitConnected(t, b, a.ID())
+}
+
+func TestDiscoveryPeerFound(t *testing.T) {
+	a, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	d, err := StartDiscovery(b, DiscoveryConfig{})
+	if err != nil {
+		t.Fatal("StartDiscovery error ", err)
+	}
+	defer d.Close()
+
+	d.HandlePeerFound(peer.AddrInfo{ID: a.ID(), Addrs: a.Addrs()})
+	waitConnected(t, b, a.ID())
+	if len(b.Peerstore().Addrs(a.ID())) == 0 {
+		t.Fatal("excepted the addrs of a in the peerstore")
+	}
+}
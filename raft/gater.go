@@ -0,0 +1,196 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
+	host "github.com/libp2p/go-libp2p-host"
+	pnet "github.com/libp2p/go-libp2p-pnet"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// recheckInterval is how often the gater closes the connections of peers
+// which were removed from the cluster
+const recheckInterval = 30 * time.Second
+
+// gaterRejections counts the connections closed by the gaters, by reason:
+// inbound, outbound and revoked (the peer left the cluster)
+var gaterRejections = expvar.NewMap("magicdb_gater_rejected")
+
+// LoadSwarmKey read a libp2p private network key, nodes which do not share
+// it cannot connect
+func LoadSwarmKey(path string) (ipnet.Protector, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pnet.NewProtector(f)
+}
+
+// Gater close the connections of the peers which are neither members of
+// the cluster nor in the allowlist. Connections are closed once the peer
+// is authenticated and before any of its streams is handled.
+type Gater struct {
+	host host.Host
+
+	mu      sync.RWMutex
+	allow   map[peer.ID]struct{}
+	members map[peer.ID]struct{}
+	lookup  func() ([]peer.ID, error)
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewGater start gating the connections of h, only the peers in allow are
+// admitted until SetMembers is called
+func NewGater(h host.Host, allow []peer.ID) *Gater {
+	g := &Gater{
+		host:    h,
+		allow:   make(map[peer.ID]struct{}),
+		members: make(map[peer.ID]struct{}),
+		closing: make(chan struct{}),
+	}
+	for _, pid := range allow {
+		g.allow[pid] = struct{}{}
+	}
+	h.Network().Notify(g)
+	g.wg.Add(1)
+	go g.recheckLoop()
+	return g
+}
+
+// SetMembers set the lookup of the cluster members, it is called for every
+// new connection. The last members found are used while it fails.
+func (g *Gater) SetMembers(lookup func() ([]peer.ID, error)) {
+	g.mu.Lock()
+	g.lookup = lookup
+	g.mu.Unlock()
+	g.refresh()
+}
+
+// Allowed reports whether the peer may connect
+func (g *Gater) Allowed(pid peer.ID) bool {
+	if pid == g.host.ID() {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if _, ok := g.allow[pid]; ok {
+		return true
+	}
+	_, ok := g.members[pid]
+	return ok
+}
+
+// Close stop gating, the open connections are kept
+func (g *Gater) Close() error {
+	g.host.Network().StopNotify(g)
+	close(g.closing)
+	g.wg.Wait()
+	return nil
+}
+
+// refresh update the members from the lookup
+func (g *Gater) refresh() {
+	g.mu.RLock()
+	lookup := g.lookup
+	g.mu.RUnlock()
+	if lookup == nil {
+		return
+	}
+	pids, err := lookup()
+	if err != nil {
+		log.Println("gater: members lookup failed:", err)
+		return
+	}
+	members := make(map[peer.ID]struct{}, len(pids))
+	for _, pid := range pids {
+		members[pid] = struct{}{}
+	}
+	g.mu.Lock()
+	g.members = members
+	g.mu.Unlock()
+}
+
+func (g *Gater) recheckLoop() {
+	defer g.wg.Done()
+	t := time.NewTicker(recheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			g.recheck()
+		case <-g.closing:
+			return
+		}
+	}
+}
+
+// recheck close the connections of the peers no longer allowed
+func (g *Gater) recheck() {
+	g.refresh()
+	for _, pid := range g.host.Network().Peers() {
+		if !g.Allowed(pid) {
+			gaterRejections.Add("revoked", 1)
+			log.Println("gater: closing connections of", pid.Pretty(), "which left the cluster")
+			g.host.Network().ClosePeer(pid)
+		}
+	}
+}
+
+// Connected close c if its peer is not allowed, the swarm waits for it
+// before c serves streams
+func (g *Gater) Connected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	if g.Allowed(pid) {
+		return
+	}
+	// the peer may have just been added to the cluster
+	g.refresh()
+	if g.Allowed(pid) {
+		return
+	}
+	dir := "inbound"
+	if c.Stat().Direction == network.DirOutbound {
+		dir = "outbound"
+	}
+	gaterRejections.Add(dir, 1)
+	log.Println("gater: rejected", dir, "connection of", pid.Pretty(), "from", c.RemoteMultiaddr())
+	c.Close()
+}
+
+// Disconnected is part of network.Notifiee
+func (g *Gater) Disconnected(network.Network, network.Conn) {}
+
+// Listen is part of network.Notifiee
+func (g *Gater) Listen(network.Network, ma.Multiaddr) {}
+
+// ListenClose is part of network.Notifiee
+func (g *Gater) ListenClose(network.Network, ma.Multiaddr) {}
+
+// OpenedStream is part of network.Notifiee
+func (g *Gater) OpenedStream(network.Network, network.Stream) {}
+
+// ClosedStream is part of network.Notifiee
+func (g *Gater) ClosedStream(network.Network, network.Stream) {}
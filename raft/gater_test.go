@@ -0,0 +1,145 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	host "github.com/libp2p/go-libp2p-host"
+	pnet "github.com/libp2p/go-libp2p-pnet"
+)
+
+func connect(from, to host.Host) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return from.Connect(ctx, peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()})
+}
+
+func openStream(from, to host.Host) error {
+	connect(from, to)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := from.NewStream(ctx, to.ID(), "/magicdb/test/1.0.0")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, err = s.Read(make([]byte, 1))
+	return err
+}
+
+func rejected(reason string) int64 {
+	if v, ok := gaterRejections.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestGater(t *testing.T) {
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := NewNode(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	a, b, c := hosts[0], hosts[1], hosts[2]
+	a.SetStreamHandler("/magicdb/test/1.0.0", func(s network.Stream) {
+		s.Write([]byte{1})
+		s.Close()
+	})
+
+	g := NewGater(a, []peer.ID{b.ID()})
+	defer g.Close()
+	before := rejected("inbound")
+
+	if err := openStream(b, a); err != nil {
+		t.Fatal("allowlisted peer excepted to open a stream got ", err)
+	}
+	if err := openStream(c, a); err == nil {
+		t.Fatal("excepted the stream of a stranger to fail")
+	}
+	if a.Network().Connectedness(c.ID()) == network.Connected {
+		t.Fatal("excepted the stranger disconnected")
+	}
+	if rejected("inbound") == before {
+		t.Fatal("excepted the rejection counted")
+	}
+
+	// members are admitted, and closed once they leave
+	members := []peer.ID{c.ID()}
+	g.SetMembers(func() ([]peer.ID, error) { return members, nil })
+	if err := openStream(c, a); err != nil {
+		t.Fatal("member excepted to open a stream got ", err)
+	}
+	members = nil
+	g.recheck()
+	if a.Network().Connectedness(c.ID()) == network.Connected {
+		t.Fatal("excepted the removed member disconnected")
+	}
+	if a.Network().Connectedness(b.ID()) != network.Connected {
+		t.Fatal("excepted the allowlisted peer still connected")
+	}
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	path := "/tmp/magicdb-swarm-test.key"
+	key, err := pnet.GenerateV1PSK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(key)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	var hosts []host.Host
+	for i := 0; i < 2; i++ {
+		prot, err := LoadSwarmKey(path)
+		if err != nil {
+			t.Fatal("LoadSwarmKey error ", err)
+		}
+		h, err := NewNodeWithConfig(NodeConfig{
+			ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0"},
+			Protector:   prot,
+		})
+		if err != nil {
+			t.Fatal("NewNodeWithConfig error ", err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	outsider, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+
+	if err := connect(hosts[0], hosts[1]); err != nil {
+		t.Fatal("excepted the nodes sharing the key to connect got ", err)
+	}
+	if err := connect(outsider, hosts[0]); err == nil {
+		t.Fatal("excepted a node without the key to fail")
+	}
+}
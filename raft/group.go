@@ -0,0 +1,122 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// groupTimeout is the io timeout of the transport of a raft group
+const groupTimeout = time.Minute
+
+var (
+	// ErrGroupZero is returned for the group 0, it is the raft node of
+	// NewRaftNodeWithLearners
+	ErrGroupZero = errors.New("raft group 0 is the default raft node")
+)
+
+// GroupProtocol is the libp2p protocol of the raft rpcs of group
+func GroupProtocol(group uint64) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/magicdb/raft/%d/1.0.0", group))
+}
+
+// NewGroupNode create the raft node of the raft group group which applies
+// its log to fsm, keeping its state in memory. Many groups share the host,
+// each speaks the protocol of GroupProtocol. A node joining a running
+// group passes no pids, the leader sends it the configuration.
+func NewGroupNode(peer host.Host, group uint64, pids []peer.ID, fsm praft.FSM,
+	raftQuiet bool) (*praft.Raft, *praft.NetworkTransport, error) {
+	return NewGroupNodeWithStores(peer, group, pids, fsm, MemStores(), raftQuiet)
+}
+
+// NewGroupNodeWithStores is NewGroupNode keeping the state of the node in
+// stores, which must be those of the group alone
+func NewGroupNodeWithStores(peer host.Host, group uint64, pids []peer.ID, fsm praft.FSM,
+	stores Stores, raftQuiet bool) (*praft.Raft, *praft.NetworkTransport, error) {
+	if group == 0 {
+		return nil, nil, ErrGroupZero
+	}
+
+	ln, err := gostream.Listen(peer, GroupProtocol(group))
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &praft.NetworkTransportConfig{
+		ServerAddressProvider: addrProvider{},
+		Stream:                &groupStream{host: peer, proto: GroupProtocol(group), ln: ln},
+		// streams are cheap on a libp2p connection, no need to pool them
+		MaxPool: 0,
+		Timeout: groupTimeout,
+	}
+	if raftQuiet {
+		cfg.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	transport := praft.NewNetworkTransportWithConfig(cfg)
+
+	raftNode, err := startRaft(peer, transport, stores, pids, nil, fsm, newConfig(peer, raftQuiet))
+	if err != nil {
+		transport.Close()
+		return nil, nil, err
+	}
+	return raftNode, transport, nil
+}
+
+// groupStream is the praft.StreamLayer of a raft group over libp2p streams
+type groupStream struct {
+	host  host.Host
+	proto protocol.ID
+	ln    net.Listener
+}
+
+func (g *groupStream) Dial(address praft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	pid, err := peer.IDB58Decode(string(address))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return gostream.Dial(ctx, g.host, pid, g.proto)
+}
+
+func (g *groupStream) Accept() (net.Conn, error) {
+	return g.ln.Accept()
+}
+
+func (g *groupStream) Addr() net.Addr {
+	return g.ln.Addr()
+}
+
+func (g *groupStream) Close() error {
+	return g.ln.Close()
+}
+
+// addrProvider use the peer id of a server as its address, libp2p finds
+// the peer from it
+type addrProvider struct{}
+
+func (addrProvider) ServerAddr(id praft.ServerID) (praft.ServerAddress, error) {
+	return praft.ServerAddress(id), nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"testing"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	host "github.com/libp2p/go-libp2p-host"
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+)
+
+func TestNewGroupNode(t *testing.T) {
+	var hosts []host.Host
+	var pids []peer.ID
+	for _, port := range []int{9992, 9993} {
+		h, err := NewNode(port)
+		if err != nil {
+			t.Fatal("Create node error ", err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+		pids = append(pids, h.ID())
+	}
+	hosts[0].Peerstore().AddAddrs(hosts[1].ID(), hosts[1].Addrs(), peerstore.PermanentAddrTTL)
+	hosts[1].Peerstore().AddAddrs(hosts[0].ID(), hosts[0].Addrs(), peerstore.PermanentAddrTTL)
+
+	if _, _, err := NewGroupNode(hosts[0], 0, pids, nil, true); err != ErrGroupZero {
+		t.Fatal("NewGroupNode excepted ErrGroupZero but got ", err)
+	}
+
+	// two groups share the hosts, each replicates a state of its own
+	cnss := make(map[uint64][]*libp2praft.Consensus)
+	rafts := make(map[uint64][]*praft.Raft)
+	for _, group := range []uint64{7, 8} {
+		for _, h := range hosts {
+			cns := libp2praft.NewConsensus(&raftState{})
+			r, transport, err := NewGroupNode(h, group, pids, cns.FSM(), true)
+			if err != nil {
+				t.Fatal("NewGroupNode error ", err)
+			}
+			defer transport.Close()
+			defer r.Shutdown()
+			cns.SetActor(libp2praft.NewActor(r))
+			cnss[group] = append(cnss[group], cns)
+			rafts[group] = append(rafts[group], r)
+		}
+	}
+
+	for group, rs := range rafts {
+		leader := -1
+		for i := 0; leader < 0; i++ {
+			if i == 100 {
+				t.Fatal("excepted a leader in group ", group)
+			}
+			for j, r := range rs {
+				if r.State() == praft.Leader {
+					leader = j
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		value := int(group) * 10
+		if _, err := cnss[group][leader].CommitState(&raftState{value}); err != nil {
+			t.Fatal("CommitState error ", err)
+		}
+		follower := cnss[group][1-leader]
+		for i := 0; ; i++ {
+			st, err := follower.GetCurrentState()
+			if err == nil && st.(*raftState).Value == value {
+				break
+			}
+			if i == 100 {
+				t.Fatal("excepted group ", group, " to replicate ", value, " but got ", st, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
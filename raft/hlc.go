@@ -0,0 +1,232 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+const (
+	// LogicalBits are the low bits of a hybrid timestamp counting the
+	// events of the same millisecond, the high bits are unix milliseconds
+	LogicalBits = 18
+
+	// DefaultMaxOffset is how far ahead of the local clock a remote
+	// timestamp may be to be adopted
+	DefaultMaxOffset = 500 * time.Millisecond
+
+	// stampSuffix marks the protocols whose streams start with the hybrid
+	// timestamp of the sender in each direction
+	stampSuffix = "/hlc"
+)
+
+// clockRejections counts the remote timestamps too far ahead to be adopted
+var clockRejections = expvar.NewInt("magicdb_hlc_rejected")
+
+var (
+	// ErrClockOffset is returned by Update when the remote timestamp is
+	// more than MaxOffset ahead of the local clock
+	ErrClockOffset = errors.New("remote clock too far ahead")
+)
+
+// Clock is a hybrid logical clock: its timestamps follow the physical
+// clock, never go backwards and are greater than every timestamp received
+// from another node. It is safe for concurrent use.
+type Clock struct {
+	// MaxOffset bounds the remote timestamps adopted by Update
+	MaxOffset time.Duration
+
+	mu   sync.Mutex
+	last uint64
+	wall func() time.Time
+}
+
+// NewClock create a clock reading the local time
+func NewClock() *Clock {
+	return &Clock{MaxOffset: DefaultMaxOffset, wall: time.Now}
+}
+
+// HybridTime return the hybrid timestamp of t with no logical part
+func HybridTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/int64(time.Millisecond)) << LogicalBits
+}
+
+// PhysicalTime return the physical time of a hybrid timestamp
+func PhysicalTime(ts uint64) time.Time {
+	ms := int64(ts >> LogicalBits)
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// Now return a timestamp greater than every timestamp returned or adopted
+// before
+func (c *Clock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := HybridTime(c.wall()); pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update adopt the timestamp of a remote event and return a local
+// timestamp after it. A remote timestamp more than MaxOffset ahead of the
+// local clock is not adopted, ErrClockOffset is returned with a timestamp
+// of the local clock alone.
+func (c *Clock) Update(remote uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.wall()
+	pt := HybridTime(now)
+	if c.MaxOffset > 0 && remote > HybridTime(now.Add(c.MaxOffset)) {
+		clockRejections.Add(1)
+		c.tick(pt, 0)
+		return c.last, ErrClockOffset
+	}
+	c.tick(pt, remote)
+	return c.last, nil
+}
+
+// tick move the clock past pt and remote
+func (c *Clock) tick(pt, remote uint64) {
+	if remote > c.last {
+		c.last = remote
+	}
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+}
+
+// ClockOf return the clock stamping the streams of h, nil when h was not
+// created by NewNodeWithConfig
+func ClockOf(h host.Host) *Clock {
+	if ch, ok := h.(*clockedHost); ok {
+		return ch.clock
+	}
+	return nil
+}
+
+// clockedHost stamps its streams with its clock. Every protocol is also
+// served with the stampSuffix, the streams opened to peers which know it
+// carry the timestamps, the others are plain.
+type clockedHost struct {
+	host.Host
+	clock *Clock
+}
+
+func (h *clockedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, handler)
+	h.Host.SetStreamHandler(pid+stampSuffix, h.stamped(handler))
+}
+
+func (h *clockedHost) SetStreamHandlerMatch(pid protocol.ID, match func(string) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, handler)
+	h.Host.SetStreamHandlerMatch(pid+stampSuffix, func(s string) bool {
+		return strings.HasSuffix(s, stampSuffix) && match(strings.TrimSuffix(s, stampSuffix))
+	}, h.stamped(handler))
+}
+
+func (h *clockedHost) RemoveStreamHandler(pid protocol.ID) {
+	h.Host.RemoveStreamHandler(pid)
+	h.Host.RemoveStreamHandler(pid + stampSuffix)
+}
+
+// NewStream prefer the stamped version of the protocols pids
+func (h *clockedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	all := make([]protocol.ID, 0, 2*len(pids))
+	stamped := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		all = append(all, pid+stampSuffix)
+		stamped = append(stamped, string(pid+stampSuffix))
+	}
+	all = append(all, pids...)
+	// the peerstore does not keep the order of the protocols known of p
+	if known, err := h.Peerstore().SupportsProtocols(p, stamped...); err == nil && len(known) > 0 {
+		all = []protocol.ID{protocol.ID(known[0])}
+	}
+	s, err := h.Host.NewStream(ctx, p, all...)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(string(s.Protocol()), stampSuffix) {
+		return s, nil
+	}
+	return &clockedStream{Stream: s, clock: h.clock}, nil
+}
+
+func (h *clockedHost) stamped(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(&clockedStream{Stream: s, clock: h.clock})
+	}
+}
+
+// clockedStream writes the timestamp of its clock before the first byte
+// it writes, and adopts the timestamp the remote wrote before the first
+// byte it reads
+type clockedStream struct {
+	network.Stream
+	clock *Clock
+
+	writeOnce sync.Once
+	writeErr  error
+	readOnce  sync.Once
+	readErr   error
+}
+
+// Protocol return the protocol without the stampSuffix
+func (s *clockedStream) Protocol() protocol.ID {
+	return protocol.ID(strings.TrimSuffix(string(s.Stream.Protocol()), stampSuffix))
+}
+
+func (s *clockedStream) Write(p []byte) (int, error) {
+	s.writeOnce.Do(func() {
+		var stamp [8]byte
+		binary.BigEndian.PutUint64(stamp[:], s.clock.Now())
+		_, s.writeErr = s.Stream.Write(stamp[:])
+	})
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	return s.Stream.Write(p)
+}
+
+func (s *clockedStream) Read(p []byte) (int, error) {
+	s.readOnce.Do(func() {
+		var stamp [8]byte
+		if _, s.readErr = io.ReadFull(s.Stream, stamp[:]); s.readErr != nil {
+			return
+		}
+		// a clock too far ahead is not adopted, the stream goes on
+		s.clock.Update(binary.BigEndian.Uint64(stamp[:]))
+	})
+	if s.readErr != nil {
+		return 0, s.readErr
+	}
+	return s.Stream.Read(p)
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/network"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// fixedClock return a clock whose wall time is t
+func fixedClock(t *time.Time) *Clock {
+	c := NewClock()
+	c.wall = func() time.Time { return *t }
+	return c
+}
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := fixedClock(&now)
+
+	a := c.Now()
+	if a != HybridTime(now) {
+		t.Fatal("excepted the wall time, got ", a)
+	}
+	// the wall time does not move, the logical part does
+	if b := c.Now(); b != a+1 {
+		t.Fatal("excepted ", a+1, " got ", b)
+	}
+	now = now.Add(-time.Second)
+	if b := c.Now(); b != a+2 {
+		t.Fatal("clock went backwards ", b)
+	}
+	if !PhysicalTime(a).Equal(time.Unix(1000, 0)) {
+		t.Fatal("excepted the physical time, got ", PhysicalTime(a))
+	}
+
+	// a remote event ahead within MaxOffset is adopted
+	now = time.Unix(1000, 0)
+	remote := HybridTime(now.Add(100*time.Millisecond)) + 7
+	got, err := c.Update(remote)
+	if err != nil {
+		t.Fatal("Update error ", err)
+	}
+	if got != remote+1 {
+		t.Fatal("excepted ", remote+1, " got ", got)
+	}
+	if b := c.Now(); b <= got {
+		t.Fatal("Now is not after the remote event ", b)
+	}
+
+	// a remote event too far ahead is not
+	far := HybridTime(now.Add(time.Minute))
+	got, err = c.Update(far)
+	if err != ErrClockOffset {
+		t.Fatal("excepted ErrClockOffset, got ", err)
+	}
+	if got >= far {
+		t.Fatal("adopted a remote clock too far ahead ", got)
+	}
+}
+
+func TestClockedStreams(t *testing.T) {
+	now := time.Now()
+	later := now.Add(200 * time.Millisecond)
+	a, err := NewNodeWithConfig(NodeConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0"}, Clock: fixedClock(&now)})
+	if err != nil {
+		t.Fatal("NewNodeWithConfig error ", err)
+	}
+	defer a.Close()
+	b, err := NewNodeWithConfig(NodeConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0"}, Clock: fixedClock(&later)})
+	if err != nil {
+		t.Fatal("NewNodeWithConfig error ", err)
+	}
+	defer b.Close()
+	// a host which does not stamp its streams
+	plain, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal("libp2p.New error ", err)
+	}
+	defer plain.Close()
+	if ClockOf(plain) != nil || ClockOf(a) == nil {
+		t.Fatal("excepted a clock on the hosts of NewNodeWithConfig only")
+	}
+
+	b.SetStreamHandler("/echo/1.0.0", func(s network.Stream) {
+		defer s.Close()
+		if s.Protocol() != "/echo/1.0.0" {
+			t.Error("excepted the protocol without suffix, got ", s.Protocol())
+		}
+		buf, _ := ioutil.ReadAll(s)
+		s.Write(buf)
+	})
+	for _, from := range []host.Host{a, plain} {
+		if err := connect(from, b); err != nil {
+			t.Fatal("connect error ", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s, err := from.NewStream(ctx, b.ID(), "/echo/1.0.0")
+		cancel()
+		if err != nil {
+			t.Fatal("NewStream error ", err)
+		}
+		s.Write([]byte("hello"))
+		s.Close()
+		out, err := ioutil.ReadAll(s)
+		if err != nil || string(out) != "hello" {
+			t.Fatal("excepted hello, got ", string(out), err)
+		}
+	}
+
+	// a read the reply of b, whose clock is ahead
+	if ts := ClockOf(a).Now(); ts <= HybridTime(later) {
+		t.Fatal("the clock of a did not adopt the one of b ", PhysicalTime(ts))
+	}
+}
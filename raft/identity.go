@@ -0,0 +1,89 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+var (
+	// ErrKeyExists is returned by WriteKey when the key file already exists
+	ErrKeyExists = errors.New("key file already exists")
+)
+
+// GenerateKey create a new ed25519 identity key
+func GenerateKey() (crypto.PrivKey, error) {
+	sk, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	return sk, err
+}
+
+// ReadKey read an identity key written by WriteKey
+func ReadKey(path string) (crypto.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(data)
+}
+
+// WriteKey write sk to path readable by the owner only, an existing file
+// is never overwritten
+func WriteKey(path string, sk crypto.PrivKey) error {
+	data, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ErrKeyExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// LoadOrCreateKey read the identity key at path, or generate one and
+// write it there on first start, so the peer id survives restarts
+func LoadOrCreateKey(path string) (crypto.PrivKey, error) {
+	sk, err := ReadKey(path)
+	if !os.IsNotExist(err) {
+		return sk, err
+	}
+	if sk, err = GenerateKey(); err != nil {
+		return nil, err
+	}
+	if err := WriteKey(path, sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
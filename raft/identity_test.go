@@ -0,0 +1,80 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+	dir := "/tmp/magicdb-identity-test"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.key")
+
+	sk, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal("LoadOrCreateKey error ", err)
+	}
+	again, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal("LoadOrCreateKey error ", err)
+	}
+	if !sk.Equals(again) {
+		t.Fatal("excepted the same key after reload")
+	}
+	if err := WriteKey(path, sk); err != ErrKeyExists {
+		t.Fatal("excepted ErrKeyExists got ", err)
+	}
+}
+
+func TestNewNodeWithConfig(t *testing.T) {
+	sk, err := GenerateKey()
+	if err != nil {
+		t.Fatal("GenerateKey error ", err)
+	}
+	pid, _ := peer.IDFromPrivateKey(sk)
+
+	n, err := NewNodeWithConfig(NodeConfig{
+		Key:           sk,
+		ListenAddrs:   []string{"/ip4/127.0.0.1/tcp/0", "/ip6/::1/tcp/0"},
+		AnnounceAddrs: []string{"/ip4/203.0.113.7/tcp/4001"},
+	})
+	if err != nil {
+		t.Fatal("NewNodeWithConfig error ", err)
+	}
+	defer n.Close()
+
+	if n.ID() != pid {
+		t.Fatal("excepted peer id ", pid.Pretty(), " got ", n.ID().Pretty())
+	}
+	ip6 := false
+	for _, addr := range n.Network().ListenAddresses() {
+		if _, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+			ip6 = true
+		}
+	}
+	if !ip6 {
+		t.Fatal("excepted an ip6 listen address got ", n.Network().ListenAddresses())
+	}
+	addrs := n.Addrs()
+	if len(addrs) != 1 || addrs[0].String() != "/ip4/203.0.113.7/tcp/4001" {
+		t.Fatal("excepted the announce address got ", addrs)
+	}
+}
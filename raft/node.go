@@ -16,9 +16,12 @@ package raft
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
 	host "github.com/libp2p/go-libp2p-host"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -29,22 +32,76 @@ type raftState struct {
 	Value int
 }
 
-// NewNode create a new node
+// NodeConfig configures the libp2p node of NewNodeWithConfig
+type NodeConfig struct {
+	// Key is the identity of the node, a random one is used if nil
+	Key crypto.PrivKey
+
+	// ListenAddrs are the multiaddrs to listen on, such as
+	// /ip4/0.0.0.0/tcp/4001 or /ip6/::/tcp/4001
+	ListenAddrs []string
+
+	// AnnounceAddrs replace the listen addrs advertised to peers, e.g. the
+	// public address of a node behind nat
+	AnnounceAddrs []string
+
+	// Protector makes the node part of a private network, see LoadSwarmKey
+	Protector ipnet.Protector
+
+	// Clock stamps the streams of the node, a new one is used if nil. See
+	// ClockOf.
+	Clock *Clock
+}
+
+// NewNode create a new node with a random identity listening on port of
+// the loopback interface
 func NewNode(port int) (host.Host, error) {
+	return NewNodeWithConfig(NodeConfig{
+		ListenAddrs: []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)},
+	})
+}
 
+// NewNodeWithConfig create a new node from cfg
+func NewNodeWithConfig(cfg NodeConfig) (host.Host, error) {
+	if len(cfg.ListenAddrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)),
+		libp2p.ListenAddrStrings(cfg.ListenAddrs...),
+	}
+	if cfg.Key != nil {
+		opts = append(opts, libp2p.Identity(cfg.Key))
+	}
+	if cfg.Protector != nil {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.Protector))
+	}
+	if len(cfg.AnnounceAddrs) > 0 {
+		announce := make([]ma.Multiaddr, len(cfg.AnnounceAddrs))
+		for i, s := range cfg.AnnounceAddrs {
+			addr, err := ma.NewMultiaddr(s)
+			if err != nil {
+				return nil, err
+			}
+			announce[i] = addr
+		}
+		opts = append(opts, libp2p.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+			return announce
+		}))
 	}
 
 	h, err := libp2p.New(context.Background(), opts...)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Clock == nil {
+		cfg.Clock = NewClock()
+	}
+	h = &clockedHost{Host: h, clock: cfg.Clock}
 
-	addr := h.Addrs()[0]
 	maAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/%s/%s", protocolVersion, h.ID().Pretty()))
-	fullAddr := addr.Encapsulate(maAddr)
 	fmt.Println("I am running at addr: ", maAddr)
-	fmt.Println("The full addr is: ", fullAddr)
-	return h, err
+	for _, addr := range h.Addrs() {
+		fmt.Println("The full addr is: ", addr.Encapsulate(maAddr))
+	}
+	return h, nil
 }
@@ -25,16 +25,15 @@ import (
 	libp2praft "github.com/libp2p/go-libp2p-raft"
 )
 
-// TODO config this use config file
-const (
-	raftTmpFolder = "/tmp/magicdb"
-)
+// snapshotsRetained is the number of snapshots a node keeps on disk
+const snapshotsRetained = 3
 
 var (
 	// ErrExists
 	ErrExists = errors.New("bootstrap already exists")
 )
 
+// NewRaftNode create a raft node whose state is managed by libp2p consensus
 func NewRaftNode(peer host.Host, pids []peer.ID, op consensus.Op,
 	raftQuiet bool) (*praft.Raft, *libp2praft.Consensus, *praft.NetworkTransport, error) {
 
@@ -46,56 +45,125 @@ func NewRaftNode(peer host.Host, pids []peer.ID, op consensus.Op,
 		cns = libp2praft.NewConsensus(&raftState{3})
 	}
 
-	// Create Raft servers configuration
-	servers := make([]praft.Server, len(pids))
-	for i, pid := range pids {
-		servers[i] = praft.Server{
-			Suffrage: praft.Voter,
-			ID:       praft.ServerID(pid.Pretty()),
-			Address:  praft.ServerAddress(pid.Pretty()),
-		}
+	raftNode, transport, err := NewRaftNodeWithFSM(peer, pids, cns.FSM(), raftQuiet)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return raftNode, cns, transport, nil
+}
 
-	serverConfig := praft.Configuration{Servers: servers}
+// NewRaftNodeWithFSM create a raft node which applies the log to fsm
+func NewRaftNodeWithFSM(peer host.Host, pids []peer.ID, fsm praft.FSM,
+	raftQuiet bool) (*praft.Raft, *praft.NetworkTransport, error) {
+	return NewRaftNodeWithLearners(peer, pids, nil, fsm, raftQuiet)
+}
+
+// Stores are where a raft node keeps its state: Log the log entries,
+// Stable the term and the vote, and Snapshots the snapshots
+type Stores struct {
+	Log       praft.LogStore
+	Stable    praft.StableStore
+	Snapshots praft.SnapshotStore
+}
+
+// MemStores return the Stores of a node keeping its whole state in memory,
+// it starts from scratch on every restart
+func MemStores() Stores {
+	log := praft.NewInmemStore()
+	return Stores{Log: log, Stable: log, Snapshots: praft.NewInmemSnapshotStore()}
+}
+
+// DiskStores return the Stores of a node keeping its log and its stable
+// store in store and its snapshots under the directory snapDir, which
+// must be its own
+func DiskStores(store interface {
+	praft.LogStore
+	praft.StableStore
+}, snapDir string) (Stores, error) {
+	snapshots, err := praft.NewFileSnapshotStore(snapDir, snapshotsRetained, nil)
+	if err != nil {
+		return Stores{}, err
+	}
+	return Stores{Log: store, Stable: store, Snapshots: snapshots}, nil
+}
+
+// NewRaftNodeWithLearners is NewRaftNodeWithFSM bootstrapping the peers
+// learners as nonvoters: they receive the log but take no part in quorum.
+// The node keeps its state in memory.
+func NewRaftNodeWithLearners(peer host.Host, pids, learners []peer.ID, fsm praft.FSM,
+	raftQuiet bool) (*praft.Raft, *praft.NetworkTransport, error) {
+	return NewRaftNodeWithStores(peer, pids, learners, fsm, MemStores(), raftQuiet)
+}
+
+// NewRaftNodeWithStores is NewRaftNodeWithLearners keeping the state of
+// the node in stores
+func NewRaftNodeWithStores(peer host.Host, pids, learners []peer.ID, fsm praft.FSM,
+	stores Stores, raftQuiet bool) (*praft.Raft, *praft.NetworkTransport, error) {
 
 	// transport
 	transport, err := libp2praft.NewLibp2pTransport(peer, time.Minute)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+	raftNode, err := startRaft(peer, transport, stores, pids, learners, fsm, newConfig(peer, raftQuiet))
+	if err != nil {
+		transport.Close()
+		return nil, nil, err
 	}
+	return raftNode, transport, nil
+}
 
-	// config
+// newConfig return the raft config of the node of peer
+func newConfig(peer host.Host, raftQuiet bool) *praft.Config {
 	config := praft.DefaultConfig()
 	if raftQuiet {
 		config.LogOutput = ioutil.Discard
 		config.Logger = nil
 	}
 	config.LocalID = praft.ServerID(peer.ID().Pretty())
+	return config
+}
 
-	// Snapshot store, we can use disk, mem, and file.
-	// There we use file for snapshot store
-	snapshots, err := praft.NewFileSnapshotStore(raftTmpFolder, 3, nil)
-	if err != nil {
-		return nil, nil, nil, err
+// startRaft start a raft node on transport keeping its state in stores,
+// the cluster is bootstrapped with the voters pids and the nonvoters
+// learners unless it has state already
+func startRaft(peer host.Host, transport praft.Transport, stores Stores, pids, learners []peer.ID,
+	fsm praft.FSM, config *praft.Config) (*praft.Raft, error) {
+
+	// Create Raft servers configuration
+	var servers []praft.Server
+	learner := false
+	for _, pid := range pids {
+		servers = append(servers, praft.Server{
+			Suffrage: praft.Voter,
+			ID:       praft.ServerID(pid.Pretty()),
+			Address:  praft.ServerAddress(pid.Pretty()),
+		})
+	}
+	for _, pid := range learners {
+		learner = learner || pid == peer.ID()
+		servers = append(servers, praft.Server{
+			Suffrage: praft.Nonvoter,
+			ID:       praft.ServerID(pid.Pretty()),
+			Address:  praft.ServerAddress(pid.Pretty()),
+		})
 	}
 
-	// logstore & stable store.  There we use mem store.
-	logStore := praft.NewInmemStore()
+	serverConfig := praft.Configuration{Servers: servers}
 
 	// bootstrap  This should only be called at the begging of time for the
-	// cluster with an identical configuration listing all Voter servers.
-	bootstrapped, err := praft.HasExistingState(logStore, logStore, snapshots)
+	// cluster with an identical configuration listing all servers.
+	bootstrapped, err := praft.HasExistingState(stores.Log, stores.Stable, stores.Snapshots)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
-	if !bootstrapped {
+	// A learner bootstrapped with the uncommitted configuration would run
+	// for leader, it gets the configuration from the leader instead, as a
+	// node started without servers does.
+	if !bootstrapped && !learner && len(servers) > 0 {
 		// Bootstrap cluster.
-		praft.BootstrapCluster(config, logStore, logStore, snapshots, transport, serverConfig)
+		praft.BootstrapCluster(config, stores.Log, stores.Stable, stores.Snapshots, transport, serverConfig)
 	}
 
-	raftNode, err := praft.NewRaft(config, cns.FSM(), logStore, logStore, snapshots, transport)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	return raftNode, cns, transport, nil
+	return praft.NewRaft(config, fsm, stores.Log, stores.Stable, stores.Snapshots, transport)
 }
@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	praft "github.com/hashicorp/raft"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	host "github.com/libp2p/go-libp2p-host"
@@ -159,3 +160,87 @@ func TestNewRaftNode(t *testing.T) {
 	fmt.Printf("Raft3 final state: %d\n", finalRaftState3.Value)
 
 }
+
+func TestNewRaftNodeWithLearners(t *testing.T) {
+	var hosts []host.Host
+	for _, port := range []int{9994, 9995, 9996} {
+		h, err := NewNode(port)
+		if err != nil {
+			t.Fatal("Create node error ", err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	for _, h := range hosts {
+		for _, o := range hosts {
+			if h != o {
+				h.Peerstore().AddAddrs(o.ID(), o.Addrs(), peerstore.PermanentAddrTTL)
+			}
+		}
+	}
+	voters := []peer.ID{hosts[0].ID(), hosts[1].ID()}
+	learners := []peer.ID{hosts[2].ID()}
+
+	var rafts []*praft.Raft
+	var cnss []*libp2praft.Consensus
+	for _, h := range hosts {
+		cns := libp2praft.NewConsensus(&raftState{})
+		r, transport, err := NewRaftNodeWithLearners(h, voters, learners, cns.FSM(), true)
+		if err != nil {
+			t.Fatal("Create raftnode error ", err)
+		}
+		defer transport.Close()
+		defer r.Shutdown()
+		cns.SetActor(libp2praft.NewActor(r))
+		rafts = append(rafts, r)
+		cnss = append(cnss, cns)
+	}
+
+	var leader int
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("excepted a leader to be elected")
+		}
+		if rafts[0].State() == praft.Leader {
+			break
+		}
+		if rafts[1].State() == praft.Leader {
+			leader = 1
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rafts[2].State() == praft.Leader || rafts[2].State() == praft.Candidate {
+		t.Fatal("excepted the learner to never run for leader")
+	}
+	if _, err := cnss[leader].CommitState(&raftState{42}); err != nil {
+		t.Fatal("CommitState error ", err)
+	}
+	for i := 0; ; i++ {
+		st, err := cnss[2].GetCurrentState()
+		if err == nil && st.(*raftState).Value == 42 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("excepted the learner to replicate the state but got ", st, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	future := rafts[2].GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatal("GetConfiguration error ", err)
+	}
+	if n := len(future.Configuration().Servers); n != 3 {
+		t.Fatal("excepted the learner to get 3 servers but got ", n)
+	}
+	for _, srv := range future.Configuration().Servers {
+		excepted := praft.Voter
+		if srv.ID == praft.ServerID(hosts[2].ID().Pretty()) {
+			excepted = praft.Nonvoter
+		}
+		if srv.Suffrage != excepted {
+			t.Fatal("excepted ", excepted, " for ", srv.ID, " but got ", srv.Suffrage)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	raft "github.com/magicdb/raft"
+	"github.com/magicdb/server"
+	"github.com/magicdb/service"
+	"github.com/magicdb/storage"
+	"github.com/spf13/viper"
+)
+
+// runServe run a magicdb node until it is interrupted
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.Int("p", viper.GetInt("port"), "libp2p listen port on the loopback, when no listen address is set")
+	listen := fs.String("listen", strings.Join(viper.GetStringSlice("node.listen"), ","),
+		"comma separated libp2p listen multiaddrs, such as /ip4/0.0.0.0/tcp/4001,/ip6/::/tcp/4001")
+	announce := fs.String("announce", strings.Join(viper.GetStringSlice("node.announce"), ","),
+		"comma separated multiaddrs advertised to peers instead of the listen ones")
+	labels := fs.String("labels", formatLabels(viper.GetStringMapString("node.labels")),
+		"comma separated key=value labels of the node, replicas are spread over the zone then the rack labels")
+	keyFile := fs.String("key", "", "identity key file, created if missing (default node.keyFile or <db>/"+keyFileName+")")
+	httpAddr := fs.String("http", viper.GetString("http.addr"), "http api listen address")
+	respAddr := fs.String("resp", viper.GetString("resp.addr"), "redis protocol listen address, empty disables it")
+	dbDir := fs.String("db", viper.GetString("dataDir"), "data directory of the store")
+	raftDir := fs.String("raft-dir", viper.GetString("raft.dir"), "raft log and snapshots directory (default <db>/raft)")
+	peers := fs.String("peers", "", "comma separated addresses /ip4/<ip>/tcp/<port>/ipfs/<id> of the other members")
+	learners := fs.String("learners", "",
+		"comma separated addresses /ip4/<ip>/tcp/<port>/ipfs/<id> of the members which replicate but never vote")
+	mdns := fs.Bool("mdns", viper.GetBool("discovery.mdns"), "discover the nodes on the local network")
+	bootstrap := fs.String("bootstrap", strings.Join(viper.GetStringSlice("discovery.bootstrap"), ","),
+		"comma separated addresses /ip4/<ip>/tcp/<port>/ipfs/<id> dialed until connected, -peers are added to them")
+	swarmKey := fs.String("swarm-key", viper.GetString("security.swarmKeyFile"), "private network key file, empty disables it")
+	gate := fs.Bool("gate", viper.GetBool("security.gate"), "only admit the connections of members and of the allowlist")
+	encKey := fs.String("encryption-key", viper.GetString("security.encryptionKeyFile"),
+		"encryption key file of the data at rest, empty disables it, reloaded on SIGHUP")
+	tlsCert := fs.String("tls-cert", viper.GetString("tls.certFile"), "certificate file of the http and redis apis, empty disables tls")
+	tlsKey := fs.String("tls-key", viper.GetString("tls.keyFile"), "private key file of -tls-cert")
+	tlsCA := fs.String("tls-client-ca", viper.GetString("tls.clientCAFile"), "ca file verifying the client certificates")
+	tlsRequire := fs.Bool("tls-require-client-cert", viper.GetBool("tls.requireClientCert"),
+		"reject the clients without a certificate signed by -tls-client-ca")
+	drainTimeout := fs.Duration("drain-timeout", viper.GetDuration("drain.timeout"),
+		"how long SIGTERM and SIGINT wait for the node to drain, 0 stops at once")
+	fs.Parse(args)
+	nodeLabels, err := parseLabels(*labels)
+	if err != nil {
+		return err
+	}
+
+	if *keyFile == "" {
+		*keyFile = defaultKeyFile(*dbDir)
+	}
+	if *raftDir == "" {
+		*raftDir = filepath.Join(*dbDir, "raft")
+	}
+	sk, err := raft.LoadOrCreateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := raft.NodeConfig{
+		Key:           sk,
+		ListenAddrs:   splitList(*listen),
+		AnnounceAddrs: splitList(*announce),
+	}
+	if len(cfg.ListenAddrs) == 0 {
+		cfg.ListenAddrs = []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", *port)}
+	}
+	if *swarmKey != "" {
+		if cfg.Protector, err = raft.LoadSwarmKey(*swarmKey); err != nil {
+			return fmt.Errorf("%s: %v", *swarmKey, err)
+		}
+	}
+	n, err := raft.NewNodeWithConfig(cfg)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+
+	pids := []peer.ID{n.ID()}
+	var lids []peer.ID
+	for _, addr := range splitList(*peers) {
+		pid, maddr, err := parsePeerAddr(addr)
+		if err != nil {
+			return err
+		}
+		n.Peerstore().AddAddr(pid, maddr, peerstore.PermanentAddrTTL)
+		pids = append(pids, pid)
+	}
+	for _, addr := range splitList(*learners) {
+		pid, maddr, err := parsePeerAddr(addr)
+		if err != nil {
+			return err
+		}
+		n.Peerstore().AddAddr(pid, maddr, peerstore.PermanentAddrTTL)
+		if pid == n.ID() {
+			// the learner itself, it must not bootstrap as a voter
+			pids = pids[1:]
+		}
+		lids = append(lids, pid)
+	}
+
+	var gater *raft.Gater
+	if *gate {
+		allow, err := allowedPeers(append(append(pids, lids...), n.ID()), splitList(*bootstrap))
+		if err != nil {
+			return err
+		}
+		gater = raft.NewGater(n, allow)
+		defer gater.Close()
+	}
+
+	disc, err := raft.StartDiscovery(n, raft.DiscoveryConfig{
+		MDNS:           *mdns,
+		ServiceTag:     viper.GetString("discovery.serviceTag"),
+		Bootstrap:      append(append(splitList(*bootstrap), splitList(*peers)...), splitList(*learners)...),
+		RedialInterval: viper.GetDuration("discovery.redialInterval"),
+	})
+	if err != nil {
+		return err
+	}
+	defer disc.Close()
+
+	store, err := storage.NewKvStore(storage.NewDefaultOptions(), *dbDir)
+	if err != nil {
+		return err
+	}
+	if *encKey != "" {
+		kr, err := storage.LoadKeyring(*encKey)
+		if err != nil {
+			store.Close()
+			return fmt.Errorf("%s: %v", *encKey, err)
+		}
+		store.SetKeyring(kr)
+		log.Println("encrypting the data at rest with key", kr.Active())
+	}
+	sinks, err := cdcSinks(n)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	var primaries []peer.ID
+	for _, id := range viper.GetStringSlice("replication.primaries") {
+		pid, err := peer.IDB58Decode(id)
+		if err != nil {
+			store.Close()
+			return fmt.Errorf("replication.primaries: %s: %v", id, err)
+		}
+		primaries = append(primaries, pid)
+	}
+	db, err := server.NewServerWithConfig(n, store, server.Config{
+		Peers:      pids,
+		Learners:   lids,
+		PromoteLag: uint64(viper.GetInt64("raft.promoteLag")),
+		SplitSize:  uint64(viper.GetSizeInBytes("ranges.splitSize")),
+		SplitQPS:   viper.GetFloat64("ranges.splitQPS"),
+		MergeSize:  uint64(viper.GetSizeInBytes("ranges.mergeSize")),
+		MergeQPS:   viper.GetFloat64("ranges.mergeQPS"),
+		Labels:     nodeLabels,
+		Capacity:   uint64(viper.GetSizeInBytes("node.capacity")),
+		Replicas:   viper.GetInt("pd.replicas"),
+		GCWindow:   viper.GetDuration("mvcc.gcWindow"),
+		Sinks:      sinks,
+		Standby:    viper.GetBool("replication.standby"),
+		Primaries:  primaries,
+		RaftDir:    *raftDir,
+	})
+	if err != nil {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+		store.Close()
+		return err
+	}
+	defer db.Shutdown()
+	if gater != nil {
+		gater.SetMembers(db.MemberIDs)
+	}
+
+	var certs *service.CertReloader
+	if *tlsCert != "" {
+		certs, err = service.NewCertReloader(service.TLSConfig{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			ClientCAFile:      *tlsCA,
+			RequireClientCert: *tlsRequire,
+		})
+		if err != nil {
+			return err
+		}
+		defer certs.Close()
+		log.Println("serving tls with", *tlsCert, "reloaded when it changes")
+	}
+
+	api := service.NewHTTPServer(*httpAddr, db)
+	api.BackupDir = viper.GetString("backup.dir")
+	api.ReadyMaxLag = uint64(viper.GetInt64("http.readyMaxLag"))
+	if certs != nil {
+		api.TLS = certs.Config()
+	}
+	if err := api.Start(); err != nil {
+		return err
+	}
+	defer api.Close()
+	log.Println("serving http api on", *httpAddr)
+
+	ps := service.NewP2PServer(n, db)
+	ps.Start()
+	defer ps.Close()
+	log.Println("serving", service.KVProtocol, "on", n.ID().Pretty())
+
+	if *respAddr != "" {
+		rs := service.NewRESPServer(*respAddr, db)
+		if certs != nil {
+			rs.TLS = certs.Config()
+		}
+		if err := rs.Start(); err != nil {
+			return err
+		}
+		defer rs.Close()
+		log.Println("serving redis protocol on", *respAddr)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				if *encKey != "" {
+					reloadKeyring(store, *encKey)
+				}
+				continue
+			}
+			if *drainTimeout > 0 && !db.Draining() {
+				drain(db, *drainTimeout)
+			}
+			break loop
+		case <-db.Drained():
+			log.Println("drained")
+			break loop
+		}
+	}
+	log.Println("shutting down")
+	return nil
+}
+
+// drain hand the leadership over and let the requests in flight end before
+// the node shuts down
+func drain(db *server.Server, timeout time.Duration) {
+	log.Println("draining")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.Drain(ctx, false); err != nil {
+		log.Println("drain:", err)
+		return
+	}
+	log.Println("drained")
+}
+
+// reloadKeyring load the encryption key file again, the values are
+// encrypted again in background when the active key changed
+func reloadKeyring(store *storage.KvStore, path string) {
+	kr, err := storage.LoadKeyring(path)
+	if err != nil {
+		log.Printf("reload %s: %v", path, err)
+		return
+	}
+	store.SetKeyring(kr)
+	log.Println("encrypting the data at rest with key", kr.Active())
+}
+
+// allowedPeers are the peers admitted by the gater besides the members:
+// pids, the bootstrap peers and security.allowlist
+func allowedPeers(pids []peer.ID, bootstrap []string) ([]peer.ID, error) {
+	allow := append([]peer.ID(nil), pids...)
+	for _, addr := range bootstrap {
+		pid, _, err := parsePeerAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(allow, pid)
+	}
+	for _, s := range viper.GetStringSlice("security.allowlist") {
+		pid, err := peer.IDB58Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("security.allowlist: %s: %v", s, err)
+		}
+		allow = append(allow, pid)
+	}
+	return allow, nil
+}
+
+// parseLabels parse comma separated key=value labels
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, item := range splitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, want key=value", item)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// formatLabels is the reverse of parseLabels, sorted by key
+func formatLabels(labels map[string]string) string {
+	items := make([]string, 0, len(labels))
+	for k, v := range labels {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// splitList split a comma separated list, skipping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cdcSinks return the sinks of the cdc and replication config, the changes
+// are captured only when one is set
+func cdcSinks(n host.Host) ([]server.Sink, error) {
+	var sinks []server.Sink
+	if path := viper.GetString("cdc.file.path"); path != "" {
+		sink, err := server.NewFileSink(path, int64(viper.GetSizeInBytes("cdc.file.maxSize")), viper.GetInt("cdc.file.maxFiles"))
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+		log.Println("capturing the changes to", path)
+	}
+	if url := viper.GetString("cdc.webhook.url"); url != "" {
+		sinks = append(sinks, server.NewWebhookSink(url, viper.GetDuration("cdc.webhook.timeout")))
+		log.Println("capturing the changes to", url)
+	}
+	var standby []peer.ID
+	for _, addr := range viper.GetStringSlice("replication.peers") {
+		pid, maddr, err := parsePeerAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("replication.peers: %s: %v", addr, err)
+		}
+		n.Peerstore().AddAddr(pid, maddr, peerstore.PermanentAddrTTL)
+		standby = append(standby, pid)
+	}
+	if len(standby) > 0 {
+		sinks = append(sinks, server.NewReplicaSink(n, standby))
+		log.Println("replicating the changes to the standby", strings.Join(viper.GetStringSlice("replication.peers"), ","))
+	}
+	return sinks, nil
+}
@@ -0,0 +1,535 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magicdb/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// authPrefix holds the users, the roles and the token secret
+	authPrefix    = "\x00auth/"
+	userPrefix    = authPrefix + "user/"
+	rolePrefix    = authPrefix + "role/"
+	authSecretKey = authPrefix + "secret"
+
+	// RootUser is the bootstrap account created by EnableAuth
+	RootUser = "root"
+
+	// RootRole grants every permission on every key and on the cluster, it
+	// is built in and cannot be changed
+	RootRole = "root"
+
+	// TokenTTL is how long a token issued by IssueToken is valid
+	TokenTTL = 24 * time.Hour
+)
+
+var (
+	// ErrReservedKey is returned for the keys of the system keyspace
+	ErrReservedKey = errors.New("key is reserved")
+	// ErrAuthRequired is returned when auth is enabled and the request
+	// carries no credentials
+	ErrAuthRequired = errors.New("authentication required")
+	// ErrAuthFailed is returned for a wrong user name or password
+	ErrAuthFailed = errors.New("invalid user name or password")
+	// ErrInvalidToken is returned for a forged or expired token
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrPermissionDenied is returned when the user lacks a permission
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrAuthEnabled is returned by EnableAuth when root already exists
+	ErrAuthEnabled = errors.New("authentication is already enabled")
+	// ErrUnknownUser is returned for a user which does not exist
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrUnknownRole is returned for a role which does not exist
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrRootImmutable is returned when removing root or changing its role
+	ErrRootImmutable = errors.New("the root user and role cannot be removed")
+)
+
+// Perm is a permission level, each level includes the lower ones
+type Perm int
+
+const (
+	// PermRead allows reading keys
+	PermRead Perm = iota + 1
+	// PermWrite allows writing keys
+	PermWrite
+	// PermAdmin on the empty prefix allows the cluster and auth operations
+	PermAdmin
+)
+
+func (p Perm) String() string {
+	switch p {
+	case PermRead:
+		return "read"
+	case PermWrite:
+		return "write"
+	case PermAdmin:
+		return "admin"
+	}
+	return "perm(" + strconv.Itoa(int(p)) + ")"
+}
+
+// ParsePerm parse read, write or admin
+func ParsePerm(s string) (Perm, error) {
+	switch s {
+	case "read":
+		return PermRead, nil
+	case "write":
+		return PermWrite, nil
+	case "admin":
+		return PermAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown permission %q, want read, write or admin", s)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p Perm) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *Perm) UnmarshalText(text []byte) error {
+	v, err := ParsePerm(string(text))
+	*p = v
+	return err
+}
+
+// Permission grants Perm on the keys starting with Prefix, the empty
+// prefix covers every key
+type Permission struct {
+	Prefix string `json:"prefix"`
+	Perm   Perm   `json:"perm"`
+}
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// UserInfo is a user without its credentials
+type UserInfo struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// user is the stored form of a user
+type user struct {
+	Name  string
+	Hash  []byte
+	Roles []string
+}
+
+// authState is the cached content of the auth keyspace
+type authState struct {
+	users  map[string]*user
+	roles  map[string]*Role
+	secret []byte
+}
+
+// authCache load the auth keyspace on demand, the fsm resets it when the
+// keyspace changes
+type authCache struct {
+	mu    sync.RWMutex
+	state *authState
+}
+
+func (c *authCache) reset() {
+	c.mu.Lock()
+	c.state = nil
+	c.mu.Unlock()
+}
+
+func (c *authCache) get(store *storage.KvStore) (*authState, error) {
+	c.mu.RLock()
+	st := c.state
+	c.mu.RUnlock()
+	if st != nil {
+		return st, nil
+	}
+
+	st = &authState{users: make(map[string]*user), roles: make(map[string]*Role)}
+	var err error
+	iterErr := store.Iterate([]byte(authPrefix), func(k, v []byte) bool {
+		switch key := string(k); {
+		case strings.HasPrefix(key, userPrefix):
+			u := new(user)
+			if err = gob.NewDecoder(bytes.NewReader(v)).Decode(u); err != nil {
+				return false
+			}
+			st.users[u.Name] = u
+		case strings.HasPrefix(key, rolePrefix):
+			r := new(Role)
+			if err = gob.NewDecoder(bytes.NewReader(v)).Decode(r); err != nil {
+				return false
+			}
+			st.roles[r.Name] = r
+		case key == authSecretKey:
+			st.secret = v
+		}
+		return true
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.state = st
+	c.mu.Unlock()
+	return st, nil
+}
+
+// enabled reports whether auth is on, it is once root exists
+func (st *authState) enabled() bool {
+	_, ok := st.users[RootUser]
+	return ok
+}
+
+func (st *authState) allowed(name string, key []byte, perm Perm) bool {
+	u, ok := st.users[name]
+	if !ok {
+		return false
+	}
+	for _, rn := range u.Roles {
+		if rn == RootRole {
+			return true
+		}
+		r, ok := st.roles[rn]
+		if !ok {
+			continue
+		}
+		for _, p := range r.Permissions {
+			if p.Perm >= perm && bytes.HasPrefix(key, []byte(p.Prefix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthEnabled reports whether requests must be authenticated
+func (s *Server) AuthEnabled() (bool, error) {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return false, err
+	}
+	return st.enabled(), nil
+}
+
+// EnableAuth create the root user with the root role and turn auth on for
+// the whole cluster. It must be called on the leader, it fails with
+// ErrAuthEnabled once auth is on.
+func (s *Server) EnableAuth(rootPassword string) error {
+	if rootPassword == "" {
+		return errors.New("empty root password")
+	}
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	if st.enabled() {
+		return ErrAuthEnabled
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	root, err := newUser(RootUser, rootPassword, []string{RootRole})
+	if err != nil {
+		return err
+	}
+	v, err := gobEncode(root)
+	if err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdEnableAuth, Puts: []pair{
+		{[]byte(authSecretKey), secret},
+		{[]byte(userPrefix + RootUser), v},
+	}})
+}
+
+// applyEnableAuth turn auth on with the secret and root user of cmd, unless
+// an earlier entry did. Two calls racing or a leader behind its log thus
+// never replace the secret and root.
+func (f *fsm) applyEnableAuth(index uint64, cmd *command) interface{} {
+	v, err := f.store.Get([]byte(authSecretKey))
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return ErrAuthEnabled
+	}
+	return f.write(index, cmd, nil)
+}
+
+// Authenticate check the password of a user
+func (s *Server) Authenticate(name, password string) error {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	u, ok := st.users[name]
+	if !ok || bcrypt.CompareHashAndPassword(u.Hash, []byte(password)) != nil {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// IssueToken check the password of a user and return a token valid for
+// TokenTTL on every node, changing the password revokes it
+func (s *Server) IssueToken(name, password string) (string, time.Time, error) {
+	if err := s.Authenticate(name, password); err != nil {
+		return "", time.Time{}, err
+	}
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(TokenTTL).Truncate(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := tokenMAC(st.secret, name, exp, st.users[name].Hash)
+	token := base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + exp + "." +
+		base64.RawURLEncoding.EncodeToString(mac)
+	return token, expires, nil
+}
+
+// VerifyToken return the user of a token issued by IssueToken
+func (s *Server) VerifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return "", ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return "", err
+	}
+	u, ok := st.users[string(name)]
+	if !ok || !hmac.Equal(mac, tokenMAC(st.secret, u.Name, parts[1], u.Hash)) {
+		return "", ErrInvalidToken
+	}
+	return u.Name, nil
+}
+
+// CheckUser return ErrUnknownUser if the user does not exist, it is used
+// for the users authenticated by a client certificate
+func (s *Server) CheckUser(name string) error {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	if _, ok := st.users[name]; !ok {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// Authorize return ErrPermissionDenied unless user has perm on key, a nil
+// key with PermAdmin asks for the cluster admin permission. Everything is
+// allowed while auth is disabled.
+func (s *Server) Authorize(user string, key []byte, perm Perm) error {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	if !st.enabled() || st.allowed(user, key, perm) {
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// PutUser create or update a user, an empty password keeps the current
+// one. Every role must exist. It must be called on the leader.
+func (s *Server) PutUser(name, password string, roles []string) error {
+	if name == "" {
+		return errors.New("empty user name")
+	}
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	for _, rn := range roles {
+		if _, ok := st.roles[rn]; !ok && rn != RootRole {
+			return fmt.Errorf("%v %q", ErrUnknownRole, rn)
+		}
+	}
+	if name == RootUser && !contains(roles, RootRole) {
+		return ErrRootImmutable
+	}
+
+	var u *user
+	if password != "" {
+		if u, err = newUser(name, password, roles); err != nil {
+			return err
+		}
+	} else {
+		old, ok := st.users[name]
+		if !ok {
+			return errors.New("empty password")
+		}
+		u = &user{Name: name, Hash: old.Hash, Roles: roles}
+	}
+	v, err := gobEncode(u)
+	if err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Puts: []pair{{[]byte(userPrefix + name), v}}})
+}
+
+// DeleteUser remove a user, root cannot be removed
+func (s *Server) DeleteUser(name string) error {
+	if name == RootUser {
+		return ErrRootImmutable
+	}
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	if _, ok := st.users[name]; !ok {
+		return ErrUnknownUser
+	}
+	return s.apply(&command{Type: cmdWrite, Deletes: [][]byte{[]byte(userPrefix + name)}})
+}
+
+// Users return the users sorted by name
+func (s *Server) Users() ([]UserInfo, error) {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]UserInfo, 0, len(st.users))
+	for _, u := range st.users {
+		users = append(users, UserInfo{Name: u.Name, Roles: u.Roles})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// PutRole create or replace a role, root cannot be changed
+func (s *Server) PutRole(role Role) error {
+	if role.Name == "" {
+		return errors.New("empty role name")
+	}
+	if role.Name == RootRole {
+		return ErrRootImmutable
+	}
+	for _, p := range role.Permissions {
+		if p.Perm < PermRead || p.Perm > PermAdmin {
+			return fmt.Errorf("invalid permission %v", p.Perm)
+		}
+	}
+	v, err := gobEncode(&role)
+	if err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Puts: []pair{{[]byte(rolePrefix + role.Name), v}}})
+}
+
+// DeleteRole remove a role, the users keep it in their roles until they
+// are updated but it grants nothing
+func (s *Server) DeleteRole(name string) error {
+	if name == RootRole {
+		return ErrRootImmutable
+	}
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return err
+	}
+	if _, ok := st.roles[name]; !ok {
+		return ErrUnknownRole
+	}
+	return s.apply(&command{Type: cmdWrite, Deletes: [][]byte{[]byte(rolePrefix + name)}})
+}
+
+// Roles return the roles sorted by name, root included
+func (s *Server) Roles() ([]Role, error) {
+	st, err := s.auth.get(s.store)
+	if err != nil {
+		return nil, err
+	}
+	roles := []Role{{Name: RootRole, Permissions: []Permission{{Prefix: "", Perm: PermAdmin}}}}
+	for _, r := range st.roles {
+		roles = append(roles, *r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func newUser(name, password string, roles []string) (*user, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &user{Name: name, Hash: hash, Roles: roles}, nil
+}
+
+// tokenMAC binds a token to the password hash, so a new password revokes
+// the tokens of the old one
+func tokenMAC(secret []byte, name, exp string, hash []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(name))
+	m.Write([]byte{0})
+	m.Write([]byte(exp))
+	m.Write([]byte{0})
+	m.Write(hash)
+	return m.Sum(nil)
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"testing"
+
+	praft "github.com/hashicorp/raft"
+)
+
+// newTestAuthServer return a server without raft over the store of f, the
+// auth keyspace is written by applying commands to f
+func newTestAuthServer(f *fsm) *Server {
+	s := &Server{store: f.store, watches: newWatchHub()}
+	f.notify = s.onApply
+	return s
+}
+
+func putAuth(t *testing.T, f *fsm, index uint64, key string, v interface{}) {
+	data, err := gobEncode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCmd(t, f, index, &command{Type: cmdWrite, Puts: []pair{{[]byte(key), data}}})
+}
+
+func putUser(t *testing.T, f *fsm, index uint64, name, password string, roles ...string) {
+	u, err := newUser(name, password, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putAuth(t, f, index, userPrefix+name, u)
+}
+
+func TestAuthorize(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	s := newTestAuthServer(f)
+
+	if err := s.Authorize("", []byte("user/1"), PermWrite); err != nil {
+		t.Fatal("Authorize with auth disabled error ", err)
+	}
+
+	putAuth(t, f, 1, rolePrefix+"reader", &Role{Name: "reader", Permissions: []Permission{{"user/", PermRead}}})
+	putUser(t, f, 2, "alice", "secret", "reader")
+	if on, _ := s.AuthEnabled(); on {
+		t.Fatal("Auth should be disabled until root exists")
+	}
+	putUser(t, f, 3, RootUser, "rootpw", RootRole)
+	if on, _ := s.AuthEnabled(); !on {
+		t.Fatal("Auth should be enabled once root exists")
+	}
+
+	cases := []struct {
+		user string
+		key  string
+		perm Perm
+		err  error
+	}{
+		{"alice", "user/1", PermRead, nil},
+		{"alice", "user/1", PermWrite, ErrPermissionDenied},
+		{"alice", "order/1", PermRead, ErrPermissionDenied},
+		{"alice", "", PermAdmin, ErrPermissionDenied},
+		{"bob", "user/1", PermRead, ErrPermissionDenied},
+		{RootUser, "order/1", PermWrite, nil},
+		{RootUser, "", PermAdmin, nil},
+	}
+	for _, c := range cases {
+		if err := s.Authorize(c.user, []byte(c.key), c.perm); err != c.err {
+			t.Fatalf("Authorize(%s, %q, %v) excepted %v but got %v", c.user, c.key, c.perm, c.err, err)
+		}
+	}
+
+	// a change of the role is seen at once
+	putAuth(t, f, 4, rolePrefix+"reader", &Role{Name: "reader", Permissions: []Permission{{"user/", PermWrite}}})
+	if err := s.Authorize("alice", []byte("user/1"), PermWrite); err != nil {
+		t.Fatal("Authorize after the role update error ", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	s := newTestAuthServer(f)
+
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{[]byte(authSecretKey), []byte("0123456789abcdef")}}})
+	putUser(t, f, 2, RootUser, "rootpw", RootRole)
+	putUser(t, f, 3, "alice", "secret")
+
+	if _, _, err := s.IssueToken("alice", "wrong"); err != ErrAuthFailed {
+		t.Fatal("IssueToken with a wrong password excepted ErrAuthFailed but got ", err)
+	}
+	token, _, err := s.IssueToken("alice", "secret")
+	if err != nil {
+		t.Fatal("IssueToken error ", err)
+	}
+	name, err := s.VerifyToken(token)
+	if err != nil || name != "alice" {
+		t.Fatalf("VerifyToken excepted alice but got %q, %v", name, err)
+	}
+	if _, err := s.VerifyToken(token[:len(token)-2] + "AA"); err != ErrInvalidToken {
+		t.Fatal("VerifyToken of a forged token excepted ErrInvalidToken but got ", err)
+	}
+
+	// a new password revokes the token
+	putUser(t, f, 4, "alice", "secret2")
+	if _, err := s.VerifyToken(token); err != ErrInvalidToken {
+		t.Fatal("VerifyToken after a password change excepted ErrInvalidToken but got ", err)
+	}
+}
+
+func TestWatchSkipsSystemKeys(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	s := newTestAuthServer(f)
+
+	events, cancel := s.Watch(nil)
+	defer cancel()
+	putUser(t, f, 1, "alice", "secret")
+	applyCmd(t, f, 2, &command{Type: cmdWrite, Puts: []pair{{[]byte("foo"), []byte("bar")}}})
+
+	e := <-events
+	if string(e.Key) != "foo" {
+		t.Fatalf("Watch excepted foo but got %q", e.Key)
+	}
+}
+
+func TestFSMEnableAuthOnce(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	enable := func(secret string) *command {
+		return &command{Type: cmdEnableAuth, Puts: []pair{{[]byte(authSecretKey), []byte(secret)}}}
+	}
+	applyCmd(t, f, 1, enable("first"))
+
+	// a second enable, racing or from a leader behind, changes nothing
+	data, err := encodeCommand(enable("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := f.Apply(&praft.Log{Index: 2, Data: data}); res != ErrAuthEnabled {
+		t.Fatal("second enable excepted ErrAuthEnabled but got ", res)
+	}
+	if v, err := f.store.Get([]byte(authSecretKey)); err != nil || string(v) != "first" {
+		t.Fatal("excepted the first secret to be kept but got ", string(v), err)
+	}
+}
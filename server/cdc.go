@@ -0,0 +1,344 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// cdcLogPrefix holds the changes of the keys of every range not yet
+	// delivered to every sink, by range then revision: <range>/<index><seq>
+	cdcLogPrefix = "\x00cdc/log/"
+
+	// cdcCheckpointPrefix holds the key of the last change of a range
+	// delivered to a sink: <range>/<sink name>
+	cdcCheckpointPrefix = "\x00cdc/ckpt/"
+
+	// cdcCapturePrefix marks the ranges whose changes are captured, it is
+	// set by cmdCapture: <range>
+	cdcCapturePrefix = "\x00cdc/on/"
+
+	// cdcInterval is how often the leader of a range delivers its changes
+	cdcInterval = time.Second
+
+	// cdcBatch is the max number of changes written to a sink at once
+	cdcBatch = 500
+)
+
+// Change is a change of a key captured for the sinks. Revision is the raft
+// index of the change in its range, TS its hybrid timestamp. Old is the
+// value before a put or a delete, New the value put.
+type Change struct {
+	Range    uint64 `json:"range"`
+	Revision uint64 `json:"revision"`
+	TS       uint64 `json:"ts"`
+	Type     string `json:"type"`
+	Key      []byte `json:"key"`
+	Old      []byte `json:"old,omitempty"`
+	New      []byte `json:"new,omitempty"`
+}
+
+// The types of a Change
+const (
+	ChangePut    = "put"
+	ChangeDelete = "delete"
+)
+
+// Sink receives the changes captured by the leaders of the ranges, in
+// order in every range. A change may be written again after a failure or
+// a leader change, until Write returned nil for it. Name identifies the
+// checkpoint of the sink, every node must have the same sinks.
+type Sink interface {
+	Name() string
+	Write(changes []Change) error
+	Close() error
+}
+
+func cdcLogRange(group uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x/", cdcLogPrefix, group))
+}
+
+func cdcLogKey(group, index uint64, seq int) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%016x%08x", cdcLogPrefix, group, index, seq))
+}
+
+func cdcCheckpointKey(group uint64, sink string) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%s", cdcCheckpointPrefix, group, sink))
+}
+
+func cdcCaptureKey(group uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x", cdcCapturePrefix, group))
+}
+
+// cdcGroup return the range of a change, checkpoint or capture key
+func cdcGroup(k []byte) (uint64, bool) {
+	var rest []byte
+	switch {
+	case bytes.HasPrefix(k, []byte(cdcLogPrefix)):
+		rest = k[len(cdcLogPrefix):]
+	case bytes.HasPrefix(k, []byte(cdcCheckpointPrefix)):
+		rest = k[len(cdcCheckpointPrefix):]
+	case bytes.HasPrefix(k, []byte(cdcCapturePrefix)):
+		rest = k[len(cdcCapturePrefix):]
+		if len(rest) != 16 {
+			return 0, false
+		}
+		rest = append(rest[:16:16], '/')
+	default:
+		return 0, false
+	}
+	var group uint64
+	if len(rest) < 17 || rest[16] != '/' {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(string(rest[:16]), "%016x", &group); err != nil {
+		return 0, false
+	}
+	return group, true
+}
+
+// track return what the fsm writes along with puts and dels at index and
+// ts: the versions of the keys and, when the changes are captured, their
+// changes
+func (f *fsm) track(index, ts uint64, puts []storage.KV, dels []interface{}) ([]storage.KV, error) {
+	kvs := versions(ts, puts, dels)
+	if !f.cdc {
+		return kvs, nil
+	}
+	seq := 0
+	add := func(typ string, k, v []byte) error {
+		old, err := f.store.Get(k)
+		if err != nil {
+			return err
+		}
+		if typ == ChangeDelete && old == nil {
+			return nil
+		}
+		rec, err := gobEncode(&Change{Range: f.group, Revision: index, TS: ts, Type: typ, Key: k, Old: old, New: v})
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, storage.KV{Key: cdcLogKey(f.group, index, seq), Value: rec})
+		seq++
+		return nil
+	}
+	for _, p := range puts {
+		k, ok := p.Key.([]byte)
+		if !ok || storage.IsSystemKey(k) {
+			continue
+		}
+		v, _ := p.Value.([]byte)
+		if err := add(ChangePut, k, v); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range dels {
+		if k, ok := d.([]byte); ok && !storage.IsSystemKey(k) {
+			if err := add(ChangeDelete, k, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return kvs, nil
+}
+
+// applyCapture turn the capture of the changes of the range on or off,
+// turned off it drops the changes not delivered yet and the checkpoints
+func (f *fsm) applyCapture(index uint64, on bool) interface{} {
+	var puts []storage.KV
+	var dels []interface{}
+	if on {
+		puts = append(puts, storage.KV{Key: cdcCaptureKey(f.group), Value: []byte{1}})
+	} else {
+		dels = append(dels, cdcCaptureKey(f.group))
+		for _, prefix := range [][]byte{cdcLogRange(f.group), []byte(fmt.Sprintf("%s%016x/", cdcCheckpointPrefix, f.group))} {
+			err := f.store.Iterate(prefix, func(k, v []byte) bool {
+				dels = append(dels, k)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.cdc = on
+	return nil
+}
+
+// capturing read whether the changes of the range are captured
+func (f *fsm) capturing() (bool, error) {
+	v, err := f.store.Get(cdcCaptureKey(f.group))
+	return v != nil, err
+}
+
+// mergeChanges move the changes of the range right merged at index after
+// those of the range, they keep their order. The checkpoints and the
+// capture mark of right are dropped, its changes not delivered to every
+// sink are written again.
+func (f *fsm) mergeChanges(index uint64, right uint64) ([]storage.KV, []interface{}, error) {
+	var puts []storage.KV
+	var dels []interface{}
+	seq := 0
+	err := f.store.Iterate(cdcLogRange(right), func(k, v []byte) bool {
+		puts = append(puts, storage.KV{Key: cdcLogKey(f.group, index, seq), Value: append([]byte{}, v...)})
+		dels = append(dels, append([]byte{}, k...))
+		seq++
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = f.store.Iterate([]byte(fmt.Sprintf("%s%016x/", cdcCheckpointPrefix, right)), func(k, v []byte) bool {
+		dels = append(dels, append([]byte{}, k...))
+		return true
+	})
+	return puts, append(dels, cdcCaptureKey(right)), err
+}
+
+// cdcLoop deliver the changes of the ranges the server leads to the sinks.
+// It turns the capture of a range it leads on when the server has sinks
+// and off when it has none: the capture is part of the replicated state of
+// the range, the sinks of the node only decide what the leader proposes.
+func (s *Server) cdcLoop() {
+	ticker := time.NewTicker(cdcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		for _, d := range s.ranges.all() {
+			r := s.replica(d.ID)
+			if r == nil || d.Frozen || r.raft.State() != praft.Leader {
+				continue
+			}
+			on := len(s.cfg.Sinks) > 0
+			if v, err := s.store.Get(cdcCaptureKey(d.ID)); err != nil || (v != nil) != on {
+				if err == nil {
+					s.applyIn(r.raft, &command{Type: cmdCapture, Capture: on})
+				}
+				continue
+			}
+			if !on {
+				continue
+			}
+			// a full batch leaves more to deliver
+			for s.deliver(r, d.ID) == cdcBatch {
+			}
+		}
+	}
+}
+
+// deliver write a batch of the changes of the range group to every sink
+// from its checkpoint, then move the checkpoints and drop the changes
+// every sink got. It return the size of the largest batch delivered.
+func (s *Server) deliver(r *replica, group uint64) int {
+	prefix := cdcLogRange(group)
+	cmd := &command{Type: cmdWrite}
+	var oldest []byte
+	most := 0
+	for i, sink := range s.cfg.Sinks {
+		ckpt := cdcCheckpointKey(group, sink.Name())
+		offset, err := s.store.Get(ckpt)
+		if err != nil {
+			return 0
+		}
+		var changes []Change
+		var last []byte
+		var decErr error
+		err = s.store.IterateFrom(prefix, offset, func(k, v []byte) bool {
+			var c Change
+			if decErr = gob.NewDecoder(bytes.NewReader(v)).Decode(&c); decErr != nil {
+				return false
+			}
+			changes = append(changes, c)
+			last = append([]byte{}, k...)
+			return len(changes) < cdcBatch
+		})
+		if err != nil || decErr != nil {
+			return 0
+		}
+		if len(changes) > 0 {
+			if err := sink.Write(changes); err != nil {
+				s.metrics.cdcErrors.WithLabelValues(sink.Name()).Inc()
+				last = nil
+			} else {
+				s.metrics.cdcChanges.WithLabelValues(sink.Name()).Add(float64(len(changes)))
+				cmd.Puts = append(cmd.Puts, pair{ckpt, last})
+				offset = last
+				if len(changes) > most {
+					most = len(changes)
+				}
+			}
+		}
+		if i == 0 || bytes.Compare(offset, oldest) < 0 {
+			oldest = offset
+		}
+	}
+	if len(oldest) > 0 {
+		s.store.Iterate(prefix, func(k, v []byte) bool {
+			if bytes.Compare(k, oldest) > 0 {
+				return false
+			}
+			cmd.Deletes = append(cmd.Deletes, append([]byte{}, k...))
+			return len(cmd.Deletes) < cdcBatch
+		})
+	}
+	if len(cmd.Puts) == 0 && len(cmd.Deletes) == 0 {
+		return 0
+	}
+	if _, err := s.applyIn(r.raft, cmd); err != nil {
+		return 0
+	}
+	return most
+}
+
+// cdcLag return how long ago the oldest change not delivered to the sink
+// was made, in the ranges the server leads
+func (s *Server) cdcLag(sink string) time.Duration {
+	var lag time.Duration
+	for _, d := range s.ranges.all() {
+		r := s.replica(d.ID)
+		if r == nil || r.raft.State() != praft.Leader {
+			continue
+		}
+		offset, err := s.store.Get(cdcCheckpointKey(d.ID, sink))
+		if err != nil {
+			continue
+		}
+		s.store.IterateFrom(cdcLogRange(d.ID), offset, func(k, v []byte) bool {
+			var c Change
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&c) == nil {
+				if l := time.Since(raft.PhysicalTime(c.TS)); l > lag {
+					lag = l
+				}
+			}
+			return false
+		})
+	}
+	return lag
+}
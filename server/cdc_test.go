@@ -0,0 +1,173 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCDCOwns(t *testing.T) {
+	d := &RangeDesc{ID: 3, Start: []byte("p")}
+	if !owns(d, cdcLogKey(3, 10, 0)) || !owns(d, cdcCheckpointKey(3, "file")) || !owns(d, cdcCaptureKey(3)) {
+		t.Fatal("excepted the range to own its changes and checkpoints")
+	}
+	if owns(d, cdcLogKey(4, 10, 0)) || owns(d, cdcCheckpointKey(0, "file")) || owns(d, cdcCaptureKey(4)) {
+		t.Fatal("excepted the range not to own the changes of other ranges")
+	}
+	if bytes.Compare(cdcLogKey(3, 9, 1), cdcLogKey(3, 10, 0)) >= 0 {
+		t.Fatal("excepted the changes ordered by revision")
+	}
+}
+
+func TestFSMChanges(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k := []byte("k")
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{[]byte("before"), []byte("v")}}, HLC: 50})
+	applyCmd(t, f, 2, &command{Type: cmdCapture, Capture: true})
+	applyCmd(t, f, 3, &command{Type: cmdWrite, Puts: []pair{{k, []byte("v1")}}, HLC: 100})
+	applyCmd(t, f, 4, &command{Type: cmdSet, Key: k, Value: []byte("v2"), HLC: 200})
+	applyCmd(t, f, 5, &command{Type: cmdWrite, Deletes: [][]byte{k, []byte("missing")}, HLC: 300})
+
+	var changes []Change
+	f.store.Iterate(cdcLogRange(f.group), func(_, v []byte) bool {
+		var c Change
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&c); err != nil {
+			t.Fatal("decode change error ", err)
+		}
+		changes = append(changes, c)
+		return true
+	})
+	excepted := []Change{
+		{Revision: 3, TS: 100, Type: ChangePut, Key: k, New: []byte("v1")},
+		{Revision: 4, TS: 200, Type: ChangePut, Key: k, Old: []byte("v1"), New: []byte("v2")},
+		{Revision: 5, TS: 300, Type: ChangeDelete, Key: k, Old: []byte("v2")},
+	}
+	if len(changes) != len(excepted) {
+		t.Fatal("excepted ", len(excepted), " changes but got ", changes)
+	}
+	for i, c := range changes {
+		e := excepted[i]
+		if c.Revision != e.Revision || c.TS != e.TS || c.Type != e.Type || !bytes.Equal(c.Key, e.Key) ||
+			!bytes.Equal(c.Old, e.Old) || !bytes.Equal(c.New, e.New) {
+			t.Fatal("change ", i, " excepted ", e, " but got ", c)
+		}
+	}
+
+	// turned off, the capture drops the changes not delivered
+	applyCmd(t, f, 6, &command{Type: cmdCapture})
+	applyCmd(t, f, 7, &command{Type: cmdWrite, Puts: []pair{{k, []byte("v3")}}, HLC: 400})
+	n := 0
+	f.store.Iterate(cdcLogRange(f.group), func(_, v []byte) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Fatal("excepted no change once the capture is off but got ", n)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdc")
+	if err != nil {
+		t.Fatal("TempDir error ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.jsonl")
+
+	line, _ := encodeChanges([]Change{{Revision: 1, Type: ChangePut, Key: []byte("k"), New: []byte("v")}})
+	s, err := NewFileSink(path, int64(2*len(line)), 2)
+	if err != nil {
+		t.Fatal("NewFileSink error ", err)
+	}
+	for i := uint64(1); i <= 7; i++ {
+		if err := s.Write([]Change{{Revision: i, Type: ChangePut, Key: []byte("k"), New: []byte("v")}}); err != nil {
+			t.Fatal("Write error ", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("Close error ", err)
+	}
+
+	// two changes a file, the oldest file is gone
+	for name, revisions := range map[string][]uint64{path: {7}, path + ".1": {5, 6}, path + ".2": {3, 4}} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal("Open error ", err)
+		}
+		var got []uint64
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var c Change
+			if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+				t.Fatal("Unmarshal error ", err)
+			}
+			got = append(got, c.Revision)
+		}
+		f.Close()
+		if len(got) != len(revisions) || got[0] != revisions[0] || got[len(got)-1] != revisions[len(revisions)-1] {
+			t.Fatal(name, " excepted ", revisions, " but got ", got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("excepted no third rotated file but got ", err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got []Change
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var c Change
+			if err := dec.Decode(&c); err != nil {
+				t.Error("Decode error ", err)
+				return
+			}
+			got = append(got, c)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewWebhookSink(ts.URL, 0)
+	defer s.Close()
+	changes := []Change{
+		{Range: 2, Revision: 5, Type: ChangePut, Key: []byte("a"), New: []byte("1")},
+		{Range: 2, Revision: 6, Type: ChangeDelete, Key: []byte("a"), Old: []byte("1")},
+	}
+	if err := s.Write(changes); err == nil {
+		t.Fatal("excepted the write to fail on a 503")
+	}
+	fail = false
+	if err := s.Write(changes); err != nil {
+		t.Fatal("Write error ", err)
+	}
+	if len(got) != 2 || got[1].Type != ChangeDelete || string(got[1].Old) != "1" || got[0].Range != 2 {
+		t.Fatal("excepted the changes to be posted but got ", got)
+	}
+}
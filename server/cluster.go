@@ -0,0 +1,118 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"errors"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	// ErrUnknownMember is returned for a peer which is not in the raft
+	// configuration
+	ErrUnknownMember = errors.New("peer is not a member of the cluster")
+)
+
+// Member is a server of the raft configuration
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+}
+
+// Members return the servers of the latest raft configuration
+func (s *Server) Members() ([]Member, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader := s.raft.Leader()
+	var members []Member
+	for _, srv := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+			Leader:   srv.Address == leader,
+		})
+	}
+	return members, nil
+}
+
+// MemberIDs return the peer ids of the servers of the latest raft
+// configuration
+func (s *Server) MemberIDs() ([]peer.ID, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var pids []peer.ID
+	for _, srv := range future.Configuration().Servers {
+		pid, err := peer.IDB58Decode(string(srv.ID))
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// RemoveMember remove the peer pid from the cluster, it must be called on
+// the leader
+func (s *Server) RemoveMember(pid peer.ID) error {
+	if ok, err := s.isMember(pid); err != nil || !ok {
+		if err == nil {
+			err = ErrUnknownMember
+		}
+		return err
+	}
+	return s.raft.RemoveServer(praft.ServerID(pid.Pretty()), 0, applyTimeout).Error()
+}
+
+// TransferLeadership hand the leadership over to target, or to the most
+// up to date voter if target is empty. It must be called on the leader.
+func (s *Server) TransferLeadership(target peer.ID) error {
+	if target == "" {
+		return s.raft.LeadershipTransfer().Error()
+	}
+	if ok, err := s.isMember(target); err != nil || !ok {
+		if err == nil {
+			err = ErrUnknownMember
+		}
+		return err
+	}
+	id := target.Pretty()
+	return s.raft.LeadershipTransferToServer(praft.ServerID(id), praft.ServerAddress(id)).Error()
+}
+
+// Snapshot take a raft snapshot now, compacting the log
+func (s *Server) Snapshot() error {
+	return s.raft.Snapshot().Error()
+}
+
+func (s *Server) isMember(pid peer.ID) (bool, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == praft.ServerID(pid.Pretty()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
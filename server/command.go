@@ -0,0 +1,170 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+type cmdType int
+
+const (
+	// cmdWrite puts and deletes keys atomically
+	cmdWrite cmdType = iota
+
+	// cmdIngest ingests sst files staged on the Source peer
+	cmdIngest
+
+	// cmdSet puts Key if Cond holds, with an optional ExpireAt
+	cmdSet
+
+	// cmdIncr adds Delta to the integer value of Key
+	cmdIncr
+
+	// cmdExpire sets the ExpireAt of Key if it exists
+	cmdExpire
+
+	// cmdReap deletes the keys of Deletes which are expired at Now
+	cmdReap
+
+	// cmdSplit splits the range at Key, the keys from Key on move to the
+	// new range Range replicated by Peers
+	cmdSplit
+
+	// cmdFreeze stops the range from taking writes ahead of its merge into
+	// the range before it
+	cmdFreeze
+
+	// cmdThaw takes back a cmdFreeze whose merge was given up
+	cmdThaw
+
+	// cmdMerge extends the range over the frozen range Range after it
+	cmdMerge
+
+	// cmdPeers sets the Peers replicating the range
+	cmdPeers
+
+	// cmdTimestamp reserves Delta timestamps of the oracle
+	cmdTimestamp
+
+	// cmdPrewrite locks the keys of Puts and Deletes for the transaction
+	// StartTS whose primary key is Primary, the locks expire at ExpireAt
+	cmdPrewrite
+
+	// cmdCommitTxn commits the Keys of the transaction StartTS at CommitTS
+	cmdCommitTxn
+
+	// cmdRollbackTxn rolls the transaction StartTS back on Keys
+	cmdRollbackTxn
+
+	// cmdCheckTxn decides the status of the transaction StartTS from its
+	// primary Key
+	cmdCheckTxn
+
+	// cmdGC drops the versions of Deletes, older than the safe point
+	cmdGC
+
+	// cmdCapture turns the capture of the changes of the range for the
+	// sinks on or off with Capture
+	cmdCapture
+
+	// cmdReplicate applies the Changes of the primary to a standby, those
+	// older than the last change of their key are skipped
+	cmdReplicate
+
+	// cmdEnableAuth puts the token secret and the root user of Puts, it
+	// fails with ErrAuthEnabled when auth is on already
+	cmdEnableAuth
+)
+
+type setCond int
+
+const (
+	condNone setCond = iota
+	// condNX only set the key if it does not exist
+	condNX
+	// condXX only set the key if it already exists
+	condXX
+)
+
+// command is the payload of a raft log entry
+type command struct {
+	Type    cmdType
+	Puts    []pair
+	Deletes [][]byte
+
+	Files  []sstFile
+	Source string
+
+	Key      []byte
+	Value    []byte
+	Cond     setCond
+	ExpireAt int64
+	Delta    int64
+
+	Range   uint64
+	Peers   []string
+	Capture bool
+	Changes []Change
+
+	Primary  []byte
+	StartTS  uint64
+	CommitTS uint64
+	Keys     [][]byte
+
+	// Now is the clock of the proposer in unix milliseconds. Expiry is
+	// decided against it, so every replica takes the same decision.
+	Now int64
+	// HLC is the hybrid clock of the proposer, the replicas adopt it
+	HLC uint64
+}
+
+// keys return the keys written by cmd, they route it to its range
+func (c *command) keys() [][]byte {
+	keys := make([][]byte, 0, len(c.Puts)+len(c.Deletes)+len(c.Keys)+len(c.Changes)+1)
+	for _, p := range c.Puts {
+		keys = append(keys, p.Key)
+	}
+	keys = append(keys, c.Deletes...)
+	keys = append(keys, c.Keys...)
+	for _, ch := range c.Changes {
+		keys = append(keys, ch.Key)
+	}
+	if c.Key != nil {
+		keys = append(keys, c.Key)
+	}
+	return keys
+}
+
+type pair struct {
+	Key   []byte
+	Value []byte
+}
+
+func encodeCommand(cmd *command) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCommand(data []byte) (*command, error) {
+	cmd := &command{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
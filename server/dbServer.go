@@ -12,3 +12,661 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+	host "github.com/libp2p/go-libp2p-host"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+// applyTimeout bounds how long a write waits to be committed
+const applyTimeout = 10 * time.Second
+
+var (
+	// ErrNotInteger is returned by Incr when the value is not an integer
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+)
+
+// Server is a magicdb node, a kv store replicated with raft
+type Server struct {
+	cfg       Config
+	host      host.Host
+	store     *storage.KvStore
+	raftLog   *storage.RaftLog
+	raft      *praft.Raft
+	transport *praft.NetworkTransport
+	watches   *watchHub
+	auth      authCache
+	metrics   *metrics
+	observer  *praft.Observer
+
+	// ranges route the keys to their range, replicas are the raft groups
+	// of the ranges replicated here, the range 0 is raft
+	ranges   *rangeTable
+	rangesMu sync.Mutex
+	replicas map[uint64]*replica
+	load     rangeLoad
+	pd       placement
+
+	// clock is the hybrid clock of the node, stamping its streams and
+	// raft entries, tso the window of timestamps of the oracle
+	clock *raft.Clock
+	tso   tso
+
+	// draining is set by Drain, inflight counts the requests being served
+	draining  int32
+	inflight  int64
+	drained   chan struct{}
+	drainOnce sync.Once
+
+	closing chan struct{}
+}
+
+// SetOptions are the conditions and ttl of Set
+type SetOptions struct {
+	// NX only set the key if it does not exist
+	NX bool
+	// XX only set the key if it already exists
+	XX bool
+	// TTL expires the key after it, 0 means never
+	TTL time.Duration
+}
+
+// Config is the cluster configuration of a server
+type Config struct {
+	// Peers are the voters the cluster is bootstrapped with, the server
+	// included
+	Peers []peer.ID
+	// Learners are bootstrapped as nonvoters, they replicate the log and
+	// serve reads without taking part in quorum
+	Learners []peer.ID
+	// PromoteLag is how many entries behind the leader a member added with
+	// AddMember may be to be promoted from learner to voter
+	PromoteLag uint64
+	// SplitSize and SplitQPS are the approximate bytes and the requests
+	// per second served by this node over which a range led here is
+	// split, 0 disables them
+	SplitSize uint64
+	SplitQPS  float64
+	// MergeSize is the approximate bytes under which two neighbour ranges
+	// are merged, provided their requests per second stay under MergeQPS.
+	// A MergeSize of 0 disables merges, a MergeQPS of 0 ignores the load.
+	MergeSize uint64
+	MergeQPS  float64
+	// Labels place the node, the replicas of a range are spread over the
+	// "zone" then the "rack" labels. Capacity is the bytes the node may
+	// hold, 0 is unbounded.
+	Labels   map[string]string
+	Capacity uint64
+	// Replicas is how many replicas the placement driver keeps of every
+	// range but the range 0, 0 leaves the ranges as they are
+	Replicas int
+	// GCWindow is how long the versions of the keys are kept for the
+	// reads in the past, 0 keeps the newest only
+	GCWindow time.Duration
+	// Sinks receive the changes of the keys, every node must be given the
+	// same sinks. They are closed on Shutdown.
+	Sinks []Sink
+	// Standby makes the cluster a read-only replica of a primary cluster
+	// shipping its changes with a ReplicaSink, until it is promoted.
+	// Primaries are the nodes of the primary allowed to ship them.
+	Standby   bool
+	Primaries []peer.ID
+	// RaftDir keeps the raft log and snapshots of the node, it must be
+	// its own. Empty keeps them in memory, a restart then starts over.
+	RaftDir   string
+	RaftQuiet bool
+}
+
+// Defaults of the Config of NewServer
+const (
+	DefaultPromoteLag = 100
+	DefaultSplitSize  = 64 << 20
+	DefaultSplitQPS   = 2500
+	DefaultMergeSize  = 16 << 20
+	DefaultMergeQPS   = 250
+	DefaultReplicas   = 3
+	DefaultGCWindow   = 24 * time.Hour
+)
+
+// NewServer create a server replicating store among the peers pids
+func NewServer(h host.Host, pids []peer.ID, store *storage.KvStore, raftQuiet bool) (*Server, error) {
+	return NewServerWithConfig(h, store, Config{
+		Peers:      pids,
+		PromoteLag: DefaultPromoteLag,
+		SplitSize:  DefaultSplitSize,
+		SplitQPS:   DefaultSplitQPS,
+		MergeSize:  DefaultMergeSize,
+		MergeQPS:   DefaultMergeQPS,
+		Replicas:   DefaultReplicas,
+		GCWindow:   DefaultGCWindow,
+		RaftQuiet:  raftQuiet,
+	})
+}
+
+// NewServerWithConfig create a server replicating store in the cluster of
+// cfg
+func NewServerWithConfig(h host.Host, store *storage.KvStore, cfg Config) (*Server, error) {
+	s := &Server{
+		cfg:      cfg,
+		host:     h,
+		store:    store,
+		watches:  newWatchHub(),
+		ranges:   &rangeTable{},
+		replicas: make(map[uint64]*replica),
+		drained:  make(chan struct{}),
+		closing:  make(chan struct{}),
+		clock:    raft.ClockOf(h),
+	}
+	if s.clock == nil {
+		s.clock = raft.NewClock()
+	}
+	descs, err := readRanges(store)
+	if err != nil {
+		return nil, err
+	}
+	s.ranges.reset(descs)
+	f := &fsm{
+		store:    store,
+		desc:     s.ranges.get(0),
+		stage:    s.ingestPath,
+		notify:   s.onApply,
+		restored: s.onRestore,
+		split:    s.onSplit,
+		merged:   s.onMerge,
+		changed:  s.onChanged,
+		clock:    s.clock,
+	}
+
+	if cfg.RaftDir != "" {
+		if s.raftLog, err = storage.OpenRaftLog(filepath.Join(cfg.RaftDir, "log"), store); err != nil {
+			return nil, err
+		}
+	}
+	stores, err := s.groupStores(0)
+	if err != nil {
+		s.closeRaftLog()
+		return nil, err
+	}
+	raftNode, transport, err := raft.NewRaftNodeWithStores(h, cfg.Peers, cfg.Learners, f, stores, cfg.RaftQuiet)
+	if err != nil {
+		s.closeRaftLog()
+		return nil, err
+	}
+	s.raft = raftNode
+	s.transport = transport
+	s.replicas[0] = &replica{raft: raftNode, transport: transport}
+	s.metrics = newMetrics(s)
+	if err := s.reloadRanges(); err != nil {
+		s.stopRanges()
+		raftNode.Shutdown()
+		transport.Close()
+		s.closeRaftLog()
+		return nil, err
+	}
+
+	obs := make(chan praft.Observation, 16)
+	s.observer = praft.NewObserver(obs, false, func(o *praft.Observation) bool {
+		_, ok := o.Data.(praft.LeaderObservation)
+		return ok
+	})
+	raftNode.RegisterObserver(s.observer)
+	go s.observeLeader(obs)
+
+	h.SetStreamHandler(sstProtocol, s.handleSSTStream)
+	h.SetStreamHandler(sstStageProtocol, s.handleSSTStageStream)
+	h.SetStreamHandler(statusProtocol, s.handleStatusStream)
+	h.SetStreamHandler(leaveProtocol, s.handleLeaveStream)
+	h.SetStreamHandler(pdProtocol, s.handlePDStream)
+	h.SetStreamHandler(replicateProtocol, s.handleReplicateStream)
+	go s.reapLoop()
+	go s.promoteLoop()
+	go s.resizeLoop()
+	go s.heartbeatLoop()
+	go s.placeLoop()
+	go s.gcLoop()
+	go s.cdcLoop()
+	go s.lagLoop()
+	return s, nil
+}
+
+// ID return the peer id of the server
+func (s *Server) ID() peer.ID {
+	return s.host.ID()
+}
+
+// Raft return the raft node of the server
+func (s *Server) Raft() *praft.Raft {
+	return s.raft
+}
+
+// Store return the local kv store of the server
+func (s *Server) Store() *storage.KvStore {
+	return s.store
+}
+
+// Put a key-value, it must be called on the leader
+func (s *Server) Put(key, value []byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Puts: []pair{{key, value}}})
+}
+
+// Get a key from the local store, expired keys are not returned
+func (s *Server) Get(key []byte) ([]byte, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return nil, err
+	}
+	if err := s.local(key); err != nil {
+		return nil, err
+	}
+	v, err := s.store.Get(key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	dead, err := expired(s.store, key, nowMs())
+	if err != nil || dead {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Delete a key, it must be called on the leader
+func (s *Server) Delete(key []byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Deletes: [][]byte{key}})
+}
+
+// BatchPut put keys[i]-values[i] pairs in one raft entry
+func (s *Server) BatchPut(keys, values [][]byte) error {
+	return s.Write(keys, values, nil)
+}
+
+// BatchDelete delete keys in one raft entry
+func (s *Server) BatchDelete(keys [][]byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Deletes: keys})
+}
+
+// Write put keys[i]-values[i] pairs and delete dels in one raft entry
+func (s *Server) Write(keys, values [][]byte, dels [][]byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return err
+	}
+	if err := checkKeys(dels...); err != nil {
+		return err
+	}
+	cmd := &command{Type: cmdWrite, Puts: make([]pair, len(keys)), Deletes: dels}
+	for i := range keys {
+		cmd.Puts[i] = pair{keys[i], values[i]}
+	}
+	return s.apply(cmd)
+}
+
+// Del delete keys and return how many of them existed
+func (s *Server) Del(keys [][]byte) (int, error) {
+	if err := s.enter(); err != nil {
+		return 0, err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return 0, err
+	}
+	res, err := s.applyResult(&command{Type: cmdWrite, Deletes: keys})
+	if err != nil {
+		return 0, err
+	}
+	return res.(int), nil
+}
+
+// Exists return how many of keys exist in the local store, a key given
+// twice is counted twice
+func (s *Server) Exists(keys [][]byte) (int, error) {
+	if err := s.enter(); err != nil {
+		return 0, err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return 0, err
+	}
+	if err := s.local(keys...); err != nil {
+		return 0, err
+	}
+	n := 0
+	now := nowMs()
+	for _, k := range keys {
+		ok, err := exists(s.store, k, now)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Set put a key-value if the conditions of opts hold, and reports whether
+// the key was set. Without TTL the ttl of the key is cleared.
+func (s *Server) Set(key, value []byte, opts SetOptions) (bool, error) {
+	if err := s.enter(); err != nil {
+		return false, err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return false, err
+	}
+	cmd := &command{Type: cmdSet, Key: key, Value: value}
+	if opts.NX {
+		cmd.Cond = condNX
+	} else if opts.XX {
+		cmd.Cond = condXX
+	}
+	if opts.TTL > 0 {
+		cmd.ExpireAt = nowMs() + int64(opts.TTL/time.Millisecond)
+	}
+	res, err := s.applyResult(cmd)
+	if err != nil {
+		return false, err
+	}
+	return res.(bool), nil
+}
+
+// Incr add delta to the integer value of key and return the new value, a
+// missing key counts as 0
+func (s *Server) Incr(key []byte, delta int64) (int64, error) {
+	if err := s.enter(); err != nil {
+		return 0, err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return 0, err
+	}
+	res, err := s.applyResult(&command{Type: cmdIncr, Key: key, Delta: delta})
+	if err != nil {
+		return 0, err
+	}
+	return res.(int64), nil
+}
+
+// Expire set the ttl of an existing key and reports whether it exists. A
+// ttl <= 0 deletes the key.
+func (s *Server) Expire(key []byte, ttl time.Duration) (bool, error) {
+	if err := s.enter(); err != nil {
+		return false, err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return false, err
+	}
+	if ttl <= 0 {
+		n, err := s.Del([][]byte{key})
+		return n > 0, err
+	}
+	res, err := s.applyResult(&command{
+		Type:     cmdExpire,
+		Key:      key,
+		ExpireAt: nowMs() + int64(ttl/time.Millisecond),
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.(bool), nil
+}
+
+// TTL return the remaining time to live of key. ok is false if the key does
+// not exist, ttl is negative if the key has no ttl.
+func (s *Server) TTL(key []byte) (ttl time.Duration, ok bool, err error) {
+	if err = s.enter(); err != nil {
+		return 0, false, err
+	}
+	defer s.exit()
+	if err = checkKeys(key); err != nil {
+		return 0, false, err
+	}
+	if err = s.local(key); err != nil {
+		return 0, false, err
+	}
+	now := nowMs()
+	if ok, err = exists(s.store, key, now); err != nil || !ok {
+		return 0, false, err
+	}
+	d, err := deadline(s.store, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if d == 0 {
+		return -1, true, nil
+	}
+	return time.Duration(d-now) * time.Millisecond, true, nil
+}
+
+// Iterate calls fn in key order for every live key with the prefix in the
+// local store, until fn returns false. System and expired keys are skipped,
+// so are the ranges not replicated on this node.
+func (s *Server) Iterate(prefix []byte, fn func(k, v []byte) bool) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+// IterateFrom is Iterate starting after the key start
+func (s *Server) IterateFrom(prefix, start []byte, fn func(k, v []byte) bool) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	now := nowMs()
+	var err error
+	iterErr := s.store.IterateFrom(prefix, start, func(k, v []byte) bool {
+		if storage.IsSystemKey(k) {
+			return true
+		}
+		var dead bool
+		if dead, err = expired(s.store, k, now); err != nil {
+			return false
+		}
+		return dead || fn(k, v)
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
+
+// Backup take a cluster-consistent backup of the store into dir. It must
+// be called on the leader of the range 0, on a node replicating every
+// range, or it fails with ErrBackupIncomplete. The barriers make sure
+// every committed entry of the ranges led here is applied; the backup
+// records the raft index of every range in GroupIndexes, the ranges led
+// elsewhere at the index this node applied.
+func (s *Server) Backup(dir string) (*storage.BackupInfo, error) {
+	var led []*replica
+	for _, d := range s.ranges.all() {
+		r := s.replica(d.ID)
+		if r == nil {
+			return nil, ErrBackupIncomplete
+		}
+		if d.ID == 0 || r.raft.State() == praft.Leader {
+			led = append(led, r)
+		}
+	}
+	for _, r := range led {
+		if err := r.raft.Barrier(applyTimeout).Error(); err != nil {
+			return nil, err
+		}
+	}
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, srv := range future.Configuration().Servers {
+		members = append(members, string(srv.ID))
+	}
+	labels := map[string]string{
+		"term":    s.raft.Stats()["term"],
+		"members": strings.Join(members, ","),
+	}
+	return s.store.Backup(dir, labels)
+}
+
+// Shutdown stop raft and close the store
+func (s *Server) Shutdown() error {
+	close(s.closing)
+	s.host.RemoveStreamHandler(sstProtocol)
+	s.host.RemoveStreamHandler(sstStageProtocol)
+	s.host.RemoveStreamHandler(statusProtocol)
+	s.host.RemoveStreamHandler(leaveProtocol)
+	s.host.RemoveStreamHandler(pdProtocol)
+	s.host.RemoveStreamHandler(replicateProtocol)
+	s.raft.DeregisterObserver(s.observer)
+	s.stopRanges()
+	err := s.raft.Shutdown().Error()
+	s.watches.closeAll()
+	s.transport.Close()
+	s.closeRaftLog()
+	s.store.Close()
+	for _, sink := range s.cfg.Sinks {
+		sink.Close()
+	}
+	return err
+}
+
+// groupStores return the stores of the raft group group, under its own
+// directory of cfg.RaftDir, or in memory without a RaftDir. The range 0
+// keeps its snapshots in RaftDir itself.
+func (s *Server) groupStores(group uint64) (raft.Stores, error) {
+	if s.raftLog == nil {
+		return raft.MemStores(), nil
+	}
+	return raft.DiskStores(s.raftLog.Group(group), s.groupDir(group))
+}
+
+// groupDir is the snapshot directory of the raft group group
+func (s *Server) groupDir(group uint64) string {
+	if group == 0 {
+		return s.cfg.RaftDir
+	}
+	return filepath.Join(s.cfg.RaftDir, fmt.Sprintf("group-%d", group))
+}
+
+// dropGroup delete the raft state of the raft group group once its
+// replica stopped, a replica added back later starts over
+func (s *Server) dropGroup(group uint64) {
+	if s.raftLog == nil {
+		return
+	}
+	s.raftLog.DropGroup(group)
+	os.RemoveAll(s.groupDir(group))
+}
+
+// closeRaftLog close the raft log once the rafts using it are shut down
+func (s *Server) closeRaftLog() {
+	if s.raftLog != nil {
+		s.raftLog.Close()
+	}
+}
+
+// onApply refresh the auth cache when the auth keyspace changed and hand
+// the changes of the user keys to the watches
+func (s *Server) onApply(events []Event) {
+	user := events[:0:0]
+	reload := false
+	for _, ev := range events {
+		if !storage.IsSystemKey(ev.Key) {
+			user = append(user, ev)
+		} else if strings.HasPrefix(string(ev.Key), authPrefix) {
+			s.auth.reset()
+		} else if strings.HasPrefix(string(ev.Key), pdRangePrefix) {
+			reload = true
+		}
+	}
+	if reload {
+		s.reloadRanges()
+	}
+	s.watches.notify(user)
+}
+
+// checkKeys return ErrReservedKey if a key belongs to the system keyspace
+func checkKeys(keys ...[]byte) error {
+	for _, k := range keys {
+		if storage.IsSystemKey(k) {
+			return ErrReservedKey
+		}
+	}
+	return nil
+}
+
+func (s *Server) apply(cmd *command) error {
+	_, err := s.applyResult(cmd)
+	return err
+}
+
+// applyResult replicate cmd in the range of its keys and return the result
+// of applying it, a standby refuses the writes of the user keys
+func (s *Server) applyResult(cmd *command) (interface{}, error) {
+	if err := s.readOnly(cmd); err != nil {
+		return nil, err
+	}
+	r, err := s.route(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyIn(r, cmd)
+}
+
+// applyIn replicate cmd with the raft group r
+func (s *Server) applyIn(r *praft.Raft, cmd *command) (interface{}, error) {
+	if cmd.Now == 0 {
+		cmd.Now = nowMs()
+	}
+	cmd.HLC = s.clock.Now()
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	future := r.Apply(data, applyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	s.metrics.applyDuration.Observe(time.Since(start).Seconds())
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// leaveProtocol asks the leader to remove the calling member
+	leaveProtocol = "/magicdb/leave/1.0.0"
+
+	// drainPoll is how often Drain checks the requests in flight
+	drainPoll = 10 * time.Millisecond
+)
+
+var (
+	// ErrDraining is returned for the requests a draining node refuses
+	ErrDraining = errors.New("node is draining")
+	// ErrLastVoter is returned when draining with leave the only voter
+	ErrLastVoter = errors.New("the last voter cannot leave the cluster")
+)
+
+// Drain prepare the node to stop without unavailability: it hands the
+// leadership of every range it leads over to another voter, refuses new
+// requests and closes the watches, waits for the requests in flight, then
+// with leave asks the leader to remove the node from the cluster. Drained
+// is closed once it succeeded. A failed drain is aborted, the node takes
+// requests again.
+func (s *Server) Drain(ctx context.Context, leave bool) (err error) {
+	if s.raft.State() == praft.Leader {
+		n, err := voters(s.raft)
+		if err != nil {
+			return err
+		}
+		if n > 1 {
+			if err := s.raft.LeadershipTransfer().Error(); err != nil {
+				return err
+			}
+		} else if leave {
+			return ErrLastVoter
+		}
+	}
+
+	if err := s.transferLeaders(); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	defer func() {
+		if err != nil {
+			atomic.StoreInt32(&s.draining, 0)
+		}
+	}()
+	s.watches.closeAll()
+	for atomic.LoadInt64(&s.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPoll):
+		}
+	}
+
+	if leave {
+		if err := s.leave(ctx); err != nil {
+			return err
+		}
+	}
+	s.drainOnce.Do(func() { close(s.drained) })
+	return nil
+}
+
+// Draining reports whether Drain started refusing requests
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Drained is closed once Drain succeeded, the node can then shut down
+func (s *Server) Drained() <-chan struct{} {
+	return s.drained
+}
+
+// enter count a request in flight, it must be paired with exit unless it
+// returns ErrDraining
+func (s *Server) enter() error {
+	atomic.AddInt64(&s.inflight, 1)
+	if s.Draining() {
+		s.exit()
+		return ErrDraining
+	}
+	return nil
+}
+
+func (s *Server) exit() {
+	atomic.AddInt64(&s.inflight, -1)
+}
+
+func voters(r *praft.Raft) (int, error) {
+	ids, err := voterIDs(r)
+	return len(ids), err
+}
+
+// leave ask the leader to remove the node
+func (s *Server) leave(ctx context.Context) error {
+	leader := s.raft.Leader()
+	if leader == "" {
+		return ErrNoLeader
+	}
+	pid, err := peer.IDB58Decode(string(leader))
+	if err != nil {
+		return err
+	}
+	if pid == s.host.ID() {
+		return s.RemoveMember(pid)
+	}
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, leaveProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	reply, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if reply = strings.TrimSpace(reply); reply != "ok" {
+		return errors.New(reply)
+	}
+	return nil
+}
+
+// handleLeaveStream remove the member at the other end of the stream, a
+// member can only remove itself
+func (s *Server) handleLeaveStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(applyTimeout))
+	reply := "ok"
+	if err := s.RemoveMember(stream.Conn().RemotePeer()); err != nil {
+		reply = err.Error()
+	}
+	stream.Write([]byte(reply + "\n"))
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+)
+
+// newTestRaft start a raft group of a single voter applying to fsm and
+// wait for it to lead
+func newTestRaft(t *testing.T, fsm praft.FSM) *praft.Raft {
+	conf := praft.DefaultConfig()
+	conf.LocalID = "node"
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+
+	store := praft.NewInmemStore()
+	addr, trans := praft.NewInmemTransport("")
+	r, err := praft.NewRaft(conf, fsm, store, store, praft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		t.Fatal("NewRaft error ", err)
+	}
+	err = r.BootstrapCluster(praft.Configuration{Servers: []praft.Server{{ID: conf.LocalID, Address: addr}}}).Error()
+	if err != nil {
+		t.Fatal("BootstrapCluster error ", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.State() != praft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("excepted the node to lead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r
+}
+
+func TestDrainAborts(t *testing.T) {
+	r := newTestRaft(t, &praft.MockFSM{})
+	defer r.Shutdown()
+	s := &Server{raft: r, watches: newWatchHub(), drained: make(chan struct{})}
+
+	if err := s.Drain(context.Background(), true); err != ErrLastVoter {
+		t.Fatal("Drain with leave excepted ErrLastVoter but got ", err)
+	}
+
+	// a request in flight outlives the drain, which then gives up
+	if err := s.enter(); err != nil {
+		t.Fatal("enter error ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx, false); err != context.DeadlineExceeded {
+		t.Fatal("Drain excepted context.DeadlineExceeded but got ", err)
+	}
+	if s.Draining() {
+		t.Fatal("excepted a failed drain to take requests again")
+	}
+	s.exit()
+
+	if err := s.Drain(context.Background(), false); err != nil {
+		t.Fatal("Drain error ", err)
+	}
+	select {
+	case <-s.Drained():
+	default:
+		t.Fatal("excepted Drained to be closed")
+	}
+	if err := s.enter(); err != ErrDraining {
+		t.Fatal("enter excepted ErrDraining but got ", err)
+	}
+}
+
+func TestDrainRefusesRequests(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	s := newTestAuthServer(f)
+	s.raft = newTestRaft(t, &praft.MockFSM{})
+	defer s.raft.Shutdown()
+	s.drained = make(chan struct{})
+
+	events, _ := s.Watch([]byte("user/"))
+	if _, err := s.Get([]byte("user/1")); err != nil {
+		t.Fatal("Get error ", err)
+	}
+	if n := atomic.LoadInt64(&s.inflight); n != 0 {
+		t.Fatal("excepted no request in flight but got ", n)
+	}
+
+	if err := s.Drain(context.Background(), false); err != nil {
+		t.Fatal("Drain error ", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatal("excepted the watch to be closed")
+	}
+	if _, err := s.Get([]byte("user/1")); err != ErrDraining {
+		t.Fatal("Get excepted ErrDraining but got ", err)
+	}
+	if _, err := s.Exists([][]byte{[]byte("user/1")}); err != ErrDraining {
+		t.Fatal("Exists excepted ErrDraining but got ", err)
+	}
+	events, _ = s.Watch([]byte("user/"))
+	if _, ok := <-events; ok {
+		t.Fatal("excepted a new watch to be closed")
+	}
+	if n := atomic.LoadInt64(&s.inflight); n != 0 {
+		t.Fatal("excepted refused requests not to stay in flight but got ", n)
+	}
+}
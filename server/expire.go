@@ -0,0 +1,116 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/binary"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// ttlPrefix holds the deadline of keys with a ttl, in unix ms
+	ttlPrefix = "\x00ttl/"
+
+	// reapInterval is how often the leader deletes expired keys
+	reapInterval = time.Second
+
+	// reapBatch is the max number of keys deleted per reap
+	reapBatch = 1000
+)
+
+func ttlKey(key []byte) []byte {
+	return append([]byte(ttlPrefix), key...)
+}
+
+func encodeDeadline(ms int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(ms))
+	return buf
+}
+
+func decodeDeadline(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// nowMs return the local clock in unix milliseconds
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// deadline return the deadline of key in unix ms, 0 if it has no ttl
+func deadline(store *storage.KvStore, key []byte) (int64, error) {
+	v, err := store.Get(ttlKey(key))
+	if err != nil {
+		return 0, err
+	}
+	return decodeDeadline(v), nil
+}
+
+// expired reports whether key has a ttl which passed at now
+func expired(store *storage.KvStore, key []byte, now int64) (bool, error) {
+	d, err := deadline(store, key)
+	if err != nil {
+		return false, err
+	}
+	return d > 0 && d <= now, nil
+}
+
+// exists reports whether key exists and is not expired at now
+func exists(store *storage.KvStore, key []byte, now int64) (bool, error) {
+	v, err := store.Get(key)
+	if err != nil || v == nil {
+		return false, err
+	}
+	dead, err := expired(store, key, now)
+	return !dead, err
+}
+
+// reapLoop delete expired keys of the ranges the server leads. Reads hide
+// expired keys already, this only reclaims the space.
+func (s *Server) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		now := nowMs()
+		byRange := make(map[uint64][][]byte)
+		n := 0
+		s.store.Iterate([]byte(ttlPrefix), func(k, v []byte) bool {
+			if d := decodeDeadline(v); d > 0 && d <= now {
+				key := k[len(ttlPrefix):]
+				id := s.ranges.lookup(key).ID
+				byRange[id] = append(byRange[id], key)
+				n++
+			}
+			return n < reapBatch
+		})
+		// every range reaps its keys on its leader
+		for id, keys := range byRange {
+			if r := s.replica(id); r != nil && r.raft.State() == praft.Leader {
+				s.applyIn(r.raft, &command{Type: cmdReap, Deletes: keys, Now: now})
+			}
+		}
+	}
+}
@@ -0,0 +1,665 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+// fsm applies committed raft log entries to the kv store
+type fsm struct {
+	store *storage.KvStore
+
+	// group is the raft group of the fsm and desc the range it holds, a
+	// nil desc holds every key
+	group uint64
+	desc  *RangeDesc
+
+	// stage return the local path of a sst file, fetching it from the
+	// source peer when it is not staged yet
+	stage func(source string, f sstFile) (string, error)
+
+	// halted is the error of a committed entry the fsm failed to apply, it
+	// applies no entry after it so that it does not diverge. A restart
+	// resumes from that entry.
+	halted error
+
+	// notify receive the changes of every applied entry, it may be nil
+	notify func(events []Event)
+
+	// restored is called after the store is replaced by a snapshot, it
+	// may be nil
+	restored func()
+
+	// split is called once the range split child off, merged once it
+	// took right over and changed once it was frozen, thawed or got new
+	// peers. They may be nil.
+	split   func(parent, child *RangeDesc)
+	merged  func(left, right *RangeDesc)
+	changed func(d *RangeDesc)
+
+	// fresh is set on a replica joining its range, its first restore has
+	// no key of the range to clear
+	fresh bool
+
+	// clock adopts the hybrid clock of the proposers, it may be nil
+	clock *raft.Clock
+
+	// cdc is set when the changes of the keys are captured for the sinks,
+	// by cmdCapture. It is read from the store with applied.
+	cdc bool
+
+	// applied is the index of the last entry of the group in the store,
+	// it is read from the store on the first entry and after a restore
+	applied uint64
+	loaded  bool
+}
+
+// Apply a committed log entry, the returned value is an error or the
+// result of the command
+func (f *fsm) Apply(l *praft.Log) interface{} {
+	if f.halted != nil {
+		return f.halted
+	}
+	if !f.loaded {
+		applied, err := f.store.GroupAppliedIndex(f.group)
+		if err != nil {
+			return err
+		}
+		if f.cdc, err = f.capturing(); err != nil {
+			return err
+		}
+		f.applied, f.loaded = applied, true
+	}
+	if l.Index <= f.applied {
+		// the log replayed at startup is behind the store, the entries
+		// already applied are not applied twice
+		return nil
+	}
+	f.applied = l.Index
+
+	cmd, err := decodeCommand(l.Data)
+	if err != nil {
+		return err
+	}
+	if err := f.check(cmd); err != nil {
+		return err
+	}
+	if f.clock != nil && cmd.HLC != 0 {
+		// a clock too far ahead is not adopted, the entry is applied
+		f.clock.Update(cmd.HLC)
+	}
+
+	switch cmd.Type {
+	case cmdWrite:
+		return f.applyWrite(l.Index, cmd)
+
+	case cmdIngest:
+		if err := f.applyIngest(l.Index, cmd); err != nil {
+			f.halted = err
+			return err
+		}
+		return nil
+
+	case cmdSplit:
+		return f.applySplit(l.Index, cmd)
+
+	case cmdFreeze, cmdThaw:
+		return f.applyFreeze(l.Index, cmd.Type == cmdFreeze)
+
+	case cmdMerge:
+		return f.applyMerge(l.Index, cmd)
+
+	case cmdPeers:
+		return f.applyPeers(l.Index, cmd)
+
+	case cmdTimestamp:
+		return f.applyTimestamp(l.Index, cmd)
+
+	case cmdPrewrite:
+		return f.applyPrewrite(l.Index, cmd)
+
+	case cmdCommitTxn:
+		return f.applyCommitTxn(l.Index, cmd)
+
+	case cmdRollbackTxn:
+		return f.applyRollbackTxn(l.Index, cmd)
+
+	case cmdCheckTxn:
+		return f.applyCheckTxn(l.Index, cmd)
+
+	case cmdGC:
+		return f.applyGC(l.Index, cmd)
+
+	case cmdSet:
+		return f.applySet(l.Index, cmd)
+
+	case cmdIncr:
+		return f.applyIncr(l.Index, cmd)
+
+	case cmdExpire:
+		return f.applyExpire(l.Index, cmd)
+
+	case cmdReap:
+		return f.applyReap(l.Index, cmd)
+
+	case cmdCapture:
+		return f.applyCapture(l.Index, cmd.Capture)
+
+	case cmdReplicate:
+		return f.applyReplicate(l.Index, cmd)
+
+	case cmdEnableAuth:
+		return f.applyEnableAuth(l.Index, cmd)
+	}
+	return fmt.Errorf("unknown command type %d", cmd.Type)
+}
+
+// applyIngest ingest the sst files of cmd, staged on the replica before
+// cmd was proposed. The ingested keys get their versions and captured
+// changes like written ones, ingested along with the files.
+func (f *fsm) applyIngest(index uint64, cmd *command) error {
+	paths := make([]string, len(cmd.Files))
+	var puts []storage.KV
+	for i, sst := range cmd.Files {
+		var err error
+		if paths[i], err = f.stage(cmd.Source, sst); err != nil {
+			return err
+		}
+		err = storage.ReadSST(paths[i], func(k, v []byte) bool {
+			puts = append(puts, storage.KV{Key: k, Value: v})
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	kvs, err := f.track(index, versionTS(cmd), puts, nil)
+	if err != nil {
+		return err
+	}
+	return f.store.Ingest(index, paths, kvs)
+}
+
+// check return ErrWrongRange if cmd writes keys the range does not hold,
+// the range was split after cmd was routed. Ingested files may hold any
+// key, so only a range holding the whole keyspace ingests, the others
+// return ErrIngestSplit. A frozen range only takes cmdThaw.
+func (f *fsm) check(cmd *command) error {
+	if f.desc != nil && f.desc.Frozen && cmd.Type != cmdThaw {
+		return ErrRangeMerging
+	}
+	switch cmd.Type {
+	case cmdSplit:
+		return nil
+	case cmdIngest:
+		if f.desc != nil && (f.desc.ID != 0 || len(f.desc.Start) > 0 || len(f.desc.End) > 0) {
+			return ErrIngestSplit
+		}
+		return nil
+	}
+	for _, k := range cmd.keys() {
+		if !owns(f.desc, k) {
+			return ErrWrongRange
+		}
+	}
+	return nil
+}
+
+// owns reports whether the replicated key k belongs to the range d: the
+// keys of its span with their ttl, transaction columns, versions and
+// replicated timestamps, its descriptors, captured changes and capture
+// mark, and for the range 0 every other system key. A nil d owns every
+// key.
+func owns(d *RangeDesc, k []byte) bool {
+	switch {
+	case d == nil:
+		return true
+	case bytes.HasPrefix(k, []byte(rangePrefix)):
+		return bytes.Equal(k, rangeKey(d.ID))
+	case bytes.HasPrefix(k, []byte(splitPrefix)):
+		parent, _, ok := recordIDs(k[len(splitPrefix):])
+		return ok && parent == d.ID
+	case bytes.HasPrefix(k, []byte(mergedPrefix)):
+		left, _, ok := recordIDs(k[len(mergedPrefix):])
+		return ok && left == d.ID
+	case bytes.HasPrefix(k, []byte(ttlPrefix)):
+		return d.Contains(k[len(ttlPrefix):])
+	case bytes.HasPrefix(k, []byte(replicaTSPrefix)):
+		return d.Contains(k[len(replicaTSPrefix):])
+	case bytes.HasPrefix(k, []byte(txnPrefix)):
+		key, ok := txnUserKey(k)
+		return ok && d.Contains(key)
+	case bytes.HasPrefix(k, []byte(mvccPrefix)):
+		key, ok := versionUserKey(k)
+		return ok && d.Contains(key)
+	case bytes.HasPrefix(k, []byte(cdcLogPrefix)), bytes.HasPrefix(k, []byte(cdcCheckpointPrefix)),
+		bytes.HasPrefix(k, []byte(cdcCapturePrefix)):
+		group, ok := cdcGroup(k)
+		return ok && group == d.ID
+	case storage.IsSystemKey(k):
+		return d.ID == 0
+	}
+	return d.Contains(k)
+}
+
+// applySplit cut the range at Key, the keys from Key on move to the new
+// range Range. The result is the new range.
+func (f *fsm) applySplit(index uint64, cmd *command) interface{} {
+	parent := f.desc
+	if parent == nil {
+		parent = &RangeDesc{ID: f.group}
+	}
+	if !parent.Contains(cmd.Key) || bytes.Equal(cmd.Key, parent.Start) {
+		return ErrInvalidSplit
+	}
+	if cmd.Range == 0 || cmd.Range == parent.ID {
+		return ErrRangeExists
+	}
+	if v, err := f.store.Get(rangeKey(cmd.Range)); err != nil || v != nil {
+		if err == nil {
+			err = ErrRangeExists
+		}
+		return err
+	}
+
+	left := &RangeDesc{ID: parent.ID, Start: parent.Start, End: cmd.Key, Peers: parent.Peers}
+	right := &RangeDesc{ID: cmd.Range, Start: cmd.Key, End: parent.End, Peers: cmd.Peers}
+	l, err := gobEncode(left)
+	if err != nil {
+		return err
+	}
+	r, err := gobEncode(right)
+	if err != nil {
+		return err
+	}
+	puts := []storage.KV{{Key: rangeKey(left.ID), Value: l}, {Key: splitKey(left.ID, right.ID), Value: r}}
+	if f.cdc {
+		// the new range captures its changes as its parent does
+		puts = append(puts, storage.KV{Key: cdcCaptureKey(right.ID), Value: []byte{1}})
+	}
+	if err := f.store.ApplyGroup(f.group, index, puts, nil); err != nil {
+		return err
+	}
+	f.desc = left
+	if f.split != nil {
+		f.split(left, right)
+	}
+	return right
+}
+
+// applyFreeze freeze or thaw the range, the range 0 which is first is
+// never merged
+func (f *fsm) applyFreeze(index uint64, freeze bool) interface{} {
+	if f.group == 0 {
+		return ErrInvalidMerge
+	}
+	d := &RangeDesc{ID: f.group}
+	if f.desc != nil {
+		*d = *f.desc
+	}
+	d.Frozen = freeze
+	return f.setDesc(index, d)
+}
+
+// applyPeers set the peers of the range, the range 0 whose peers are the
+// members of the cluster excepted
+func (f *fsm) applyPeers(index uint64, cmd *command) interface{} {
+	if f.group == 0 || len(cmd.Peers) == 0 {
+		return ErrInvalidPlacement
+	}
+	d := &RangeDesc{ID: f.group}
+	if f.desc != nil {
+		*d = *f.desc
+	}
+	d.Peers = cmd.Peers
+	return f.setDesc(index, d)
+}
+
+// setDesc write the new descriptor d of the range
+func (f *fsm) setDesc(index uint64, d *RangeDesc) interface{} {
+	v, err := gobEncode(d)
+	if err != nil {
+		return err
+	}
+	if err := f.store.ApplyGroup(f.group, index, []storage.KV{{Key: rangeKey(d.ID), Value: v}}, nil); err != nil {
+		return err
+	}
+	f.desc = d
+	if f.changed != nil {
+		f.changed(d)
+	}
+	return nil
+}
+
+// applyMerge extend the range over the frozen range Range which starts at
+// its end. Every replica applied the last entry of Range before the merge
+// was proposed, so its keys are the same in every store. The range takes
+// over the split and merge records and the captured changes of Range. The
+// result is the merged range.
+func (f *fsm) applyMerge(index uint64, cmd *command) interface{} {
+	left := f.desc
+	if left == nil {
+		left = &RangeDesc{ID: f.group}
+	}
+	right, err := findRange(f.store, cmd.Range)
+	if err != nil {
+		return err
+	}
+	if right == nil || !right.Frozen || len(left.End) == 0 || !bytes.Equal(left.End, right.Start) {
+		return ErrInvalidMerge
+	}
+
+	merged := &RangeDesc{ID: left.ID, Start: left.Start, End: right.End, Peers: left.Peers}
+	v, err := gobEncode(merged)
+	if err != nil {
+		return err
+	}
+	puts := []storage.KV{
+		{Key: rangeKey(merged.ID), Value: v},
+		{Key: mergedKey(merged.ID, right.ID)},
+	}
+	dels := []interface{}{rangeKey(right.ID)}
+	for _, prefix := range []string{splitPrefix, mergedPrefix} {
+		from := []byte(fmt.Sprintf("%s%016x/", prefix, right.ID))
+		err := f.store.Iterate(from, func(k, v []byte) bool {
+			puts = append(puts, storage.KV{Key: []byte(fmt.Sprintf("%s%016x/%s", prefix, merged.ID, k[len(from):])), Value: v})
+			dels = append(dels, k)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	changes, gone, err := f.mergeChanges(index, right.ID)
+	if err != nil {
+		return err
+	}
+	puts = append(puts, changes...)
+	dels = append(dels, gone...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.desc = merged
+	if f.merged != nil {
+		f.merged(merged, right)
+	}
+	return merged
+}
+
+// applyWrite put and delete keys, a put clears the ttl of the key. It
+// fails with ErrKeyLocked on a key locked by a transaction. The result is
+// the number of existing keys deleted.
+func (f *fsm) applyWrite(index uint64, cmd *command) interface{} {
+	return f.write(index, cmd, nil)
+}
+
+// write is applyWrite putting extra along with the keys of cmd
+func (f *fsm) write(index uint64, cmd *command, extra []storage.KV) interface{} {
+	var puts []storage.KV
+	var dels []interface{}
+	for _, p := range cmd.Puts {
+		puts = append(puts, storage.KV{Key: p.Key, Value: p.Value})
+		dels = append(dels, ttlKey(p.Key))
+	}
+
+	deleted := 0
+	var events []Event
+	for _, k := range cmd.Deletes {
+		ok, err := exists(f.store, k, cmd.Now)
+		if err != nil {
+			return err
+		}
+		if ok {
+			deleted++
+			events = append(events, Event{Type: EventDelete, Key: k, Index: index})
+		}
+		dels = append(dels, k, ttlKey(k))
+	}
+	txn, gone, err := f.plainWrite(versionTS(cmd), puts, dels)
+	if err != nil {
+		return err
+	}
+	tracked, err := f.track(index, versionTS(cmd), puts, dels)
+	if err != nil {
+		return err
+	}
+	puts = append(append(puts, tracked...), txn...)
+	puts = append(puts, extra...)
+	dels = append(dels, gone...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+
+	for _, p := range cmd.Puts {
+		events = append(events, Event{Type: EventPut, Key: p.Key, Value: p.Value, Index: index})
+	}
+	f.emit(events)
+	return deleted
+}
+
+// applySet put a key if its condition holds, the result tells whether the
+// key was set
+func (f *fsm) applySet(index uint64, cmd *command) interface{} {
+	if cmd.Cond != condNone {
+		ok, err := exists(f.store, cmd.Key, cmd.Now)
+		if err != nil {
+			return err
+		}
+		if (cmd.Cond == condNX && ok) || (cmd.Cond == condXX && !ok) {
+			return false
+		}
+	}
+
+	puts := []storage.KV{{Key: cmd.Key, Value: cmd.Value}}
+	var dels []interface{}
+	if cmd.ExpireAt > 0 {
+		puts = append(puts, storage.KV{Key: ttlKey(cmd.Key), Value: encodeDeadline(cmd.ExpireAt)})
+	} else {
+		dels = append(dels, ttlKey(cmd.Key))
+	}
+	txn, gone, err := f.plainWrite(versionTS(cmd), puts, nil)
+	if err != nil {
+		return err
+	}
+	tracked, err := f.track(index, versionTS(cmd), puts, nil)
+	if err != nil {
+		return err
+	}
+	puts = append(append(puts, tracked...), txn...)
+	dels = append(dels, gone...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.emit([]Event{{Type: EventPut, Key: cmd.Key, Value: cmd.Value, Index: index}})
+	return true
+}
+
+// applyIncr add Delta to an integer value, a missing key counts as 0. The
+// result is the new value.
+func (f *fsm) applyIncr(index uint64, cmd *command) interface{} {
+	ok, err := exists(f.store, cmd.Key, cmd.Now)
+	if err != nil {
+		return err
+	}
+
+	var n int64
+	var dels []interface{}
+	if ok {
+		v, err := f.store.Get(cmd.Key)
+		if err != nil {
+			return err
+		}
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return ErrNotInteger
+		}
+	} else {
+		// an expired key starts again without ttl
+		dels = append(dels, ttlKey(cmd.Key))
+	}
+	if (cmd.Delta > 0 && n > math.MaxInt64-cmd.Delta) || (cmd.Delta < 0 && n < math.MinInt64-cmd.Delta) {
+		return ErrNotInteger
+	}
+	n += cmd.Delta
+
+	value := []byte(strconv.FormatInt(n, 10))
+	puts := []storage.KV{{Key: cmd.Key, Value: value}}
+	txn, gone, err := f.plainWrite(versionTS(cmd), puts, nil)
+	if err != nil {
+		return err
+	}
+	tracked, err := f.track(index, versionTS(cmd), puts, nil)
+	if err != nil {
+		return err
+	}
+	puts = append(append(puts, tracked...), txn...)
+	dels = append(dels, gone...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.emit([]Event{{Type: EventPut, Key: cmd.Key, Value: value, Index: index}})
+	return n
+}
+
+// applyExpire set the deadline of an existing key, the result tells
+// whether the key exists
+func (f *fsm) applyExpire(index uint64, cmd *command) interface{} {
+	ok, err := exists(f.store, cmd.Key, cmd.Now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return false
+	}
+	puts := []storage.KV{{Key: ttlKey(cmd.Key), Value: encodeDeadline(cmd.ExpireAt)}}
+	if err := f.store.ApplyGroup(f.group, index, puts, nil); err != nil {
+		return err
+	}
+	return true
+}
+
+// applyReap delete the keys which are expired at Now. The keys are checked
+// again here since they may have been set after the reaper listed them.
+func (f *fsm) applyReap(index uint64, cmd *command) interface{} {
+	var dels []interface{}
+	var events []Event
+	for _, k := range cmd.Deletes {
+		dead, err := expired(f.store, k, cmd.Now)
+		if err != nil {
+			return err
+		}
+		if dead {
+			dels = append(dels, k, ttlKey(k))
+			events = append(events, Event{Type: EventDelete, Key: k, Index: index})
+		}
+	}
+	txn, gone, err := f.plainWrite(versionTS(cmd), nil, dels)
+	if err != nil {
+		return err
+	}
+	puts, err := f.track(index, versionTS(cmd), nil, dels)
+	if err != nil {
+		return err
+	}
+	puts = append(puts, txn...)
+	dels = append(dels, gone...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.emit(events)
+	return nil
+}
+
+func (f *fsm) emit(events []Event) {
+	if f.notify != nil {
+		f.notify(events)
+	}
+}
+
+// Snapshot the keys of the range, it is persisted concurrently with Apply
+func (f *fsm) Snapshot() (praft.FSMSnapshot, error) {
+	sn, err := f.store.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	snap := &fsmSnapshot{snap: sn, group: f.group}
+	if d := f.desc; d != nil {
+		snap.keep = func(k []byte) bool { return owns(d, k) }
+	}
+	return snap, nil
+}
+
+// Restore the keys of the range from a snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var keep func(k []byte) bool
+	if d := f.desc; f.fresh {
+		keep = func(k []byte) bool { return false }
+	} else if d != nil {
+		keep = func(k []byte) bool { return owns(d, k) }
+	}
+	if err := f.store.LoadGroup(rc, f.group, keep); err != nil {
+		return err
+	}
+	f.fresh = false
+	f.loaded = false
+	f.halted = nil
+	if f.desc != nil {
+		// the snapshot may be of the range after it split
+		v, err := f.store.Get(rangeKey(f.group))
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			d := &RangeDesc{}
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(d); err != nil {
+				return err
+			}
+			f.desc = d
+		}
+	}
+	if f.restored != nil {
+		f.restored()
+	}
+	return nil
+}
+
+type fsmSnapshot struct {
+	snap  *storage.Snapshot
+	group uint64
+	keep  func(k []byte) bool
+}
+
+// Persist write the snapshot to sink
+func (s *fsmSnapshot) Persist(sink praft.SnapshotSink) error {
+	if err := s.snap.DumpGroup(sink, s.group, s.keep); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release the store snapshot
+func (s *fsmSnapshot) Release() {
+	s.snap.Release()
+}
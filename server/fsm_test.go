@@ -0,0 +1,185 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/storage"
+)
+
+var tmpPath = "/tmp/magicdb-server-test"
+
+func newTestFSM(t *testing.T) (*fsm, func()) {
+	os.RemoveAll(tmpPath)
+	store, err := storage.NewKvStore(storage.NewDefaultOptions(), tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fsm{store: store}, func() {
+		store.Close()
+		os.RemoveAll(tmpPath)
+	}
+}
+
+func applyCmd(t *testing.T, f *fsm, index uint64, cmd *command) interface{} {
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := f.Apply(&praft.Log{Index: index, Data: data})
+	if err, ok := res.(error); ok {
+		t.Fatal("Apply error ", err)
+	}
+	return res
+}
+
+func TestFSMSetCond(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	key := []byte("foo")
+	if !applyCmd(t, f, 1, &command{Type: cmdSet, Key: key, Value: []byte("1"), Cond: condNX}).(bool) {
+		t.Fatal("SET NX on a missing key should set it")
+	}
+	if applyCmd(t, f, 2, &command{Type: cmdSet, Key: key, Value: []byte("2"), Cond: condNX}).(bool) {
+		t.Fatal("SET NX on an existing key should not set it")
+	}
+	if !applyCmd(t, f, 3, &command{Type: cmdSet, Key: key, Value: []byte("3"), Cond: condXX}).(bool) {
+		t.Fatal("SET XX on an existing key should set it")
+	}
+	if applyCmd(t, f, 4, &command{Type: cmdSet, Key: []byte("bar"), Value: []byte("1"), Cond: condXX}).(bool) {
+		t.Fatal("SET XX on a missing key should not set it")
+	}
+
+	v, _ := f.store.Get(key)
+	if string(v) != "3" {
+		t.Fatal("Value excepted '3' but got ", string(v))
+	}
+	index, _ := f.store.AppliedIndex()
+	if index != 4 {
+		t.Fatal("Applied index excepted 4 but got ", index)
+	}
+}
+
+func TestFSMIncr(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	key := []byte("counter")
+	for i := int64(1); i <= 3; i++ {
+		if n := applyCmd(t, f, uint64(i), &command{Type: cmdIncr, Key: key, Delta: 1}).(int64); n != i {
+			t.Fatalf("Incr excepted %d but got %d", i, n)
+		}
+	}
+
+	applyCmd(t, f, 4, &command{Type: cmdWrite, Puts: []pair{{key, []byte("abc")}}})
+	data, _ := encodeCommand(&command{Type: cmdIncr, Key: key, Delta: 1})
+	if res := f.Apply(&praft.Log{Index: 5, Data: data}); res != ErrNotInteger {
+		t.Fatal("Incr on a non integer excepted ErrNotInteger but got ", res)
+	}
+}
+
+func TestFSMReplay(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	key := []byte("counter")
+	for i := uint64(1); i <= 2; i++ {
+		applyCmd(t, f, i, &command{Type: cmdIncr, Key: key, Delta: 1})
+	}
+
+	// a restarted node replays its log onto the store which is ahead
+	g := &fsm{store: f.store}
+	for i := uint64(1); i <= 3; i++ {
+		applyCmd(t, g, i, &command{Type: cmdIncr, Key: key, Delta: 1})
+	}
+	if v, err := f.store.Get(key); err != nil || string(v) != "3" {
+		t.Fatal("Incr replayed excepted 3 but got ", string(v), err)
+	}
+}
+
+func TestFSMIngestHalts(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	missing := errors.New("sst is missing")
+	f.stage = func(source string, sst sstFile) (string, error) {
+		return "", missing
+	}
+	applyCmd(t, f, 1, &command{Type: cmdIncr, Key: []byte("counter"), Delta: 1})
+	data, err := encodeCommand(&command{Type: cmdIngest, Files: []sstFile{{Name: "a.sst"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := f.Apply(&praft.Log{Index: 2, Data: data}); res != missing {
+		t.Fatal("Apply of an ingest excepted the error of stage but got ", res)
+	}
+
+	// the entries after a failed ingest are not applied
+	data, err = encodeCommand(&command{Type: cmdIncr, Key: []byte("counter"), Delta: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := f.Apply(&praft.Log{Index: 3, Data: data}); res != missing {
+		t.Fatal("Apply after a failed ingest excepted its error but got ", res)
+	}
+	if v, err := f.store.Get("counter"); err != nil || string(v) != "1" {
+		t.Fatal("Incr after a failed ingest excepted 1 but got ", string(v), err)
+	}
+	if index, err := f.store.AppliedIndex(); err != nil || index != 1 {
+		t.Fatal("Applied index excepted 1 but got ", index, err)
+	}
+}
+
+func TestFSMExpire(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	key := []byte("session")
+	applyCmd(t, f, 1, &command{Type: cmdSet, Key: key, Value: []byte("v"), ExpireAt: 1000, Now: 500})
+
+	ok, err := exists(f.store, key, 999)
+	if err != nil || !ok {
+		t.Fatal("Key should exist before its deadline ", err)
+	}
+	if ok, _ := exists(f.store, key, 1000); ok {
+		t.Fatal("Key should not exist at its deadline")
+	}
+
+	// an expired key counts as missing for NX
+	if !applyCmd(t, f, 2, &command{Type: cmdSet, Key: key, Value: []byte("new"), Cond: condNX, Now: 2000}).(bool) {
+		t.Fatal("SET NX on an expired key should set it")
+	}
+	if d, _ := deadline(f.store, key); d != 0 {
+		t.Fatal("SET without ttl should clear the deadline, got ", d)
+	}
+
+	// the reaper does not delete a key that was set again
+	applyCmd(t, f, 3, &command{Type: cmdReap, Deletes: [][]byte{key}, Now: 3000})
+	if v, _ := f.store.Get(key); string(v) != "new" {
+		t.Fatal("Reap deleted a live key")
+	}
+
+	if !applyCmd(t, f, 4, &command{Type: cmdExpire, Key: key, ExpireAt: 4000, Now: 3000}).(bool) {
+		t.Fatal("EXPIRE on an existing key should succeed")
+	}
+	applyCmd(t, f, 5, &command{Type: cmdReap, Deletes: [][]byte{key}, Now: 5000})
+	if v, _ := f.store.Get(key); v != nil {
+		t.Fatal("Reap should delete an expired key, got ", string(v))
+	}
+}
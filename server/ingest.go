@@ -0,0 +1,330 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// sstProtocol serves staged sst files to the other replicas
+	sstProtocol = "/magicdb/sst/1.0.0"
+
+	// sstStageProtocol asks a replica to stage a sst file of the caller
+	// before its ingest is proposed
+	sstStageProtocol = "/magicdb/sst/stage/1.0.0"
+
+	// sstRetryInterval is how long a replica missing the sst file of a
+	// committed ingest waits before fetching it again
+	sstRetryInterval = 5 * time.Second
+
+	// sstFetchTimeout bounds the download of one sst file
+	sstFetchTimeout = 10 * time.Minute
+
+	// stagingRetention is how long staged sst files are kept for replicas
+	// that are behind
+	stagingRetention = 24 * time.Hour
+)
+
+var (
+	// ErrInvalidSSTName is returned for sst names that are not a plain
+	// file name ending with .sst
+	ErrInvalidSSTName = errors.New("invalid sst file name")
+	// ErrIngestSplit is returned by Ingest once the keyspace is split in
+	// ranges, an sst file may hold the keys of any of them
+	ErrIngestSplit = errors.New("ingest needs a keyspace of a single range, merge the ranges back first")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// sstFile describe a staged sst file of an ingest command
+type sstFile struct {
+	Name  string
+	Size  int64
+	CRC32 uint32
+}
+
+// Ingest stage the sst file read from r and ingest it on every replica at
+// the same raft log index. It must be called on the leader, every member
+// fetches the file from the leader before the ingest is proposed, so the
+// entry only names files the replicas hold. The file may hold any key and
+// is not routed to the ranges, so it is refused with ErrIngestSplit once
+// the keyspace is split in ranges.
+func (s *Server) Ingest(name string, r io.Reader) error {
+	if s.raft.State() != praft.Leader {
+		return praft.ErrNotLeader
+	}
+	if len(s.ranges.all()) > 1 {
+		return ErrIngestSplit
+	}
+	if !validSSTName(name) {
+		return ErrInvalidSSTName
+	}
+	if err := os.MkdirAll(s.stagingDir(), 0755); err != nil {
+		return err
+	}
+	s.cleanStaging()
+
+	// a unique name, the same sst may be ingested more than once
+	sst := sstFile{Name: fmt.Sprintf("%d-%s", time.Now().UnixNano(), name)}
+	path := filepath.Join(s.stagingDir(), sst.Name)
+	size, sum, err := writeStaged(path, r)
+	if err != nil {
+		return err
+	}
+	sst.Size, sst.CRC32 = size, sum
+	if err := s.stageMembers(sst); err != nil {
+		return err
+	}
+
+	return s.apply(&command{
+		Type:   cmdIngest,
+		Files:  []sstFile{sst},
+		Source: s.host.ID().Pretty(),
+	})
+}
+
+func (s *Server) stagingDir() string {
+	return s.store.Name() + ".ingest"
+}
+
+// stageMembers have every other member fetch the staged file f from this
+// node, it fails if one of them could not
+func (s *Server) stageMembers(f sstFile) error {
+	pids, err := s.MemberIDs()
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(pids))
+	for _, pid := range pids {
+		go func(pid peer.ID) {
+			if pid == s.host.ID() {
+				errs <- nil
+				return
+			}
+			if err := s.stageOn(pid, f); err != nil {
+				errs <- fmt.Errorf("stage %s on %s: %v", f.Name, pid.Pretty(), err)
+				return
+			}
+			errs <- nil
+		}(pid)
+	}
+	for range pids {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// stageOn ask pid to fetch the staged file f from this node
+func (s *Server) stageOn(pid peer.ID, f sstFile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sstFetchTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, sstStageProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(sstFetchTimeout))
+
+	if err := json.NewEncoder(stream).Encode(f); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if reply = strings.TrimSpace(reply); reply != "ok" {
+		return errors.New(reply)
+	}
+	return nil
+}
+
+// handleSSTStageStream fetch the sst file named on the stream from the
+// member at the other end
+func (s *Server) handleSSTStageStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(sstFetchTimeout))
+
+	var f sstFile
+	if err := json.NewDecoder(stream).Decode(&f); err != nil {
+		stream.Reset()
+		return
+	}
+	reply := "ok"
+	if _, err := s.stageSST(stream.Conn().RemotePeer().Pretty(), f); err != nil {
+		reply = err.Error()
+	}
+	stream.Write([]byte(reply + "\n"))
+}
+
+// ingestPath return the local path of f for the fsm. f was staged on the
+// members before its ingest was proposed, a replica which joined since
+// fetches it from source or from another member, retrying until it holds
+// it: a committed ingest is never skipped. It fails only once the server
+// is closing.
+func (s *Server) ingestPath(source string, f sstFile) (string, error) {
+	for {
+		path, err := s.stageSST(source, f)
+		if err == nil {
+			return path, nil
+		}
+		pids, _ := s.MemberIDs()
+		for _, pid := range pids {
+			if id := pid.Pretty(); id != source && pid != s.host.ID() {
+				if path, err := s.stageSST(id, f); err == nil {
+					return path, nil
+				}
+			}
+		}
+		select {
+		case <-s.closing:
+			return "", err
+		case <-time.After(sstRetryInterval):
+		}
+	}
+}
+
+// stageSST return the local path of f, fetching it from source if needed
+func (s *Server) stageSST(source string, f sstFile) (string, error) {
+	if !validSSTName(f.Name) {
+		return "", ErrInvalidSSTName
+	}
+	path := filepath.Join(s.stagingDir(), f.Name)
+	if size, sum, err := checksumFile(path); err == nil && size == f.Size && sum == f.CRC32 {
+		return path, nil
+	}
+	if source == s.host.ID().Pretty() {
+		return "", fmt.Errorf("staged sst %s is missing or corrupted", f.Name)
+	}
+
+	pid, err := peer.IDB58Decode(source)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.stagingDir(), 0755); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sstFetchTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, sstProtocol)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(sstFetchTimeout))
+
+	if _, err := stream.Write([]byte(f.Name + "\n")); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	size, sum, err := writeStaged(tmp, stream)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if size != f.Size || sum != f.CRC32 {
+		os.Remove(tmp)
+		return "", fmt.Errorf("fetched sst %s does not match its checksum", f.Name)
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// handleSSTStream send a staged sst file to a replica
+func (s *Server) handleSSTStream(stream network.Stream) {
+	defer stream.Close()
+
+	name, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	name = strings.TrimSpace(name)
+	if !validSSTName(name) {
+		stream.Reset()
+		return
+	}
+	f, err := os.Open(filepath.Join(s.stagingDir(), name))
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(stream, f); err != nil {
+		stream.Reset()
+	}
+}
+
+// cleanStaging remove staged files older than stagingRetention
+func (s *Server) cleanStaging() {
+	files, err := ioutil.ReadDir(s.stagingDir())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > stagingRetention {
+			os.Remove(filepath.Join(s.stagingDir(), f.Name()))
+		}
+	}
+}
+
+func validSSTName(name string) bool {
+	return name != "" && filepath.Base(name) == name && strings.HasSuffix(name, ".sst")
+}
+
+func writeStaged(path string, r io.Reader) (int64, uint32, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	h := crc32.New(castagnoli)
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return size, h.Sum32(), err
+}
+
+func checksumFile(path string) (int64, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(castagnoli)
+	size, err := io.Copy(h, f)
+	return size, h.Sum32(), err
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// promotePrefix marks the learners to promote to voter once caught up,
+	// the value is unused
+	promotePrefix = "\x00promote/"
+
+	// promoteInterval is how often the leader checks the learners to promote
+	promoteInterval = 2 * time.Second
+)
+
+var (
+	// ErrTooStale is returned when the data of the node may be older than
+	// the staleness allowed by a read
+	ErrTooStale = errors.New("node data is staler than allowed")
+)
+
+// AddMember add the peer pid as a voter, addrs are where it listens. It
+// joins as a learner and is promoted to voter once it is at most PromoteLag
+// entries behind the leader, so a new member never holds up commits while
+// it catches up. It must be called on the leader.
+func (s *Server) AddMember(pid peer.ID, addrs []ma.Multiaddr) error {
+	if voter, err := s.isVoter(pid); err != nil || voter {
+		return err
+	}
+	if err := s.AddLearner(pid, addrs); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdWrite, Puts: []pair{{promoteKey(pid), nil}}})
+}
+
+// AddLearner add the peer pid as a nonvoter, addrs are where it listens. A
+// learner replicates the log and serves reads but takes no part in
+// elections or quorum. It must be called on the leader.
+func (s *Server) AddLearner(pid peer.ID, addrs []ma.Multiaddr) error {
+	s.host.Peerstore().AddAddrs(pid, addrs, peerstore.PermanentAddrTTL)
+	id := pid.Pretty()
+	return s.raft.AddNonvoter(praft.ServerID(id), praft.ServerAddress(id), 0, applyTimeout).Error()
+}
+
+// CheckStaleness return ErrTooStale unless the local data may be at most
+// maxStaleness old: the leader is always fresh, a follower or a learner is
+// as fresh as its last contact with the leader
+func (s *Server) CheckStaleness(maxStaleness time.Duration) error {
+	if s.raft.State() == praft.Leader {
+		return nil
+	}
+	last := s.raft.LastContact()
+	if last.IsZero() || time.Since(last) > maxStaleness {
+		return ErrTooStale
+	}
+	return nil
+}
+
+func promoteKey(pid peer.ID) []byte {
+	return []byte(promotePrefix + pid.Pretty())
+}
+
+// promoteLoop promote on the leader the learners added by AddMember once
+// they caught up
+func (s *Server) promoteLoop() {
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() == praft.Leader {
+			s.promote()
+		}
+	}
+}
+
+func (s *Server) promote() {
+	var ids []string
+	s.store.Iterate([]byte(promotePrefix), func(k, v []byte) bool {
+		ids = append(ids, string(k[len(promotePrefix):]))
+		return true
+	})
+	if len(ids) == 0 {
+		return
+	}
+	future := s.raft.GetConfiguration()
+	if future.Error() != nil {
+		return
+	}
+	suffrage := make(map[string]praft.ServerSuffrage)
+	for _, srv := range future.Configuration().Servers {
+		suffrage[string(srv.ID)] = srv.Suffrage
+	}
+
+	var done [][]byte
+	for _, id := range ids {
+		sf, ok := suffrage[id]
+		// removed members and voters need no promotion
+		if !ok || sf == praft.Voter {
+			done = append(done, []byte(promotePrefix+id))
+			continue
+		}
+		pid, err := peer.IDB58Decode(id)
+		if err != nil {
+			done = append(done, []byte(promotePrefix+id))
+			continue
+		}
+		st, err := s.PeerStatus(context.Background(), pid)
+		if err != nil || st.LastIndex+s.cfg.PromoteLag < s.raft.LastIndex() {
+			continue
+		}
+		if s.raft.AddVoter(praft.ServerID(id), praft.ServerAddress(id), 0, applyTimeout).Error() == nil {
+			done = append(done, []byte(promotePrefix+id))
+		}
+	}
+	if len(done) > 0 {
+		s.apply(&command{Type: cmdWrite, Deletes: done})
+	}
+}
+
+func (s *Server) isVoter(pid peer.ID) (bool, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == praft.ServerID(pid.Pretty()) {
+			return srv.Suffrage == praft.Voter, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lagInterval is how often the leader measures the lag of its followers,
+// the scrapes read the last measure
+const lagInterval = 15 * time.Second
+
+// raftStates are the values of the magicdb_raft_state label
+var raftStates = []praft.RaftState{praft.Follower, praft.Candidate, praft.Leader, praft.Shutdown}
+
+// metrics are the prometheus metrics of a server, the gauges are read on
+// every scrape
+type metrics struct {
+	s *Server
+
+	applyDuration prometheus.Histogram
+	leaderChanges prometheus.Counter
+	cdcChanges    *prometheus.CounterVec
+	cdcErrors     *prometheus.CounterVec
+
+	state        *prometheus.Desc
+	term         *prometheus.Desc
+	lastIndex    *prometheus.Desc
+	commitIndex  *prometheus.Desc
+	appliedIndex *prometheus.Desc
+	lag          *prometheus.Desc
+	conns        *prometheus.Desc
+	peers        *prometheus.Desc
+	memtable     *prometheus.Desc
+	pending      *prometheus.Desc
+	compactions  *prometheus.Desc
+	sstBytes     *prometheus.Desc
+	sstFiles     *prometheus.Desc
+	keys         *prometheus.Desc
+	cacheBytes   *prometheus.Desc
+	cacheHits    *prometheus.Desc
+	cacheMisses  *prometheus.Desc
+	cdcLag       *prometheus.Desc
+	standby      *prometheus.Desc
+
+	lagMu sync.Mutex
+	lags  map[peer.ID]uint64
+}
+
+func newMetrics(s *Server) *metrics {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("magicdb_"+name, help, labels, nil)
+	}
+	return &metrics{
+		s: s,
+		applyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "magicdb_raft_apply_duration_seconds",
+			Help:    "Time to replicate and apply a write on the leader.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}),
+		leaderChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "magicdb_raft_leader_changes_total",
+			Help: "Leader changes seen by the node, losing the leader included.",
+		}),
+		cdcChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "magicdb_cdc_changes_delivered_total",
+			Help: "Changes of the keys written to each sink by the node.",
+		}, []string{"sink"}),
+		cdcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "magicdb_cdc_sink_errors_total",
+			Help: "Failed writes of changes to each sink, they are retried.",
+		}, []string{"sink"}),
+		state:        desc("raft_state", "1 for the raft state of the node.", "state"),
+		term:         desc("raft_term", "Current raft term."),
+		lastIndex:    desc("raft_last_index", "Index of the last entry of the raft log."),
+		commitIndex:  desc("raft_commit_index", "Index of the last committed raft entry."),
+		appliedIndex: desc("raft_applied_index", "Index of the last raft entry applied to the store."),
+		lag:          desc("raft_replication_lag_entries", "Raft entries a follower is behind the leader, on the leader only, measured every 15s.", "peer"),
+		conns:        desc("libp2p_connections", "Open libp2p connections.", "direction"),
+		peers:        desc("libp2p_peers", "Connected libp2p peers."),
+		memtable:     desc("rocksdb_memtable_bytes", "Size of the rocksdb memtables."),
+		pending:      desc("rocksdb_pending_compaction_bytes", "Estimated bytes left to compact."),
+		compactions:  desc("rocksdb_running_compactions", "Running rocksdb compactions."),
+		sstBytes:     desc("rocksdb_live_sst_bytes", "Size of the live sst files."),
+		sstFiles:     desc("rocksdb_sst_files", "Number of sst files of each level.", "level"),
+		keys:         desc("rocksdb_estimated_keys", "Estimated number of keys in the store."),
+		cacheBytes:   desc("rocksdb_block_cache_bytes", "Memory used by the block cache."),
+		cacheHits:    desc("rocksdb_block_cache_hits_total", "Block cache hits."),
+		cacheMisses:  desc("rocksdb_block_cache_misses_total", "Block cache misses."),
+		cdcLag:       desc("cdc_lag_seconds", "Age of the oldest change not delivered to each sink, in the ranges led by the node.", "sink"),
+		standby:      desc("replication_standby", "1 while the node is in a standby cluster not promoted."),
+	}
+}
+
+// Collector return the prometheus collector of the raft, libp2p and rocksdb
+// metrics of the server
+func (s *Server) Collector() prometheus.Collector {
+	return s.metrics
+}
+
+// Describe implements prometheus.Collector
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.applyDuration.Describe(ch)
+	m.leaderChanges.Describe(ch)
+	m.cdcChanges.Describe(ch)
+	m.cdcErrors.Describe(ch)
+	for _, d := range []*prometheus.Desc{
+		m.state, m.term, m.lastIndex, m.commitIndex, m.appliedIndex, m.lag,
+		m.conns, m.peers, m.memtable, m.pending, m.compactions, m.sstBytes,
+		m.sstFiles, m.keys, m.cacheBytes, m.cacheHits, m.cacheMisses, m.cdcLag, m.standby,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.applyDuration.Collect(ch)
+	m.leaderChanges.Collect(ch)
+	m.cdcChanges.Collect(ch)
+	m.cdcErrors.Collect(ch)
+	m.collectRaft(ch)
+	m.collectLibp2p(ch)
+	m.collectStore(ch)
+	m.collectCDC(ch)
+}
+
+func (m *metrics) collectRaft(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+	st := m.s.Status()
+	for _, state := range raftStates {
+		v := uint64(0)
+		if state.String() == st.State {
+			v = 1
+		}
+		gauge(m.state, v, state.String())
+	}
+	gauge(m.term, st.Term)
+	gauge(m.lastIndex, st.LastIndex)
+	gauge(m.commitIndex, st.CommitIndex)
+	gauge(m.appliedIndex, st.AppliedIndex)
+
+	if m.s.raft.State() != praft.Leader {
+		return
+	}
+	m.lagMu.Lock()
+	defer m.lagMu.Unlock()
+	for pid, lag := range m.lags {
+		gauge(m.lag, lag, pid.Pretty())
+	}
+}
+
+// lagLoop measure the lag of the followers while the node leads, so that
+// a scrape does no network round trip
+func (s *Server) lagLoop() {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		s.metrics.measureLags()
+	}
+}
+
+// measureLags ask every follower its last index, an unreachable follower
+// has no lag, its absence is the alert
+func (m *metrics) measureLags() {
+	lags := make(map[peer.ID]uint64)
+	defer func() {
+		m.lagMu.Lock()
+		m.lags = lags
+		m.lagMu.Unlock()
+	}()
+	if m.s.raft.State() != praft.Leader {
+		return
+	}
+	pids, err := m.s.MemberIDs()
+	if err != nil {
+		return
+	}
+	last := m.s.raft.LastIndex()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, pid := range pids {
+		if pid == m.s.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			fst, err := m.s.PeerStatus(context.Background(), pid)
+			if err != nil {
+				return
+			}
+			lag := uint64(0)
+			if last > fst.LastIndex {
+				lag = last - fst.LastIndex
+			}
+			mu.Lock()
+			lags[pid] = lag
+			mu.Unlock()
+		}(pid)
+	}
+	wg.Wait()
+}
+
+func (m *metrics) collectLibp2p(ch chan<- prometheus.Metric) {
+	var in, out int
+	for _, c := range m.s.host.Network().Conns() {
+		if c.Stat().Direction == network.DirInbound {
+			in++
+		} else {
+			out++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(m.conns, prometheus.GaugeValue, float64(in), "inbound")
+	ch <- prometheus.MustNewConstMetric(m.conns, prometheus.GaugeValue, float64(out), "outbound")
+	ch <- prometheus.MustNewConstMetric(m.peers, prometheus.GaugeValue, float64(len(m.s.host.Network().Peers())))
+}
+
+func (m *metrics) collectStore(ch chan<- prometheus.Metric) {
+	st, err := m.s.store.Stats()
+	if err != nil {
+		return
+	}
+	gauge := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+	gauge(m.memtable, st.MemtableBytes)
+	gauge(m.pending, st.PendingCompactionBytes)
+	gauge(m.compactions, st.RunningCompactions)
+	gauge(m.sstBytes, st.LiveSSTBytes)
+	gauge(m.keys, st.EstimatedKeys)
+	gauge(m.cacheBytes, st.BlockCacheBytes)
+	for level, n := range st.SSTFiles {
+		gauge(m.sstFiles, n, strconv.Itoa(level))
+	}
+	ch <- prometheus.MustNewConstMetric(m.cacheHits, prometheus.CounterValue, float64(st.BlockCacheHits))
+	ch <- prometheus.MustNewConstMetric(m.cacheMisses, prometheus.CounterValue, float64(st.BlockCacheMisses))
+}
+
+// observeLeader count the leader changes until the server shuts down
+func (s *Server) observeLeader(obs chan praft.Observation) {
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-obs:
+			s.metrics.leaderChanges.Inc()
+		}
+	}
+}
+
+func (m *metrics) collectCDC(ch chan<- prometheus.Metric) {
+	for _, sink := range m.s.cfg.Sinks {
+		lag := m.s.cdcLag(sink.Name())
+		ch <- prometheus.MustNewConstMetric(m.cdcLag, prometheus.GaugeValue, lag.Seconds(), sink.Name())
+	}
+	standby := 0.0
+	if m.s.Standby() {
+		standby = 1
+	}
+	ch <- prometheus.MustNewConstMetric(m.standby, prometheus.GaugeValue, standby)
+}
@@ -0,0 +1,357 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// mvccPrefix holds the versions of the keys, see storage.EncodeVersion.
+	// Every write stores the new value of its keys there as well, at the
+	// hybrid timestamp of its entry, or a tombstone for a delete.
+	mvccPrefix = "\x00mvcc/"
+
+	// pinPrefix holds the pins by name, they keep the versions read at
+	// their timestamp from the gc
+	pinPrefix = "\x00pin/"
+
+	// gcInterval is how often the leader of a range drops the versions
+	// older than the safe point
+	gcInterval = time.Minute
+
+	// gcBatch is the max number of versions dropped per entry
+	gcBatch = 1000
+)
+
+// The kinds of a version, its first byte
+const (
+	versionPut byte = iota
+	versionDelete
+)
+
+var (
+	// ErrTimestampTooOld is returned when reading at a timestamp older
+	// than the gc safe point, its versions may be gone
+	ErrTimestampTooOld = errors.New("timestamp is older than the gc safe point")
+	// ErrInvalidPin is returned by Pin without a name, a ttl or with a
+	// timestamp older than the safe point
+	ErrInvalidPin = errors.New("invalid pin, it needs a name, a ttl and a timestamp after the safe point")
+)
+
+// Pin keeps the versions read at TS until ExpireAt, in unix milliseconds,
+// such as those of a backup being taken
+type Pin struct {
+	Name     string `json:"name"`
+	TS       uint64 `json:"ts"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+func versionKey(key []byte, ts uint64) []byte {
+	return append([]byte(mvccPrefix), storage.EncodeVersion(key, ts)...)
+}
+
+// versionUserKey return the key of a version
+func versionUserKey(k []byte) ([]byte, bool) {
+	key, _, ok := storage.DecodeVersion(k[len(mvccPrefix):])
+	return key, ok
+}
+
+func pinKey(name string) []byte {
+	return []byte(pinPrefix + name)
+}
+
+// versionTS return the timestamp of the versions written by cmd: the
+// hybrid clock of its proposer, or its clock for an older proposer
+func versionTS(cmd *command) uint64 {
+	if cmd.HLC != 0 {
+		return cmd.HLC
+	}
+	return uint64(cmd.Now) << tsLogicalBits
+}
+
+// versions return the versions at ts of the keys put by puts and deleted
+// by dels, the system keys have none
+func versions(ts uint64, puts []storage.KV, dels []interface{}) []storage.KV {
+	var kvs []storage.KV
+	for _, p := range puts {
+		k, ok := p.Key.([]byte)
+		if !ok || storage.IsSystemKey(k) {
+			continue
+		}
+		v, _ := p.Value.([]byte)
+		kvs = append(kvs, storage.KV{Key: versionKey(k, ts), Value: append([]byte{versionPut}, v...)})
+	}
+	for _, d := range dels {
+		if k, ok := d.([]byte); ok && !storage.IsSystemKey(k) {
+			kvs = append(kvs, storage.KV{Key: versionKey(k, ts), Value: []byte{versionDelete}})
+		}
+	}
+	return kvs
+}
+
+// readVersion return the value of key at ts, nil when it did not exist.
+// The history of a key starts at its first write since the versions are
+// kept.
+func readVersion(store *storage.KvStore, key []byte, ts uint64) ([]byte, error) {
+	prefix := versionKey(key, 0)
+	prefix = prefix[:len(prefix)-8]
+	// the start is excluded, begin right before the version at ts
+	var start []byte
+	if inv := ^ts; inv > 0 {
+		start = versionKey(key, ts+1)
+	}
+	var value []byte
+	err := store.IterateFrom(prefix, start, func(k, v []byte) bool {
+		if len(v) > 0 && v[0] == versionPut {
+			value = append([]byte{}, v[1:]...)
+		}
+		return false
+	})
+	return value, err
+}
+
+// SafePoint return the oldest timestamp the reads may be served at: the
+// versions older than it are dropped, but the newest of every key. It is
+// GCWindow ago, or the timestamp of the oldest pin.
+func (s *Server) SafePoint() (uint64, error) {
+	safe := raft.HybridTime(time.Now().Add(-s.cfg.GCWindow))
+	pins, err := s.Pins()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range pins {
+		if p.TS < safe {
+			safe = p.TS
+		}
+	}
+	return safe, nil
+}
+
+// readAt check that the versions at ts are kept, and move the clock past
+// ts so that the writes proposed here after the read come after it
+func (s *Server) readAt(ts uint64) error {
+	safe, err := s.SafePoint()
+	if err != nil {
+		return err
+	}
+	if ts < safe {
+		return ErrTimestampTooOld
+	}
+	_, err = s.clock.Update(ts)
+	return err
+}
+
+// GetAt read the value key had at the hybrid timestamp ts from the local
+// store, nil when it did not exist. Ttls are not applied, the expired keys
+// exist until they are reaped.
+func (s *Server) GetAt(key []byte, ts uint64) ([]byte, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.exit()
+	if err := checkKeys(key); err != nil {
+		return nil, err
+	}
+	if err := s.local(key); err != nil {
+		return nil, err
+	}
+	if err := s.readAt(ts); err != nil {
+		return nil, err
+	}
+	return readVersion(s.store, key, ts)
+}
+
+// IterateAt is IterateFrom at the hybrid timestamp ts, see GetAt
+func (s *Server) IterateAt(prefix, start []byte, ts uint64, fn func(k, v []byte) bool) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := s.readAt(ts); err != nil {
+		return err
+	}
+	var from []byte
+	if start != nil {
+		// after the oldest version of start
+		from = versionKey(start, 0)
+	}
+	var last []byte
+	return s.store.IterateFrom(append([]byte(mvccPrefix), storage.VersionPrefix(prefix)...), from,
+		func(k, v []byte) bool {
+			key, vts, ok := storage.DecodeVersion(k[len(mvccPrefix):])
+			if !ok || vts > ts || (last != nil && bytes.Equal(key, last)) {
+				return true
+			}
+			// the newest version of key at ts, the older ones are skipped
+			last = key
+			if len(v) == 0 || v[0] != versionPut {
+				return true
+			}
+			return fn(key, v[1:])
+		})
+}
+
+// Pins return the pins which did not expire
+func (s *Server) Pins() ([]Pin, error) {
+	now := nowMs()
+	var pins []Pin
+	var decErr error
+	err := s.store.Iterate([]byte(pinPrefix), func(k, v []byte) bool {
+		var p Pin
+		if decErr = gob.NewDecoder(bytes.NewReader(v)).Decode(&p); decErr != nil {
+			return false
+		}
+		if p.ExpireAt > now {
+			pins = append(pins, p)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pins, decErr
+}
+
+// Pin keep the versions read at ts from the gc for ttl under name, a pin
+// with the same name is replaced. ts may not be older than the safe point.
+// It must be called on the leader.
+func (s *Server) Pin(name string, ts uint64, ttl time.Duration) error {
+	if name == "" || ttl <= 0 {
+		return ErrInvalidPin
+	}
+	safe, err := s.SafePoint()
+	if err != nil {
+		return err
+	}
+	if ts < safe {
+		return ErrInvalidPin
+	}
+	v, err := gobEncode(&Pin{Name: name, TS: ts, ExpireAt: nowMs() + int64(ttl/time.Millisecond)})
+	if err != nil {
+		return err
+	}
+	_, err = s.applyIn(s.raft, &command{Type: cmdWrite, Puts: []pair{{pinKey(name), v}}})
+	return err
+}
+
+// Unpin drop the pin name, it must be called on the leader
+func (s *Server) Unpin(name string) error {
+	_, err := s.applyIn(s.raft, &command{Type: cmdWrite, Deletes: [][]byte{pinKey(name)}})
+	return err
+}
+
+// gcLoop drop the versions older than the safe point in the ranges the
+// server leads, and the expired pins on the leader
+func (s *Server) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		safe, err := s.SafePoint()
+		if err != nil {
+			continue
+		}
+		for _, d := range s.ranges.all() {
+			r := s.replica(d.ID)
+			if r == nil || d.Frozen || r.raft.State() != praft.Leader {
+				continue
+			}
+			// a full batch leaves more to drop
+			for s.gc(r, d, safe) == gcBatch {
+			}
+		}
+		if s.raft.State() == praft.Leader {
+			s.dropPins()
+		}
+	}
+}
+
+// gc drop a batch of the versions of the range d older than safe but the
+// newest of every key, which is read at safe unless it is a tombstone. It
+// return how many versions it dropped.
+func (s *Server) gc(r *replica, d *RangeDesc, safe uint64) int {
+	var from []byte
+	if len(d.Start) > 0 {
+		from = append([]byte(mvccPrefix), storage.VersionPrefix(d.Start)...)
+	}
+	var dels [][]byte
+	var last []byte
+	s.store.IterateFrom([]byte(mvccPrefix), from, func(k, v []byte) bool {
+		key, ts, ok := storage.DecodeVersion(k[len(mvccPrefix):])
+		if !ok {
+			return true
+		}
+		if len(d.End) > 0 && bytes.Compare(key, d.End) >= 0 {
+			return false
+		}
+		if ts > safe {
+			return true
+		}
+		if last == nil || !bytes.Equal(key, last) {
+			// the newest version at safe is kept, a tombstone is not read
+			last = key
+			if len(v) > 0 && v[0] == versionPut {
+				return true
+			}
+		}
+		dels = append(dels, append([]byte{}, k...))
+		return len(dels) < gcBatch
+	})
+	if len(dels) == 0 {
+		return 0
+	}
+	if _, err := s.applyIn(r.raft, &command{Type: cmdGC, Deletes: dels}); err != nil {
+		return 0
+	}
+	return len(dels)
+}
+
+// dropPins delete the expired pins
+func (s *Server) dropPins() {
+	now := nowMs()
+	var dels [][]byte
+	s.store.Iterate([]byte(pinPrefix), func(k, v []byte) bool {
+		var p Pin
+		if gob.NewDecoder(bytes.NewReader(v)).Decode(&p) == nil && p.ExpireAt <= now {
+			dels = append(dels, append([]byte{}, k...))
+		}
+		return true
+	})
+	if len(dels) > 0 {
+		s.applyIn(s.raft, &command{Type: cmdWrite, Deletes: dels})
+	}
+}
+
+// applyGC delete the versions of Deletes, the gc of a version older than
+// the safe point never changes its mind
+func (f *fsm) applyGC(index uint64, cmd *command) interface{} {
+	dels := make([]interface{}, len(cmd.Deletes))
+	for i, k := range cmd.Deletes {
+		dels[i] = k
+	}
+	return f.store.ApplyGroup(f.group, index, nil, dels)
+}
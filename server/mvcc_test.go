@@ -0,0 +1,93 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/magicdb/storage"
+)
+
+func TestVersionOwns(t *testing.T) {
+	d := &RangeDesc{ID: 3, Start: []byte("p")}
+	if !owns(d, versionKey([]byte("x\x00y"), 5)) {
+		t.Fatal("excepted the range to own the versions of its keys")
+	}
+	if owns(d, versionKey([]byte("order/1"), 5)) {
+		t.Fatal("excepted the range not to own the versions of other keys")
+	}
+	if key, ok := versionUserKey(versionKey([]byte("x\x00y"), 5)); !ok || string(key) != "x\x00y" {
+		t.Fatal("versionUserKey excepted x\\x00y but got ", key, ok)
+	}
+}
+
+func TestFSMVersions(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k := []byte("k")
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{k, []byte("v1")}}, HLC: 100})
+	applyCmd(t, f, 2, &command{Type: cmdSet, Key: k, Value: []byte("v2"), HLC: 200})
+	applyCmd(t, f, 3, &command{Type: cmdWrite, Deletes: [][]byte{k}, HLC: 300})
+	applyCmd(t, f, 4, &command{Type: cmdIncr, Key: k, Delta: 4, HLC: 400})
+
+	for ts, excepted := range map[uint64]string{50: "", 100: "v1", 150: "v1", 200: "v2", 299: "v2", 300: "", 350: "", 400: "4", 1 << 60: "4"} {
+		v, err := readVersion(f.store, k, ts)
+		if err != nil || string(v) != excepted {
+			t.Fatal("readVersion at ", ts, " excepted ", excepted, " but got ", string(v), err)
+		}
+	}
+
+	// the gc drops the versions, the key reads the same after
+	applyCmd(t, f, 5, &command{Type: cmdGC, Deletes: [][]byte{versionKey(k, 100), versionKey(k, 200)}})
+	if v, err := readVersion(f.store, k, 250); err != nil || v != nil {
+		t.Fatal("readVersion excepted the dropped versions to be gone but got ", string(v), err)
+	}
+	if v, err := readVersion(f.store, k, 400); err != nil || string(v) != "4" {
+		t.Fatal("readVersion excepted 4 but got ", string(v), err)
+	}
+}
+
+func TestFSMIngestVersions(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k := []byte("k")
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{k, []byte("v1")}}, HLC: 100})
+
+	path := tmpPath + ".sst"
+	defer os.Remove(path)
+	w, err := storage.NewSSTWriter(storage.NewDefaultOptions(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Add(k, []byte("v2"))
+	if err == nil {
+		err = w.Finish()
+	}
+	w.Close()
+	if err != nil {
+		t.Fatal("SST error ", err)
+	}
+	f.stage = func(source string, sst sstFile) (string, error) {
+		return path, nil
+	}
+	applyCmd(t, f, 2, &command{Type: cmdIngest, Files: []sstFile{{Name: "a.sst"}}, HLC: 200})
+
+	for ts, excepted := range map[uint64]string{150: "v1", 200: "v2", 250: "v2"} {
+		v, err := readVersion(f.store, k, ts)
+		if err != nil || string(v) != excepted {
+			t.Fatal("readVersion at ", ts, " excepted ", excepted, " but got ", string(v), err)
+		}
+	}
+}
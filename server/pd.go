@@ -0,0 +1,859 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// pdProtocol carries the heartbeats of the nodes to the placement
+	// driver, the leader of the range 0, and its operators back
+	pdProtocol = "/magicdb/pd/1.0.0"
+
+	// pdNodePrefix holds the last NodeInfo of every node by id
+	pdNodePrefix = "\x00pd/node/"
+
+	// pdRangePrefix holds the RangeDesc of every range by id as reported
+	// by its leader, so that every node knows the peers of every range
+	pdRangePrefix = "\x00pd/range/"
+
+	// pdDecisionPrefix holds the last Decisions by time
+	pdDecisionPrefix = "\x00pd/decision/"
+
+	// heartbeatInterval is how often a node reports to the placement
+	// driver, and how often the placement driver schedules
+	heartbeatInterval = 10 * time.Second
+
+	// nodeDownTimeout is how long a node may miss its heartbeats before
+	// its replicas are moved away
+	nodeDownTimeout = time.Minute
+
+	// operatorTimeout bounds an operator, a range is not scheduled again
+	// until its operator is done or timed out
+	operatorTimeout = time.Minute
+
+	// maxOperators is how many operators run at once in the cluster
+	maxOperators = 4
+
+	// maxDecisions is how many decisions are kept
+	maxDecisions = 100
+
+	// zoneLabel and rackLabel are the labels the replicas of a range are
+	// spread over, zones first
+	zoneLabel = "zone"
+	rackLabel = "rack"
+)
+
+// The kinds of Operator
+const (
+	OpTransferLeader = "transfer-leader"
+	OpAddReplica     = "add-replica"
+	OpRemoveReplica  = "remove-replica"
+	OpMoveReplica    = "move-replica"
+)
+
+var (
+	// ErrInvalidPlacement is returned when a range would be left without
+	// peers, or for the range 0 whose peers are the cluster members
+	ErrInvalidPlacement = errors.New("invalid replica placement")
+)
+
+// NodeInfo is a node as known by the placement driver: its labels, its
+// capacity and load, and the ranges it replicates and leads
+type NodeInfo struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Capacity is the bytes the node may hold, 0 is unbounded. Used is
+	// the approximate bytes it holds.
+	Capacity uint64  `json:"capacity"`
+	Used     uint64  `json:"used"`
+	QPS      float64 `json:"qps"`
+	// Ranges and Leaders are the ranges replicated and led, the range 0
+	// excepted
+	Ranges    []uint64  `json:"ranges"`
+	Leaders   []uint64  `json:"leaders"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Up is set while the node heartbeats
+	Up bool `json:"up"`
+}
+
+// Operator is a change of the replicas of a range, run by its leader
+type Operator struct {
+	Range uint64 `json:"range"`
+	Kind  string `json:"kind"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// Decision is an Operator scheduled by the placement driver and why
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Operator Operator  `json:"operator"`
+	Reason   string    `json:"reason"`
+}
+
+// heartbeat is sent by a node to the placement driver with the ranges it
+// leads and the ranges whose operator it finished
+type heartbeat struct {
+	Node  NodeInfo
+	Descs []RangeDesc
+	Done  []uint64
+}
+
+// heartbeatResponse carries the operators for the node
+type heartbeatResponse struct {
+	Operators []Operator
+	Error     string
+}
+
+// placement is the state of the placement driver kept by the leader of
+// the range 0: the operators waiting for the next heartbeat of the node
+// leading their range and the ranges they are scheduled on
+type placement struct {
+	mu       sync.Mutex
+	pending  map[string][]Operator
+	inflight map[uint64]time.Time
+	// done are the ranges whose operator finished on this node, sent with
+	// the next heartbeat
+	done []uint64
+	// qps is the float64 bits of the requests per second served by the
+	// node
+	qps uint64
+}
+
+// schedule queue op for the node leading its range
+func (p *placement) schedule(node string, op Operator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		p.pending = make(map[string][]Operator)
+		p.inflight = make(map[uint64]time.Time)
+	}
+	p.pending[node] = append(p.pending[node], op)
+	p.inflight[op.Range] = time.Now()
+}
+
+// take return the operators for node and forget the finished ones
+func (p *placement) take(node string, done []uint64) []Operator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range done {
+		delete(p.inflight, id)
+	}
+	ops := p.pending[node]
+	delete(p.pending, node)
+	return ops
+}
+
+// busy return the ranges with an operator in flight, the timed out ones
+// are forgotten
+func (p *placement) busy() map[uint64]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	busy := make(map[uint64]bool)
+	for id, at := range p.inflight {
+		if time.Since(at) > operatorTimeout {
+			delete(p.inflight, id)
+			continue
+		}
+		busy[id] = true
+	}
+	return busy
+}
+
+func (p *placement) finish(id uint64) {
+	p.mu.Lock()
+	p.done = append(p.done, id)
+	p.mu.Unlock()
+}
+
+func (p *placement) takeDone() []uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := p.done
+	p.done = nil
+	return done
+}
+
+func pdNodeKey(id string) []byte {
+	return []byte(pdNodePrefix + id)
+}
+
+func pdRangeKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x", pdRangePrefix, id))
+}
+
+func pdDecisionKey(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%016x", pdDecisionPrefix, t.UnixNano()))
+}
+
+// Nodes return the nodes known by the placement driver ordered by id, a
+// node is down once it missed its heartbeats for nodeDownTimeout
+func (s *Server) Nodes() ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	var decErr error
+	err := s.store.Iterate([]byte(pdNodePrefix), func(k, v []byte) bool {
+		var n NodeInfo
+		if decErr = json.Unmarshal(v, &n); decErr != nil {
+			return false
+		}
+		n.Up = time.Since(n.Heartbeat) < nodeDownTimeout
+		nodes = append(nodes, n)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, decErr
+}
+
+// Decisions return the last decisions of the placement driver, newest
+// first
+func (s *Server) Decisions() ([]Decision, error) {
+	var decisions []Decision
+	var decErr error
+	err := s.store.Iterate([]byte(pdDecisionPrefix), func(k, v []byte) bool {
+		var d Decision
+		if decErr = json.Unmarshal(v, &d); decErr != nil {
+			return false
+		}
+		decisions = append(decisions, d)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(decisions)-1; i < j; i, j = i+1, j-1 {
+		decisions[i], decisions[j] = decisions[j], decisions[i]
+	}
+	return decisions, decErr
+}
+
+// heartbeatLoop report the node to the placement driver every
+// heartbeatInterval and run the operators it returns
+func (s *Server) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		ops, err := s.sendHeartbeat()
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			go s.runOperator(op)
+		}
+	}
+}
+
+// placeLoop schedule the operators of the cluster every heartbeatInterval
+// while this node leads the range 0, a Replicas of 0 schedules nothing
+func (s *Server) placeLoop() {
+	if s.cfg.Replicas == 0 {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() == praft.Leader {
+			s.schedule()
+		}
+	}
+}
+
+// nodeHeartbeat return the heartbeat of this node
+func (s *Server) nodeHeartbeat() *heartbeat {
+	hb := &heartbeat{
+		Node: NodeInfo{
+			ID:       s.host.ID().Pretty(),
+			Labels:   s.cfg.Labels,
+			Capacity: s.cfg.Capacity,
+			Used:     s.store.ApproximateSize([]byte{1}, nil),
+			QPS:      math.Float64frombits(atomic.LoadUint64(&s.pd.qps)),
+		},
+		Done: s.pd.takeDone(),
+	}
+	s.rangesMu.Lock()
+	for id, r := range s.replicas {
+		if id == 0 {
+			continue
+		}
+		hb.Node.Ranges = append(hb.Node.Ranges, id)
+		if r.raft.State() == praft.Leader {
+			hb.Node.Leaders = append(hb.Node.Leaders, id)
+		}
+	}
+	s.rangesMu.Unlock()
+	for _, id := range hb.Node.Leaders {
+		if d := s.ranges.desc(id); d != nil {
+			hb.Descs = append(hb.Descs, *d)
+		}
+	}
+	return hb
+}
+
+// sendHeartbeat report the node to the placement driver and return the
+// operators it has for the node
+func (s *Server) sendHeartbeat() ([]Operator, error) {
+	hb := s.nodeHeartbeat()
+	leader := s.raft.Leader()
+	if leader == "" {
+		return nil, ErrNoLeader
+	}
+	pid, err := peer.IDB58Decode(string(leader))
+	if err != nil {
+		return nil, err
+	}
+	if pid == s.host.ID() {
+		return s.handleHeartbeat(hb)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, pdProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	if err := json.NewEncoder(stream).Encode(hb); err != nil {
+		return nil, err
+	}
+	var resp heartbeatResponse
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Operators, nil
+}
+
+// handlePDStream take the heartbeat of the node at the other end of the
+// stream
+func (s *Server) handlePDStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(applyTimeout))
+	var hb heartbeat
+	if err := json.NewDecoder(stream).Decode(&hb); err != nil {
+		stream.Reset()
+		return
+	}
+	hb.Node.ID = stream.Conn().RemotePeer().Pretty()
+	var resp heartbeatResponse
+	ops, err := s.handleHeartbeat(&hb)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Operators = ops
+	json.NewEncoder(stream).Encode(&resp)
+}
+
+// handleHeartbeat record hb in the range 0: the node and the ranges it
+// leads which changed. The ranges merged into a reported range are
+// forgotten. It return the operators waiting for the node.
+func (s *Server) handleHeartbeat(hb *heartbeat) ([]Operator, error) {
+	if s.raft.State() != praft.Leader {
+		return nil, praft.ErrNotLeader
+	}
+	hb.Node.Heartbeat = time.Now()
+	hb.Node.Up = false
+	v, err := json.Marshal(&hb.Node)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &command{Type: cmdWrite, Puts: []pair{{pdNodeKey(hb.Node.ID), v}}}
+
+	known := make(map[uint64]*RangeDesc)
+	var decErr error
+	err = s.store.Iterate([]byte(pdRangePrefix), func(k, v []byte) bool {
+		d := &RangeDesc{}
+		if decErr = gob.NewDecoder(bytes.NewReader(v)).Decode(d); decErr != nil {
+			return false
+		}
+		known[d.ID] = d
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decErr != nil {
+		return nil, decErr
+	}
+	for i := range hb.Descs {
+		d := &hb.Descs[i]
+		if d.ID == 0 {
+			continue
+		}
+		if old := known[d.ID]; old == nil || !sameDesc(old, d) {
+			v, err := gobEncode(d)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Puts = append(cmd.Puts, pair{pdRangeKey(d.ID), v})
+		}
+		for id, old := range known {
+			if id != d.ID && covers(d, old) {
+				cmd.Deletes = append(cmd.Deletes, pdRangeKey(id))
+			}
+		}
+	}
+	if _, err := s.applyIn(s.raft, cmd); err != nil {
+		return nil, err
+	}
+	return s.pd.take(hb.Node.ID, hb.Done), nil
+}
+
+// sameDesc reports whether a and b are the same descriptor
+func sameDesc(a, b *RangeDesc) bool {
+	if a.ID != b.ID || a.Frozen != b.Frozen || !bytes.Equal(a.Start, b.Start) ||
+		!bytes.Equal(a.End, b.End) || len(a.Peers) != len(b.Peers) {
+		return false
+	}
+	for i := range a.Peers {
+		if a.Peers[i] != b.Peers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether the span of b is inside the span of a
+func covers(a, b *RangeDesc) bool {
+	if !a.Contains(b.Start) {
+		return false
+	}
+	return len(a.End) == 0 || (len(b.End) > 0 && bytes.Compare(b.End, a.End) <= 0)
+}
+
+// schedule plan the operators of the ranges without one in flight, queue
+// them for the leaders of their range and record the decisions
+func (s *Server) schedule() {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return
+	}
+	busy := s.pd.busy()
+	if len(busy) >= maxOperators {
+		return
+	}
+	leaders := make(map[uint64]string)
+	for _, n := range nodes {
+		for _, id := range n.Leaders {
+			leaders[id] = n.ID
+		}
+	}
+	decisions := plan(nodes, s.ranges.all(), s.cfg.Replicas, busy)
+	if len(decisions) > maxOperators-len(busy) {
+		decisions = decisions[:maxOperators-len(busy)]
+	}
+	if len(decisions) == 0 {
+		return
+	}
+
+	cmd := &command{Type: cmdWrite}
+	now := time.Now()
+	for i := range decisions {
+		d := &decisions[i]
+		d.Time = now.Add(time.Duration(i))
+		v, err := json.Marshal(d)
+		if err != nil {
+			return
+		}
+		cmd.Puts = append(cmd.Puts, pair{pdDecisionKey(d.Time), v})
+	}
+	var keys [][]byte
+	s.store.Iterate([]byte(pdDecisionPrefix), func(k, v []byte) bool {
+		keys = append(keys, append([]byte(nil), k...))
+		return true
+	})
+	if extra := len(keys) + len(decisions) - maxDecisions; extra > 0 {
+		cmd.Deletes = keys[:extra]
+	}
+	if _, err := s.applyIn(s.raft, cmd); err != nil {
+		return
+	}
+	for _, d := range decisions {
+		s.pd.schedule(leaders[d.Operator.Range], d.Operator)
+	}
+}
+
+// cluster is the view of the nodes plan decides on, the counts are
+// updated by every decision
+type cluster struct {
+	nodes    map[string]*NodeInfo
+	replicas map[string]int
+	leaders  map[string]int
+}
+
+// up reports whether the node id may hold replicas, a node unknown to the
+// placement driver is not judged
+func (c *cluster) up(id string) bool {
+	n, ok := c.nodes[id]
+	return !ok || n.Up
+}
+
+func (c *cluster) label(id, name string) string {
+	if n, ok := c.nodes[id]; ok {
+		return n.Labels[name]
+	}
+	return ""
+}
+
+// spread return how many zones and racks the peers are spread over
+func (c *cluster) spread(peers []string) (zones, racks int) {
+	zs := make(map[string]bool)
+	rs := make(map[string]bool)
+	for _, id := range peers {
+		zone := c.label(id, zoneLabel)
+		zs[zone] = true
+		rs[zone+"/"+c.label(id, rackLabel)] = true
+	}
+	return len(zs), len(rs)
+}
+
+// better reports whether the peers a are spread over more zones, or as
+// many zones and more racks, than b
+func (c *cluster) better(a, b []string) bool {
+	az, ar := c.spread(a)
+	bz, br := c.spread(b)
+	return az > bz || (az == bz && ar > br)
+}
+
+// usage is the share of its capacity a node holds
+func (c *cluster) usage(id string) float64 {
+	n, ok := c.nodes[id]
+	if !ok || n.Capacity == 0 {
+		return 0
+	}
+	return float64(n.Used) / float64(n.Capacity)
+}
+
+// target return the best node to replicate a range held by peers, from
+// left out: the up node with room which spreads the replicas over the
+// most zones then racks, then holding the fewest replicas, then the least
+// used. It return "" without a candidate.
+func (c *cluster) target(peers []string, from string) string {
+	rest := without(peers, from)
+	var ids []string
+	for id, n := range c.nodes {
+		if n.Up && !contains(peers, id) && (n.Capacity == 0 || n.Used < n.Capacity) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	best := ""
+	for _, id := range ids {
+		if best == "" {
+			best = id
+			continue
+		}
+		a, b := with(rest, id), with(rest, best)
+		switch {
+		case c.better(a, b):
+			best = id
+		case c.better(b, a):
+		case c.replicas[id] < c.replicas[best]:
+			best = id
+		case c.replicas[id] == c.replicas[best] && c.usage(id) < c.usage(best):
+			best = id
+		}
+	}
+	return best
+}
+
+// worst return the peer of a range to remove: a down one, else the one
+// whose removal keeps the replicas spread the most, then holding the most
+// replicas. The leader is only removed last.
+func (c *cluster) worst(peers []string, leader string) string {
+	for _, id := range peers {
+		if !c.up(id) {
+			return id
+		}
+	}
+	worst := ""
+	for _, id := range peers {
+		if id == leader {
+			continue
+		}
+		if worst == "" {
+			worst = id
+			continue
+		}
+		a, b := without(peers, id), without(peers, worst)
+		if c.better(a, b) || (!c.better(b, a) && c.replicas[id] > c.replicas[worst]) {
+			worst = id
+		}
+	}
+	if worst == "" {
+		return leader
+	}
+	return worst
+}
+
+func (c *cluster) move(d *RangeDesc, from, to string) {
+	c.replicas[from]--
+	c.replicas[to]++
+	d.Peers = with(without(d.Peers, from), to)
+}
+
+// plan decide an operator for every range but the range 0 which is not
+// frozen, whose leader is known and which has no operator in flight. In
+// order, a range: moves its replicas off the down nodes, gets to replicas
+// replicas, spreads them over more zones and racks, moves a replica from a
+// node holding more than one replica above the least loaded one, and
+// hands its leadership to a peer leading at least two ranges fewer.
+func plan(nodes []NodeInfo, descs []*RangeDesc, replicas int, busy map[uint64]bool) []Decision {
+	c := &cluster{
+		nodes:    make(map[string]*NodeInfo),
+		replicas: make(map[string]int),
+		leaders:  make(map[string]int),
+	}
+	leaderOf := make(map[uint64]string)
+	for i := range nodes {
+		n := &nodes[i]
+		c.nodes[n.ID] = n
+		c.leaders[n.ID] = len(n.Leaders)
+		for _, id := range n.Leaders {
+			leaderOf[id] = n.ID
+		}
+	}
+	var ranges []*RangeDesc
+	for _, d := range descs {
+		if d.ID == 0 {
+			continue
+		}
+		d := &RangeDesc{ID: d.ID, Start: d.Start, End: d.End, Peers: append([]string(nil), d.Peers...), Frozen: d.Frozen}
+		for _, id := range d.Peers {
+			c.replicas[id]++
+		}
+		ranges = append(ranges, d)
+	}
+
+	var decisions []Decision
+	decide := func(op Operator, reason string, args ...interface{}) {
+		decisions = append(decisions, Decision{Operator: op, Reason: fmt.Sprintf(reason, args...)})
+	}
+	for _, d := range ranges {
+		leader := leaderOf[d.ID]
+		if d.Frozen || busy[d.ID] || leader == "" {
+			continue
+		}
+		var down string
+		for _, id := range d.Peers {
+			if !c.up(id) {
+				down = id
+				break
+			}
+		}
+		from := c.worst(d.Peers, leader)
+		switch {
+		case down != "" && len(d.Peers) > replicas:
+			c.replicas[down]--
+			d.Peers = without(d.Peers, down)
+			decide(Operator{Range: d.ID, Kind: OpRemoveReplica, From: down}, "node %s is down", down)
+			continue
+
+		case down != "":
+			if to := c.target(d.Peers, down); to != "" {
+				c.move(d, down, to)
+				decide(Operator{Range: d.ID, Kind: OpMoveReplica, From: down, To: to}, "node %s is down", down)
+				continue
+			}
+
+		case len(d.Peers) < replicas:
+			if to := c.target(d.Peers, ""); to != "" {
+				c.replicas[to]++
+				d.Peers = append(d.Peers, to)
+				decide(Operator{Range: d.ID, Kind: OpAddReplica, To: to}, "range has %d of %d replicas", len(d.Peers)-1, replicas)
+				continue
+			}
+
+		case len(d.Peers) > replicas:
+			c.replicas[from]--
+			d.Peers = without(d.Peers, from)
+			decide(Operator{Range: d.ID, Kind: OpRemoveReplica, From: from}, "range has %d of %d replicas", len(d.Peers)+1, replicas)
+			continue
+
+		default:
+			if to := c.target(d.Peers, from); to != "" {
+				after := with(without(d.Peers, from), to)
+				if c.better(after, d.Peers) {
+					c.move(d, from, to)
+					decide(Operator{Range: d.ID, Kind: OpMoveReplica, From: from, To: to}, "spread the replicas over more zones or racks")
+					continue
+				}
+				if !c.better(d.Peers, after) && c.replicas[from]-c.replicas[to] > 1 {
+					decide(Operator{Range: d.ID, Kind: OpMoveReplica, From: from, To: to}, "node %s holds %d replicas, node %s %d", from, c.replicas[from], to, c.replicas[to])
+					c.move(d, from, to)
+					continue
+				}
+			}
+		}
+
+		to := ""
+		for _, id := range d.Peers {
+			if id != leader && c.up(id) && (to == "" || c.leaders[id] < c.leaders[to]) {
+				to = id
+			}
+		}
+		if to != "" && c.leaders[leader]-c.leaders[to] > 1 {
+			decide(Operator{Range: d.ID, Kind: OpTransferLeader, From: leader, To: to}, "node %s leads %d ranges, node %s %d", leader, c.leaders[leader], to, c.leaders[to])
+			c.leaders[leader]--
+			c.leaders[to]++
+		}
+	}
+	return decisions
+}
+
+// without return list without s
+func without(list []string, s string) []string {
+	res := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// with return a copy of list with s appended
+func with(list []string, s string) []string {
+	return append(append(make([]string, 0, len(list)+1), list...), s)
+}
+
+// runOperator run op on the range it changes, this node must lead it
+func (s *Server) runOperator(op Operator) error {
+	defer s.pd.finish(op.Range)
+	r := s.replica(op.Range)
+	if r == nil {
+		return ErrRangeNotFound
+	}
+	if r.raft.State() != praft.Leader {
+		return praft.ErrNotLeader
+	}
+	switch op.Kind {
+	case OpTransferLeader:
+		return r.raft.LeadershipTransferToServer(praft.ServerID(op.To), praft.ServerAddress(op.To)).Error()
+	case OpAddReplica:
+		return s.addReplica(r, op.To)
+	case OpRemoveReplica:
+		return s.removeReplica(r, op.From)
+	case OpMoveReplica:
+		if err := s.addReplica(r, op.To); err != nil {
+			return err
+		}
+		return s.removeReplica(r, op.From)
+	}
+	return fmt.Errorf("unknown operator %q", op.Kind)
+}
+
+// addReplica add the node id to the range of r: it joins as a nonvoter,
+// it is added to the peers and the placement driver told at once so that
+// it starts the raft group, and it is promoted once caught up. A replica
+// not caught up within operatorTimeout is removed, the error is then
+// ErrCatchingUp.
+func (s *Server) addReplica(r *replica, id string) error {
+	d := s.ranges.desc(r.id)
+	if d == nil {
+		return ErrRangeNotFound
+	}
+	if contains(d.Peers, id) {
+		return nil
+	}
+	pid, err := peer.IDB58Decode(id)
+	if err != nil {
+		return err
+	}
+	old := append([]string(nil), d.Peers...)
+	if err := r.raft.AddNonvoter(praft.ServerID(id), praft.ServerAddress(id), 0, applyTimeout).Error(); err != nil {
+		return err
+	}
+	if _, err := s.applyIn(r.raft, &command{Type: cmdPeers, Peers: append(old, id)}); err != nil {
+		r.raft.RemoveServer(praft.ServerID(id), 0, applyTimeout)
+		return err
+	}
+	s.sendHeartbeat()
+
+	ticker := time.NewTicker(seedInterval)
+	defer ticker.Stop()
+	timeout := time.After(operatorTimeout)
+	for {
+		select {
+		case <-s.closing:
+			return ErrCatchingUp
+		case <-timeout:
+			s.applyIn(r.raft, &command{Type: cmdPeers, Peers: old})
+			r.raft.RemoveServer(praft.ServerID(id), 0, applyTimeout)
+			return ErrCatchingUp
+		case <-ticker.C:
+		}
+		applied, err := s.store.GroupAppliedIndex(r.id)
+		if err != nil {
+			continue
+		}
+		st, err := s.PeerStatus(context.Background(), pid)
+		if err != nil || st.Ranges[r.id] == 0 || st.Ranges[r.id]+s.cfg.PromoteLag < applied {
+			continue
+		}
+		return r.raft.AddVoter(praft.ServerID(id), praft.ServerAddress(id), 0, applyTimeout).Error()
+	}
+}
+
+// removeReplica remove the node id from the range of r. The leader does
+// not remove itself, it hands its leadership over and the new leader is
+// given the operator again.
+func (s *Server) removeReplica(r *replica, id string) error {
+	d := s.ranges.desc(r.id)
+	if d == nil {
+		return ErrRangeNotFound
+	}
+	if !contains(d.Peers, id) {
+		return nil
+	}
+	if id == s.host.ID().Pretty() {
+		return r.raft.LeadershipTransfer().Error()
+	}
+	if _, err := s.applyIn(r.raft, &command{Type: cmdPeers, Peers: without(d.Peers, id)}); err != nil {
+		return err
+	}
+	return r.raft.RemoveServer(praft.ServerID(id), 0, applyTimeout).Error()
+}
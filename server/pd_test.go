@@ -0,0 +1,97 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"testing"
+)
+
+func testNodes(zones ...string) []NodeInfo {
+	nodes := make([]NodeInfo, len(zones))
+	for i, zone := range zones {
+		nodes[i] = NodeInfo{ID: string(rune('a' + i)), Labels: map[string]string{zoneLabel: zone}, Up: true}
+	}
+	return nodes
+}
+
+func TestPlanReplicas(t *testing.T) {
+	nodes := testNodes("z1", "z1", "z2", "z3")
+	nodes[0].Leaders = []uint64{1, 2}
+
+	// range 1 lacks a replica, the one in z3 is picked over the one in z1
+	// which already holds one
+	descs := []*RangeDesc{{ID: 0}, {ID: 1, Peers: []string{"a", "c"}}}
+	ds := plan(nodes, descs, 3, nil)
+	if len(ds) != 1 || ds[0].Operator != (Operator{Range: 1, Kind: OpAddReplica, To: "d"}) {
+		t.Fatal("plan excepted to add a replica on d but got ", ds)
+	}
+
+	// range 2 has one replica too many, the one sharing a zone goes
+	descs = []*RangeDesc{{ID: 2, Peers: []string{"a", "b", "c", "d"}}}
+	ds = plan(nodes, descs, 3, nil)
+	if len(ds) != 1 || ds[0].Operator != (Operator{Range: 2, Kind: OpRemoveReplica, From: "b"}) {
+		t.Fatal("plan excepted to remove the replica on b but got ", ds)
+	}
+
+	// a range with an operator in flight is left alone
+	if ds := plan(nodes, descs, 3, map[uint64]bool{2: true}); len(ds) != 0 {
+		t.Fatal("plan excepted no decision for a busy range but got ", ds)
+	}
+}
+
+func TestPlanDownNode(t *testing.T) {
+	nodes := testNodes("z1", "z2", "z3", "z3")
+	nodes[0].Leaders = []uint64{1}
+	nodes[2].Up = false
+	descs := []*RangeDesc{{ID: 1, Peers: []string{"a", "b", "c"}}}
+	ds := plan(nodes, descs, 3, nil)
+	if len(ds) != 1 || ds[0].Operator != (Operator{Range: 1, Kind: OpMoveReplica, From: "c", To: "d"}) {
+		t.Fatal("plan excepted to move the replica of c to d but got ", ds)
+	}
+	if ds := plan(nodes[:3], descs, 3, nil); len(ds) != 0 {
+		t.Fatal("plan excepted no decision without a node to move to but got ", ds)
+	}
+}
+
+func TestPlanSpread(t *testing.T) {
+	nodes := testNodes("z1", "z1", "z2")
+	nodes[0].Leaders = []uint64{1}
+	descs := []*RangeDesc{{ID: 1, Peers: []string{"a", "b"}}}
+	ds := plan(nodes, descs, 2, nil)
+	if len(ds) != 1 || ds[0].Operator != (Operator{Range: 1, Kind: OpMoveReplica, From: "b", To: "c"}) {
+		t.Fatal("plan excepted to move the replica of b to another zone but got ", ds)
+	}
+}
+
+func TestPlanLeaders(t *testing.T) {
+	nodes := testNodes("z1", "z2", "z3")
+	nodes[0].Leaders = []uint64{1, 2, 3}
+	var descs []*RangeDesc
+	for id := uint64(1); id <= 3; id++ {
+		descs = append(descs, &RangeDesc{ID: id, Peers: []string{"a", "b", "c"}})
+	}
+	ds := plan(nodes, descs, 3, nil)
+	if len(ds) != 2 || ds[0].Operator.Kind != OpTransferLeader || ds[1].Operator.Kind != OpTransferLeader ||
+		ds[0].Operator.To == ds[1].Operator.To {
+		t.Fatal("plan excepted to hand two leaderships over to b and c but got ", ds)
+	}
+}
+
+func TestCovers(t *testing.T) {
+	all := &RangeDesc{ID: 1, Start: []byte("g")}
+	part := &RangeDesc{ID: 2, Start: []byte("m"), End: []byte("t")}
+	if !covers(all, part) || covers(part, all) || !covers(part, part) {
+		t.Fatal("covers excepted a range to cover the ranges inside it only")
+	}
+}
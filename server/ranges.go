@@ -0,0 +1,735 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// rangePrefix holds the RangeDesc of every range by id, written by the
+	// raft group of the range
+	rangePrefix = "\x00range/"
+
+	// splitPrefix holds the first RangeDesc of a range under the id of the
+	// range it was split from and its own, written by the parent group
+	splitPrefix = "\x00split/"
+
+	// mergedPrefix holds under the id of a range the ids of the ranges it
+	// merged, written by its raft group. The value is unused.
+	mergedPrefix = "\x00merged/"
+
+	// seedInterval is how often a range made by a split checks whether its
+	// first entry is applied
+	seedInterval = 100 * time.Millisecond
+
+	// mergeTimeout bounds the wait for the replicas of a frozen range to
+	// apply the freeze
+	mergeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrCrossRange is returned when the keys of a write belong to several
+	// ranges
+	ErrCrossRange = errors.New("keys belong to several ranges")
+	// ErrRangeNotFound is returned when the range of a key is not
+	// replicated on this node
+	ErrRangeNotFound = errors.New("range is not replicated on this node")
+	// ErrBackupIncomplete is returned by Backup on a node which does not
+	// replicate every range
+	ErrBackupIncomplete = errors.New("backup needs a node replicating every range")
+	// ErrWrongRange is returned when a command reaches a range which no
+	// longer holds its keys, the range was split after it was routed
+	ErrWrongRange = errors.New("key is outside of the range")
+	// ErrInvalidSplit is returned for a split key which is not strictly
+	// inside its range
+	ErrInvalidSplit = errors.New("split key must be inside the range, after its start")
+	// ErrRangeExists is returned when the id of a new range is taken
+	ErrRangeExists = errors.New("range already exists")
+	// ErrInvalidMerge is returned when a range cannot be merged into the
+	// range before it: it is the first range, they do not have the same
+	// peers, or they are not replicated on this node
+	ErrInvalidMerge = errors.New("range cannot be merged into the range before it")
+	// ErrRangeMerging is returned for a command reaching a range frozen
+	// ahead of its merge
+	ErrRangeMerging = errors.New("range is being merged")
+	// ErrMergeAborted is returned when a replica of a frozen range did not
+	// catch up in time, the range is thawed
+	ErrMergeAborted = errors.New("merge aborted, a replica did not catch up")
+)
+
+// RangeDesc is a range of the keyspace, the keys from Start to End
+// excluded, replicated by the raft group ID among Peers. An empty End is
+// the end of the keyspace. The range 0 is the first raft group of the
+// cluster, it also holds the system keys.
+type RangeDesc struct {
+	ID    uint64   `json:"id"`
+	Start []byte   `json:"start"`
+	End   []byte   `json:"end"`
+	Peers []string `json:"peers"`
+	// Frozen is set on a range about to be merged into the range before
+	// it, it takes no writes
+	Frozen bool `json:"frozen,omitempty"`
+}
+
+// Contains reports whether key belongs to the range
+func (d *RangeDesc) Contains(key []byte) bool {
+	return bytes.Compare(key, d.Start) >= 0 && (len(d.End) == 0 || bytes.Compare(key, d.End) < 0)
+}
+
+// RangeStatus is a range and the leader of its raft group, the leader is
+// only known on the nodes replicating the range
+type RangeStatus struct {
+	RangeDesc
+	Leader string `json:"leader"`
+	// Local is set when this node replicates the range
+	Local bool `json:"local"`
+}
+
+// rangeTable route the keys to their range, it is the RangeDesc of the
+// store ordered by Start
+type rangeTable struct {
+	mu    sync.RWMutex
+	descs []*RangeDesc
+}
+
+// replica is a raft group replicating a range on this node
+type replica struct {
+	id        uint64
+	raft      *praft.Raft
+	transport *praft.NetworkTransport
+	log       praft.LogStore
+}
+
+func (r *replica) stop() {
+	r.raft.Shutdown().Error()
+	r.transport.Close()
+}
+
+// dropReplica stop r, a replica which left the node, and delete its raft
+// state
+func (s *Server) dropReplica(r *replica) {
+	r.stop()
+	s.dropGroup(r.id)
+}
+
+func rangeKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x", rangePrefix, id))
+}
+
+func splitKey(parent, id uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%016x", splitPrefix, parent, id))
+}
+
+func mergedKey(left, id uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x/%016x", mergedPrefix, left, id))
+}
+
+// recordIDs parse the ids of a split or merged key k stripped of its
+// prefix, owner is the range which wrote it
+func recordIDs(k []byte) (owner, id uint64, ok bool) {
+	if len(k) != 33 || k[16] != '/' {
+		return 0, 0, false
+	}
+	owner, err := strconv.ParseUint(string(k[:16]), 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	id, err = strconv.ParseUint(string(k[17:]), 16, 64)
+	return owner, id, err == nil
+}
+
+// readRanges return the ranges of store ordered by Start, the range 0
+// holds the whole keyspace until it is split. The merged ranges are left
+// out.
+func readRanges(store *storage.KvStore) ([]*RangeDesc, error) {
+	byID := make(map[uint64]*RangeDesc)
+	var decErr error
+	read := func(k, v []byte) bool {
+		d := &RangeDesc{}
+		if decErr = gob.NewDecoder(bytes.NewReader(v)).Decode(d); decErr != nil {
+			return false
+		}
+		byID[d.ID] = d
+		return true
+	}
+	// a range made by a split has no descriptor of its own until it
+	// changes, the first one is read then overridden by the one the
+	// placement driver knows and last by the one of the range
+	for _, prefix := range []string{splitPrefix, pdRangePrefix, rangePrefix} {
+		if err := store.Iterate([]byte(prefix), read); err != nil {
+			return nil, err
+		}
+		if decErr != nil {
+			return nil, decErr
+		}
+	}
+	err := store.Iterate([]byte(mergedPrefix), func(k, v []byte) bool {
+		if _, id, ok := recordIDs(k[len(mergedPrefix):]); ok {
+			delete(byID, id)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := byID[0]; !ok {
+		byID[0] = &RangeDesc{}
+	}
+
+	descs := make([]*RangeDesc, 0, len(byID))
+	for _, d := range byID {
+		descs = append(descs, d)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return bytes.Compare(descs[i].Start, descs[j].Start) < 0
+	})
+	return descs, nil
+}
+
+// findRange return the range id of store, nil when there is none
+func findRange(store *storage.KvStore, id uint64) (*RangeDesc, error) {
+	descs, err := readRanges(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range descs {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+func (t *rangeTable) reset(descs []*RangeDesc) {
+	t.mu.Lock()
+	t.descs = descs
+	t.mu.Unlock()
+}
+
+// lookup return the range holding key, the system keys belong to the
+// range 0. A nil table holds the range 0 only.
+func (t *rangeTable) lookup(key []byte) *RangeDesc {
+	if t == nil {
+		return &RangeDesc{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !storage.IsSystemKey(key) {
+		i := sort.Search(len(t.descs), func(i int) bool {
+			return bytes.Compare(t.descs[i].Start, key) > 0
+		})
+		for i--; i >= 0; i-- {
+			if t.descs[i].Contains(key) {
+				return t.descs[i]
+			}
+		}
+	}
+	return t.get(0)
+}
+
+// get return the range id, the range 0 holds the whole keyspace until it
+// is split. The caller holds mu.
+func (t *rangeTable) get(id uint64) *RangeDesc {
+	for _, d := range t.descs {
+		if d.ID == id {
+			return d
+		}
+	}
+	return &RangeDesc{ID: id}
+}
+
+// desc return a copy of the range id, nil when the table does not hold
+// it. The range 0 holds the whole keyspace until it is split.
+func (t *rangeTable) desc(id uint64) *RangeDesc {
+	if t == nil {
+		if id == 0 {
+			return &RangeDesc{}
+		}
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, d := range t.descs {
+		if d.ID == id {
+			c := *d
+			c.Peers = append([]string(nil), d.Peers...)
+			return &c
+		}
+	}
+	if id == 0 {
+		return &RangeDesc{}
+	}
+	return nil
+}
+
+// before return the range id and the range before it, nil when id is the
+// first range or is not found
+func (t *rangeTable) before(id uint64) (left, d *RangeDesc) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for i := 1; i < len(t.descs); i++ {
+		if t.descs[i].ID == id {
+			return t.descs[i-1], t.descs[i]
+		}
+	}
+	return nil, nil
+}
+
+func (t *rangeTable) all() []*RangeDesc {
+	if t == nil {
+		return []*RangeDesc{{}}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]*RangeDesc(nil), t.descs...)
+}
+
+// Ranges return the ranges of the keyspace ordered by start key
+func (s *Server) Ranges() []RangeStatus {
+	var ranges []RangeStatus
+	for _, d := range s.ranges.all() {
+		st := RangeStatus{RangeDesc: *d}
+		if r := s.replica(d.ID); r != nil {
+			st.Leader = string(r.raft.Leader())
+			st.Local = true
+		}
+		ranges = append(ranges, st)
+	}
+	return ranges
+}
+
+// Split the range holding key at key: the keys from key on move to a new
+// range, replicated by a raft group of its own among the voters of the
+// range. It must be called on the leader of the range, the new range is
+// returned.
+func (s *Server) Split(key []byte) (*RangeDesc, error) {
+	if err := checkKeys(key); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrInvalidSplit
+	}
+	r := s.replica(s.ranges.lookup(key).ID)
+	if r == nil {
+		return nil, ErrRangeNotFound
+	}
+	peers, err := voterIDs(r.raft)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newRangeID()
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.applyIn(r.raft, &command{Type: cmdSplit, Key: key, Range: id, Peers: peers})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*RangeDesc), nil
+}
+
+// Merge the range id into the range before it, they must have the same
+// peers. The range is frozen, then once every replica applied the freeze
+// the range before it takes over its keys and its raft group is stopped.
+// It must be called on the leader of both ranges, the merged range is
+// returned.
+func (s *Server) Merge(id uint64) (*RangeDesc, error) {
+	left, d := s.ranges.before(id)
+	if d == nil {
+		return nil, ErrInvalidMerge
+	}
+	return s.merge(left, d)
+}
+
+func (s *Server) merge(left, right *RangeDesc) (*RangeDesc, error) {
+	l, r := s.replica(left.ID), s.replica(right.ID)
+	if l == nil || r == nil || !s.samePeers(left, right) || !bytes.Equal(left.End, right.Start) {
+		return nil, ErrInvalidMerge
+	}
+	if l.raft.State() != praft.Leader || r.raft.State() != praft.Leader {
+		return nil, praft.ErrNotLeader
+	}
+	// a range found frozen is the leftover of an interrupted merge, a range
+	// is only frozen once every peer answers
+	if !right.Frozen {
+		if err := s.waitApplied(right, 0); err != nil {
+			return nil, err
+		}
+		if _, err := s.applyIn(r.raft, &command{Type: cmdFreeze}); err != nil {
+			return nil, err
+		}
+	} else if err := r.raft.Barrier(applyTimeout).Error(); err != nil {
+		return nil, err
+	}
+	index, err := s.store.GroupAppliedIndex(right.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.waitApplied(right, index); err != nil {
+		s.applyIn(r.raft, &command{Type: cmdThaw})
+		return nil, err
+	}
+	res, err := s.applyIn(l.raft, &command{Type: cmdMerge, Range: right.ID})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*RangeDesc), nil
+}
+
+// waitApplied wait until every peer of d applied the entry index of its
+// raft group, it return ErrMergeAborted after mergeTimeout
+func (s *Server) waitApplied(d *RangeDesc, index uint64) error {
+	ticker := time.NewTicker(seedInterval)
+	defer ticker.Stop()
+	timeout := time.After(mergeTimeout)
+
+	for {
+		caughtUp := true
+		for _, id := range d.Peers {
+			pid, err := peer.IDB58Decode(id)
+			if err != nil {
+				return err
+			}
+			st, err := s.PeerStatus(context.Background(), pid)
+			if err != nil || st.Ranges[d.ID] < index {
+				caughtUp = false
+				break
+			}
+		}
+		if caughtUp {
+			return nil
+		}
+		select {
+		case <-s.closing:
+			return ErrMergeAborted
+		case <-timeout:
+			return ErrMergeAborted
+		case <-ticker.C:
+		}
+	}
+}
+
+// samePeers reports whether the ranges a and b have the same peers, those
+// of the range 0 are the voters of its raft group
+func (s *Server) samePeers(a, b *RangeDesc) bool {
+	peers := func(d *RangeDesc) []string {
+		if d.ID != 0 {
+			return d.Peers
+		}
+		ids, _ := voterIDs(s.raft)
+		return ids
+	}
+	pa, pb := peers(a), peers(b)
+	if len(pa) != len(pb) {
+		return false
+	}
+	for _, id := range pa {
+		if !contains(pb, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// voterIDs return the ids of the voters of r
+func voterIDs(r *praft.Raft) ([]string, error) {
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, srv := range future.Configuration().Servers {
+		if srv.Suffrage == praft.Voter {
+			ids = append(ids, string(srv.ID))
+		}
+	}
+	return ids, nil
+}
+
+// newRangeID return a random range id, kept below 2^53 so that json
+// clients read it exactly
+func newRangeID() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	if id := binary.BigEndian.Uint64(b[:]) >> 11; id != 0 {
+		return id, nil
+	}
+	return newRangeID()
+}
+
+// route return the raft group of the range holding the keys of cmd
+func (s *Server) route(cmd *command) (*praft.Raft, error) {
+	if s.ranges == nil {
+		return s.raft, nil
+	}
+	id := uint64(0)
+	for i, k := range cmd.keys() {
+		d := s.ranges.lookup(k)
+		if i > 0 && d.ID != id {
+			return nil, ErrCrossRange
+		}
+		id = d.ID
+	}
+	s.load.add(id)
+	r := s.replica(id)
+	if r == nil {
+		return nil, ErrRangeNotFound
+	}
+	return r.raft, nil
+}
+
+// local return ErrRangeNotFound unless the ranges of keys are replicated
+// on this node
+func (s *Server) local(keys ...[]byte) error {
+	if s.ranges == nil {
+		return nil
+	}
+	for _, k := range keys {
+		id := s.ranges.lookup(k).ID
+		if s.replica(id) == nil {
+			return ErrRangeNotFound
+		}
+		s.load.add(id)
+	}
+	return nil
+}
+
+func (s *Server) replica(id uint64) *replica {
+	s.rangesMu.Lock()
+	defer s.rangesMu.Unlock()
+	return s.replicas[id]
+}
+
+// reloadRanges read the ranges from the store, start the raft groups of
+// the new ranges replicated by this node and stop those of the ranges
+// merged or moved away
+func (s *Server) reloadRanges() error {
+	descs, err := readRanges(s.store)
+	if err != nil {
+		return err
+	}
+	s.ranges.reset(descs)
+	self := s.host.ID().Pretty()
+	live := make(map[uint64]bool)
+	for _, d := range descs {
+		live[d.ID] = contains(d.Peers, self)
+		if err := s.startRange(d, false); err != nil {
+			return err
+		}
+	}
+
+	s.rangesMu.Lock()
+	for id, r := range s.replicas {
+		if id != 0 && !live[id] {
+			delete(s.replicas, id)
+			go s.dropReplica(r)
+		}
+	}
+	s.rangesMu.Unlock()
+	return nil
+}
+
+// refreshRanges read the ranges from the store again
+func (s *Server) refreshRanges() {
+	if descs, err := readRanges(s.store); err == nil {
+		s.ranges.reset(descs)
+	}
+}
+
+// onSplit is called by the fsm of parent once it split child off
+func (s *Server) onSplit(parent, child *RangeDesc) {
+	s.refreshRanges()
+	s.startRange(child, true)
+}
+
+// onChanged is called by the fsm of a range once its descriptor changed,
+// a replica removed from the peers stops and drops the keys of the range
+func (s *Server) onChanged(d *RangeDesc) {
+	s.refreshRanges()
+	if d.ID == 0 || contains(d.Peers, s.host.ID().Pretty()) {
+		return
+	}
+	s.rangesMu.Lock()
+	r := s.replicas[d.ID]
+	delete(s.replicas, d.ID)
+	s.rangesMu.Unlock()
+	if r == nil {
+		return
+	}
+	go func() {
+		s.dropReplica(r)
+		// the split and merged records stay, other ranges are read from them
+		s.store.ClearFunc(func(k []byte) bool {
+			return owns(d, k) && !bytes.HasPrefix(k, []byte(splitPrefix)) && !bytes.HasPrefix(k, []byte(mergedPrefix))
+		})
+	}()
+}
+
+// onMerge is called by the fsm of left once it took right over, the raft
+// group of right is stopped
+func (s *Server) onMerge(left, right *RangeDesc) {
+	s.refreshRanges()
+	s.rangesMu.Lock()
+	r := s.replicas[right.ID]
+	delete(s.replicas, right.ID)
+	s.rangesMu.Unlock()
+	if r != nil {
+		go s.dropReplica(r)
+	}
+}
+
+// onRestore is called once a raft group restored a snapshot
+func (s *Server) onRestore() {
+	s.auth.reset()
+	s.reloadRanges()
+}
+
+// startRange start the raft group of d if this node is one of its peers.
+// A range just split off on this node is seeded: its first entry is
+// snapshotted away once applied. The others are joined, their peers are
+// sent by the leader.
+func (s *Server) startRange(d *RangeDesc, seed bool) error {
+	if d.ID == 0 || !contains(d.Peers, s.host.ID().Pretty()) {
+		return nil
+	}
+	s.rangesMu.Lock()
+	defer s.rangesMu.Unlock()
+	if _, ok := s.replicas[d.ID]; ok || s.replicas == nil {
+		return nil
+	}
+
+	var pids []peer.ID
+	if seed {
+		for _, id := range d.Peers {
+			pid, err := peer.IDB58Decode(id)
+			if err != nil {
+				return err
+			}
+			pids = append(pids, pid)
+		}
+	}
+	applied, err := s.store.GroupAppliedIndex(d.ID)
+	if err != nil {
+		return err
+	}
+	f := &fsm{
+		store:    s.store,
+		group:    d.ID,
+		desc:     d,
+		notify:   s.onApply,
+		split:    s.onSplit,
+		merged:   s.onMerge,
+		changed:  s.onChanged,
+		restored: s.onRestore,
+		clock:    s.clock,
+		fresh:    !seed && applied == 0,
+	}
+	stores, err := s.groupStores(d.ID)
+	if err != nil {
+		return err
+	}
+	raftNode, transport, err := raft.NewGroupNodeWithStores(s.host, d.ID, pids, f, stores, s.cfg.RaftQuiet)
+	if err != nil {
+		return err
+	}
+	r := &replica{id: d.ID, raft: raftNode, transport: transport, log: stores.Log}
+	s.replicas[d.ID] = r
+	if seed {
+		go s.seed(r)
+	}
+	return nil
+}
+
+// seed compact the log of a range made by a split once its first entry is
+// applied: the log does not hold the data the range started with, so a
+// replica which missed the split must catch up from a snapshot. The
+// trailing entries raft keeps after a snapshot are dropped for that.
+func (s *Server) seed(r *replica) {
+	ticker := time.NewTicker(seedInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		if applied, err := s.store.GroupAppliedIndex(r.id); err == nil && applied > 0 {
+			if r.raft.Snapshot().Error() == nil {
+				if first, err := r.log.FirstIndex(); err == nil && first > 0 {
+					r.log.DeleteRange(first, applied)
+				}
+			}
+			return
+		}
+		if r.raft.State() == praft.Leader {
+			s.applyIn(r.raft, &command{Type: cmdWrite})
+		}
+	}
+}
+
+// transferLeaders hand the leadership of the ranges led by this node over
+// to another voter, the range 0 excepted
+func (s *Server) transferLeaders() error {
+	s.rangesMu.Lock()
+	var rs []*replica
+	for id, r := range s.replicas {
+		if id != 0 && r.raft.State() == praft.Leader {
+			rs = append(rs, r)
+		}
+	}
+	s.rangesMu.Unlock()
+
+	for _, r := range rs {
+		if n, err := voters(r.raft); err != nil || n < 2 {
+			continue
+		}
+		if err := r.raft.LeadershipTransfer().Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopRanges shut the raft groups of the ranges down, the range 0 excepted
+func (s *Server) stopRanges() {
+	s.rangesMu.Lock()
+	replicas := s.replicas
+	s.replicas = nil
+	s.rangesMu.Unlock()
+
+	for id, r := range replicas {
+		if id != 0 {
+			r.stop()
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"testing"
+
+	praft "github.com/hashicorp/raft"
+)
+
+func TestRangeTableLookup(t *testing.T) {
+	table := &rangeTable{}
+	table.reset([]*RangeDesc{
+		{ID: 0, End: []byte("g")},
+		{ID: 5, Start: []byte("g"), End: []byte("p")},
+		{ID: 9, Start: []byte("p")},
+	})
+	cases := map[string]uint64{
+		"":             0,
+		"a":            0,
+		"g":            5,
+		"ozz":          5,
+		"p":            9,
+		"zzz":          9,
+		"\x00auth/foo": 0,
+	}
+	for key, id := range cases {
+		if d := table.lookup([]byte(key)); d.ID != id {
+			t.Fatal("lookup ", key, " excepted range ", id, " but got ", d.ID)
+		}
+	}
+
+	var empty *rangeTable
+	if d := empty.lookup([]byte("a")); d.ID != 0 {
+		t.Fatal("lookup on a nil table excepted range 0 but got ", d.ID)
+	}
+}
+
+func TestRangeTableDesc(t *testing.T) {
+	table := &rangeTable{}
+	table.reset([]*RangeDesc{{ID: 5, Start: []byte("g"), Peers: []string{"a"}}})
+	d := table.desc(5)
+	if d == nil || string(d.Start) != "g" {
+		t.Fatal("desc excepted range 5 but got ", d)
+	}
+	d.Peers[0] = "b"
+	if table.desc(5).Peers[0] != "a" {
+		t.Fatal("desc excepted a copy of the range")
+	}
+	if d := table.desc(7); d != nil {
+		t.Fatal("desc of a missing range excepted nil but got ", d)
+	}
+	if d := table.desc(0); d == nil || d.ID != 0 {
+		t.Fatal("desc excepted range 0 but got ", d)
+	}
+}
+
+func TestOwns(t *testing.T) {
+	first := &RangeDesc{ID: 0, End: []byte("m")}
+	second := &RangeDesc{ID: 3, Start: []byte("m")}
+	cases := []struct {
+		key    []byte
+		first  bool
+		second bool
+	}{
+		{[]byte("a"), true, false},
+		{[]byte("m"), false, true},
+		{ttlKey([]byte("a")), true, false},
+		{ttlKey([]byte("x")), false, true},
+		{[]byte(authPrefix + "users/root"), true, false},
+		{rangeKey(0), true, false},
+		{rangeKey(3), false, true},
+		{splitKey(0, 3), true, false},
+		{splitKey(3, 7), false, true},
+		{mergedKey(0, 5), true, false},
+		{mergedKey(3, 5), false, true},
+	}
+	for _, c := range cases {
+		if owns(first, c.key) != c.first || owns(second, c.key) != c.second {
+			t.Fatal("owns ", string(c.key), " excepted ", c.first, c.second)
+		}
+	}
+	if !owns(nil, []byte("anything")) {
+		t.Fatal("a nil range excepted to own every key")
+	}
+}
+
+func TestFSMSplit(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	f.desc = &RangeDesc{Peers: []string{"a", "b"}}
+	var split *RangeDesc
+	f.split = func(parent, child *RangeDesc) { split = child }
+
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{[]byte("x"), []byte("1")}}})
+	child := applyCmd(t, f, 2, &command{Type: cmdSplit, Key: []byte("m"), Range: 3, Peers: []string{"a"}}).(*RangeDesc)
+	if split != child || child.ID != 3 || string(child.Start) != "m" || len(child.End) != 0 {
+		t.Fatal("split excepted range 3 from 'm' but got ", child)
+	}
+	if string(f.desc.End) != "m" {
+		t.Fatal("split excepted the range to end at 'm' but got ", string(f.desc.End))
+	}
+
+	data, _ := encodeCommand(&command{Type: cmdWrite, Puts: []pair{{[]byte("x"), []byte("2")}}})
+	if err := f.Apply(&praft.Log{Index: 3, Data: data}); err != ErrWrongRange {
+		t.Fatal("write after split excepted ErrWrongRange but got ", err)
+	}
+	data, _ = encodeCommand(&command{Type: cmdSplit, Key: []byte("z"), Range: 4})
+	if err := f.Apply(&praft.Log{Index: 4, Data: data}); err != ErrInvalidSplit {
+		t.Fatal("split outside the range excepted ErrInvalidSplit but got ", err)
+	}
+
+	descs, err := readRanges(f.store)
+	if err != nil {
+		t.Fatal("readRanges error ", err)
+	}
+	if len(descs) != 2 || descs[0].ID != 0 || descs[1].ID != 3 {
+		t.Fatal("readRanges excepted ranges 0 and 3 but got ", descs)
+	}
+}
+
+func TestRecordIDs(t *testing.T) {
+	owner, id, ok := recordIDs(splitKey(3, 42)[len(splitPrefix):])
+	if !ok || owner != 3 || id != 42 {
+		t.Fatal("recordIDs excepted 3 and 42 but got ", owner, id, ok)
+	}
+	if _, _, ok := recordIDs([]byte("0000000000000003-000000000000002a")); ok {
+		t.Fatal("recordIDs excepted a malformed key to be refused")
+	}
+}
+
+func TestFSMMerge(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	f.desc = &RangeDesc{Peers: []string{"a"}}
+	var child *RangeDesc
+	f.split = func(parent, c *RangeDesc) { child = c }
+	var merged *RangeDesc
+	f.merged = func(left, right *RangeDesc) { merged = right }
+
+	applyCmd(t, f, 1, &command{Type: cmdSplit, Key: []byte("m"), Range: 3, Peers: []string{"a"}})
+	g := &fsm{store: f.store, group: 3, desc: child}
+	applyCmd(t, g, 1, &command{Type: cmdSplit, Key: []byte("t"), Range: 4, Peers: []string{"a"}})
+	applyCmd(t, g, 2, &command{Type: cmdWrite, Puts: []pair{{[]byte("p"), []byte("1")}}})
+
+	data, _ := encodeCommand(&command{Type: cmdMerge, Range: 3})
+	if err := f.Apply(&praft.Log{Index: 2, Data: data}); err != ErrInvalidMerge {
+		t.Fatal("merge of a range not frozen excepted ErrInvalidMerge but got ", err)
+	}
+	applyCmd(t, g, 3, &command{Type: cmdFreeze})
+	data, _ = encodeCommand(&command{Type: cmdWrite, Puts: []pair{{[]byte("p"), []byte("2")}}})
+	if err := g.Apply(&praft.Log{Index: 4, Data: data}); err != ErrRangeMerging {
+		t.Fatal("write to a frozen range excepted ErrRangeMerging but got ", err)
+	}
+
+	d := applyCmd(t, f, 3, &command{Type: cmdMerge, Range: 3}).(*RangeDesc)
+	if merged == nil || merged.ID != 3 || d.ID != 0 || string(d.End) != "t" {
+		t.Fatal("merge excepted range 0 to end at 't' but got ", d)
+	}
+	if !owns(f.desc, []byte("p")) {
+		t.Fatal("merge excepted range 0 to own the keys of range 3")
+	}
+	descs, err := readRanges(f.store)
+	if err != nil {
+		t.Fatal("readRanges error ", err)
+	}
+	if len(descs) != 2 || descs[0].ID != 0 || descs[1].ID != 4 {
+		t.Fatal("readRanges excepted ranges 0 and 4 but got ", descs)
+	}
+	// the split record of range 4 was taken over by range 0
+	if v, _ := f.store.Get(splitKey(0, 4)); v == nil {
+		t.Fatal("merge excepted range 0 to hold the split record of range 4")
+	}
+}
+
+func TestResizeThresholds(t *testing.T) {
+	s := &Server{cfg: Config{SplitSize: 100, SplitQPS: 10, MergeSize: 50, MergeQPS: 2}}
+	if s.overSplit(rangeUsage{size: 100, qps: 10}) || !s.overSplit(rangeUsage{size: 101}) || !s.overSplit(rangeUsage{qps: 11}) {
+		t.Fatal("overSplit excepted a range over SplitSize or SplitQPS only")
+	}
+	if !s.underMerge(rangeUsage{size: 49, qps: 1}) || s.underMerge(rangeUsage{size: 49, qps: 2}) || s.underMerge(rangeUsage{size: 50}) {
+		t.Fatal("underMerge excepted ranges under MergeSize and MergeQPS only")
+	}
+	s.cfg.MergeSize = 0
+	if s.underMerge(rangeUsage{}) {
+		t.Fatal("underMerge excepted no merge with a MergeSize of 0")
+	}
+}
+
+func TestRangeLoad(t *testing.T) {
+	var l rangeLoad
+	l.add(3)
+	l.add(3)
+	l.add(0)
+	counts := l.take()
+	if counts[3] != 2 || counts[0] != 1 {
+		t.Fatal("take excepted 2 requests on range 3 and 1 on range 0 but got ", counts)
+	}
+	if counts := l.take(); len(counts) != 0 {
+		t.Fatal("take excepted the counts to start again but got ", counts)
+	}
+}
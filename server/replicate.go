@@ -0,0 +1,337 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/magicdb/storage"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// replicateProtocol carries the changes of a primary cluster to the
+	// leaders of the ranges of its standby
+	replicateProtocol = "/magicdb/replicate/1.0.0"
+
+	// promotedKey is set in the range 0 once the standby was promoted, it
+	// holds the time of the promotion
+	promotedKey = "\x00repl/promoted"
+
+	// replicaTSPrefix holds the timestamp of the last change of the
+	// primary applied to a key of the standby: <key>
+	replicaTSPrefix = "\x00repl/ts/"
+
+	// replicateHops is how many redirections to the leader of a range of
+	// the standby a write follows without applying a change
+	replicateHops = 3
+)
+
+var (
+	// ErrStandby is returned for the writes to a standby not promoted
+	ErrStandby = errors.New("the cluster is a read-only standby")
+	// ErrNotStandby is returned when a cluster which is not a standby, or
+	// was promoted, is sent changes or promoted
+	ErrNotStandby = errors.New("the cluster is not a standby")
+	// ErrNotPrimary is returned to a peer shipping changes to a standby
+	// which does not list it in its primaries
+	ErrNotPrimary = errors.New("the peer is not a primary of the standby")
+)
+
+type replicateRequest struct {
+	Changes []Change `json:"changes"`
+}
+
+// replicateResponse tells how many changes of the request were applied,
+// Leader is the peer of the range to send the next one to, at Addrs
+type replicateResponse struct {
+	Applied int      `json:"applied"`
+	Leader  string   `json:"leader,omitempty"`
+	Addrs   []string `json:"addrs,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Standby reports whether the server is in a standby cluster not promoted
+// yet, it only takes the changes of its primary
+func (s *Server) Standby() bool {
+	if !s.cfg.Standby {
+		return false
+	}
+	v, err := s.store.Get([]byte(promotedKey))
+	return err != nil || v == nil
+}
+
+// Promote turn the standby into a cluster taking writes, it stops
+// applying the changes of the primary. It must be called on the leader.
+func (s *Server) Promote() error {
+	if !s.Standby() {
+		return ErrNotStandby
+	}
+	at := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	_, err := s.applyIn(s.raft, &command{Type: cmdWrite, Puts: []pair{{[]byte(promotedKey), at}}})
+	return err
+}
+
+// readOnly return ErrStandby if cmd writes user keys in a standby
+func (s *Server) readOnly(cmd *command) error {
+	if !s.cfg.Standby {
+		return nil
+	}
+	user := cmd.Type == cmdIngest
+	for _, k := range cmd.keys() {
+		user = user || !storage.IsSystemKey(k)
+	}
+	if user && s.Standby() {
+		return ErrStandby
+	}
+	return nil
+}
+
+func replicaTSKey(key []byte) []byte {
+	return append([]byte(replicaTSPrefix), key...)
+}
+
+// applyChanges apply changes of the primary in order, a run of changes of
+// distinct keys in one range is applied in one raft entry. It return how
+// many changes were applied and, when the next one belongs to a range led
+// elsewhere, the leader of that range. A change older than the last one
+// applied to its key is skipped by the fsm.
+func (s *Server) applyChanges(changes []Change) (int, string, error) {
+	if !s.Standby() {
+		return 0, "", ErrNotStandby
+	}
+	applied := 0
+	for applied < len(changes) {
+		var r *praft.Raft
+		cmd := &command{Type: cmdReplicate}
+		seen := make(map[string]bool)
+		n := applied
+		for ; n < len(changes); n++ {
+			c := changes[n]
+			if err := checkKeys(c.Key); err != nil {
+				return applied, "", err
+			}
+			if seen[string(c.Key)] {
+				break
+			}
+			cr, err := s.route(&command{Type: cmdWrite, Deletes: [][]byte{c.Key}})
+			if err != nil {
+				if n == applied {
+					return applied, "", err
+				}
+				break
+			}
+			if r != nil && cr != r {
+				break
+			}
+			r = cr
+			seen[string(c.Key)] = true
+			cmd.Changes = append(cmd.Changes, c)
+		}
+		if r.State() != praft.Leader {
+			return applied, string(r.Leader()), praft.ErrNotLeader
+		}
+		if _, err := s.applyIn(r, cmd); err != nil {
+			return applied, "", err
+		}
+		applied = n
+	}
+	return applied, "", nil
+}
+
+// applyReplicate apply the changes of the primary in cmd. A change older
+// than the last one applied to its key is skipped: after a split or a
+// merge of the primary, the changes of a key may come from two of its
+// ranges.
+func (f *fsm) applyReplicate(index uint64, cmd *command) interface{} {
+	w := &command{Type: cmdWrite, Now: cmd.Now, HLC: cmd.HLC}
+	var marks []storage.KV
+	for _, c := range cmd.Changes {
+		k := replicaTSKey(c.Key)
+		v, err := f.store.Get(k)
+		if err != nil {
+			return err
+		}
+		if len(v) == 8 && binary.BigEndian.Uint64(v) >= c.TS {
+			continue
+		}
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, c.TS)
+		marks = append(marks, storage.KV{Key: k, Value: ts})
+		if c.Type == ChangeDelete {
+			w.Deletes = append(w.Deletes, c.Key)
+		} else {
+			w.Puts = append(w.Puts, pair{c.Key, c.New})
+		}
+	}
+	return f.write(index, w, marks)
+}
+
+// primary reports whether pid is allowed to ship changes to the standby
+func (s *Server) primary(pid peer.ID) bool {
+	for _, p := range s.cfg.Primaries {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// handleReplicateStream apply the changes a primary sent on the stream,
+// the peers not in cfg.Primaries are refused
+func (s *Server) handleReplicateStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(applyTimeout))
+	var req replicateRequest
+	if err := json.NewDecoder(stream).Decode(&req); err != nil {
+		stream.Reset()
+		return
+	}
+	var resp replicateResponse
+	if !s.primary(stream.Conn().RemotePeer()) {
+		resp.Error = ErrNotPrimary.Error()
+	} else if err := s.enter(); err != nil {
+		resp.Error = err.Error()
+	} else {
+		applied, leader, err := s.applyChanges(req.Changes)
+		s.exit()
+		resp.Applied, resp.Leader = applied, leader
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if pid, err := peer.IDB58Decode(leader); err == nil {
+			for _, addr := range s.host.Peerstore().Addrs(pid) {
+				resp.Addrs = append(resp.Addrs, addr.String())
+			}
+		}
+	}
+	json.NewEncoder(stream).Encode(&resp)
+}
+
+// ReplicaSink ships the changes to a standby cluster over libp2p, each
+// change is applied by the leader of its range in the standby. The
+// changes of a range of the primary are applied in order.
+type ReplicaSink struct {
+	host  host.Host
+	peers []peer.ID
+
+	mu     sync.Mutex
+	leader peer.ID
+	next   int
+}
+
+// NewReplicaSink return a sink shipping to the standby nodes peers, their
+// addresses must be in the peerstore of h
+func NewReplicaSink(h host.Host, peers []peer.ID) *ReplicaSink {
+	return &ReplicaSink{host: h, peers: peers}
+}
+
+// Name implements Sink
+func (s *ReplicaSink) Name() string {
+	return "replica"
+}
+
+// Write implements Sink, it follows the standby to the leaders of its
+// ranges until every change is applied
+func (s *ReplicaSink) Write(changes []Change) error {
+	hops := 0
+	for len(changes) > 0 {
+		pid := s.target()
+		resp, err := s.send(pid, changes)
+		if err != nil {
+			s.forget(pid)
+			return err
+		}
+		if resp.Applied > 0 {
+			changes = changes[resp.Applied:]
+			hops = 0
+		}
+		if resp.Error == "" {
+			continue
+		}
+		leader, err := peer.IDB58Decode(resp.Leader)
+		if err != nil || leader == pid || hops >= replicateHops {
+			s.forget(pid)
+			return errors.New(resp.Error)
+		}
+		for _, addr := range resp.Addrs {
+			if maddr, err := ma.NewMultiaddr(addr); err == nil {
+				s.host.Peerstore().AddAddr(leader, maddr, peerstore.TempAddrTTL)
+			}
+		}
+		s.mu.Lock()
+		s.leader = leader
+		s.mu.Unlock()
+		hops++
+	}
+	return nil
+}
+
+// target return the last leader seen, or the next standby peer
+func (s *ReplicaSink) target() peer.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leader == "" && len(s.peers) > 0 {
+		s.leader = s.peers[s.next%len(s.peers)]
+		s.next++
+	}
+	return s.leader
+}
+
+func (s *ReplicaSink) forget(pid peer.ID) {
+	s.mu.Lock()
+	if s.leader == pid {
+		s.leader = ""
+	}
+	s.mu.Unlock()
+}
+
+func (s *ReplicaSink) send(pid peer.ID, changes []Change) (*replicateResponse, error) {
+	if pid == "" {
+		return nil, ErrNoLeader
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, replicateProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	if err := json.NewEncoder(stream).Encode(&replicateRequest{Changes: changes}); err != nil {
+		return nil, err
+	}
+	var resp replicateResponse
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Close implements Sink
+func (s *ReplicaSink) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/magicdb/raft"
+)
+
+// fakeStandby answer the replication streams of h with reply
+func fakeStandby(h host.Host, got *[]Change, reply func(req *replicateRequest) replicateResponse) {
+	h.SetStreamHandler(replicateProtocol, func(stream network.Stream) {
+		defer stream.Close()
+		var req replicateRequest
+		if err := json.NewDecoder(stream).Decode(&req); err != nil {
+			stream.Reset()
+			return
+		}
+		resp := reply(&req)
+		*got = append(*got, req.Changes[:resp.Applied]...)
+		json.NewEncoder(stream).Encode(&resp)
+	})
+}
+
+func TestReplicaSink(t *testing.T) {
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := raft.NewNodeWithConfig(raft.NodeConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0"}})
+		if err != nil {
+			t.Fatal("NewNodeWithConfig error ", err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	primary, follower, leader := hosts[0], hosts[1], hosts[2]
+	primary.Peerstore().AddAddrs(follower.ID(), follower.Addrs(), peerstore.PermanentAddrTTL)
+	follower.Peerstore().AddAddrs(leader.ID(), leader.Addrs(), peerstore.PermanentAddrTTL)
+
+	// the follower applies the first change of its own range, then sends
+	// the sink to the leader of the next one
+	var got []Change
+	fakeStandby(follower, &got, func(req *replicateRequest) replicateResponse {
+		resp := replicateResponse{Applied: 1, Leader: leader.ID().Pretty(), Error: "node is not the leader"}
+		for _, addr := range leader.Addrs() {
+			resp.Addrs = append(resp.Addrs, addr.String())
+		}
+		return resp
+	})
+	fakeStandby(leader, &got, func(req *replicateRequest) replicateResponse {
+		return replicateResponse{Applied: len(req.Changes)}
+	})
+
+	sink := NewReplicaSink(primary, []peer.ID{follower.ID()})
+	defer sink.Close()
+	var changes []Change
+	for i := uint64(1); i <= 3; i++ {
+		changes = append(changes, Change{Revision: i, Type: ChangePut, Key: []byte{'a' + byte(i)}, New: []byte("v")})
+	}
+	if err := sink.Write(changes); err != nil {
+		t.Fatal("Write error ", err)
+	}
+	if len(got) != 3 || got[0].Revision != 1 || got[2].Revision != 3 {
+		t.Fatal("excepted the changes applied in order but got ", got)
+	}
+
+	// the next write goes to the leader at once
+	got = nil
+	if err := sink.Write(changes[:1]); err != nil {
+		t.Fatal("Write error ", err)
+	}
+	if len(got) != 1 {
+		t.Fatal("excepted the change applied by the leader but got ", got)
+	}
+
+	// a standby refusing the changes fails the write, it is retried
+	fakeStandby(leader, &got, func(req *replicateRequest) replicateResponse {
+		return replicateResponse{Error: ErrNotStandby.Error()}
+	})
+	if err := sink.Write(changes); err == nil || err.Error() != ErrNotStandby.Error() {
+		t.Fatal("excepted ", ErrNotStandby, " but got ", err)
+	}
+}
+
+func TestStandbyReadOnly(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	s := &Server{cfg: Config{Standby: true}, store: f.store}
+	if !s.Standby() {
+		t.Fatal("excepted the server to be a standby")
+	}
+	if err := s.readOnly(&command{Type: cmdWrite, Puts: []pair{{[]byte("k"), []byte("v")}}}); err != ErrStandby {
+		t.Fatal("excepted ", ErrStandby, " but got ", err)
+	}
+	if err := s.readOnly(&command{Type: cmdWrite, Puts: []pair{{[]byte(userPrefix + "bob"), nil}}}); err != nil {
+		t.Fatal("excepted the system keys to be written but got ", err)
+	}
+
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{[]byte(promotedKey), []byte("now")}}})
+	if s.Standby() {
+		t.Fatal("excepted the promoted server not to be a standby")
+	}
+	if err := s.readOnly(&command{Type: cmdIncr, Key: []byte("k"), Delta: 1}); err != nil {
+		t.Fatal("excepted the promoted server to take writes but got ", err)
+	}
+}
+
+func TestFSMReplicateOrder(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+
+	k := []byte("k")
+	applyCmd(t, f, 1, &command{Type: cmdReplicate, Changes: []Change{{TS: 200, Type: ChangePut, Key: k, New: []byte("new")}}})
+	// a change of the key from another range of the primary, older
+	applyCmd(t, f, 2, &command{Type: cmdReplicate, Changes: []Change{{TS: 100, Type: ChangePut, Key: k, New: []byte("old")}}})
+	if v, err := f.store.Get(k); err != nil || string(v) != "new" {
+		t.Fatal("excepted the older change to be skipped but got ", string(v), err)
+	}
+	applyCmd(t, f, 3, &command{Type: cmdReplicate, Changes: []Change{{TS: 300, Type: ChangeDelete, Key: k}}})
+	applyCmd(t, f, 4, &command{Type: cmdReplicate, Changes: []Change{{TS: 250, Type: ChangePut, Key: k, New: []byte("old")}}})
+	if v, err := f.store.Get(k); err != nil || v != nil {
+		t.Fatal("excepted the key to stay deleted but got ", string(v), err)
+	}
+}
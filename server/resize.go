@@ -0,0 +1,155 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+)
+
+// resizeInterval is how often the ranges are checked for a split or a
+// merge, the requests per second are measured over it
+const resizeInterval = 10 * time.Second
+
+// rangeLoad counts the requests served by this node per range
+type rangeLoad struct {
+	mu     sync.Mutex
+	counts map[uint64]uint64
+}
+
+func (l *rangeLoad) add(id uint64) {
+	l.mu.Lock()
+	if l.counts == nil {
+		l.counts = make(map[uint64]uint64)
+	}
+	l.counts[id]++
+	l.mu.Unlock()
+}
+
+// take return the counts and start them again
+func (l *rangeLoad) take() map[uint64]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := l.counts
+	l.counts = nil
+	return counts
+}
+
+// rangeUsage is the approximate size and the load of a range
+type rangeUsage struct {
+	size uint64
+	qps  float64
+}
+
+// resizeLoop split and merge the ranges led by this node every
+// resizeInterval, and measure the requests per second of the node reported
+// to the placement driver
+func (s *Server) resizeLoop() {
+	ticker := time.NewTicker(resizeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		counts := s.load.take()
+		var total uint64
+		for _, n := range counts {
+			total += n
+		}
+		atomic.StoreUint64(&s.pd.qps, math.Float64bits(float64(total)/resizeInterval.Seconds()))
+		s.resize(counts, resizeInterval)
+	}
+}
+
+// resize split the ranges led by this node which are over SplitSize or
+// SplitQPS at their middle key. Without a split, the first two neighbour
+// ranges led here whose sum is under MergeSize and MergeQPS are merged. A
+// range frozen by an interrupted merge is merged whatever its usage.
+func (s *Server) resize(counts map[uint64]uint64, elapsed time.Duration) {
+	descs := s.ranges.all()
+	usage := make(map[uint64]rangeUsage)
+	split := false
+	for _, d := range descs {
+		r := s.replica(d.ID)
+		if r == nil {
+			continue
+		}
+		u := rangeUsage{
+			size: s.store.ApproximateSize(dataStart(d), d.End),
+			qps:  float64(counts[d.ID]) / elapsed.Seconds(),
+		}
+		usage[d.ID] = u
+		if d.Frozen || r.raft.State() != praft.Leader || !s.overSplit(u) {
+			continue
+		}
+		key, err := s.store.MiddleKey(dataStart(d), d.End)
+		if err == nil && key != nil {
+			if _, err := s.Split(key); err == nil {
+				split = true
+			}
+		}
+	}
+	if split {
+		return
+	}
+
+	for i := 1; i < len(descs); i++ {
+		left, right := descs[i-1], descs[i]
+		lu, lok := usage[left.ID]
+		ru, rok := usage[right.ID]
+		if !lok || !rok || left.Frozen || !bytes.Equal(left.End, right.Start) || !s.samePeers(left, right) {
+			continue
+		}
+		if !right.Frozen && !s.underMerge(rangeUsage{size: lu.size + ru.size, qps: lu.qps + ru.qps}) {
+			continue
+		}
+		l, r := s.replica(left.ID), s.replica(right.ID)
+		if l == nil || r == nil || r.raft.State() != praft.Leader {
+			continue
+		}
+		if l.raft.State() == praft.Leader {
+			s.merge(left, right)
+			return
+		}
+		// the merge is run by the leader of both ranges
+		if leader := l.raft.Leader(); leader != "" {
+			r.raft.LeadershipTransferToServer(praft.ServerID(leader), leader)
+		}
+	}
+}
+
+func (s *Server) overSplit(u rangeUsage) bool {
+	return (s.cfg.SplitSize > 0 && u.size > s.cfg.SplitSize) || (s.cfg.SplitQPS > 0 && u.qps > s.cfg.SplitQPS)
+}
+
+func (s *Server) underMerge(u rangeUsage) bool {
+	return s.cfg.MergeSize > 0 && u.size < s.cfg.MergeSize && (s.cfg.MergeQPS == 0 || u.qps < s.cfg.MergeQPS)
+}
+
+// dataStart return where the user keys of d start, the system keys held by
+// the range 0 are left out
+func dataStart(d *RangeDesc) []byte {
+	if len(d.Start) == 0 {
+		return []byte{1}
+	}
+	return d.Start
+}
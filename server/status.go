@@ -0,0 +1,209 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// statusProtocol serves the NodeStatus of a node to its peers
+	statusProtocol = "/magicdb/status/1.0.0"
+
+	// statusTimeout bounds a status request to a peer
+	statusTimeout = 2 * time.Second
+)
+
+var (
+	// ErrNotJoined is returned by Ready while the node is not in the raft
+	// configuration
+	ErrNotJoined = errors.New("node has not joined the cluster")
+	// ErrNoLeader is returned by Ready while there is no raft leader
+	ErrNoLeader = errors.New("no raft leader")
+	// ErrCatchingUp is returned by Ready while the node applied less than
+	// the commit index of the leader minus the allowed lag
+	ErrCatchingUp = errors.New("node is catching up with the leader")
+)
+
+// NodeStatus is the raft progress of a node
+type NodeStatus struct {
+	ID           string `json:"id"`
+	State        string `json:"state"`
+	Term         uint64 `json:"term"`
+	LastIndex    uint64 `json:"last_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// LastContact is when a follower last heard from the leader
+	LastContact time.Time `json:"last_contact"`
+	// Addrs are the libp2p addresses the node listens on
+	Addrs []string `json:"addrs"`
+	// Ranges are the applied index of the raft group of every range
+	// replicated by the node, the range 0 excepted
+	Ranges map[uint64]uint64 `json:"ranges,omitempty"`
+}
+
+// Status return the raft progress of the node
+func (s *Server) Status() NodeStatus {
+	stats := s.raft.Stats()
+	st := NodeStatus{
+		ID:           s.host.ID().Pretty(),
+		State:        s.raft.State().String(),
+		Term:         statUint(stats, "term"),
+		LastIndex:    s.raft.LastIndex(),
+		CommitIndex:  statUint(stats, "commit_index"),
+		AppliedIndex: s.raft.AppliedIndex(),
+		LastContact:  s.raft.LastContact(),
+	}
+	for _, addr := range s.host.Addrs() {
+		st.Addrs = append(st.Addrs, addr.String())
+	}
+	s.rangesMu.Lock()
+	for id := range s.replicas {
+		if id == 0 {
+			continue
+		}
+		if st.Ranges == nil {
+			st.Ranges = make(map[uint64]uint64)
+		}
+		st.Ranges[id], _ = s.store.GroupAppliedIndex(id)
+	}
+	s.rangesMu.Unlock()
+	return st
+}
+
+// MemberStatus is a member and its raft progress, Error is set instead of
+// Status when the member did not answer
+type MemberStatus struct {
+	Member
+	Status *NodeStatus `json:"status,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Cluster return the members of the raft configuration with the status
+// each of them reports
+func (s *Server) Cluster(ctx context.Context) ([]MemberStatus, error) {
+	members, err := s.Members()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MemberStatus, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		statuses[i].Member = m
+		pid, err := peer.IDB58Decode(m.ID)
+		if err != nil {
+			statuses[i].Error = err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func(ms *MemberStatus) {
+			defer wg.Done()
+			st, err := s.PeerStatus(ctx, pid)
+			if err != nil {
+				ms.Error = err.Error()
+				return
+			}
+			ms.Status = &st
+		}(&statuses[i])
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// Ready return nil when the node can serve: it is not draining, its store
+// is open, it is a member, and it applied the commit index of the leader minus at most
+// maxLag entries
+func (s *Server) Ready(ctx context.Context, maxLag uint64) error {
+	if s.Draining() {
+		return ErrDraining
+	}
+	if _, err := s.store.AppliedIndex(); err != nil {
+		return err
+	}
+	if ok, err := s.isMember(s.host.ID()); err != nil || !ok {
+		if err == nil {
+			err = ErrNotJoined
+		}
+		return err
+	}
+	leader := string(s.raft.Leader())
+	var commit uint64
+	if leader != "" {
+		pid, err := peer.IDB58Decode(leader)
+		if err != nil {
+			return err
+		}
+		st, err := s.PeerStatus(ctx, pid)
+		if err != nil {
+			return err
+		}
+		commit = st.CommitIndex
+	}
+	return checkReady(leader, commit, s.raft.AppliedIndex(), maxLag)
+}
+
+// checkReady return ErrNoLeader when there is no leader, and ErrCatchingUp
+// when applied is more than maxLag entries behind commit, the commit index
+// of the leader
+func checkReady(leader string, commit, applied, maxLag uint64) error {
+	if leader == "" {
+		return ErrNoLeader
+	}
+	if commit > applied+maxLag {
+		return ErrCatchingUp
+	}
+	return nil
+}
+
+// PeerStatus ask the peer pid for its NodeStatus
+func (s *Server) PeerStatus(ctx context.Context, pid peer.ID) (NodeStatus, error) {
+	if pid == s.host.ID() {
+		return s.Status(), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	stream, err := s.host.NewStream(ctx, pid, statusProtocol)
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	defer stream.Close()
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	var st NodeStatus
+	err = json.NewDecoder(stream).Decode(&st)
+	return st, err
+}
+
+// handleStatusStream send the NodeStatus of the node
+func (s *Server) handleStatusStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(statusTimeout))
+	if err := json.NewEncoder(stream).Encode(s.Status()); err != nil {
+		stream.Reset()
+	}
+}
+
+func statUint(stats map[string]string, name string) uint64 {
+	n, _ := strconv.ParseUint(stats[name], 10, 64)
+	return n
+}
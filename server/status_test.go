@@ -0,0 +1,40 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import "testing"
+
+func TestCheckReady(t *testing.T) {
+	cases := []struct {
+		leader                  string
+		commit, applied, maxLag uint64
+		err                     error
+	}{
+		{"", 0, 0, 100, ErrNoLeader},
+		{"", 10, 10, 100, ErrNoLeader},
+		{"QmLeader", 500, 100, 100, ErrCatchingUp},
+		{"QmLeader", 201, 100, 100, ErrCatchingUp},
+		{"QmLeader", 200, 100, 100, nil},
+		{"QmLeader", 100, 100, 0, nil},
+		{"QmLeader", 101, 100, 0, ErrCatchingUp},
+		{"QmLeader", 90, 100, 0, nil},
+	}
+	for _, c := range cases {
+		err := checkReady(c.leader, c.commit, c.applied, c.maxLag)
+		if err != c.err {
+			t.Fatalf("checkReady(%q, %d, %d, %d) excepted %v but got %v",
+				c.leader, c.commit, c.applied, c.maxLag, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// tsoKey holds the last timestamp reserved by the oracle, a new
+	// leader hands out timestamps after it
+	tsoKey = "\x00tso"
+
+	// tsLogicalBits are the low bits of a timestamp counting the
+	// timestamps handed out in the same millisecond
+	tsLogicalBits = raft.LogicalBits
+
+	// tsoWindow is how far ahead of its clock the oracle reserves
+	// timestamps with one raft entry
+	tsoWindow = 3 * time.Second
+
+	// MaxTimestamps is how many timestamps Timestamps hands out at once
+	MaxTimestamps = 1 << 16
+)
+
+var (
+	// ErrInvalidCount is returned by Timestamps for a count out of
+	// 1..MaxTimestamps
+	ErrInvalidCount = errors.New("invalid count of timestamps")
+)
+
+// tso is the window of timestamps reserved by the oracle while it leads
+// the range 0: next is the first not handed out yet and limit the last
+// one, 0 when nothing is reserved. The window is only used in the term it
+// was reserved in.
+type tso struct {
+	mu    sync.Mutex
+	next  uint64
+	limit uint64
+	term  uint64
+}
+
+// Timestamp hand out a timestamp from the oracle, greater than every
+// timestamp handed out before. It must be called on the leader of the
+// range 0.
+func (s *Server) Timestamp() (uint64, error) {
+	return s.Timestamps(1)
+}
+
+// Timestamps hand out n consecutive timestamps from the oracle and return
+// the first, they are greater than every timestamp handed out before and
+// than the hybrid clock of the node. It must be called on the leader of
+// the range 0, which reserves them in windows of tsoWindow through raft:
+// the next leader starts after the last window, even if its clock is
+// behind. A new term always reserves a window first: the entry is applied
+// after those of the leaders before, which the node may not have applied
+// yet when it wins the election.
+func (s *Server) Timestamps(n int) (uint64, error) {
+	if n < 1 || n > MaxTimestamps {
+		return 0, ErrInvalidCount
+	}
+	s.tso.mu.Lock()
+	defer s.tso.mu.Unlock()
+	if s.raft.State() != praft.Leader {
+		return 0, praft.ErrNotLeader
+	}
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return 0, err
+	}
+	if term := statUint(s.raft.Stats(), "term"); term != s.tso.term {
+		s.tso.term, s.tso.limit = term, 0
+	}
+	// another leader reserved timestamps since the window was
+	if v, err := s.store.Get([]byte(tsoKey)); err != nil {
+		return 0, err
+	} else if len(v) != 8 || binary.BigEndian.Uint64(v) != s.tso.limit {
+		s.tso.limit = 0
+	}
+
+	first := s.clock.Now()
+	if s.tso.next > first {
+		first = s.tso.next
+	}
+	if s.tso.limit == 0 || first+uint64(n)-1 > s.tso.limit {
+		window := uint64(tsoWindow/time.Millisecond) << tsLogicalBits
+		if window < uint64(n) {
+			window = uint64(n)
+		}
+		res, err := s.applyIn(s.raft, &command{Type: cmdTimestamp, Delta: int64(window)})
+		if err != nil {
+			s.tso.limit = 0
+			return 0, err
+		}
+		first = res.(uint64)
+		s.tso.limit = first + window - 1
+	}
+	s.tso.next = first + uint64(n)
+	return first, nil
+}
+
+// applyTimestamp reserve Delta timestamps of the oracle and return the
+// first: the hybrid clock of the proposer, its clock when an older
+// proposer sent no HLC, or the last reserved plus one when the clock is
+// behind. The last one reserved is stored.
+func (f *fsm) applyTimestamp(index uint64, cmd *command) interface{} {
+	if f.group != 0 {
+		return ErrWrongRange
+	}
+	v, err := f.store.Get([]byte(tsoKey))
+	if err != nil {
+		return err
+	}
+	ts := uint64(cmd.Now) << tsLogicalBits
+	if cmd.HLC > ts {
+		ts = cmd.HLC
+	}
+	if len(v) == 8 {
+		if last := binary.BigEndian.Uint64(v); ts <= last {
+			ts = last + 1
+		}
+	}
+	limit := ts
+	if cmd.Delta > 1 {
+		limit += uint64(cmd.Delta) - 1
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, limit)
+	if err := f.store.ApplyGroup(f.group, index, []storage.KV{{Key: []byte(tsoKey), Value: buf}}, nil); err != nil {
+		return err
+	}
+	return ts
+}
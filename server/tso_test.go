@@ -0,0 +1,93 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/magicdb/raft"
+)
+
+func TestFSMTimestamp(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	first := applyCmd(t, f, 1, &command{Type: cmdTimestamp, Now: 1000}).(uint64)
+	// a proposer whose clock is behind still gets a greater timestamp
+	second := applyCmd(t, f, 2, &command{Type: cmdTimestamp, Now: 900}).(uint64)
+	if first != 1000<<tsLogicalBits || second != first+1 {
+		t.Fatal("timestamps excepted to grow but got ", first, second)
+	}
+}
+
+func TestFSMTimestampWindow(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	f.clock = raft.NewClock()
+	// a proposer whose hybrid clock is a little ahead
+	hlc := raft.HybridTime(time.Now().Add(100*time.Millisecond)) + 5
+	first := applyCmd(t, f, 1, &command{Type: cmdTimestamp, Now: 1000, HLC: hlc, Delta: 100}).(uint64)
+	if first != hlc {
+		t.Fatal("excepted the hybrid clock of the proposer but got ", first)
+	}
+	v, err := f.store.Get([]byte(tsoKey))
+	if err != nil || len(v) != 8 || binary.BigEndian.Uint64(v) != hlc+99 {
+		t.Fatal("excepted the end of the window to be stored but got ", v, err)
+	}
+	// the next leader, whose clock is behind, starts after the window
+	next := applyCmd(t, f, 2, &command{Type: cmdTimestamp, Now: 1000, HLC: hlc, Delta: 100}).(uint64)
+	if next != hlc+100 {
+		t.Fatal("excepted the timestamp after the window but got ", next)
+	}
+	// the replica adopted the clock of the proposer
+	if now := f.clock.Now(); now <= hlc {
+		t.Fatal("excepted the clock after the one of the proposer but got ", now)
+	}
+}
+
+func TestTimestampsLeaderChange(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	r := newTestRaft(t, f)
+	defer r.Shutdown()
+	s := &Server{store: f.store, raft: r, clock: raft.NewClock()}
+	s.metrics = newMetrics(s)
+
+	first, err := s.Timestamp()
+	if err != nil {
+		t.Fatal("Timestamp error ", err)
+	}
+	reserved, _ := f.store.Get([]byte(tsoKey))
+
+	// the window of an earlier term whose end is still the last reserved
+	// one the node applied, another leader may have reserved after it
+	s.tso.mu.Lock()
+	s.tso.term--
+	s.tso.mu.Unlock()
+	second, err := s.Timestamp()
+	if err != nil {
+		t.Fatal("Timestamp error ", err)
+	}
+	v, _ := f.store.Get([]byte(tsoKey))
+	if len(v) != 8 || binary.BigEndian.Uint64(v) <= binary.BigEndian.Uint64(reserved) {
+		t.Fatal("excepted a new term to reserve a new window")
+	}
+	if second <= binary.BigEndian.Uint64(reserved) || second <= first {
+		t.Fatal("excepted a timestamp after the last window but got ", second)
+	}
+	if s.tso.term != statUint(r.Stats(), "term") {
+		t.Fatal("excepted the window of the current term")
+	}
+}
@@ -0,0 +1,655 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/storage"
+)
+
+const (
+	// txnPrefix holds the columns of the transactions, keyed by the user
+	// key so that they belong to its range: the lock of a key being
+	// written, the values written by every transaction at its start
+	// timestamp and the commit records by commit timestamp, newest first
+	txnPrefix      = "\x00txn/"
+	txnLockPrefix  = txnPrefix + "lock/"
+	txnDataPrefix  = txnPrefix + "data/"
+	txnWritePrefix = txnPrefix + "write/"
+
+	// txnHistory is how long the versions overwritten by a commit are
+	// kept, a transaction reads until it is that old
+	txnHistory = 10 * time.Minute
+)
+
+// The kinds of a commit record
+const (
+	txnPut byte = iota
+	txnDelete
+	txnRollback
+)
+
+var (
+	// ErrWriteConflict is returned by Prewrite when a key was committed
+	// after the transaction started, or the transaction was rolled back
+	ErrWriteConflict = errors.New("write conflict, the key changed since the transaction started")
+	// ErrKeyLocked is returned by Prewrite when another transaction
+	// holds the lock of a key
+	ErrKeyLocked = errors.New("key is locked by another transaction")
+	// ErrTxnAborted is returned by CommitTxn when the transaction was
+	// rolled back
+	ErrTxnAborted = errors.New("transaction was rolled back")
+	// ErrTxnCommitted is returned by RollbackTxn when the transaction
+	// was committed
+	ErrTxnCommitted = errors.New("transaction was committed")
+	// ErrTxnTooOld is returned when reading at a start timestamp older
+	// than the versions kept
+	ErrTxnTooOld = errors.New("transaction is too old")
+)
+
+// Lock is the lock of a key prewritten by the transaction started at
+// StartTS, Primary is the key whose commit record decides the
+// transaction. The lock may be resolved once ExpireAt, in unix
+// milliseconds, passed.
+type Lock struct {
+	Key      []byte `json:"key"`
+	Primary  []byte `json:"primary"`
+	StartTS  uint64 `json:"start_ts"`
+	ExpireAt int64  `json:"expire_at"`
+	Delete   bool   `json:"delete,omitempty"`
+}
+
+// Mutation is a write of a transaction, a put or a delete of Key
+type Mutation struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// TxnStatus is the state of a transaction decided by its primary key: a
+// CommitTS once committed, Locked while its lock is alive, rolled back
+// otherwise
+type TxnStatus struct {
+	CommitTS uint64 `json:"commit_ts,omitempty"`
+	Locked   bool   `json:"locked,omitempty"`
+	ExpireAt int64  `json:"expire_at,omitempty"`
+}
+
+// txnRecord is the commit record of a key, under its commit timestamp
+type txnRecord struct {
+	StartTS uint64
+	Kind    byte
+}
+
+func txnLockKey(key []byte) []byte {
+	return append([]byte(txnLockPrefix), key...)
+}
+
+func txnDataKey(key []byte, startTS uint64) []byte {
+	return tsKey(txnDataPrefix, key, startTS)
+}
+
+// txnWriteKey is the key of the commit record of key at commitTS, the
+// timestamp is inverted so the newest record comes first
+func txnWriteKey(key []byte, commitTS uint64) []byte {
+	return tsKey(txnWritePrefix, key, ^commitTS)
+}
+
+func tsKey(prefix string, key []byte, ts uint64) []byte {
+	k := make([]byte, len(prefix)+len(key)+8)
+	copy(k, prefix)
+	copy(k[len(prefix):], key)
+	binary.BigEndian.PutUint64(k[len(prefix)+len(key):], ts)
+	return k
+}
+
+// txnUserKey return the user key of a column key of the transactions
+func txnUserKey(k []byte) ([]byte, bool) {
+	switch {
+	case bytes.HasPrefix(k, []byte(txnLockPrefix)):
+		return k[len(txnLockPrefix):], true
+	case bytes.HasPrefix(k, []byte(txnDataPrefix)) && len(k) >= len(txnDataPrefix)+8:
+		return k[len(txnDataPrefix) : len(k)-8], true
+	case bytes.HasPrefix(k, []byte(txnWritePrefix)) && len(k) >= len(txnWritePrefix)+8:
+		return k[len(txnWritePrefix) : len(k)-8], true
+	}
+	return nil, false
+}
+
+func getLock(store *storage.KvStore, key []byte) (*Lock, error) {
+	v, err := store.Get(txnLockKey(key))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	l := &Lock{}
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// iterateWrites call fn with the commit records of key newest first,
+// from the one committed at or before ts, until fn returns false
+func iterateWrites(store *storage.KvStore, key []byte, ts uint64, fn func(commitTS uint64, rec *txnRecord) bool) error {
+	prefix := append([]byte(txnWritePrefix), key...)
+	var start []byte
+	if inv := ^ts; inv > 0 {
+		start = tsKey(txnWritePrefix, key, inv-1)
+	}
+	var decErr error
+	err := store.IterateFrom(prefix, start, func(k, v []byte) bool {
+		// the records of the keys key is a prefix of
+		if len(k) != len(prefix)+8 {
+			return true
+		}
+		rec := &txnRecord{}
+		if decErr = gob.NewDecoder(bytes.NewReader(v)).Decode(rec); decErr != nil {
+			return false
+		}
+		return fn(^binary.BigEndian.Uint64(k[len(prefix):]), rec)
+	})
+	if err != nil {
+		return err
+	}
+	return decErr
+}
+
+// findWrite return the commit record of the transaction started at
+// startTS on key, nil if there is none
+func findWrite(store *storage.KvStore, key []byte, startTS uint64) (uint64, *txnRecord, error) {
+	var commitTS uint64
+	var found *txnRecord
+	err := iterateWrites(store, key, ^uint64(0), func(ts uint64, rec *txnRecord) bool {
+		if rec.StartTS == startTS {
+			commitTS, found = ts, rec
+			return false
+		}
+		// the records before startTS were committed before it started
+		return ts >= startTS
+	})
+	return commitTS, found, err
+}
+
+// readTxn return the value of key as of ts, or the lock of a transaction
+// started before ts which may have committed before it. Only a key without
+// any commit record, written before the records were kept or ingested, is
+// read as is.
+func readTxn(store *storage.KvStore, key []byte, ts uint64) ([]byte, *Lock, error) {
+	l, err := getLock(store, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l != nil && l.StartTS <= ts {
+		return nil, l, nil
+	}
+
+	var value []byte
+	var getErr error
+	written, found := false, false
+	err = iterateWrites(store, key, ts, func(commitTS uint64, rec *txnRecord) bool {
+		switch rec.Kind {
+		case txnRollback:
+			return true
+		case txnPut:
+			value, getErr = store.Get(txnDataKey(key, rec.StartTS))
+		}
+		found = true
+		return false
+	})
+	if err == nil {
+		err = getErr
+	}
+	if err != nil || found {
+		return value, nil, err
+	}
+	err = iterateWrites(store, key, ^uint64(0), func(uint64, *txnRecord) bool {
+		written = true
+		return false
+	})
+	if err != nil || written {
+		return nil, nil, err
+	}
+	v, err := store.Get(key)
+	if err != nil || v == nil {
+		return nil, nil, err
+	}
+	dead, err := expired(store, key, nowMs())
+	if err != nil || dead {
+		return nil, nil, err
+	}
+	return v, nil, nil
+}
+
+// txnReplica return the replica of the range of key, it must lead it so
+// that the reads see every commit
+func (s *Server) txnReplica(key []byte) (*replica, error) {
+	if err := checkKeys(key); err != nil {
+		return nil, err
+	}
+	r := s.replica(s.ranges.lookup(key).ID)
+	if r == nil {
+		return nil, ErrRangeNotFound
+	}
+	if r.raft.State() != praft.Leader {
+		return nil, praft.ErrNotLeader
+	}
+	return r, nil
+}
+
+// TxnGet read key as of the start timestamp of a transaction. When a
+// transaction started before holds its lock, the lock is returned instead:
+// the reader resolves it with CheckTxn on its primary then reads again. It
+// must be called on the leader of the range of key.
+func (s *Server) TxnGet(key []byte, startTS uint64) ([]byte, *Lock, error) {
+	if err := s.enter(); err != nil {
+		return nil, nil, err
+	}
+	defer s.exit()
+	if time.Since(raft.PhysicalTime(startTS)) > txnHistory {
+		return nil, nil, ErrTxnTooOld
+	}
+	r, err := s.txnReplica(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the commits before startTS are applied past the barrier
+	if err := r.raft.Barrier(applyTimeout).Error(); err != nil {
+		return nil, nil, err
+	}
+	return readTxn(s.store, key, startTS)
+}
+
+// Prewrite lock the keys of muts for the transaction started at startTS
+// and stage their values, the keys must belong to the same range. It fails
+// with ErrWriteConflict when a key was committed since startTS and with
+// ErrKeyLocked when another transaction holds a lock. The locks expire
+// after ttl.
+func (s *Server) Prewrite(primary []byte, startTS uint64, ttl time.Duration, muts []Mutation) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if time.Since(raft.PhysicalTime(startTS)) > txnHistory {
+		return ErrTxnTooOld
+	}
+	cmd := &command{Type: cmdPrewrite, Primary: primary, StartTS: startTS}
+	cmd.Now = nowMs()
+	cmd.ExpireAt = cmd.Now + ttl.Nanoseconds()/int64(time.Millisecond)
+	for _, m := range muts {
+		if m.Delete {
+			cmd.Deletes = append(cmd.Deletes, m.Key)
+		} else {
+			cmd.Puts = append(cmd.Puts, pair{m.Key, m.Value})
+		}
+	}
+	if err := checkKeys(append(cmd.keys(), primary)...); err != nil {
+		return err
+	}
+	return s.apply(cmd)
+}
+
+// CommitTxn commit the keys prewritten by the transaction started at
+// startTS at commitTS, the keys must belong to the same range. The
+// transaction is committed once its primary key is, it fails with
+// ErrTxnAborted when it was rolled back.
+func (s *Server) CommitTxn(startTS, commitTS uint64, keys [][]byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdCommitTxn, StartTS: startTS, CommitTS: commitTS, Keys: keys})
+}
+
+// RollbackTxn drop the locks and values of the transaction started at
+// startTS on keys, it fails with ErrTxnCommitted when it was committed
+func (s *Server) RollbackTxn(startTS uint64, keys [][]byte) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	if err := checkKeys(keys...); err != nil {
+		return err
+	}
+	return s.apply(&command{Type: cmdRollbackTxn, StartTS: startTS, Keys: keys})
+}
+
+// CheckTxn return the status of the transaction started at startTS from
+// its primary key. A transaction whose primary lock expired or is missing
+// is rolled back, so that a crashed coordinator cannot commit it later.
+func (s *Server) CheckTxn(primary []byte, startTS uint64) (TxnStatus, error) {
+	if err := s.enter(); err != nil {
+		return TxnStatus{}, err
+	}
+	defer s.exit()
+	if err := checkKeys(primary); err != nil {
+		return TxnStatus{}, err
+	}
+	res, err := s.applyResult(&command{Type: cmdCheckTxn, Key: primary, StartTS: startTS})
+	if err != nil {
+		return TxnStatus{}, err
+	}
+	return res.(TxnStatus), nil
+}
+
+// applyPrewrite lock the keys of Puts and Deletes for the transaction
+// StartTS and stage the values of Puts. Every key is checked before any is
+// written, a prewrite sent again is accepted.
+func (f *fsm) applyPrewrite(index uint64, cmd *command) interface{} {
+	muts := make([]Mutation, 0, len(cmd.Puts)+len(cmd.Deletes))
+	for _, p := range cmd.Puts {
+		muts = append(muts, Mutation{Key: p.Key, Value: p.Value})
+	}
+	for _, k := range cmd.Deletes {
+		muts = append(muts, Mutation{Key: k, Delete: true})
+	}
+
+	var puts []storage.KV
+	for _, m := range muts {
+		l, err := getLock(f.store, m.Key)
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			if l.StartTS == cmd.StartTS {
+				continue
+			}
+			return ErrKeyLocked
+		}
+		conflict := false
+		err = iterateWrites(f.store, m.Key, ^uint64(0), func(commitTS uint64, rec *txnRecord) bool {
+			// a rollback record of the transaction is at its start
+			conflict = commitTS >= cmd.StartTS
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if conflict {
+			return ErrWriteConflict
+		}
+		v, err := gobEncode(&Lock{Key: m.Key, Primary: cmd.Primary, StartTS: cmd.StartTS, ExpireAt: cmd.ExpireAt, Delete: m.Delete})
+		if err != nil {
+			return err
+		}
+		puts = append(puts, storage.KV{Key: txnLockKey(m.Key), Value: v})
+		if !m.Delete {
+			puts = append(puts, storage.KV{Key: txnDataKey(m.Key, cmd.StartTS), Value: m.Value})
+		}
+	}
+	return f.store.ApplyGroup(f.group, index, puts, nil)
+}
+
+// applyCommitTxn write the commit records of Keys at CommitTS, drop their
+// locks and apply their values to the keys. The versions older than
+// txnHistory are dropped.
+func (f *fsm) applyCommitTxn(index uint64, cmd *command) interface{} {
+	var locks []*Lock
+	for _, k := range cmd.Keys {
+		l, err := getLock(f.store, k)
+		if err != nil {
+			return err
+		}
+		if l != nil && l.StartTS == cmd.StartTS {
+			locks = append(locks, l)
+			continue
+		}
+		// committed already, or rolled back
+		_, rec, err := findWrite(f.store, k, cmd.StartTS)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Kind == txnRollback {
+			return ErrTxnAborted
+		}
+	}
+
+	var puts []storage.KV
+	var dels []interface{}
+	var events []Event
+	for _, l := range locks {
+		rec := &txnRecord{StartTS: cmd.StartTS, Kind: txnPut}
+		if l.Delete {
+			rec.Kind = txnDelete
+		}
+		v, err := gobEncode(rec)
+		if err != nil {
+			return err
+		}
+		puts = append(puts, storage.KV{Key: txnWriteKey(l.Key, cmd.CommitTS), Value: v})
+		dels = append(dels, txnLockKey(l.Key), ttlKey(l.Key))
+		if l.Delete {
+			dels = append(dels, l.Key)
+			events = append(events, Event{Type: EventDelete, Key: l.Key, Index: index})
+		} else {
+			value, err := f.store.Get(txnDataKey(l.Key, cmd.StartTS))
+			if err != nil {
+				return err
+			}
+			puts = append(puts, storage.KV{Key: l.Key, Value: value})
+			events = append(events, Event{Type: EventPut, Key: l.Key, Value: value, Index: index})
+		}
+		old, err := f.oldVersions(l.Key, cmd.CommitTS)
+		if err != nil {
+			return err
+		}
+		dels = append(dels, old...)
+	}
+	tracked, err := f.track(index, cmd.CommitTS, puts, dels)
+	if err != nil {
+		return err
+	}
+	puts = append(puts, tracked...)
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	f.emit(events)
+	return nil
+}
+
+// oldVersions return the keys of the versions of key no transaction reads
+// anymore once it is committed at commitTS: those overwritten more than
+// txnHistory before it
+func (f *fsm) oldVersions(key []byte, commitTS uint64) ([]interface{}, error) {
+	window := uint64(txnHistory/time.Millisecond) << tsLogicalBits
+	if commitTS <= window {
+		return nil, nil
+	}
+	horizon := commitTS - window
+	var dels []interface{}
+	newer := false
+	err := iterateWrites(f.store, key, horizon, func(ts uint64, rec *txnRecord) bool {
+		if !newer && rec.Kind != txnRollback {
+			// the newest version before the horizon is still read
+			newer = true
+			return true
+		}
+		dels = append(dels, txnWriteKey(key, ts), txnDataKey(key, rec.StartTS))
+		return true
+	})
+	return dels, err
+}
+
+// plainWrite return what a write outside the transactions of the keys of
+// puts and dels at ts adds to the columns of the transactions. Every key
+// gets a commit record of its own, so that the transactions read the write
+// as of their start and conflict with it. The value a key held before its
+// first record is kept as the version 0. It fails with ErrKeyLocked while
+// a transaction holds the lock of a key.
+func (f *fsm) plainWrite(ts uint64, puts []storage.KV, dels []interface{}) ([]storage.KV, []interface{}, error) {
+	var kvs []storage.KV
+	var gone []interface{}
+	add := func(key, value []byte, kind byte) error {
+		if storage.IsSystemKey(key) {
+			return nil
+		}
+		l, err := getLock(f.store, key)
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			return ErrKeyLocked
+		}
+		var last uint64
+		written := false
+		err = iterateWrites(f.store, key, ^uint64(0), func(commitTS uint64, rec *txnRecord) bool {
+			last, written = commitTS, true
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if !written {
+			base, err := f.baseVersion(key, int64(ts>>tsLogicalBits))
+			if err != nil {
+				return err
+			}
+			kvs = append(kvs, base...)
+		}
+		// the records stay ordered whatever the clock of the proposer
+		commitTS := ts
+		if commitTS <= last {
+			commitTS = last + 1
+		}
+		rec, err := gobEncode(&txnRecord{StartTS: commitTS, Kind: kind})
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, storage.KV{Key: txnWriteKey(key, commitTS), Value: rec})
+		if kind == txnPut {
+			kvs = append(kvs, storage.KV{Key: txnDataKey(key, commitTS), Value: value})
+		}
+		old, err := f.oldVersions(key, commitTS)
+		gone = append(gone, old...)
+		return err
+	}
+	for _, p := range puts {
+		if k, ok := p.Key.([]byte); ok {
+			v, _ := p.Value.([]byte)
+			if err := add(k, v, txnPut); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, d := range dels {
+		if k, ok := d.([]byte); ok {
+			if err := add(k, nil, txnDelete); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return kvs, gone, nil
+}
+
+// baseVersion return the version 0 of key, a key without commit record,
+// holding its value if it is live at now
+func (f *fsm) baseVersion(key []byte, now int64) ([]storage.KV, error) {
+	v, err := f.store.Get(key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	dead, err := expired(f.store, key, now)
+	if err != nil || dead {
+		return nil, err
+	}
+	rec, err := gobEncode(&txnRecord{Kind: txnPut})
+	if err != nil {
+		return nil, err
+	}
+	return []storage.KV{
+		{Key: txnWriteKey(key, 0), Value: rec},
+		{Key: txnDataKey(key, 0), Value: v},
+	}, nil
+}
+
+// applyRollbackTxn drop the locks and values of the transaction StartTS on
+// Keys and write a rollback record, so that a late prewrite fails
+func (f *fsm) applyRollbackTxn(index uint64, cmd *command) interface{} {
+	for _, k := range cmd.Keys {
+		_, rec, err := findWrite(f.store, k, cmd.StartTS)
+		if err != nil {
+			return err
+		}
+		if rec != nil && rec.Kind != txnRollback {
+			return ErrTxnCommitted
+		}
+	}
+	var puts []storage.KV
+	var dels []interface{}
+	for _, k := range cmd.Keys {
+		kv, del, err := f.rollback(k, cmd.StartTS)
+		if err != nil {
+			return err
+		}
+		puts = append(puts, kv...)
+		dels = append(dels, del...)
+	}
+	return f.store.ApplyGroup(f.group, index, puts, dels)
+}
+
+// rollback return the writes rolling the transaction startTS back on key
+func (f *fsm) rollback(key []byte, startTS uint64) ([]storage.KV, []interface{}, error) {
+	var dels []interface{}
+	l, err := getLock(f.store, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l != nil && l.StartTS == startTS {
+		dels = append(dels, txnLockKey(key), txnDataKey(key, startTS))
+	}
+	v, err := gobEncode(&txnRecord{StartTS: startTS, Kind: txnRollback})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []storage.KV{{Key: txnWriteKey(key, startTS), Value: v}}, dels, nil
+}
+
+// applyCheckTxn decide the status of the transaction StartTS from its
+// primary Key, a transaction whose lock expired at Now is rolled back
+func (f *fsm) applyCheckTxn(index uint64, cmd *command) interface{} {
+	commitTS, rec, err := findWrite(f.store, cmd.Key, cmd.StartTS)
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		if rec.Kind == txnRollback {
+			return TxnStatus{}
+		}
+		return TxnStatus{CommitTS: commitTS}
+	}
+	l, err := getLock(f.store, cmd.Key)
+	if err != nil {
+		return err
+	}
+	if l != nil && l.StartTS == cmd.StartTS && l.ExpireAt > cmd.Now {
+		return TxnStatus{Locked: true, ExpireAt: l.ExpireAt}
+	}
+	puts, dels, err := f.rollback(cmd.Key, cmd.StartTS)
+	if err != nil {
+		return err
+	}
+	if err := f.store.ApplyGroup(f.group, index, puts, dels); err != nil {
+		return err
+	}
+	return TxnStatus{}
+}
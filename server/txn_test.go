@@ -0,0 +1,150 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	praft "github.com/hashicorp/raft"
+)
+
+func TestTxnKeys(t *testing.T) {
+	key := []byte("order/1")
+	for _, k := range [][]byte{txnLockKey(key), txnDataKey(key, 7), txnWriteKey(key, 7)} {
+		if user, ok := txnUserKey(k); !ok || !bytes.Equal(user, key) {
+			t.Fatal("txnUserKey excepted ", string(key), " but got ", string(user), ok)
+		}
+	}
+	// the newest commit record comes first
+	if bytes.Compare(txnWriteKey(key, 9), txnWriteKey(key, 8)) >= 0 {
+		t.Fatal("txnWriteKey excepted the records newest first")
+	}
+	d := &RangeDesc{ID: 3, Start: []byte("p")}
+	if owns(d, txnWriteKey(key, 1)) || !owns(d, txnLockKey([]byte("stock/1"))) {
+		t.Fatal("owns excepted the transaction columns to belong to the range of their key")
+	}
+}
+
+func TestFSMTxn(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k1, k2 := []byte("order/1"), []byte("stock/1")
+
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{k2, []byte("5")}}})
+	applyCmd(t, f, 2, &command{Type: cmdPrewrite, Primary: k1, StartTS: 10, ExpireAt: 100,
+		Puts: []pair{{k1, []byte("new")}, {k2, []byte("4")}}})
+
+	// a reader started after the prewrite finds the lock, one started
+	// before reads the key as it was
+	if _, l, err := readTxn(f.store, k1, 11); err != nil || l == nil || !bytes.Equal(l.Primary, k1) {
+		t.Fatal("readTxn excepted the lock of the primary but got ", l, err)
+	}
+	if v, l, err := readTxn(f.store, k2, 9); err != nil || l != nil || string(v) != "5" {
+		t.Fatal("readTxn excepted the value before the transaction but got ", string(v), l, err)
+	}
+
+	data, _ := encodeCommand(&command{Type: cmdPrewrite, Primary: k2, StartTS: 12, ExpireAt: 100, Puts: []pair{{k2, []byte("3")}}})
+	if err := f.Apply(&praft.Log{Index: 3, Data: data}); err != ErrKeyLocked {
+		t.Fatal("prewrite of a locked key excepted ErrKeyLocked but got ", err)
+	}
+
+	applyCmd(t, f, 4, &command{Type: cmdCommitTxn, StartTS: 10, CommitTS: 20, Keys: [][]byte{k1}})
+	// the secondary lock is resolved from the primary
+	st := applyCmd(t, f, 5, &command{Type: cmdCheckTxn, Key: k1, StartTS: 10, Now: 200}).(TxnStatus)
+	if st.CommitTS != 20 {
+		t.Fatal("CheckTxn excepted the commit at 20 but got ", st)
+	}
+	applyCmd(t, f, 6, &command{Type: cmdCommitTxn, StartTS: 10, CommitTS: 20, Keys: [][]byte{k2}})
+
+	if v, _, err := readTxn(f.store, k2, 21); err != nil || string(v) != "4" {
+		t.Fatal("readTxn after the commit excepted 4 but got ", string(v), err)
+	}
+	if v, _, err := readTxn(f.store, k2, 15); err != nil || v != nil {
+		t.Fatal("readTxn before the commit excepted no committed value but got ", string(v), err)
+	}
+	if v, _ := f.store.Get(k2); string(v) != "4" {
+		t.Fatal("commit excepted the key to hold 4 but got ", string(v))
+	}
+
+	// a transaction started before the commit conflicts
+	data, _ = encodeCommand(&command{Type: cmdPrewrite, Primary: k2, StartTS: 15, ExpireAt: 100, Puts: []pair{{k2, []byte("3")}}})
+	if err := f.Apply(&praft.Log{Index: 7, Data: data}); err != ErrWriteConflict {
+		t.Fatal("prewrite after a newer commit excepted ErrWriteConflict but got ", err)
+	}
+
+	// an expired lock is rolled back and its commit refused
+	applyCmd(t, f, 8, &command{Type: cmdPrewrite, Primary: k1, StartTS: 30, ExpireAt: 100, Deletes: [][]byte{k1}})
+	st = applyCmd(t, f, 9, &command{Type: cmdCheckTxn, Key: k1, StartTS: 30, Now: 200}).(TxnStatus)
+	if st.CommitTS != 0 || st.Locked {
+		t.Fatal("CheckTxn of an expired lock excepted a rollback but got ", st)
+	}
+	data, _ = encodeCommand(&command{Type: cmdCommitTxn, StartTS: 30, CommitTS: 40, Keys: [][]byte{k1}})
+	if err := f.Apply(&praft.Log{Index: 10, Data: data}); err != ErrTxnAborted {
+		t.Fatal("commit of a rolled back transaction excepted ErrTxnAborted but got ", err)
+	}
+	if v, _, err := readTxn(f.store, k1, 50); err != nil || string(v) != "new" {
+		t.Fatal("readTxn excepted the rolled back delete to be ignored but got ", string(v), err)
+	}
+}
+
+func TestFSMPlainWriteConflict(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k := []byte("stock/2")
+	applyCmd(t, f, 1, &command{Type: cmdWrite, Puts: []pair{{k, []byte("1")}}, HLC: 5 << tsLogicalBits})
+
+	// the transaction starts at 10, a plain Put lands at 20
+	applyCmd(t, f, 2, &command{Type: cmdWrite, Puts: []pair{{k, []byte("2")}}, HLC: 20 << tsLogicalBits})
+	if v, _, err := readTxn(f.store, k, 10<<tsLogicalBits); err != nil || string(v) != "1" {
+		t.Fatal("readTxn at the start excepted 1 but got ", string(v), err)
+	}
+	data, _ := encodeCommand(&command{Type: cmdPrewrite, Primary: k, StartTS: 10 << tsLogicalBits, ExpireAt: 100, Puts: []pair{{k, []byte("3")}}})
+	if err := f.Apply(&praft.Log{Index: 3, Data: data}); err != ErrWriteConflict {
+		t.Fatal("prewrite over a later plain Put excepted ErrWriteConflict but got ", err)
+	}
+	if v, _ := f.store.Get(k); string(v) != "2" {
+		t.Fatal("the plain Put excepted to be kept but got ", string(v))
+	}
+}
+
+func TestFSMPlainWriteTxn(t *testing.T) {
+	f, done := newTestFSM(t)
+	defer done()
+	k := []byte("stock/1")
+
+	applyCmd(t, f, 1, &command{Type: cmdPrewrite, Primary: k, StartTS: 10, ExpireAt: 100, Puts: []pair{{k, []byte("5")}}})
+	data, _ := encodeCommand(&command{Type: cmdIncr, Key: k, Delta: 1, HLC: 15})
+	if err := f.Apply(&praft.Log{Index: 2, Data: data}); err != ErrKeyLocked {
+		t.Fatal("Incr of a locked key excepted ErrKeyLocked but got ", err)
+	}
+	applyCmd(t, f, 3, &command{Type: cmdCommitTxn, StartTS: 10, CommitTS: 20, Keys: [][]byte{k}})
+
+	// a write outside the transactions is a commit of its own
+	applyCmd(t, f, 4, &command{Type: cmdIncr, Key: k, Delta: 1, HLC: 30})
+	if v, _, err := readTxn(f.store, k, 31); err != nil || string(v) != "6" {
+		t.Fatal("readTxn after Incr excepted 6 but got ", string(v), err)
+	}
+	if v, _, err := readTxn(f.store, k, 25); err != nil || string(v) != "5" {
+		t.Fatal("readTxn before Incr excepted 5 but got ", string(v), err)
+	}
+	data, _ = encodeCommand(&command{Type: cmdPrewrite, Primary: k, StartTS: 25, ExpireAt: 100, Puts: []pair{{k, []byte("0")}}})
+	if err := f.Apply(&praft.Log{Index: 5, Data: data}); err != ErrWriteConflict {
+		t.Fatal("prewrite started before Incr excepted ErrWriteConflict but got ", err)
+	}
+	applyCmd(t, f, 6, &command{Type: cmdWrite, Deletes: [][]byte{k}, HLC: 40})
+	if v, _, err := readTxn(f.store, k, 41); err != nil || v != nil {
+		t.Fatal("readTxn after the delete excepted nothing but got ", string(v), err)
+	}
+}
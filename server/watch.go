@@ -0,0 +1,119 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"bytes"
+	"sync"
+)
+
+// watchBuffer is the number of events buffered per watcher, a watcher
+// which falls further behind is dropped
+const watchBuffer = 256
+
+// EventType is the kind of change of an Event
+type EventType int
+
+const (
+	// EventPut is a key set to a value
+	EventPut EventType = iota
+	// EventDelete is a key deleted
+	EventDelete
+)
+
+// Event is a change of a key applied to the store
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte
+	// Index is the raft log index of the change
+	Index uint64
+}
+
+type watcher struct {
+	prefix []byte
+	ch     chan Event
+}
+
+// watchHub fan out the events applied by the fsm to the watchers
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// Watch return a channel receiving the changes of keys with the prefix
+// applied on this server, and a func to stop watching. Ingested sst files
+// produce no events. The channel is closed when the watch is stopped, when
+// the receiver is too slow to keep up, or when the server drains.
+func (s *Server) Watch(prefix []byte) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+	s.watches.mu.Lock()
+	s.watches.watchers[w] = struct{}{}
+	s.watches.mu.Unlock()
+	// Drain sets the flag before closing the watches
+	if s.Draining() {
+		s.watches.remove(w)
+	}
+
+	return w.ch, func() { s.watches.remove(w) }
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// notify never blocks, the fsm calls it while applying the log
+func (h *watchHub) notify(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		for _, e := range events {
+			if !bytes.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- e:
+			default:
+				delete(h.watchers, w)
+				close(w.ch)
+			}
+			if _, ok := h.watchers[w]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// closeAll stop every watch
+func (h *watchHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/magicdb/server"
+	"github.com/magicdb/storage"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxHTTPScanLimit caps the number of pairs of a scan response
+const maxHTTPScanLimit = 10000
+
+// ScanResponse is the body of GET /v1/scan
+type ScanResponse struct {
+	KVs []KV `json:"kvs"`
+	// More is true when there are pairs after the last one returned
+	More bool `json:"more"`
+}
+
+// Event is a line of GET /v1/watch
+type Event struct {
+	Type  string `json:"type"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Index uint64 `json:"index"`
+}
+
+// StatusResponse is the body of GET /v1/status
+type StatusResponse struct {
+	ID         string                   `json:"id"`
+	Leader     string                   `json:"leader"`
+	Stats      map[string]string        `json:"stats"`
+	Encryption storage.EncryptionStatus `json:"encryption"`
+}
+
+// ClusterResponse is the body of GET /v1/cluster
+type ClusterResponse struct {
+	// ID is the node which answered
+	ID      string                `json:"id"`
+	Leader  string                `json:"leader"`
+	Members []server.MemberStatus `json:"members"`
+}
+
+// MemberRequest is the body of POST /v1/members
+type MemberRequest struct {
+	// Addr is the address of the new member, /ip4/<ip>/tcp/<port>/ipfs/<id>
+	Addr string `json:"addr"`
+	// Learner adds a nonvoter kept out of elections, else the member is
+	// promoted to voter once it caught up
+	Learner bool `json:"learner"`
+}
+
+func (h *HTTPServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := maxHTTPScanLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > 0 && n < limit {
+			limit = n
+		}
+	}
+	var start []byte
+	if s := q.Get("start"); s != "" {
+		start = []byte(s)
+	}
+	ts, past, err := parseAt(r)
+	if err != nil {
+		http.Error(w, "invalid at", http.StatusBadRequest)
+		return
+	}
+	if !h.fresh(w, r) {
+		return
+	}
+
+	user, err := h.authenticate(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	iterate := h.db.IterateFrom
+	if past {
+		iterate = func(prefix, start []byte, fn func(k, v []byte) bool) error {
+			return h.db.IterateAt(prefix, start, ts, fn)
+		}
+	}
+	resp := ScanResponse{KVs: []KV{}}
+	err = iterate([]byte(q.Get("prefix")), start, func(k, v []byte) bool {
+		if h.db.Authorize(user, k, server.PermRead) != nil {
+			return true
+		}
+		if len(resp.KVs) == limit {
+			resp.More = true
+			return false
+		}
+		resp.KVs = append(resp.KVs, KV{Key: k, Value: v})
+		return true
+	})
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// handleWatch stream a json Event per line until the client goes away
+func (h *HTTPServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	user, err := h.authenticate(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	events, cancel := h.db.Watch([]byte(r.URL.Query().Get("prefix")))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if h.db.Authorize(user, e.Key, server.PermRead) != nil {
+				continue
+			}
+			ev := Event{Type: "put", Key: e.Key, Value: e.Value, Index: e.Index}
+			if e.Type == server.EventDelete {
+				ev.Type = "delete"
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rf := h.db.Raft()
+	writeJSON(w, StatusResponse{
+		ID:         h.db.ID().Pretty(),
+		Leader:     string(rf.Leader()),
+		Stats:      rf.Stats(),
+		Encryption: h.db.Store().EncryptionStatus(),
+	})
+}
+
+func (h *HTTPServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	members, err := h.db.Cluster(r.Context())
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, ClusterResponse{
+		ID:      h.db.ID().Pretty(),
+		Leader:  string(h.db.Raft().Leader()),
+		Members: members,
+	})
+}
+
+// handleHealth is the liveness probe, it needs no auth
+func (h *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady is the readiness probe, it needs no auth
+func (h *HTTPServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(r.Context(), h.ReadyMaxLag); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (h *HTTPServer) handleMembers(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/members")
+	id = strings.TrimPrefix(id, "/")
+	if r.Method == http.MethodGet {
+		if _, err := h.authenticate(r); err != nil {
+			h.writeError(w, err)
+			return
+		}
+	} else if _, ok := h.allow(w, r, nil, server.PermAdmin); !ok {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		members, err := h.db.Members()
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		writeJSON(w, members)
+
+	case r.Method == http.MethodPost && id == "":
+		var req MemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr, err := ma.NewMultiaddr(req.Addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		add := h.db.AddMember
+		if req.Learner {
+			add = h.db.AddLearner
+		}
+		if err := add(info.ID, info.Addrs); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && id != "":
+		pid, err := peer.IDB58Decode(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.db.RemoveMember(pid); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTransfer move the leadership to the peer in the query parameter
+// to, or to any voter without it
+func (h *HTTPServer) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var target peer.ID
+	if to := r.URL.Query().Get("to"); to != "" {
+		pid, err := peer.IDB58Decode(to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target = pid
+	}
+	if err := h.db.TransferLeadership(target); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleRanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.db.Ranges())
+}
+
+// handleSplit split the range holding the key of the query at it, the new
+// range is written back
+func (h *HTTPServer) handleSplit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := h.db.Split([]byte(r.URL.Query().Get("key")))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, d)
+}
+
+// handleMerge merge the range of the query into the range before it, the
+// merged range is written back
+func (h *HTTPServer) handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid range id", http.StatusBadRequest)
+		return
+	}
+	d, err := h.db.Merge(id)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, d)
+}
+
+// handlePDNodes list the nodes known by the placement driver with their
+// labels, load and ranges
+func (h *HTTPServer) handlePDNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes, err := h.db.Nodes()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, nodes)
+}
+
+// handlePDDecisions list the last decisions of the placement driver,
+// newest first
+func (h *HTTPServer) handlePDDecisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decisions, err := h.db.Decisions()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, decisions)
+}
+
+// handleDrain drain the node, it shuts down once drained. The query
+// parameter leave removes it from the cluster, timeout bounds the wait for
+// the requests in flight.
+func (h *HTTPServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	leave := false
+	if v := q.Get("leave"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid leave", http.StatusBadRequest)
+			return
+		}
+		leave = b
+	}
+	timeout := DefaultDrainTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if err := h.db.Drain(ctx, leave); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.db.Snapshot(); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.BackupDir == "" {
+		http.Error(w, "backups are not configured", http.StatusNotImplemented)
+		return
+	}
+	info, err := h.db.Backup(h.BackupDir)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
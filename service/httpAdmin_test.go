@@ -0,0 +1,53 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/magicdb/server"
+)
+
+func TestHandleReady(t *testing.T) {
+	cases := []struct {
+		leader bool
+		lag    uint64
+		code   int
+	}{
+		{false, 0, http.StatusServiceUnavailable},
+		{true, DefaultReadyMaxLag + 1, http.StatusServiceUnavailable},
+		{true, DefaultReadyMaxLag, http.StatusOK},
+		{true, 0, http.StatusOK},
+	}
+	for _, c := range cases {
+		h := &HTTPServer{ReadyMaxLag: DefaultReadyMaxLag}
+		h.ready = func(ctx context.Context, maxLag uint64) error {
+			if !c.leader {
+				return server.ErrNoLeader
+			}
+			if c.lag > maxLag {
+				return server.ErrCatchingUp
+			}
+			return nil
+		}
+		w := httptest.NewRecorder()
+		h.handleReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if w.Code != c.code {
+			t.Fatalf("leader %v lag %d excepted %d but got %d: %s", c.leader, c.lag, c.code, w.Code, w.Body)
+		}
+	}
+}
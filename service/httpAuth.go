@@ -0,0 +1,228 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/magicdb/server"
+)
+
+// EnableAuthRequest is the body of POST /v1/auth/enable
+type EnableAuthRequest struct {
+	// Password of the root user
+	Password string `json:"password"`
+}
+
+// TokenRequest is the body of POST /v1/auth/token
+type TokenRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// TokenResponse is the body of a POST /v1/auth/token response, the token
+// is sent as "Authorization: Bearer <token>"
+type TokenResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// UserRequest is the body of PUT /v1/auth/users/<name>, an empty password
+// keeps the current one
+type UserRequest struct {
+	Password string   `json:"password,omitempty"`
+	Roles    []string `json:"roles"`
+}
+
+// RoleRequest is the body of PUT /v1/auth/roles/<name>
+type RoleRequest struct {
+	Permissions []server.Permission `json:"permissions"`
+}
+
+// authenticate return the user of a request, from a bearer token, basic
+// auth or the common name of a verified client certificate. It returns an
+// empty user while auth is disabled.
+func (h *HTTPServer) authenticate(r *http.Request) (string, error) {
+	on, err := h.db.AuthEnabled()
+	if err != nil || !on {
+		return "", err
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return h.db.VerifyToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		if err := h.db.Authenticate(name, password); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if err := h.db.CheckUser(name); err != nil {
+			return "", server.ErrAuthFailed
+		}
+		return name, nil
+	}
+	return "", server.ErrAuthRequired
+}
+
+// allow authenticate the request and check the user has perm on key, the
+// error is written to w when it returns false
+func (h *HTTPServer) allow(w http.ResponseWriter, r *http.Request, key []byte, perm server.Perm) (string, bool) {
+	user, err := h.authenticate(r)
+	if err == nil {
+		err = h.db.Authorize(user, key, perm)
+	}
+	if err != nil {
+		h.writeError(w, err)
+		return "", false
+	}
+	return user, true
+}
+
+// admin wrap a handler of the cluster api, it needs the admin permission
+func (h *HTTPServer) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.allow(w, r, nil, server.PermAdmin); ok {
+			next(w, r)
+		}
+	}
+}
+
+// authed wrap a handler open to every authenticated user
+func (h *HTTPServer) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := h.authenticate(r); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAuthEnable create root and turn auth on, it needs no credentials
+// as it only works once
+func (h *HTTPServer) handleAuthEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req EnableAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		http.Error(w, "a root password is required", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.EnableAuth(req.Password); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, expires, err := h.db.IssueToken(req.User, req.Password)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, TokenResponse{Token: token, Expires: expires})
+}
+
+func (h *HTTPServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/auth/users"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		users, err := h.db.Users()
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		writeJSON(w, users)
+
+	case r.Method == http.MethodPut && name != "":
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.db.PutUser(name, req.Password, req.Roles); err != nil {
+			if strings.HasPrefix(err.Error(), server.ErrUnknownRole.Error()) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && name != "":
+		if err := h.db.DeleteUser(name); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HTTPServer) handleRoles(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/auth/roles"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		roles, err := h.db.Roles()
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		writeJSON(w, roles)
+
+	case r.Method == http.MethodPut && name != "":
+		var req RoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.db.PutRole(server.Role{Name: name, Permissions: req.Permissions}); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && name != "":
+		if err := h.db.DeleteRole(name); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
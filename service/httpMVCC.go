@@ -0,0 +1,108 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicdb/raft"
+	"github.com/magicdb/server"
+)
+
+// PinsResponse is the body of GET /v1/pins, reads are served at the
+// timestamps from SafePoint on
+type PinsResponse struct {
+	SafePoint uint64       `json:"safe_point"`
+	Pins      []server.Pin `json:"pins"`
+}
+
+// PinRequest is the body of PUT /v1/pins/<name>
+type PinRequest struct {
+	TS    uint64 `json:"ts"`
+	TTLMs int64  `json:"ttl_ms"`
+}
+
+// parseAt parse the at query parameter of the reads in the past: a hybrid
+// timestamp such as one of /v1/tso, a RFC 3339 time, or a negative
+// duration before now such as -24h. ok is false without at.
+func parseAt(r *http.Request) (ts uint64, ok bool, err error) {
+	s := r.URL.Query().Get("at")
+	if s == "" {
+		return 0, false, nil
+	}
+	if ts, err = strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, true, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, true, err
+		}
+		return raft.HybridTime(time.Now().Add(d)), true, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, true, err
+	}
+	return raft.HybridTime(t), true, nil
+}
+
+// handlePins list the pins, and put or delete the pin /v1/pins/<name>
+func (h *HTTPServer) handlePins(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/pins"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		safe, err := h.db.SafePoint()
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		pins, err := h.db.Pins()
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		if pins == nil {
+			pins = []server.Pin{}
+		}
+		writeJSON(w, PinsResponse{SafePoint: safe, Pins: pins})
+
+	case r.Method == http.MethodPut && name != "":
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.db.Pin(name, req.TS, time.Duration(req.TTLMs)*time.Millisecond); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && name != "":
+		if err := h.db.Unpin(name); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -12,3 +12,390 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 package service
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/raft"
+	"github.com/magicdb/server"
+)
+
+const (
+	// LeaderHeader carries the peer id of the raft leader when a write is
+	// sent to a follower.
+	LeaderHeader = "X-Magicdb-Leader"
+
+	// DefaultReadyMaxLag is the default of HTTPServer.ReadyMaxLag
+	DefaultReadyMaxLag = 1000
+
+	// DefaultDrainTimeout bounds POST /v1/drain without a timeout
+	DefaultDrainTimeout = 30 * time.Second
+
+	// closeTimeout is how long Close waits for the requests in flight
+	closeTimeout = 5 * time.Second
+)
+
+// BatchRequest is the body of POST /v1/batch, keys and values are base64
+// encoded in json.
+type BatchRequest struct {
+	Puts    []KV     `json:"puts"`
+	Deletes [][]byte `json:"deletes"`
+}
+
+// KV is a key-value pair of the http api
+type KV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// HTTPServer serve the kv api over http
+//
+//	GET    /v1/kv/<key>?max_staleness=&at=  get a key, at a time in the past with at
+//	PUT    /v1/kv/<key>  put the request body as the value of key
+//	DELETE /v1/kv/<key>  delete a key
+//	POST   /v1/batch     write a BatchRequest atomically
+//	POST   /v1/tso?count=  timestamps of the oracle, see TimestampResponse
+//	GET    /v1/txn/kv/<key>?start_ts=  read a key in a transaction, see TxnGetResponse
+//	POST   /v1/txn/prewrite  lock the keys of a PrewriteRequest
+//	POST   /v1/txn/commit    commit the keys of a TxnKeysRequest
+//	POST   /v1/txn/rollback  roll the keys of a TxnKeysRequest back
+//	POST   /v1/txn/check     the server.TxnStatus of a CheckTxnRequest
+//	PUT    /v1/ingest/<name.sst>  ingest the sst file in the body, only while the keyspace is one range
+//	GET    /v1/scan?prefix=&start=&limit=&max_staleness=&at=  list pairs, see ScanResponse
+//	GET    /v1/watch?prefix=  stream a json Event per line
+//	GET    /v1/status    raft state of the node
+//	GET    /v1/cluster   members with their raft progress, see ClusterResponse
+//	GET    /health       200 while the process serves
+//	GET    /ready        200 once the node joined and caught up, else 503
+//	GET    /v1/members   list the members
+//	POST   /v1/members   add the member of a MemberRequest
+//	DELETE /v1/members/<id>  remove a member
+//	POST   /v1/leader/transfer?to=<id>  hand the leadership over
+//	POST   /v1/drain?leave=&timeout=  drain the node before it shuts down
+//	GET    /v1/ranges    the ranges of the keyspace with their leader
+//	POST   /v1/ranges/split?key=  split the range holding key at key
+//	POST   /v1/ranges/merge?id=  merge the range id into the range before it
+//	GET    /v1/pd/nodes  the nodes known by the placement driver, see server.NodeInfo
+//	GET    /v1/pd/decisions  the last placement decisions, see server.Decision
+//	POST   /v1/snapshot  take a raft snapshot
+//	POST   /v1/backup    take a backup into BackupDir
+//	GET    /v1/pins      the gc safe point and the pins, see PinsResponse
+//	PUT    /v1/pins/<name>  keep the versions at a timestamp, see PinRequest
+//	DELETE /v1/pins/<name>  drop a pin
+//	GET    /v1/replication  whether the cluster is a standby, see ReplicationResponse
+//	POST   /v1/replication/promote  promote the standby to take writes
+//	GET    /debug/vars   expvar counters, such as magicdb_gater_rejected
+//	GET    /metrics      prometheus metrics of the apis, raft, libp2p and rocksdb
+//	POST   /v1/auth/enable  create root from an EnableAuthRequest
+//	POST   /v1/auth/token   issue the token of a TokenRequest
+//	GET    /v1/auth/users   list the users
+//	PUT    /v1/auth/users/<name>  create or update a user from a UserRequest
+//	DELETE /v1/auth/users/<name>  remove a user
+//	GET    /v1/auth/roles   list the roles
+//	PUT    /v1/auth/roles/<name>  create or replace a role from a RoleRequest
+//	DELETE /v1/auth/roles/<name>  remove a role
+//
+// Once auth is enabled every request but enable, token, health and ready
+// must carry a bearer token, basic auth or a client certificate whose
+// common name is a user. The kv api checks the permissions of the user on
+// every key, scan and watch leave out the keys it cannot read. The cluster
+// and auth api need the admin permission, status, cluster, ranges and the
+// member list any user.
+//
+// Reads are served by any member, learners included. With max_staleness, a
+// duration such as 500ms, a node which heard from the leader longer ago
+// answers 503 so the client reads elsewhere.
+//
+// Every write keeps the previous versions of its keys for the gc window,
+// at is the time of a read in the past: a timestamp of /v1/tso, a RFC 3339
+// time or a duration before now such as -1h. A pin holds the safe point of
+// the gc back to its timestamp until it expires, so that a long read such
+// as a backup sees the same versions to its end.
+//
+// A standby cluster applies the changes its primary ships over libp2p and
+// refuses the writes, with 409, until it is promoted.
+//
+// The transactions are driven by the client, see client.Txn: it takes its
+// timestamps from the oracle on the leader, prewrites the keys of every
+// range on the leader of the range, then commits the primary key and the
+// others. Transactional reads are served by the leader of the range, a
+// read finding a lock resolves it with /v1/txn/check on the primary key.
+// The oracle hands out timestamps from the hybrid clock of the leader,
+// which follows the clocks of the other nodes through their libp2p
+// streams, and reserves them ahead through raft so that a new leader
+// never goes back.
+type HTTPServer struct {
+	// BackupDir is where POST /v1/backup writes, empty disables it
+	BackupDir string
+	// ReadyMaxLag is how many entries a node ready may be behind the
+	// commit index of the leader
+	ReadyMaxLag uint64
+	// TLS serves https when set, see CertReloader
+	TLS *tls.Config
+
+	db  *server.Server
+	mux *http.ServeMux
+	srv *http.Server
+	// ready is db.Ready, the readiness probe asks it
+	ready func(ctx context.Context, maxLag uint64) error
+}
+
+// NewHTTPServer create a http server for db listening on addr
+func NewHTTPServer(addr string, db *server.Server) *HTTPServer {
+	h := &HTTPServer{ReadyMaxLag: DefaultReadyMaxLag, db: db, mux: http.NewServeMux(), ready: db.Ready}
+	h.mux.HandleFunc("/v1/kv/", h.handleKV)
+	h.mux.HandleFunc("/v1/batch", h.handleBatch)
+	h.mux.HandleFunc("/v1/tso", h.authed(h.handleTimestamp))
+	h.mux.HandleFunc("/v1/txn/kv/", h.handleTxnGet)
+	h.mux.HandleFunc("/v1/txn/prewrite", h.handlePrewrite)
+	h.mux.HandleFunc("/v1/txn/commit", h.handleCommitTxn)
+	h.mux.HandleFunc("/v1/txn/rollback", h.handleRollbackTxn)
+	h.mux.HandleFunc("/v1/txn/check", h.handleCheckTxn)
+	h.mux.HandleFunc("/v1/ingest/", h.admin(h.handleIngest))
+	h.mux.HandleFunc("/v1/scan", h.handleScan)
+	h.mux.HandleFunc("/v1/watch", h.handleWatch)
+	h.mux.HandleFunc("/v1/status", h.authed(h.handleStatus))
+	h.mux.HandleFunc("/v1/cluster", h.authed(h.handleCluster))
+	h.mux.HandleFunc("/health", h.handleHealth)
+	h.mux.HandleFunc("/ready", h.handleReady)
+	h.mux.HandleFunc("/v1/members", h.handleMembers)
+	h.mux.HandleFunc("/v1/members/", h.handleMembers)
+	h.mux.HandleFunc("/v1/leader/transfer", h.admin(h.handleTransfer))
+	h.mux.HandleFunc("/v1/drain", h.admin(h.handleDrain))
+	h.mux.HandleFunc("/v1/ranges", h.authed(h.handleRanges))
+	h.mux.HandleFunc("/v1/ranges/split", h.admin(h.handleSplit))
+	h.mux.HandleFunc("/v1/ranges/merge", h.admin(h.handleMerge))
+	h.mux.HandleFunc("/v1/pd/nodes", h.admin(h.handlePDNodes))
+	h.mux.HandleFunc("/v1/pd/decisions", h.admin(h.handlePDDecisions))
+	h.mux.HandleFunc("/v1/snapshot", h.admin(h.handleSnapshot))
+	h.mux.HandleFunc("/v1/backup", h.admin(h.handleBackup))
+	h.mux.HandleFunc("/v1/pins", h.admin(h.handlePins))
+	h.mux.HandleFunc("/v1/pins/", h.admin(h.handlePins))
+	h.mux.HandleFunc("/v1/replication", h.admin(h.handleReplication))
+	h.mux.HandleFunc("/v1/replication/promote", h.admin(h.handlePromote))
+	h.mux.HandleFunc("/debug/vars", h.admin(expvar.Handler().ServeHTTP))
+	h.mux.HandleFunc("/metrics", h.admin(newMetricsHandler(db).ServeHTTP))
+	h.mux.HandleFunc("/v1/auth/enable", h.handleAuthEnable)
+	h.mux.HandleFunc("/v1/auth/token", h.handleToken)
+	h.mux.HandleFunc("/v1/auth/users", h.admin(h.handleUsers))
+	h.mux.HandleFunc("/v1/auth/users/", h.admin(h.handleUsers))
+	h.mux.HandleFunc("/v1/auth/roles", h.admin(h.handleRoles))
+	h.mux.HandleFunc("/v1/auth/roles/", h.admin(h.handleRoles))
+	h.srv = &http.Server{Addr: addr, Handler: instrument(h.mux)}
+	return h
+}
+
+// Start listening and serve in background, over tls TLS must hold a
+// certificate or GetCertificate
+func (h *HTTPServer) Start() error {
+	if h.TLS != nil && len(h.TLS.Certificates) == 0 && h.TLS.GetCertificate == nil {
+		return ErrNoCertificate
+	}
+	ln, err := net.Listen("tcp", h.srv.Addr)
+	if err != nil {
+		return err
+	}
+	if h.TLS != nil {
+		h.srv.TLSConfig = h.TLS
+		go h.srv.ServeTLS(ln, "", "")
+		return nil
+	}
+	go h.srv.Serve(ln)
+	return nil
+}
+
+// Close the http server, the requests in flight have closeTimeout to end
+func (h *HTTPServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := h.srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		return err
+	}
+	return h.srv.Close()
+}
+
+func (h *HTTPServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/kv/"))
+	if err != nil || key == "" {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+
+	perm := server.PermWrite
+	if r.Method == http.MethodGet {
+		perm = server.PermRead
+	}
+	if _, ok := h.allow(w, r, []byte(key), perm); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !h.fresh(w, r) {
+			return
+		}
+		ts, past, err := parseAt(r)
+		if err != nil {
+			http.Error(w, "invalid at", http.StatusBadRequest)
+			return
+		}
+		var v []byte
+		if past {
+			v, err = h.db.GetAt([]byte(key), ts)
+		} else {
+			v, err = h.db.Get([]byte(key))
+		}
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		if v == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(v)
+
+	case http.MethodPut:
+		v, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.db.Put([]byte(key), v); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := h.db.Delete([]byte(key)); err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HTTPServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.authenticate(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	keys := make([][]byte, len(req.Puts))
+	values := make([][]byte, len(req.Puts))
+	for i, kv := range req.Puts {
+		keys[i] = kv.Key
+		values[i] = kv.Value
+	}
+	for _, k := range append(keys, req.Deletes...) {
+		if err := h.db.Authorize(user, k, server.PermWrite); err != nil {
+			h.writeError(w, err)
+			return
+		}
+	}
+	if err := h.db.Write(keys, values, req.Deletes); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/ingest/")
+	if err := h.db.Ingest(name, r.Body); err != nil {
+		if err == server.ErrInvalidSSTName {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fresh check the max_staleness of a read, it writes the error and return
+// false when the node is too stale
+func (h *HTTPServer) fresh(w http.ResponseWriter, r *http.Request) bool {
+	s := r.URL.Query().Get("max_staleness")
+	if s == "" {
+		return true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		http.Error(w, "invalid max_staleness", http.StatusBadRequest)
+		return false
+	}
+	if err := h.db.CheckStaleness(d); err != nil {
+		h.writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeError map an error to a http status, writes sent to a follower get
+// 503 with the leader in LeaderHeader so clients can retry elsewhere.
+func (h *HTTPServer) writeError(w http.ResponseWriter, err error) {
+	if err == praft.ErrNotLeader || err == praft.ErrLeadershipTransferInProgress {
+		w.Header().Set(LeaderHeader, string(h.db.Raft().Leader()))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	switch err {
+	case server.ErrAuthRequired, server.ErrAuthFailed, server.ErrInvalidToken:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="magicdb"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case server.ErrPermissionDenied:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case server.ErrReservedKey, server.ErrRootImmutable, server.ErrCrossRange, server.ErrInvalidSplit,
+		server.ErrInvalidMerge, server.ErrInvalidPlacement, server.ErrInvalidCount, server.ErrInvalidPin,
+		raft.ErrClockOffset:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case server.ErrAuthEnabled, server.ErrRangeExists, server.ErrWriteConflict, server.ErrKeyLocked,
+		server.ErrTxnAborted, server.ErrTxnCommitted, server.ErrTxnTooOld, server.ErrTimestampTooOld,
+		server.ErrStandby, server.ErrNotStandby, server.ErrIngestSplit, server.ErrBackupIncomplete:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case server.ErrUnknownMember, server.ErrUnknownUser, server.ErrUnknownRole:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case server.ErrDraining, server.ErrTooStale, server.ErrRangeNotFound, server.ErrWrongRange,
+		server.ErrRangeMerging, server.ErrMergeAborted:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case server.ErrLastVoter:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicdb/server"
+)
+
+// TimestampResponse is the body of POST /v1/tso, the timestamps handed
+// out are TS to TS+Count-1
+type TimestampResponse struct {
+	TS    uint64 `json:"ts"`
+	Count int    `json:"count"`
+}
+
+// TxnGetResponse is the body of GET /v1/txn/kv/<key>, Lock is set instead
+// of the value when a transaction started before holds the key
+type TxnGetResponse struct {
+	Value []byte       `json:"value,omitempty"`
+	Found bool         `json:"found"`
+	Lock  *server.Lock `json:"lock,omitempty"`
+}
+
+// PrewriteRequest is the body of POST /v1/txn/prewrite, the keys of the
+// mutations belong to the same range
+type PrewriteRequest struct {
+	Primary   []byte            `json:"primary"`
+	StartTS   uint64            `json:"start_ts"`
+	TTLMs     int64             `json:"ttl_ms"`
+	Mutations []server.Mutation `json:"mutations"`
+}
+
+// TxnKeysRequest is the body of POST /v1/txn/commit and /v1/txn/rollback,
+// the keys belong to the same range. CommitTS is unused by rollback.
+type TxnKeysRequest struct {
+	StartTS  uint64   `json:"start_ts"`
+	CommitTS uint64   `json:"commit_ts,omitempty"`
+	Keys     [][]byte `json:"keys"`
+}
+
+// CheckTxnRequest is the body of POST /v1/txn/check
+type CheckTxnRequest struct {
+	Primary []byte `json:"primary"`
+	StartTS uint64 `json:"start_ts"`
+}
+
+// handleTimestamp hand out ?count timestamps of the oracle, 1 by default
+func (h *HTTPServer) handleTimestamp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 1
+	if s := r.URL.Query().Get("count"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	ts, err := h.db.Timestamps(n)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, TimestampResponse{TS: ts, Count: n})
+}
+
+// handleTxnGet read a key as of the start_ts of the query
+func (h *HTTPServer) handleTxnGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/txn/kv/"))
+	if err != nil || key == "" {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	ts, err := strconv.ParseUint(r.URL.Query().Get("start_ts"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid start_ts", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.allow(w, r, []byte(key), server.PermRead); !ok {
+		return
+	}
+	v, lock, err := h.db.TxnGet([]byte(key), ts)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, TxnGetResponse{Value: v, Found: v != nil, Lock: lock})
+}
+
+func (h *HTTPServer) handlePrewrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PrewriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the primary takes a lock too, even when it is not one of the mutations
+	keys := [][]byte{req.Primary}
+	for _, m := range req.Mutations {
+		keys = append(keys, m.Key)
+	}
+	if !h.allowKeys(w, r, keys) {
+		return
+	}
+	ttl := time.Duration(req.TTLMs) * time.Millisecond
+	if err := h.db.Prewrite(req.Primary, req.StartTS, ttl, req.Mutations); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPServer) handleCommitTxn(w http.ResponseWriter, r *http.Request) {
+	h.handleTxnKeys(w, r, func(req *TxnKeysRequest) error {
+		return h.db.CommitTxn(req.StartTS, req.CommitTS, req.Keys)
+	})
+}
+
+func (h *HTTPServer) handleRollbackTxn(w http.ResponseWriter, r *http.Request) {
+	h.handleTxnKeys(w, r, func(req *TxnKeysRequest) error {
+		return h.db.RollbackTxn(req.StartTS, req.Keys)
+	})
+}
+
+func (h *HTTPServer) handleTxnKeys(w http.ResponseWriter, r *http.Request, fn func(req *TxnKeysRequest) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TxnKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.allowKeys(w, r, req.Keys) {
+		return
+	}
+	if err := fn(&req); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCheckTxn return the TxnStatus of a transaction from its primary
+// key, rolling it back when its lock expired
+func (h *HTTPServer) handleCheckTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CheckTxnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.allowKeys(w, r, [][]byte{req.Primary}) {
+		return
+	}
+	st, err := h.db.CheckTxn(req.Primary, req.StartTS)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, st)
+}
+
+// allowKeys check the write permission of the user of r on keys, it writes
+// the error and return false when one is denied
+func (h *HTTPServer) allowKeys(w http.ResponseWriter, r *http.Request, keys [][]byte) bool {
+	user, err := h.authenticate(r)
+	if err != nil {
+		h.writeError(w, err)
+		return false
+	}
+	for _, k := range keys {
+		if err := h.db.Authorize(user, k, server.PermWrite); err != nil {
+			h.writeError(w, err)
+			return false
+		}
+	}
+	return true
+}
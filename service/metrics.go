@@ -0,0 +1,147 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magicdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The request metrics of the apis, labelled by api (http, resp or p2p)
+// and op. The result of a http request is its status code, of a redis
+// command ok or the prefix of its error, of a p2p request ok or error.
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "magicdb_request_duration_seconds",
+		Help:    "Latency of the api requests, watches excluded.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+	}, []string{"api", "op"})
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magicdb_requests_total",
+		Help: "Api requests by result.",
+	}, []string{"api", "op", "result"})
+
+	// gaterRejected bridges the expvar counters of the libp2p gater
+	gaterRejected = prometheus.NewExpvarCollector(map[string]*prometheus.Desc{
+		"magicdb_gater_rejected": prometheus.NewDesc("magicdb_gater_rejected_total",
+			"Connections closed by the gater, by reason.", []string{"reason"}, nil),
+	})
+)
+
+// httpOps name the routes in the op label, other paths are "other"
+var httpOps = []struct{ prefix, op string }{
+	{"/v1/batch", "batch"},
+	{"/v1/tso", "tso"},
+	{"/v1/txn/", "txn"},
+	{"/v1/ingest/", "ingest"},
+	{"/v1/scan", "scan"},
+	{"/v1/watch", "watch"},
+	{"/v1/status", "status"},
+	{"/v1/cluster", "cluster"},
+	{"/health", "health"},
+	{"/ready", "ready"},
+	{"/v1/members", "members"},
+	{"/v1/leader/", "transfer"},
+	{"/v1/drain", "drain"},
+	{"/v1/ranges", "ranges"},
+	{"/v1/pd/", "pd"},
+	{"/v1/snapshot", "snapshot"},
+	{"/v1/backup", "backup"},
+	{"/v1/pins", "pins"},
+	{"/v1/replication", "replication"},
+	{"/v1/auth/", "auth"},
+	{"/debug/vars", "vars"},
+	{"/metrics", "metrics"},
+}
+
+// newMetricsHandler serve the metrics of db and of the apis
+func newMetricsHandler(db *server.Server) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		requestDuration,
+		requestsTotal,
+		gaterRejected,
+		db.Collector(),
+	)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// observe record a request of api
+func observe(api, op, result string, start time.Time) {
+	if op != "watch" {
+		requestDuration.WithLabelValues(api, op).Observe(time.Since(start).Seconds())
+	}
+	requestsTotal.WithLabelValues(api, op, result).Inc()
+}
+
+// httpOp is the op label of a http request, the method for the kv api
+func httpOp(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		switch r.Method {
+		case http.MethodGet, http.MethodPut, http.MethodDelete:
+			return strings.ToLower(r.Method)
+		}
+		return "kv"
+	}
+	for _, route := range httpOps {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			return route.op
+		}
+	}
+	return "other"
+}
+
+// instrument record the requests served by next
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		observe("http", httpOp(r), strconv.Itoa(rec.status), start)
+	})
+}
+
+// statusRecorder keep the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush let the watches stream through the recorder
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// respResult is the result label of a redis command error
+func respResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return strings.SplitN(err.Error(), " ", 2)[0]
+}
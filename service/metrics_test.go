@@ -0,0 +1,71 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHTTPOp(t *testing.T) {
+	cases := []struct {
+		method, path, op string
+	}{
+		{http.MethodGet, "/v1/kv/foo", "get"},
+		{http.MethodPut, "/v1/kv/a/b", "put"},
+		{http.MethodPost, "/v1/kv/foo", "kv"},
+		{http.MethodPost, "/v1/batch", "batch"},
+		{http.MethodDelete, "/v1/members/Qm", "members"},
+		{http.MethodPut, "/v1/auth/users/bob", "auth"},
+		{http.MethodGet, "/nowhere", "other"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if op := httpOp(r); op != c.op {
+			t.Fatalf("httpOp(%s %s) excepted %s but got %s", c.method, c.path, c.op, op)
+		}
+	}
+
+	if r := respResult(errNoPerm); r != "NOPERM" {
+		t.Fatal("respResult excepted NOPERM but got ", r)
+	}
+	if r := respResult(nil); r != "ok" {
+		t.Fatal("respResult excepted ok but got ", r)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	h := instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Fatal("excepted the recorder to be a http.Flusher")
+		}
+		http.Error(w, "teapot", http.StatusTeapot)
+	}))
+	before := testCount(t, "http", "batch", "418")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/batch", nil))
+	if n := testCount(t, "http", "batch", "418"); n != before+1 {
+		t.Fatal("excepted one more request counted but got ", n-before)
+	}
+}
+
+func testCount(t *testing.T, labels ...string) float64 {
+	m := &dto.Metric{}
+	if err := requestsTotal.WithLabelValues(labels...).Write(m); err != nil {
+		t.Fatal("write metric error ", err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,308 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	praft "github.com/hashicorp/raft"
+	"github.com/libp2p/go-libp2p-core/network"
+	host "github.com/libp2p/go-libp2p-host"
+	"github.com/magicdb/pb"
+	"github.com/magicdb/server"
+)
+
+const (
+	// KVProtocol is the libp2p protocol of the kv api, see pb/kv.proto
+	KVProtocol = "/magicdb/kv/1.0.0"
+
+	// maxMessageSize is the max size of a request or a response
+	maxMessageSize = 64 << 20
+
+	// maxScanLimit caps the number of pairs of a SCAN response
+	maxScanLimit = 10000
+
+	// maxStreamRequests caps the requests of a stream handled at once, the
+	// stream is not read further meanwhile. A watch counts until it is
+	// registered.
+	maxStreamRequests = 64
+
+	// maxStreamWatches caps the watches open on a stream
+	maxStreamWatches = 1024
+)
+
+// P2PServer serve the kv store to libp2p peers over KVProtocol. When auth
+// is enabled every request carries a token and is checked against the
+// permissions of its user.
+type P2PServer struct {
+	host host.Host
+	db   *server.Server
+
+	mu      sync.Mutex
+	streams map[network.Stream]struct{}
+}
+
+// NewP2PServer create a kv protocol server for db on the host h
+func NewP2PServer(h host.Host, db *server.Server) *P2PServer {
+	return &P2PServer{
+		host:    h,
+		db:      db,
+		streams: make(map[network.Stream]struct{}),
+	}
+}
+
+// Start handling KVProtocol streams
+func (ps *P2PServer) Start() {
+	ps.host.SetStreamHandler(KVProtocol, ps.handleStream)
+}
+
+// Close stop handling new streams and reset the open ones
+func (ps *P2PServer) Close() error {
+	ps.host.RemoveStreamHandler(KVProtocol)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for s := range ps.streams {
+		s.Reset()
+	}
+	return nil
+}
+
+// kvStream is a stream of multiplexed requests
+type kvStream struct {
+	ps     *P2PServer
+	stream network.Stream
+
+	wmu sync.Mutex
+	w   ggio.WriteCloser
+
+	// slots holds a token for every request being handled
+	slots chan struct{}
+
+	mu      sync.Mutex
+	watches map[uint64]func()
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func (ps *P2PServer) handleStream(stream network.Stream) {
+	ps.mu.Lock()
+	ps.streams[stream] = struct{}{}
+	ps.mu.Unlock()
+
+	ks := &kvStream{
+		ps:      ps,
+		stream:  stream,
+		w:       ggio.NewDelimitedWriter(stream),
+		slots:   make(chan struct{}, maxStreamRequests),
+		watches: make(map[uint64]func()),
+	}
+	ks.serve()
+
+	ps.mu.Lock()
+	delete(ps.streams, stream)
+	ps.mu.Unlock()
+}
+
+// serve read requests until the stream is closed, each request is handled
+// in its own goroutine so a slow one does not hold up the others, up to
+// maxStreamRequests at once
+func (ks *kvStream) serve() {
+	r := ggio.NewDelimitedReader(ks.stream, maxMessageSize)
+	defer func() {
+		ks.mu.Lock()
+		ks.closed = true
+		for id, cancel := range ks.watches {
+			delete(ks.watches, id)
+			cancel()
+		}
+		ks.mu.Unlock()
+		ks.wg.Wait()
+		ks.stream.Close()
+	}()
+
+	for {
+		req := new(pb.Request)
+		if err := r.ReadMsg(req); err != nil {
+			return
+		}
+		if req.Op == pb.Op_CANCEL {
+			ks.cancel(req.Id)
+			continue
+		}
+		ks.slots <- struct{}{}
+		ks.wg.Add(1)
+		go func() {
+			defer ks.wg.Done()
+			var once sync.Once
+			release := func() {
+				once.Do(func() { <-ks.slots })
+			}
+			defer release()
+			ks.handle(req, release)
+		}()
+	}
+}
+
+// handle req, release frees its slot and is called by a watch once it is
+// registered
+func (ks *kvStream) handle(req *pb.Request, release func()) {
+	start := time.Now()
+	db := ks.ps.db
+	resp := &pb.Response{Id: req.Id}
+	user, err := ks.authenticate(req)
+	if err == nil {
+		switch req.Op {
+		case pb.Op_GET:
+			if err = db.Authorize(user, req.Key, server.PermRead); err == nil {
+				resp.Value, err = db.Get(req.Key)
+				resp.Found = resp.Value != nil
+			}
+		case pb.Op_PUT:
+			if err = db.Authorize(user, req.Key, server.PermWrite); err == nil {
+				err = db.Put(req.Key, req.Value)
+			}
+		case pb.Op_DELETE:
+			if err = db.Authorize(user, req.Key, server.PermWrite); err == nil {
+				err = db.Delete(req.Key)
+			}
+		case pb.Op_SCAN:
+			err = ks.scan(user, req, resp)
+		case pb.Op_WATCH:
+			ks.watch(user, req, release)
+			return
+		default:
+			resp.Error = "unknown op " + req.Op.String()
+		}
+	}
+	if err != nil {
+		ks.setError(resp, err)
+	}
+	result := "ok"
+	if resp.Error != "" {
+		result = "error"
+	}
+	observe("p2p", strings.ToLower(req.Op.String()), result, start)
+	ks.send(resp)
+}
+
+// authenticate return the user of the request token, or an empty user
+// while auth is disabled
+func (ks *kvStream) authenticate(req *pb.Request) (string, error) {
+	on, err := ks.ps.db.AuthEnabled()
+	if err != nil || !on {
+		return "", err
+	}
+	if req.Token == "" {
+		return "", server.ErrAuthRequired
+	}
+	return ks.ps.db.VerifyToken(req.Token)
+}
+
+func (ks *kvStream) scan(user string, req *pb.Request, resp *pb.Response) error {
+	limit := int(req.Limit)
+	if limit == 0 || limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+	var start []byte
+	if len(req.Start) > 0 {
+		start = req.Start
+	}
+	return ks.ps.db.IterateFrom(req.Key, start, func(k, v []byte) bool {
+		if ks.ps.db.Authorize(user, k, server.PermRead) != nil {
+			return true
+		}
+		if len(resp.Kvs) == limit {
+			resp.More = true
+			return false
+		}
+		resp.Kvs = append(resp.Kvs, &pb.KV{Key: k, Value: v})
+		return true
+	})
+}
+
+// watch send an event response for every change until the watch is
+// cancelled, then a final response with no event. A watch is not
+// registered once the stream is closed.
+func (ks *kvStream) watch(user string, req *pb.Request, release func()) {
+	events, cancel := ks.ps.db.Watch(req.Key)
+	ks.mu.Lock()
+	refused := ""
+	switch _, dup := ks.watches[req.Id]; {
+	case ks.closed:
+		refused = "stream closed"
+	case dup:
+		refused = "duplicate watch id"
+	case len(ks.watches) >= maxStreamWatches:
+		refused = "too many watches"
+	default:
+		ks.watches[req.Id] = cancel
+	}
+	ks.mu.Unlock()
+	release()
+	if refused != "" {
+		cancel()
+		ks.send(&pb.Response{Id: req.Id, Error: refused})
+		return
+	}
+
+	for e := range events {
+		if ks.ps.db.Authorize(user, e.Key, server.PermRead) != nil {
+			continue
+		}
+		ev := &pb.Event{Key: e.Key, Value: e.Value, Index: e.Index}
+		if e.Type == server.EventDelete {
+			ev.Type = pb.EventType_EVENT_DELETE
+		}
+		if err := ks.send(&pb.Response{Id: req.Id, Event: ev}); err != nil {
+			ks.cancel(req.Id)
+		}
+	}
+
+	// The channel is also closed when the watcher is too slow
+	ks.mu.Lock()
+	_, live := ks.watches[req.Id]
+	delete(ks.watches, req.Id)
+	ks.mu.Unlock()
+	resp := &pb.Response{Id: req.Id}
+	if live {
+		resp.Error = "watch lagged behind"
+	}
+	ks.send(resp)
+}
+
+func (ks *kvStream) cancel(id uint64) {
+	ks.mu.Lock()
+	cancel, ok := ks.watches[id]
+	delete(ks.watches, id)
+	ks.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (ks *kvStream) setError(resp *pb.Response, err error) {
+	resp.Error = err.Error()
+	if err == praft.ErrNotLeader {
+		resp.Leader = string(ks.ps.db.Raft().Leader())
+	}
+}
+
+func (ks *kvStream) send(resp *pb.Response) error {
+	ks.wmu.Lock()
+	defer ks.wmu.Unlock()
+	return ks.w.WriteMsg(resp)
+}
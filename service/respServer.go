@@ -0,0 +1,949 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/magicdb/server"
+)
+
+const (
+	// maxBulkLen is the max length of a bulk string in a request
+	maxBulkLen = 512 << 20
+
+	// maxArgs is the max number of arguments of a request
+	maxArgs = 1 << 20
+
+	// defaultScanCount is the number of keys returned by SCAN without COUNT
+	defaultScanCount = 10
+)
+
+var (
+	errProtocol  = errors.New("ERR Protocol error")
+	errSyntax    = errors.New("ERR syntax error")
+	errNotInt    = errors.New("ERR value is not an integer or out of range")
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errNoPerm    = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// RESPServer serve the kv store over the redis protocol, RESP2 by default
+// and RESP3 after HELLO 3, so redis-cli and redis clients can use magicdb.
+// Supported commands are GET, SET, DEL, MGET, MSET, EXISTS, INCR, SCAN,
+// EXPIRE, TTL and PING, plus AUTH, HELLO, SELECT 0, COMMAND and QUIT.
+//
+// Once auth is enabled a connection must run AUTH user password, AUTH
+// token or HELLO 3 AUTH user password first, then every key is checked
+// against the permissions of the user and SCAN leaves out the keys it
+// cannot read. Over TLS a verified client certificate whose common name
+// is a user authenticates the connection.
+type RESPServer struct {
+	// TLS serves the connections over tls when set, see CertReloader
+	TLS *tls.Config
+
+	addr string
+	db   *server.Server
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// respHandler run a command, args[0] is the command name
+type respHandler func(c *respConn, args [][]byte) error
+
+// NewRESPServer create a redis protocol server for db listening on addr
+func NewRESPServer(addr string, db *server.Server) *RESPServer {
+	return &RESPServer{
+		addr:  addr,
+		db:    db,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listening and serve in background
+func (rs *RESPServer) Start() error {
+	ln, err := net.Listen("tcp", rs.addr)
+	if err != nil {
+		return err
+	}
+	if rs.TLS != nil {
+		ln = tls.NewListener(ln, rs.TLS)
+	}
+	rs.mu.Lock()
+	rs.ln = ln
+	rs.mu.Unlock()
+
+	rs.wg.Add(1)
+	go rs.serve(ln)
+	return nil
+}
+
+// Close stop listening and close every connection
+func (rs *RESPServer) Close() error {
+	rs.mu.Lock()
+	var err error
+	if rs.ln != nil {
+		err = rs.ln.Close()
+	}
+	for conn := range rs.conns {
+		conn.Close()
+	}
+	rs.mu.Unlock()
+
+	rs.wg.Wait()
+	return err
+}
+
+func (rs *RESPServer) serve(ln net.Listener) {
+	defer rs.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		rs.mu.Lock()
+		rs.conns[conn] = struct{}{}
+		rs.mu.Unlock()
+
+		rs.wg.Add(1)
+		go func() {
+			defer rs.wg.Done()
+			rs.serveConn(conn)
+
+			rs.mu.Lock()
+			delete(rs.conns, conn)
+			rs.mu.Unlock()
+		}()
+	}
+}
+
+func (rs *RESPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &respConn{
+		rs:    rs,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
+		proto: 2,
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		c.loginCert(tc.ConnectionState())
+	}
+
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				c.writeError(errProtocol)
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		start := time.Now()
+		name := strings.ToUpper(string(args[0]))
+		h, ok := respCommands[name]
+		if !ok {
+			err = fmt.Errorf("ERR unknown command '%s'", args[0])
+			name = "UNKNOWN"
+		} else if err = c.checkAuth(name); err == nil {
+			err = h(c, args)
+		}
+		if err != nil {
+			err = rs.mapError(err)
+			c.writeError(err)
+		}
+		observe("resp", strings.ToLower(name), respResult(err), start)
+
+		// flush once the pipelined commands are all answered
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if c.quit {
+			return
+		}
+	}
+}
+
+// mapError turn a store error into a redis error reply
+func (rs *RESPServer) mapError(err error) error {
+	switch err {
+	case praft.ErrNotLeader:
+		return fmt.Errorf("READONLY not the leader, leader is %s", rs.db.Raft().Leader())
+	case server.ErrNotInteger:
+		return errNotInt
+	case server.ErrAuthRequired:
+		return errNoAuth
+	case server.ErrPermissionDenied:
+		return errNoPerm
+	case server.ErrAuthFailed, server.ErrInvalidToken:
+		return errWrongPass
+	}
+	for _, prefix := range []string{"ERR ", "WRONGTYPE ", "NOAUTH ", "NOPERM ", "WRONGPASS "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return err
+		}
+	}
+	return fmt.Errorf("ERR %v", err)
+}
+
+var respCommands map[string]respHandler
+
+func init() {
+	respCommands = map[string]respHandler{
+		"PING":    cmdPing,
+		"AUTH":    cmdAuth,
+		"HELLO":   cmdHello,
+		"SELECT":  cmdSelect,
+		"COMMAND": cmdCommand,
+		"QUIT":    cmdQuit,
+		"GET":     cmdGet,
+		"SET":     cmdSet,
+		"DEL":     cmdDel,
+		"MGET":    cmdMGet,
+		"MSET":    cmdMSet,
+		"EXISTS":  cmdExists,
+		"INCR":    cmdIncr,
+		"SCAN":    cmdScan,
+		"EXPIRE":  cmdExpire,
+		"TTL":     cmdTTL,
+	}
+}
+
+// arity check a command has at least min arguments, the name included
+func arity(args [][]byte, min int) error {
+	if len(args) < min {
+		return wrongArgs(args)
+	}
+	return nil
+}
+
+func wrongArgs(args [][]byte) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(args[0])))
+}
+
+func cmdPing(c *respConn, args [][]byte) error {
+	if len(args) > 2 {
+		return wrongArgs(args)
+	}
+	if len(args) == 2 {
+		c.writeBulk(args[1])
+		return nil
+	}
+	c.writeSimple("PONG")
+	return nil
+}
+
+// cmdAuth: AUTH [user] secret, the secret is the password of the user, or
+// a token without a user
+func cmdAuth(c *respConn, args [][]byte) error {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgs(args)
+	}
+	on, err := c.rs.db.AuthEnabled()
+	if err != nil {
+		return err
+	}
+	if !on {
+		return errors.New("ERR AUTH called without any password configured. Are you sure your configuration is correct?")
+	}
+	if len(args) == 2 {
+		err = c.loginToken(string(args[1]))
+	} else {
+		err = c.login(string(args[1]), string(args[2]))
+	}
+	if err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// cmdHello negotiate the protocol: HELLO [protover [AUTH user pass] [SETNAME name]]
+func cmdHello(c *respConn, args [][]byte) error {
+	proto := c.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return errors.New("NOPROTO unsupported protocol version")
+		}
+		proto = v
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			if err := c.login(string(args[i+1]), string(args[i+2])); err != nil {
+				return err
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if c.user == "" {
+		on, err := c.rs.db.AuthEnabled()
+		if err != nil {
+			return err
+		}
+		if on {
+			return errors.New("NOAUTH HELLO must be called with the client already authenticated, " +
+				"otherwise the HELLO AUTH <user> <pass> option can be used")
+		}
+	}
+	c.proto = proto
+
+	fields := []struct {
+		key string
+		val interface{}
+	}{
+		{"server", "magicdb"},
+		{"version", "1.0.0"},
+		{"proto", int64(c.proto)},
+		{"id", int64(0)},
+		{"mode", "standalone"},
+		{"role", "master"},
+	}
+	c.writeMap(len(fields))
+	for _, f := range fields {
+		c.writeBulk([]byte(f.key))
+		switch v := f.val.(type) {
+		case string:
+			c.writeBulk([]byte(v))
+		case int64:
+			c.writeInt(v)
+		}
+	}
+	return nil
+}
+
+func cmdSelect(c *respConn, args [][]byte) error {
+	if err := arity(args, 2); err != nil {
+		return err
+	}
+	if string(args[1]) != "0" {
+		return errors.New("ERR DB index is out of range")
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+func cmdCommand(c *respConn, args [][]byte) error {
+	c.writeArray(0)
+	return nil
+}
+
+func cmdQuit(c *respConn, args [][]byte) error {
+	c.quit = true
+	c.writeSimple("OK")
+	return nil
+}
+
+func cmdGet(c *respConn, args [][]byte) error {
+	if len(args) != 2 {
+		return wrongArgs(args)
+	}
+	if err := c.allow(server.PermRead, args[1]); err != nil {
+		return err
+	}
+	v, err := c.rs.db.Get(args[1])
+	if err != nil {
+		return err
+	}
+	c.writeBulk(v)
+	return nil
+}
+
+// cmdSet: SET key value [NX|XX] [EX seconds|PX milliseconds]
+func cmdSet(c *respConn, args [][]byte) error {
+	if err := arity(args, 3); err != nil {
+		return err
+	}
+	var opts server.SetOptions
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return errNotInt
+			}
+			unit := time.Second
+			if strings.ToUpper(string(args[i])) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl, ok := expireDuration(n, unit)
+			if !ok || n <= 0 {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			opts.TTL = ttl
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if opts.NX && opts.XX {
+		return errSyntax
+	}
+	if err := c.allow(server.PermWrite, args[1]); err != nil {
+		return err
+	}
+
+	ok, err := c.rs.db.Set(args[1], args[2], opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.writeNull()
+		return nil
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+func cmdDel(c *respConn, args [][]byte) error {
+	if err := arity(args, 2); err != nil {
+		return err
+	}
+	if err := c.allow(server.PermWrite, args[1:]...); err != nil {
+		return err
+	}
+	n, err := c.rs.db.Del(args[1:])
+	if err != nil {
+		return err
+	}
+	c.writeInt(int64(n))
+	return nil
+}
+
+func cmdMGet(c *respConn, args [][]byte) error {
+	if err := arity(args, 2); err != nil {
+		return err
+	}
+	if err := c.allow(server.PermRead, args[1:]...); err != nil {
+		return err
+	}
+	values := make([][]byte, len(args)-1)
+	for i, k := range args[1:] {
+		v, err := c.rs.db.Get(k)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	c.writeArray(len(values))
+	for _, v := range values {
+		c.writeBulk(v)
+	}
+	return nil
+}
+
+func cmdMSet(c *respConn, args [][]byte) error {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs(args)
+	}
+	var keys, values [][]byte
+	for i := 1; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, args[i+1])
+	}
+	if err := c.allow(server.PermWrite, keys...); err != nil {
+		return err
+	}
+	if err := c.rs.db.BatchPut(keys, values); err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+func cmdExists(c *respConn, args [][]byte) error {
+	if err := arity(args, 2); err != nil {
+		return err
+	}
+	if err := c.allow(server.PermRead, args[1:]...); err != nil {
+		return err
+	}
+	n, err := c.rs.db.Exists(args[1:])
+	if err != nil {
+		return err
+	}
+	c.writeInt(int64(n))
+	return nil
+}
+
+func cmdIncr(c *respConn, args [][]byte) error {
+	if len(args) != 2 {
+		return wrongArgs(args)
+	}
+	if err := c.allow(server.PermWrite, args[1]); err != nil {
+		return err
+	}
+	n, err := c.rs.db.Incr(args[1], 1)
+	if err != nil {
+		return err
+	}
+	c.writeInt(n)
+	return nil
+}
+
+// cmdScan: SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the
+// number of matching keys already returned, so it stays valid on any node.
+func cmdScan(c *respConn, args [][]byte) error {
+	if err := arity(args, 2); err != nil {
+		return err
+	}
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return errors.New("ERR invalid cursor")
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	var keys [][]byte
+	var seen uint64
+	more := false
+	err = c.rs.db.Iterate(globPrefix(pattern), func(k, v []byte) bool {
+		if pattern != nil && !globMatch(pattern, k) {
+			return true
+		}
+		if c.allow(server.PermRead, k) != nil {
+			return true
+		}
+		seen++
+		if seen <= cursor {
+			return true
+		}
+		if len(keys) == count {
+			more = true
+			return false
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	next := uint64(0)
+	if more {
+		next = cursor + uint64(len(keys))
+	}
+	c.writeArray(2)
+	c.writeBulk([]byte(strconv.FormatUint(next, 10)))
+	c.writeArray(len(keys))
+	for _, k := range keys {
+		c.writeBulk(k)
+	}
+	return nil
+}
+
+func cmdExpire(c *respConn, args [][]byte) error {
+	if len(args) != 3 {
+		return wrongArgs(args)
+	}
+	secs, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	ttl, ok := expireDuration(secs, time.Second)
+	if !ok {
+		return errors.New("ERR invalid expire time in 'expire' command")
+	}
+	if err := c.allow(server.PermWrite, args[1]); err != nil {
+		return err
+	}
+	ok, err = c.rs.db.Expire(args[1], ttl)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.writeInt(1)
+	} else {
+		c.writeInt(0)
+	}
+	return nil
+}
+
+// expireDuration return n units, false when it does not fit a duration
+func expireDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func cmdTTL(c *respConn, args [][]byte) error {
+	if len(args) != 2 {
+		return wrongArgs(args)
+	}
+	if err := c.allow(server.PermRead, args[1]); err != nil {
+		return err
+	}
+	ttl, ok, err := c.rs.db.TTL(args[1])
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok:
+		c.writeInt(-2)
+	case ttl < 0:
+		c.writeInt(-1)
+	default:
+		// round up like redis, a key with 0.5s left has a ttl of 1
+		c.writeInt(int64((ttl + time.Second - 1) / time.Second))
+	}
+	return nil
+}
+
+// respConn is a client connection and its protocol state
+type respConn struct {
+	rs    *RESPServer
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+	quit  bool
+
+	// user is set by AUTH or HELLO AUTH
+	user string
+}
+
+// noAuthCommands run before the connection is authenticated
+var noAuthCommands = map[string]bool{"AUTH": true, "HELLO": true, "PING": true, "QUIT": true}
+
+// checkAuth return ErrAuthRequired when auth is enabled, the connection
+// is not authenticated yet and the command needs it
+func (c *respConn) checkAuth(name string) error {
+	if c.user != "" || noAuthCommands[name] {
+		return nil
+	}
+	on, err := c.rs.db.AuthEnabled()
+	if err != nil || !on {
+		return err
+	}
+	return server.ErrAuthRequired
+}
+
+// allow check the user of the connection has perm on every key
+func (c *respConn) allow(perm server.Perm, keys ...[]byte) error {
+	for _, k := range keys {
+		if err := c.rs.db.Authorize(c.user, k, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *respConn) login(name, password string) error {
+	if err := c.rs.db.Authenticate(name, password); err != nil {
+		return err
+	}
+	c.user = name
+	return nil
+}
+
+// loginCert authenticate the user of the common name of a verified client
+// certificate, the connection stays anonymous when it is not a user
+func (c *respConn) loginCert(state tls.ConnectionState) {
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	if c.rs.db.CheckUser(name) == nil {
+		c.user = name
+	}
+}
+
+func (c *respConn) loginToken(token string) error {
+	name, err := c.rs.db.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+	c.user = name
+	return nil
+}
+
+// readCommand read a request, either a RESP array of bulk strings or an
+// inline command as typed in telnet
+func (c *respConn) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		var args [][]byte
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	// a null or empty array is an empty command, the arguments are not
+	// preallocated from the n of the client
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < -1 || n > maxArgs {
+		return nil, errProtocol
+	}
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		// the bulk grows as its bytes arrive, not from the size the client
+		// announced
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, c.r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b := buf.Bytes()
+		if b[size] != '\r' || b[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, b[:size])
+	}
+	return args, nil
+}
+
+func (c *respConn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(err error) {
+	c.w.WriteString("-" + strings.Replace(err.Error(), "\r\n", " ", -1) + "\r\n")
+}
+
+func (c *respConn) writeInt(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// writeBulk write a bulk string, nil is written as null
+func (c *respConn) writeBulk(b []byte) {
+	if b == nil {
+		c.writeNull()
+		return
+	}
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+		return
+	}
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArray(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeMap write a map header, RESP2 has no maps so it is a flat array
+func (c *respConn) writeMap(n int) {
+	if c.proto == 3 {
+		c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	c.writeArray(2 * n)
+}
+
+// globPrefix return the literal prefix of a glob pattern
+func globPrefix(pattern []byte) []byte {
+	for i, ch := range pattern {
+		switch ch {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// globMatch match s against a redis glob pattern supporting * ? [...] and
+// backslash escapes
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) {
+				// no closing bracket, match '[' literally
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				pattern = pattern[1:]
+				continue
+			}
+			if !matchClass(pattern[1:end], s[0]) {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[end+1:]
+
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass match ch against the content of a [...] class
+func matchClass(class []byte, ch byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		c := class[i]
+		if c == '\\' && i+1 < len(class) {
+			i++
+			c = class[i]
+		} else if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := c, class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if ch >= lo && ch <= hi {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+		if c == ch {
+			matched = true
+		}
+	}
+	return matched != negate
+}
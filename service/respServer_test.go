@@ -0,0 +1,134 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	}
+	for _, c := range cases {
+		if got := globMatch([]byte(c.pattern), []byte(c.s)); got != c.match {
+			t.Fatalf("globMatch(%q, %q) excepted %v but got %v", c.pattern, c.s, c.match, got)
+		}
+	}
+
+	if p := string(globPrefix([]byte("user:*:name"))); p != "user:" {
+		t.Fatal("globPrefix excepted 'user:' but got ", p)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\nPING hello\r\n"
+	c := &respConn{r: bufio.NewReader(strings.NewReader(input)), proto: 2}
+
+	args, err := c.readCommand()
+	if err != nil {
+		t.Fatal("Read RESP command error ", err)
+	}
+	if len(args) != 3 || string(args[0]) != "SET" || string(args[2]) != "bar" {
+		t.Fatalf("Read RESP command got unexcepted %q", args)
+	}
+
+	args, err = c.readCommand()
+	if err != nil {
+		t.Fatal("Read inline command error ", err)
+	}
+	if len(args) != 2 || string(args[0]) != "PING" || string(args[1]) != "hello" {
+		t.Fatalf("Read inline command got unexcepted %q", args)
+	}
+}
+
+func TestReadCommandArrayLength(t *testing.T) {
+	c := &respConn{r: bufio.NewReader(strings.NewReader("*-1\r\n*0\r\n")), proto: 2}
+	for i := 0; i < 2; i++ {
+		args, err := c.readCommand()
+		if err != nil || len(args) != 0 {
+			t.Fatalf("Read null or empty array excepted no arguments but got %q %v", args, err)
+		}
+	}
+	for _, input := range []string{"*-2\r\n", "*-9223372036854775808\r\n", "*99999999999\r\n"} {
+		c = &respConn{r: bufio.NewReader(strings.NewReader(input)), proto: 2}
+		if _, err := c.readCommand(); err != errProtocol {
+			t.Fatalf("Read %q excepted %v but got %v", input, errProtocol, err)
+		}
+	}
+}
+
+func TestExpireOverflow(t *testing.T) {
+	c := &respConn{}
+	cmds := [][]string{
+		{"EXPIRE", "k", "9300000000"},
+		{"SET", "k", "v", "EX", "9300000000"},
+		{"SET", "k", "v", "PX", "9223372036855"},
+	}
+	for _, cmd := range cmds {
+		var args [][]byte
+		for _, a := range cmd {
+			args = append(args, []byte(a))
+		}
+		run := cmdExpire
+		if cmd[0] == "SET" {
+			run = cmdSet
+		}
+		if err := run(c, args); err == nil || !strings.Contains(err.Error(), "invalid expire time") {
+			t.Fatalf("%q excepted an invalid expire time but got %v", cmd, err)
+		}
+	}
+}
+
+func TestReadCommandTruncatedBulk(t *testing.T) {
+	// a huge bulk announced but never sent is not allocated upfront
+	c := &respConn{r: bufio.NewReader(strings.NewReader("*1\r\n$500000000\r\nabc")), proto: 2}
+	if _, err := c.readCommand(); err != io.ErrUnexpectedEOF {
+		t.Fatal("Read truncated bulk excepted io.ErrUnexpectedEOF but got ", err)
+	}
+}
+
+func TestWriteNull(t *testing.T) {
+	var buf bytes.Buffer
+	c := &respConn{w: bufio.NewWriter(&buf), proto: 2}
+	c.writeBulk(nil)
+	c.proto = 3
+	c.writeBulk(nil)
+	c.w.Flush()
+
+	if buf.String() != "$-1\r\n_\r\n" {
+		t.Fatalf("Null replies got unexcepted %q", buf.String())
+	}
+}
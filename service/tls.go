@@ -0,0 +1,212 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// ErrNoClientCA is returned when a client certificate is required
+	// without a ClientCAFile to verify it
+	ErrNoClientCA = errors.New("tls: client certificates required without a client ca file")
+	// ErrBadClientCA is returned when ClientCAFile holds no pem certificate
+	ErrBadClientCA = errors.New("tls: no certificate in the client ca file")
+	// ErrNoCertificate is returned when starting a server over tls without
+	// a certificate
+	ErrNoCertificate = errors.New("tls: no server certificate")
+)
+
+// TLSConfig are the certificate files of the http and redis servers
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies the client certificates, a verified certificate
+	// authenticates the user of its common name
+	ClientCAFile string
+	// RequireClientCert rejects the clients without a certificate signed by
+	// ClientCAFile, otherwise a certificate is only verified when sent
+	RequireClientCert bool
+}
+
+// CertReloader serve the tls config of a TLSConfig, the files are loaded
+// again when they change. A change that fails to load keeps the previous
+// certificates.
+type CertReloader struct {
+	cfg     TLSConfig
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+
+	mu   sync.RWMutex
+	conf *tls.Config
+	err  error
+}
+
+// NewCertReloader load the files of cfg and watch them
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, ErrNoClientCA
+	}
+	r := &CertReloader{cfg: cfg, done: make(chan struct{})}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// the directories are watched, the files are often replaced by a
+	// rename or a symlink swap
+	dirs := make(map[string]bool)
+	for _, f := range r.files() {
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	r.watcher = w
+	go r.watch()
+	return r, nil
+}
+
+// Config return the tls config of the servers, every handshake uses the
+// last loaded certificates. GetCertificate is set too, the servers check
+// for it before serving.
+func (r *CertReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// Err return the error of the last reload, nil when it succeeded
+func (r *CertReloader) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Reload load the files again
+func (r *CertReloader) Reload() error {
+	conf, err := r.load()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	if err == nil {
+		r.conf = conf
+	}
+	return err
+}
+
+// Close stop watching the files
+func (r *CertReloader) Close() error {
+	close(r.done)
+	return r.watcher.Close()
+}
+
+func (r *CertReloader) current() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conf
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *CertReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.cfg.ClientCAFile == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, ErrBadClientCA
+	}
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if r.cfg.RequireClientCert {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// changed reports whether ev may have changed one of the files, the
+// "..data" symlink of a kubernetes secret volume included
+func (r *CertReloader) changed(ev fsnotify.Event) bool {
+	name := filepath.Clean(ev.Name)
+	if strings.HasPrefix(filepath.Base(name), "..") {
+		return true
+	}
+	for _, f := range r.files() {
+		if filepath.Clean(f) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reload the files on every change in their directories
+func (r *CertReloader) watch() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case ev, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if r.changed(ev) {
+				r.Reload()
+			}
+		case _, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert write a self-signed certificate of cn and its key to
+// <dir>/<name>.crt and <dir>/<name>.key, replacing them by a rename
+func writeCert(t *testing.T, dir, name, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key error ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate error ", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("marshal key error ", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	for ext, data := range map[string][]byte{".key": keyPEM, ".crt": certPEM} {
+		tmp := filepath.Join(dir, "."+name+ext+".tmp")
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			t.Fatal("write error ", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name+ext)); err != nil {
+			t.Fatal("rename error ", err)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal("key pair error ", err)
+	}
+	return cert
+}
+
+// handshake connect to ln and return the common name of the server
+// certificate
+func handshake(ln net.Listener, certs ...tls.Certificate) (string, error) {
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       certs,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// the server verifies the client certificate after the client finished
+	// its handshake, a read returns its alert
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return "", err
+		}
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+// serveTLS accept the connections of ln and hold them until closed
+func serveTLS(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if conn.(*tls.Conn).Handshake() == nil {
+				conn.Read(make([]byte, 1))
+			}
+		}()
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-tls")
+	if err != nil {
+		t.Fatal("tempdir error ", err)
+	}
+	defer os.RemoveAll(dir)
+	writeCert(t, dir, "server", "one")
+
+	cfg := TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	r, err := NewCertReloader(cfg)
+	if err != nil {
+		t.Fatal("NewCertReloader error ", err)
+	}
+	defer r.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.Config())
+	if err != nil {
+		t.Fatal("listen error ", err)
+	}
+	defer ln.Close()
+	go serveTLS(ln)
+
+	if cn, err := handshake(ln); err != nil || cn != "one" {
+		t.Fatal("excepted certificate one but got ", cn, err)
+	}
+
+	writeCert(t, dir, "server", "two")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cn, err := handshake(ln)
+		if err != nil {
+			t.Fatal("handshake error ", err)
+		}
+		if cn == "two" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("excepted the reloaded certificate two but got ", cn)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a broken key keeps the last certificate
+	if err := ioutil.WriteFile(cfg.KeyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal("write error ", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("excepted an error reloading a broken key")
+	}
+	if cn, err := handshake(ln); err != nil || cn != "two" {
+		t.Fatal("excepted certificate two but got ", cn, err)
+	}
+}
+
+func TestHTTPServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-tls")
+	if err != nil {
+		t.Fatal("tempdir error ", err)
+	}
+	defer os.RemoveAll(dir)
+	writeCert(t, dir, "server", "one")
+
+	r, err := NewCertReloader(TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")})
+	if err != nil {
+		t.Fatal("NewCertReloader error ", err)
+	}
+	defer r.Close()
+
+	h := &HTTPServer{srv: &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}}
+	h.TLS = &tls.Config{}
+	if err := h.Start(); err != ErrNoCertificate {
+		t.Fatal("Start without a certificate excepted ErrNoCertificate but got ", err)
+	}
+	h.TLS = r.Config()
+	if err := h.Start(); err != nil {
+		t.Fatal("Start error ", err)
+	}
+	h.Close()
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-tls")
+	if err != nil {
+		t.Fatal("tempdir error ", err)
+	}
+	defer os.RemoveAll(dir)
+	writeCert(t, dir, "server", "server")
+	client := writeCert(t, dir, "client", "alice")
+	other := writeCert(t, dir, "other", "mallory")
+
+	cfg := TLSConfig{
+		CertFile:          filepath.Join(dir, "server.crt"),
+		KeyFile:           filepath.Join(dir, "server.key"),
+		RequireClientCert: true,
+	}
+	if _, err := NewCertReloader(cfg); err != ErrNoClientCA {
+		t.Fatal("excepted ErrNoClientCA but got ", err)
+	}
+	cfg.ClientCAFile = filepath.Join(dir, "client.crt")
+	r, err := NewCertReloader(cfg)
+	if err != nil {
+		t.Fatal("NewCertReloader error ", err)
+	}
+	defer r.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.Config())
+	if err != nil {
+		t.Fatal("listen error ", err)
+	}
+	defer ln.Close()
+	go serveTLS(ln)
+
+	if _, err := handshake(ln, client); err != nil {
+		t.Fatal("handshake with a client certificate error ", err)
+	}
+	if _, err := handshake(ln); err == nil {
+		t.Fatal("excepted an error without a client certificate")
+	}
+	if _, err := handshake(ln, other); err == nil {
+		t.Fatal("excepted an error with an unknown client certificate")
+	}
+}
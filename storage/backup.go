@@ -0,0 +1,274 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// backupMetaDir holds magicdb's own metadata next to the BackupEngine files
+const backupMetaDir = "magicdb"
+
+var (
+	// ErrBackupNotFound is returned when a backup id does not exist
+	ErrBackupNotFound = errors.New("backup not found")
+)
+
+// BackupInfo describe a backup
+type BackupInfo struct {
+	ID        uint32
+	Timestamp int64
+	Size      int64
+	NumFiles  int32
+
+	// AppliedIndex is the raft index the backup corresponds to
+	AppliedIndex uint64
+
+	// GroupIndexes is the applied raft index of every raft group of the
+	// store, the range 0 included
+	GroupIndexes map[uint64]uint64 `json:",omitempty"`
+
+	// Labels are recorded by the caller, e.g. the raft term and members
+	Labels map[string]string
+}
+
+// Backup create an incremental backup of the store in dir. The backup is
+// taken from a checkpoint, so the data and the applied raft index recorded
+// for it are always consistent with each other.
+func (s *KvStore) Backup(dir string, labels map[string]string) (*BackupInfo, error) {
+	if err := os.MkdirAll(filepath.Join(dir, backupMetaDir), 0755); err != nil {
+		return nil, err
+	}
+	// The checkpoint sits next to the db so its files can be hard linked
+	cpDir := fmt.Sprintf("%s.checkpoint-%d", s.name, time.Now().UnixNano())
+	defer os.RemoveAll(cpDir)
+
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	cp, err := s.db.NewCheckpoint()
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	err = cp.CreateCheckpoint(cpDir, 0)
+	cp.Destroy()
+	s.release()
+	if err != nil {
+		return nil, err
+	}
+
+	// BackupEngine needs to pause file deletions, which a read-only db
+	// does not support, so the private checkpoint is opened read-write.
+	cpDB, err := gorocksdb.OpenDb(s.opts, cpDir)
+	if err != nil {
+		return nil, err
+	}
+	defer cpDB.Close()
+
+	ro := gorocksdb.NewDefaultReadOptions()
+	groups := make(map[uint64]uint64)
+	err = iterate(cpDB, ro, appliedIndexKey, nil, func(k, v []byte) bool {
+		if group, ok := appliedGroup(k); ok {
+			groups[group] = decodeIndex(v)
+		}
+		return true
+	})
+	ro.Destroy()
+	if err != nil {
+		return nil, err
+	}
+
+	be, err := gorocksdb.OpenBackupEngine(s.opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer be.Close()
+
+	if err := be.CreateNewBackupFlush(cpDB, false); err != nil {
+		return nil, err
+	}
+	infos := backupEngineInfos(be)
+	if len(infos) == 0 {
+		return nil, ErrBackupNotFound
+	}
+	info := infos[len(infos)-1]
+	info.AppliedIndex = groups[0]
+	info.GroupIndexes = groups
+	info.Labels = labels
+
+	if err := writeBackupMeta(dir, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ListBackups return the backups in dir, oldest first
+func ListBackups(opts *gorocksdb.Options, dir string) ([]*BackupInfo, error) {
+	be, err := gorocksdb.OpenBackupEngine(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer be.Close()
+
+	infos := backupEngineInfos(be)
+	for _, info := range infos {
+		meta, err := readBackupMeta(dir, info.ID)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if meta != nil {
+			info.AppliedIndex = meta.AppliedIndex
+			info.GroupIndexes = meta.GroupIndexes
+			info.Labels = meta.Labels
+		}
+	}
+	return infos, nil
+}
+
+// PurgeBackups delete all but the latest keep backups in dir
+func PurgeBackups(opts *gorocksdb.Options, dir string, keep uint32) error {
+	be, err := gorocksdb.OpenBackupEngine(opts, dir)
+	if err != nil {
+		return err
+	}
+	defer be.Close()
+
+	if err := be.PurgeOldBackups(keep); err != nil {
+		return err
+	}
+
+	alive := make(map[uint32]bool)
+	for _, info := range backupEngineInfos(be) {
+		alive[info.ID] = true
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, backupMetaDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 32)
+		if err != nil || alive[uint32(id)] {
+			continue
+		}
+		os.Remove(filepath.Join(dir, backupMetaDir, f.Name()))
+	}
+	return nil
+}
+
+// VerifyBackup check that every file of the backup with id in dir exists
+// with the size recorded by the BackupEngine, the checksums are verified
+// by RestoreBackup
+func VerifyBackup(opts *gorocksdb.Options, dir string, id uint32) error {
+	be, err := openBackup(opts, dir, id)
+	if err != nil {
+		return err
+	}
+	defer be.Close()
+	return verifyBackup(be, id)
+}
+
+// RestoreBackup restore the backup with id from dir into the empty or
+// missing directory dbDir. Every file is verified while it is copied.
+func RestoreBackup(opts *gorocksdb.Options, dir string, id uint32, dbDir string) (*BackupInfo, error) {
+	existing, err := ioutil.ReadDir(dbDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("restore target %s is not empty", dbDir)
+	}
+	be, err := openBackup(opts, dir, id)
+	if err != nil {
+		return nil, err
+	}
+	defer be.Close()
+	if err := restoreBackup(be, id, dbDir); err != nil {
+		return nil, err
+	}
+
+	info, err := readBackupMeta(dir, id)
+	if os.IsNotExist(err) {
+		return &BackupInfo{ID: id}, nil
+	}
+	return info, err
+}
+
+// openBackup open the BackupEngine of dir, ErrBackupNotFound is returned
+// if it has no backup with id
+func openBackup(opts *gorocksdb.Options, dir string, id uint32) (*gorocksdb.BackupEngine, error) {
+	be, err := gorocksdb.OpenBackupEngine(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range backupEngineInfos(be) {
+		if info.ID == id {
+			return be, nil
+		}
+	}
+	be.Close()
+	return nil, ErrBackupNotFound
+}
+
+func backupEngineInfos(be *gorocksdb.BackupEngine) []*BackupInfo {
+	bi := be.GetInfo()
+	defer bi.Destroy()
+
+	infos := make([]*BackupInfo, bi.GetCount())
+	for i := range infos {
+		infos[i] = &BackupInfo{
+			ID:        uint32(bi.GetBackupId(i)),
+			Timestamp: bi.GetTimestamp(i),
+			Size:      bi.GetSize(i),
+			NumFiles:  bi.GetNumFiles(i),
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func backupMetaPath(dir string, id uint32) string {
+	return filepath.Join(dir, backupMetaDir, fmt.Sprintf("%d.json", id))
+}
+
+func writeBackupMeta(dir string, info *BackupInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(backupMetaPath(dir, info.ID), data, 0644)
+}
+
+func readBackupMeta(dir string, id uint32) (*BackupInfo, error) {
+	data, err := ioutil.ReadFile(backupMetaPath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+// #cgo LDFLAGS: -lrocksdb
+// #include <stdlib.h>
+// #include "rocksdb/c.h"
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// gorocksdb does not wrap the backup engine calls on a given backup, they
+// are called on its C handle
+
+// verifyBackup check that every file of the backup id exists with the size
+// the BackupEngine recorded
+func verifyBackup(be *gorocksdb.BackupEngine, id uint32) error {
+	var cErr *C.char
+	C.rocksdb_backup_engine_verify_backup(cBackupEngine(be), C.uint32_t(id), &cErr)
+	return cError(cErr)
+}
+
+// restoreBackup restore the backup id into dbDir, the BackupEngine checks
+// the checksum of every file it copies
+func restoreBackup(be *gorocksdb.BackupEngine, id uint32, dbDir string) error {
+	cDir := C.CString(dbDir)
+	defer C.free(unsafe.Pointer(cDir))
+	ro := C.rocksdb_restore_options_create()
+	defer C.rocksdb_restore_options_destroy(ro)
+
+	var cErr *C.char
+	C.rocksdb_backup_engine_restore_db_from_backup(cBackupEngine(be), cDir, cDir, ro, C.uint32_t(id), &cErr)
+	return cError(cErr)
+}
+
+func cBackupEngine(be *gorocksdb.BackupEngine) *C.rocksdb_backup_engine_t {
+	return (*C.rocksdb_backup_engine_t)(be.UnsafeGetBackupEngine())
+}
+
+func cError(cErr *C.char) error {
+	if cErr == nil {
+		return nil
+	}
+	defer C.rocksdb_free(unsafe.Pointer(cErr))
+	return errors.New(C.GoString(cErr))
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+var (
+	backupPath  = "/tmp/magicdb-backup-test"
+	restorePath = "/tmp/magicdb-restore-test"
+)
+
+func TestBackupRestore(t *testing.T) {
+	os.RemoveAll(backupPath)
+	os.RemoveAll(restorePath)
+	defer os.RemoveAll(backupPath)
+	defer os.RemoveAll(restorePath)
+
+	opts := buildOpts()
+	store, err := NewKvStore(opts, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Apply(5, []KV{{"backup", "ok"}}, nil)
+	if err == nil {
+		err = store.ApplyGroup(12, 3, nil, nil)
+	}
+	if err != nil {
+		store.Close()
+		t.Fatal("Apply error ", err)
+	}
+	info, err := store.Backup(backupPath, map[string]string{"term": "1"})
+	store.Close()
+	if err != nil {
+		t.Fatal("Backup error ", err)
+	}
+	if info.AppliedIndex != 5 {
+		t.Fatal("Backup applied index excepted 5 but got ", info.AppliedIndex)
+	}
+	if info.GroupIndexes[0] != 5 || info.GroupIndexes[12] != 3 {
+		t.Fatal("Backup applied indexes of the groups got unexcepted ", info.GroupIndexes)
+	}
+
+	infos, err := ListBackups(opts, backupPath)
+	if err != nil {
+		t.Fatal("List backups error ", err)
+	}
+	if len(infos) != 1 || infos[0].ID != info.ID || infos[0].Labels["term"] != "1" || infos[0].GroupIndexes[12] != 3 {
+		t.Fatal("List backups got unexcepted ", infos)
+	}
+
+	if err := VerifyBackup(opts, backupPath, info.ID); err != nil {
+		t.Fatal("Verify backup error ", err)
+	}
+
+	if _, err := RestoreBackup(opts, backupPath, info.ID, restorePath); err != nil {
+		t.Fatal("Restore backup error ", err)
+	}
+	restored, err := NewKvStore(opts, restorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	v, err := restored.Get("backup")
+	if err != nil {
+		t.Fatal("Get from restored store error ", err)
+	}
+	if string(v) != "ok" {
+		t.Fatal("Restored value excepted 'ok' but got ", string(v))
+	}
+	index, err := restored.AppliedIndex()
+	if err != nil || index != 5 {
+		t.Fatal("Restored applied index excepted 5 but got ", index, err)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// resealRetry is the delay before a failed reseal pass is run again
+const resealRetry = time.Minute
+
+// EncryptionStatus describes the encryption at rest of a store
+type EncryptionStatus struct {
+	Enabled   bool   `json:"enabled"`
+	ActiveKey uint32 `json:"activeKey,omitempty"`
+	// Resealing is true while the values are encrypted again with the
+	// active key, after a rotation or an ingest
+	Resealing bool `json:"resealing"`
+	// Resealed counts the values encrypted again since the store opened
+	Resealed uint64 `json:"resealed"`
+	// Error of the last reseal pass, it is run again after a minute
+	Error string `json:"error,omitempty"`
+}
+
+// SetKeyring turn on the encryption of the values, or rotate its key.
+// Values written from now on are encrypted with the active key of kr, the
+// older ones are encrypted again in background. kr must know every key
+// the stored values are encrypted with.
+func (s *KvStore) SetKeyring(kr *Keyring) {
+	s.kr.Store(kr)
+	s.encMu.Lock()
+	s.enc.Enabled = true
+	s.enc.ActiveKey = kr.Active()
+	s.encMu.Unlock()
+	s.requestReseal()
+}
+
+// EncryptionStatus return the state of the encryption at rest
+func (s *KvStore) EncryptionStatus() EncryptionStatus {
+	s.encMu.Lock()
+	defer s.encMu.Unlock()
+	return s.enc
+}
+
+func (s *KvStore) keyring() *Keyring {
+	kr, _ := s.kr.Load().(*Keyring)
+	return kr
+}
+
+// sealValue encrypt the value of k if encryption is on, the local keys
+// are never encrypted. A plain value is escaped.
+func (s *KvStore) sealValue(k, v []byte) ([]byte, error) {
+	kr := s.keyring()
+	if kr == nil || isLocalKey(k) {
+		return escape(v), nil
+	}
+	return kr.seal(k, v)
+}
+
+// sealPairs split kvpair into keys and encrypted values
+func (s *KvStore) sealPairs(kvpair []KV) ([][]byte, [][]byte, error) {
+	keys := make([][]byte, len(kvpair))
+	values := make([][]byte, len(kvpair))
+	for i, _kv := range kvpair {
+		keys[i] = toBytes(_kv.Key)
+		v, err := s.sealValue(keys[i], toBytes(_kv.Value))
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = v
+	}
+	return keys, values, nil
+}
+
+// adoptValue prepare a value of a dump for the store: an encrypted value
+// is kept if its key is known, a plain one is encrypted
+func (s *KvStore) adoptValue(k, v []byte) ([]byte, error) {
+	if !isSealed(v) {
+		return s.sealValue(k, unescape(v))
+	}
+	kr := s.keyring()
+	if kr == nil {
+		return nil, ErrNoKeyring
+	}
+	if _, ok := kr.keys[sealedKey(v)]; !ok {
+		return nil, ErrUnknownDataKey
+	}
+	return v, nil
+}
+
+// iterateOpen is iterate decrypting the values
+func (s *KvStore) iterateOpen(ro *gorocksdb.ReadOptions, prefix, start []byte,
+	fn func(k, v []byte) bool) error {
+
+	kr := s.keyring()
+	var err error
+	iterErr := iterate(s.db, ro, prefix, start, func(k, v []byte) bool {
+		if v, err = kr.open(k, v); err != nil {
+			return false
+		}
+		return fn(k, v)
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
+
+func (s *KvStore) requestReseal() {
+	select {
+	case s.reseal <- struct{}{}:
+	default:
+	}
+}
+
+// resealLoop run a reseal pass when requested, until the store is closed
+func (s *KvStore) resealLoop() {
+	defer s.bg.Done()
+	for {
+		select {
+		case <-s.reseal:
+		case <-s.closing:
+			return
+		}
+		kr := s.keyring()
+		if kr == nil {
+			continue
+		}
+
+		s.encMu.Lock()
+		s.enc.Resealing = true
+		s.encMu.Unlock()
+		n, err := s.resealPass(kr)
+		if l := s.attachedRaftLog(); l != nil && err != ErrClosed {
+			m, lerr := l.reseal(kr)
+			n += m
+			if err == nil {
+				err = lerr
+			}
+		}
+		s.encMu.Lock()
+		s.enc.Resealing = false
+		s.enc.Resealed += uint64(n)
+		s.enc.Error = ""
+		if err != nil {
+			s.enc.Error = err.Error()
+		}
+		s.encMu.Unlock()
+
+		if err == ErrClosed {
+			return
+		}
+		if err != nil {
+			select {
+			case <-time.After(resealRetry):
+				s.requestReseal()
+			case <-s.closing:
+				return
+			}
+		}
+	}
+}
+
+// setRaftLog set the raft log encrypted with the keyring of the store, nil
+// once it is closed
+func (s *KvStore) setRaftLog(l *RaftLog) {
+	s.encMu.Lock()
+	s.raftLog = l
+	s.encMu.Unlock()
+	if l != nil && s.keyring() != nil {
+		s.requestReseal()
+	}
+}
+
+func (s *KvStore) attachedRaftLog() *RaftLog {
+	s.encMu.Lock()
+	defer s.encMu.Unlock()
+	return s.raftLog
+}
+
+// resealPass encrypt with the active key of kr every value which is plain
+// or encrypted with another key, then compact the store so the old
+// ciphertexts leave the disk. A value written meanwhile is left alone.
+func (s *KvStore) resealPass(kr *Keyring) (int, error) {
+	var keys, olds, news [][]byte
+	total := 0
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		n := 0
+		err := s.writeExclusive(func(wb *gorocksdb.WriteBatch) {
+			for i, k := range keys {
+				cur, err := s.db.GetBytes(s.ro, k)
+				if err == nil && bytes.Equal(cur, olds[i]) {
+					wb.Put(k, news[i])
+					n++
+				}
+			}
+		})
+		keys, olds, news = nil, nil, nil
+		total += n
+		return err
+	}
+
+	// a value which does not open is skipped, the pass goes on and reports
+	// the first such error at its end
+	var err, openErr error
+	iterErr := iterate(s.db, s.ro, nil, nil, func(k, v []byte) bool {
+		if isLocalKey(k) || !kr.stale(v) {
+			return true
+		}
+		plain, oerr := kr.open(k, v)
+		if oerr != nil {
+			if openErr == nil {
+				openErr = oerr
+			}
+			return true
+		}
+		var sealed []byte
+		if sealed, err = kr.seal(k, plain); err != nil {
+			return false
+		}
+		keys = append(keys, k)
+		olds = append(olds, v)
+		news = append(news, sealed)
+		if len(keys) >= loadBatchSize {
+			err = flush()
+		}
+		return err == nil
+	})
+	if iterErr != nil {
+		return total, iterErr
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return total, err
+	}
+	if total > 0 {
+		s.db.CompactRange(gorocksdb.Range{})
+	}
+	return total, openErr
+}
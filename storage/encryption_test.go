@@ -0,0 +1,133 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEncryption(t *testing.T) {
+	os.RemoveAll(tmpPath)
+	defer os.RemoveAll(tmpPath)
+	store, err := NewKvStore(buildOpts(), tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Put("plain", "old"); err != nil {
+		t.Fatal(err)
+	}
+	k1 := bytes.Repeat([]byte{1}, DataKeySize)
+	kr1, _ := NewKeyring(map[uint32][]byte{1: k1}, 1)
+	store.SetKeyring(kr1)
+	if err := store.Put("foo", "bar"); err != nil {
+		t.Fatal("Put with encryption error ", err)
+	}
+
+	raw, _ := store.db.GetBytes(store.ro, []byte("foo"))
+	if !isSealed(raw) || sealedKey(raw) != 1 {
+		t.Fatalf("Stored value excepted to be encrypted with key 1 but got %q", raw)
+	}
+	if v, _ := store.Get("foo"); string(v) != "bar" {
+		t.Fatalf("Get excepted bar but got %q", v)
+	}
+
+	// rotate, every value ends up encrypted with the new key
+	kr2, _ := NewKeyring(map[uint32][]byte{1: k1, 2: bytes.Repeat([]byte{2}, DataKeySize)}, 2)
+	store.SetKeyring(kr2)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := store.EncryptionStatus()
+		done := !st.Resealing
+		for _, k := range []string{"plain", "foo"} {
+			raw, _ := store.db.GetBytes(store.ro, []byte(k))
+			done = done && isSealed(raw) && sealedKey(raw) == 2
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Values were not encrypted again with key 2 ", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, _ := store.Get("plain"); string(v) != "old" {
+		t.Fatalf("Get excepted old but got %q", v)
+	}
+
+	// a dump keeps the values encrypted and loads back
+	snap, err := store.NewSnapshot()
+	if err != nil {
+		t.Fatal("NewSnapshot error ", err)
+	}
+	var buf bytes.Buffer
+	err = snap.Dump(&buf)
+	snap.Release()
+	if err != nil {
+		t.Fatal("Dump error ", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("bar")) {
+		t.Fatal("Dump contains a plain value")
+	}
+	if err := store.Load(&buf); err != nil {
+		t.Fatal("Load error ", err)
+	}
+	if v, _ := store.Get("foo"); string(v) != "bar" {
+		t.Fatalf("Get after Load excepted bar but got %q", v)
+	}
+}
+
+func TestEncryptionMagicValue(t *testing.T) {
+	os.RemoveAll(tmpPath)
+	defer os.RemoveAll(tmpPath)
+	store, err := NewKvStore(buildOpts(), tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// a plain value which looks like an encrypted one
+	magic := sealMagic + "\x00\x00\x00\x07value"
+	if err := store.Put("magic", magic); err != nil {
+		t.Fatal("Put error ", err)
+	}
+	if v, err := store.Get("magic"); err != nil || string(v) != magic {
+		t.Fatalf("Get excepted %q but got %q, %v", magic, v, err)
+	}
+
+	kr, _ := NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, DataKeySize)}, 1)
+	store.SetKeyring(kr)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := store.EncryptionStatus()
+		raw, _ := store.db.GetBytes(store.ro, []byte("magic"))
+		if !st.Resealing && isSealed(raw) && sealedKey(raw) == 1 {
+			if st.Error != "" {
+				t.Fatal("Reseal error ", st.Error)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Value was not encrypted with key 1 ", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := store.Get("magic"); err != nil || string(v) != magic {
+		t.Fatalf("Get with encryption excepted %q but got %q, %v", magic, v, err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+var (
+	// ErrUnsorted is returned when keys are not added to a sst in order
+	ErrUnsorted = errors.New("sst keys must be added in strictly increasing order")
+
+	// ErrEmptySST is returned when finishing a sst without keys
+	ErrEmptySST = errors.New("sst has no keys")
+)
+
+// SSTWriter build a sst file offline which can be ingested into a store
+type SSTWriter struct {
+	w       *gorocksdb.SSTFileWriter
+	envOpts *gorocksdb.EnvOptions
+	last    []byte
+	count   int
+}
+
+// NewSSTWriter create a sst file at path, opts must match the store's
+func NewSSTWriter(opts *gorocksdb.Options, path string) (*SSTWriter, error) {
+	envOpts := gorocksdb.NewDefaultEnvOptions()
+	w := gorocksdb.NewSSTFileWriter(envOpts, opts)
+	if err := w.Open(path); err != nil {
+		w.Destroy()
+		envOpts.Destroy()
+		return nil, err
+	}
+	return &SSTWriter{w: w, envOpts: envOpts}, nil
+}
+
+// Add a key-value, keys must be added in strictly increasing order
+func (w *SSTWriter) Add(k, v []byte) error {
+	return w.add(k, escape(v))
+}
+
+// add a key-value as it is stored
+func (w *SSTWriter) add(k, v []byte) error {
+	if w.count > 0 && bytes.Compare(k, w.last) <= 0 {
+		return ErrUnsorted
+	}
+	if err := w.w.Add(k, v); err != nil {
+		return err
+	}
+	w.last = append(w.last[:0], k...)
+	w.count++
+	return nil
+}
+
+// Count return the number of keys added
+func (w *SSTWriter) Count() int {
+	return w.count
+}
+
+// Finish write the sst file, it must be called once after the last Add
+func (w *SSTWriter) Finish() error {
+	if w.count == 0 {
+		return ErrEmptySST
+	}
+	return w.w.Finish()
+}
+
+// Close release the writer
+func (w *SSTWriter) Close() {
+	w.w.Destroy()
+	w.envOpts.Destroy()
+}
+
+// Ingest the sst files at paths as the raft log entry at index, with the
+// system keys kvs written along. The applied index and kvs are ingested
+// with them in a sst of their own, so a crash leaves either all or none.
+// The files hold no system key, which keeps that sst from overlapping them.
+// The files are copied, not moved, so they stay available to other
+// replicas. With encryption on, the plain values of the files are
+// encrypted in background.
+func (s *KvStore) Ingest(index uint64, paths []string, kvs []KV) error {
+	if len(paths) == 0 {
+		return s.Apply(index, kvs, nil)
+	}
+	indexPath := filepath.Join(filepath.Dir(paths[0]), fmt.Sprintf(".applied-%d.sst", index))
+	if err := s.writeIndexSST(indexPath, index, kvs); err != nil {
+		return err
+	}
+	defer os.Remove(indexPath)
+
+	opts := gorocksdb.NewDefaultIngestExternalFileOptions()
+	defer opts.Destroy()
+	opts.SetMoveFiles(false)
+
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	err := s.db.IngestExternalFile(append(paths[:len(paths):len(paths)], indexPath), opts)
+	s.release()
+	if err != nil {
+		return err
+	}
+	if s.keyring() != nil {
+		s.requestReseal()
+	}
+	return nil
+}
+
+// writeIndexSST write a sst file at path holding the applied index of the
+// raft group 0 and kvs, the last of the pairs sharing a key wins
+func (s *KvStore) writeIndexSST(path string, index uint64, kvs []KV) error {
+	keys, values, err := s.sealPairs(append(kvs[:len(kvs):len(kvs)], KV{appliedKey(0), encodeIndex(index)}))
+	if err != nil {
+		return err
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	w, err := NewSSTWriter(s.opts, path)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for n, i := range order {
+		if n+1 < len(order) && bytes.Equal(keys[i], keys[order[n+1]]) {
+			continue
+		}
+		if err := w.add(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+// ReadSST call fn with the key-values of the sst file at path in order
+// until it returns false. The file is copied into a scratch store next to
+// it to be read.
+func ReadSST(path string, fn func(k, v []byte) bool) error {
+	dir := path + ".read"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := gorocksdb.NewDefaultOptions()
+	defer opts.Destroy()
+	opts.SetCreateIfMissing(true)
+	db, err := gorocksdb.OpenDb(opts, dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ingestOpts := gorocksdb.NewDefaultIngestExternalFileOptions()
+	defer ingestOpts.Destroy()
+	ingestOpts.SetMoveFiles(false)
+	if err := db.IngestExternalFile([]string{path}, ingestOpts); err != nil {
+		return err
+	}
+
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	return iterate(db, ro, nil, nil, func(k, v []byte) bool {
+		return fn(k, unescape(v))
+	})
+}
+
+// Name return the directory of the store
+func (s *KvStore) Name() string {
+	return s.name
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+var sstPath = "/tmp/magicdb-test.sst"
+
+func TestIngest(t *testing.T) {
+	defer os.Remove(sstPath)
+	opts := buildOpts()
+
+	w, err := NewSSTWriter(opts, sstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := w.Add([]byte(fmt.Sprintf("sst-%d", i)), []byte("v")); err != nil {
+			w.Close()
+			t.Fatal("SST add error ", err)
+		}
+	}
+	if err := w.Add([]byte("sst-0"), []byte("v")); err != ErrUnsorted {
+		w.Close()
+		t.Fatal("SST add unsorted key, excepted ErrUnsorted but got ", err)
+	}
+	err = w.Finish()
+	w.Close()
+	if err != nil {
+		t.Fatal("SST finish error ", err)
+	}
+
+	n := 0
+	err = ReadSST(sstPath, func(k, v []byte) bool {
+		if string(k) != fmt.Sprintf("sst-%d", n) || string(v) != "v" {
+			t.Fatalf("ReadSST excepted sst-%d but got %q=%q", n, k, v)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 10 {
+		t.Fatal("ReadSST excepted 10 keys but got ", n, err)
+	}
+
+	store, err := NewKvStore(opts, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	extra := []KV{{[]byte("\x00extra/b"), []byte("2")}, {[]byte("\x00extra/a"), []byte("1")}}
+	if err := store.Ingest(7, []string{sstPath}, extra); err != nil {
+		t.Fatal("Ingest error ", err)
+	}
+	for i := 0; i < 10; i++ {
+		v, err := store.Get(fmt.Sprintf("sst-%d", i))
+		if err != nil {
+			t.Fatal("Get error ", err)
+		}
+		if string(v) != "v" {
+			t.Fatal("Ingested value excepted 'v' but got ", string(v))
+		}
+	}
+	if v, _ := store.Get("\x00extra/b"); string(v) != "2" {
+		t.Fatal("Ingested system key excepted '2' but got ", string(v))
+	}
+	index, err := store.AppliedIndex()
+	if err != nil || index != 7 {
+		t.Fatal("Applied index excepted 7 but got ", index, err)
+	}
+}
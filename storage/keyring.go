@@ -0,0 +1,281 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DataKeySize is the size of an encryption key, AES-256
+	DataKeySize = 32
+
+	// sealMagic starts every encrypted value, it is followed by the key
+	// id, the nonce and the AES-GCM ciphertext. A plain value starting
+	// with magicPrefix is stored behind plainMagic, so that no plain value
+	// is taken for an encrypted one.
+	magicPrefix = "\xffmdb"
+	sealMagic   = magicPrefix + "\x01"
+	plainMagic  = magicPrefix + "\x00"
+	sealHeader  = len(sealMagic) + 4
+)
+
+var (
+	// ErrUnknownDataKey is returned for a value encrypted with a key which
+	// is not in the keyring
+	ErrUnknownDataKey = errors.New("value is encrypted with an unknown key")
+	// ErrNoKeyring is returned for an encrypted value when the store has
+	// no keyring
+	ErrNoKeyring = errors.New("value is encrypted but no encryption key file is loaded")
+)
+
+// Keyring holds the keys of encryption at rest. New values are encrypted
+// with the active key, the others only decrypt the values written before
+// a rotation until they are encrypted again.
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewKeyring create a keyring of DataKeySize keys by id
+func NewKeyring(keys map[uint32][]byte, active uint32) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %d is not in the keyring", active)
+	}
+	kr := &Keyring{keys: make(map[uint32]cipher.AEAD), active: active}
+	for id, key := range keys {
+		if len(key) != DataKeySize {
+			return nil, fmt.Errorf("key %d: size %d, want %d", id, len(key), DataKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if kr.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// Active return the id of the key encrypting new values
+func (kr *Keyring) Active() uint32 {
+	return kr.active
+}
+
+// LoadKeyring read a key file, one "<id> <base64 key>" per line and an
+// optional "active <id>" line, the last key is active without it. Empty
+// lines and lines starting with # are skipped.
+func LoadKeyring(path string) (*Keyring, error) {
+	keys, active, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no key", path)
+	}
+	return NewKeyring(keys, active)
+}
+
+// AddDataKey append a new random key to the key file and make it active,
+// the file is created if missing. It returns the id of the new key.
+func AddDataKey(path string) (uint32, error) {
+	keys, active, err := readKeyFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if keys == nil {
+		keys = make(map[uint32][]byte)
+	}
+	for id := range keys {
+		if id > active {
+			active = id
+		}
+	}
+	active++
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+	keys[active] = key
+	return active, writeKeyFile(path, keys, active)
+}
+
+func readKeyFile(path string) (map[uint32][]byte, uint32, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := make(map[uint32][]byte)
+	var active, last uint32
+	explicit := false
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, 0, fmt.Errorf("%s:%d: want \"<id> <key>\" or \"active <id>\"", path, n)
+		}
+		if fields[0] == "active" {
+			id, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s:%d: invalid key id %q", path, n, fields[1])
+			}
+			active, explicit = uint32(id), true
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, 0, fmt.Errorf("%s:%d: invalid key id %q", path, n, fields[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if _, dup := keys[uint32(id)]; dup {
+			return nil, 0, fmt.Errorf("%s:%d: duplicate key id %d", path, n, id)
+		}
+		keys[uint32(id)] = key
+		last = uint32(id)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	if !explicit {
+		active = last
+	}
+	return keys, active, nil
+}
+
+// writeKeyFile replace the key file atomically, it is only readable by
+// its owner
+func writeKeyFile(path string, keys map[uint32][]byte, active uint32) error {
+	ids := make([]uint32, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var buf bytes.Buffer
+	buf.WriteString("# magicdb encryption keys, every node needs the same file\n")
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "%d %s\n", id, base64.StdEncoding.EncodeToString(keys[id]))
+	}
+	fmt.Fprintf(&buf, "active %d\n", active)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// escape return the plain value v as it is stored
+func escape(v []byte) []byte {
+	if !bytes.HasPrefix(v, []byte(magicPrefix)) {
+		return v
+	}
+	return append([]byte(plainMagic), v...)
+}
+
+// unescape return the plain value stored as v
+func unescape(v []byte) []byte {
+	if bytes.HasPrefix(v, []byte(plainMagic)) {
+		return v[len(plainMagic):]
+	}
+	return v
+}
+
+// isSealed reports whether v is an encrypted value
+func isSealed(v []byte) bool {
+	return len(v) >= sealHeader && string(v[:len(sealMagic)]) == sealMagic
+}
+
+// sealedKey return the key id of an encrypted value
+func sealedKey(v []byte) uint32 {
+	return binary.BigEndian.Uint32(v[len(sealMagic):sealHeader])
+}
+
+// seal encrypt the value of k with the active key, k is authenticated so
+// a value cannot be moved to another key
+func (kr *Keyring) seal(k, v []byte) ([]byte, error) {
+	aead := kr.keys[kr.active]
+	out := make([]byte, sealHeader+aead.NonceSize(), sealHeader+aead.NonceSize()+len(v)+aead.Overhead())
+	copy(out, sealMagic)
+	binary.BigEndian.PutUint32(out[len(sealMagic):], kr.active)
+	nonce := out[sealHeader:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, v, k), nil
+}
+
+// open decrypt the value of k, plain values are returned unescaped. A nil
+// keyring opens the plain values only.
+func (kr *Keyring) open(k, v []byte) ([]byte, error) {
+	if !isSealed(v) {
+		return unescape(v), nil
+	}
+	if kr == nil {
+		return nil, ErrNoKeyring
+	}
+	aead, ok := kr.keys[sealedKey(v)]
+	if !ok {
+		return nil, ErrUnknownDataKey
+	}
+	if len(v) < sealHeader+aead.NonceSize() {
+		return nil, errors.New("truncated encrypted value")
+	}
+	nonce := v[sealHeader : sealHeader+aead.NonceSize()]
+	return aead.Open(nil, nonce, v[sealHeader+aead.NonceSize():], k)
+}
+
+// stale reports whether the stored value v must be encrypted again with
+// the active key
+func (kr *Keyring) stale(v []byte) bool {
+	return !isSealed(v) || sealedKey(v) != kr.active
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	for want := uint32(1); want <= 2; want++ {
+		id, err := AddDataKey(path)
+		if err != nil {
+			t.Fatal("AddDataKey error ", err)
+		}
+		if id != want {
+			t.Fatalf("AddDataKey excepted key %d but got %d", want, id)
+		}
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Fatal("Key file mode excepted 0600 but got ", fi.Mode())
+	}
+	kr, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal("LoadKeyring error ", err)
+	}
+	if kr.Active() != 2 || len(kr.keys) != 2 {
+		t.Fatalf("Keyring excepted 2 keys with 2 active but got %d with %d", len(kr.keys), kr.Active())
+	}
+
+	// without an active line the last key is active
+	data, _ := ioutil.ReadFile(path)
+	data = bytes.Replace(data, []byte("active 2\n"), nil, 1)
+	ioutil.WriteFile(path, append(data, "active 1\n"...), 0600)
+	if kr, err = LoadKeyring(path); err != nil || kr.Active() != 1 {
+		t.Fatal("Keyring with active 1 got ", kr, err)
+	}
+	ioutil.WriteFile(path, data, 0600)
+	if kr, err = LoadKeyring(path); err != nil || kr.Active() != 2 {
+		t.Fatal("Keyring without active line got ", kr, err)
+	}
+
+	ioutil.WriteFile(path, []byte("1 c2hvcnQ=\n"), 0600)
+	if _, err := LoadKeyring(path); err == nil {
+		t.Fatal("LoadKeyring excepted a short key to be rejected")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k1 := bytes.Repeat([]byte{1}, DataKeySize)
+	k2 := bytes.Repeat([]byte{2}, DataKeySize)
+	old, err := NewKeyring(map[uint32][]byte{1: k1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyring(map[uint32][]byte{1: k1, 2: k2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := old.seal([]byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Fatal("Seal error ", err)
+	}
+	if bytes.Contains(sealed, []byte("bar")) || !kr.stale(sealed) || old.stale(sealed) {
+		t.Fatal("Sealed value got unexcepted ", sealed)
+	}
+	v, err := kr.open([]byte("foo"), sealed)
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("Open excepted bar but got %q, %v", v, err)
+	}
+	if _, err := kr.open([]byte("other"), sealed); err == nil {
+		t.Fatal("Open excepted a value moved to another key to fail")
+	}
+
+	sealed, _ = kr.seal([]byte("foo"), []byte("bar"))
+	if _, err := old.open([]byte("foo"), sealed); err != ErrUnknownDataKey {
+		t.Fatal("Open excepted ErrUnknownDataKey but got ", err)
+	}
+	var none *Keyring
+	if _, err := none.open([]byte("foo"), sealed); err != ErrNoKeyring {
+		t.Fatal("Open without keyring excepted ErrNoKeyring but got ", err)
+	}
+	if v, _ := none.open([]byte("foo"), []byte("plain")); string(v) != "plain" {
+		t.Fatal("Open of a plain value excepted it as is but got ", v)
+	}
+}
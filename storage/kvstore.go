@@ -16,17 +16,54 @@
 package storage
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tecbot/gorocksdb"
 )
 
-type kvstore struct {
-	db *gorocksdb.DB
-	mu sync.RWMutex
+// maxGroupCommit is the max number of write requests merged into one batch
+const maxGroupCommit = 128
+
+var (
+	// ErrClosed is returned when operating on a closed kvstore
+	ErrClosed = errors.New("kvstore is closed")
+)
+
+// KvStore is safe for concurrent use. RocksDB is thread-safe, so reads go
+// straight to the db, while writes are handed to a single committer that
+// merges concurrent requests into one write batch (group commit).
+type KvStore struct {
+	db   *gorocksdb.DB
+	opts *gorocksdb.Options
+	name string
+
+	ro *gorocksdb.ReadOptions
+	wo *gorocksdb.WriteOptions
+
+	writes    chan *writeRequest
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	// reads counts the reads in flight on the db, Close frees the db once
+	// they are done. readMu orders their start with closing.
+	readMu sync.RWMutex
+	reads  sync.WaitGroup
+
+	// kr holds the *Keyring of the encryption at rest, it is unset while
+	// encryption is off
+	kr     atomic.Value
+	reseal chan struct{}
+	bg     sync.WaitGroup
+	encMu  sync.Mutex
+	enc    EncryptionStatus
+	// raftLog is the raft log encrypted with the keyring, resealed along
+	raftLog *RaftLog
 }
 
-type item interface{}
+type item = interface{}
 
 type kvstorer interface {
 
@@ -41,99 +78,308 @@ type kvstorer interface {
 
 	//Batch operate
 	//Batch Put
-	BatchPut(kvpair []kv) error
+	BatchPut(kvpair []KV) error
 
 	// BatchDelete
 	BatchDelete(k []item) error
 
+	// Apply write puts and deletes of a raft log entry with its index
+	Apply(index uint64, kvpair []KV, k []item) error
+
+	// AppliedIndex the index of the last applied raft log entry
+	AppliedIndex() (uint64, error)
+
 	// Close the kvstore
 	Close()
 }
 
-type kv struct {
+// KV is a key-value pair
+type KV struct {
 	Key   item
 	Value item
 }
 
+// writeRequest is a pending write waiting for the committer
+type writeRequest struct {
+	fill func(wb *gorocksdb.WriteBatch)
+	// exclusive requests are committed in a batch of their own, so fill
+	// can read every write committed before
+	exclusive bool
+	done      chan error
+}
+
+// NewDefaultOptions return the rocksdb options used by magicdb, with the
+// statistics read by Stats enabled
+func NewDefaultOptions() *gorocksdb.Options {
+	bbto := gorocksdb.NewDefaultBlockBasedTableOptions()
+	bbto.SetBlockCache(gorocksdb.NewLRUCache(3 << 30))
+
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.SetCreateIfMissing(true)
+	opts.EnableStatistics()
+	return opts
+}
+
 // NewKvStore create a kvstore object
-func NewKvStore(opts *gorocksdb.Options, name string) (*kvstore, error) {
+func NewKvStore(opts *gorocksdb.Options, name string) (*KvStore, error) {
 	db, err := gorocksdb.OpenDb(opts, name)
 	if err != nil {
 		return nil, err
 	}
-	store := &kvstore{db: db}
+	store := newKvStore(db, opts, name)
+	store.bg.Add(1)
+	go store.resealLoop()
 	return store, nil
 }
 
-// Put a key-value to store
-func (s *kvstore) Put(k, v item) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// NewReadOnlyKvStore open the store read-only, it can be opened while
+// another process owns the store and sees the data as of opening.
+func NewReadOnlyKvStore(opts *gorocksdb.Options, name string) (*KvStore, error) {
+	db, err := gorocksdb.OpenDbForReadOnly(opts, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newKvStore(db, opts, name), nil
+}
 
+func newKvStore(db *gorocksdb.DB, opts *gorocksdb.Options, name string) *KvStore {
+	store := &KvStore{
+		db:      db,
+		opts:    opts,
+		name:    name,
+		ro:      gorocksdb.NewDefaultReadOptions(),
+		wo:      gorocksdb.NewDefaultWriteOptions(),
+		writes:  make(chan *writeRequest),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+		reseal:  make(chan struct{}, 1),
+	}
+	go store.commitLoop()
+	return store
+}
+
+// Put a key-value to store
+func (s *KvStore) Put(k, v item) error {
 	byteK := toBytes(k)
-	byteV := toBytes(v)
-	err := s.db.Put(wo, byteK, byteV)
-	return err
+	byteV, err := s.sealValue(byteK, toBytes(v))
+	if err != nil {
+		return err
+	}
+	return s.write(func(wb *gorocksdb.WriteBatch) {
+		wb.Put(byteK, byteV)
+	})
 }
 
 // Get a key from store
-func (s *kvstore) Get(k item) ([]byte, error) {
-	ro := gorocksdb.NewDefaultReadOptions()
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *KvStore) Get(k item) ([]byte, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
 
 	byteK := toBytes(k)
-	value, err := s.db.Get(ro, byteK)
+	value, err := s.db.Get(s.ro, byteK)
 	if err != nil {
 		return nil, err
 	}
-	return value.Data(), nil
+	defer value.Free()
+
+	if !value.Exists() {
+		return nil, nil
+	}
+	// value.Data() points to C memory, copy it before the slice is freed
+	data := make([]byte, value.Size())
+	copy(data, value.Data())
+	return s.keyring().open(byteK, data)
 }
 
 // Delete the key-value pair from store
-func (s *kvstore) Delete(k item) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+func (s *KvStore) Delete(k item) error {
 	byteK := toBytes(k)
-	err := s.db.Delete(wo, byteK)
-	return err
+	return s.write(func(wb *gorocksdb.WriteBatch) {
+		wb.Delete(byteK)
+	})
 }
 
 // BatchPut batch put a batch of k-v pairs to store
-func (s *kvstore) BatchPut(kvpair []kv) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
-	wb := gorocksdb.NewWriteBatch()
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for _, _kv := range kvpair {
-		byteK := toBytes(_kv.Key)
-		byteV := toBytes(_kv.Value)
-		wb.Put(byteK, byteV)
+func (s *KvStore) BatchPut(kvpair []KV) error {
+	keys, values, err := s.sealPairs(kvpair)
+	if err != nil {
+		return err
 	}
-	err := s.db.Write(wo, wb)
-	return err
+	return s.putRaw(keys, values)
+}
+
+// putRaw put values already encrypted
+func (s *KvStore) putRaw(keys, values [][]byte) error {
+	return s.write(func(wb *gorocksdb.WriteBatch) {
+		for i := range keys {
+			wb.Put(keys[i], values[i])
+		}
+	})
 }
 
 // BatchDelete delete a batch of kv pairs from store
-func (s *kvstore) BatchDelete(k []item) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
-	wb := gorocksdb.NewWriteBatch()
+func (s *KvStore) BatchDelete(k []item) error {
+	keys := make([][]byte, len(k))
+	for i, _k := range k {
+		keys[i] = toBytes(_k)
+	}
+	return s.write(func(wb *gorocksdb.WriteBatch) {
+		for _, byteK := range keys {
+			wb.Delete(byteK)
+		}
+	})
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Apply writes the puts and deletes of the raft log entry at index, together
+// with the index itself, in one atomic batch. Puts are applied before deletes.
+func (s *KvStore) Apply(index uint64, kvpair []KV, k []item) error {
+	return s.ApplyGroup(0, index, kvpair, k)
+}
 
-	for _, _k := range k {
-		byteK := toBytes(_k)
-		wb.Delete(byteK)
+// ApplyGroup is Apply for the raft group group, every group sharing the
+// store keeps an applied index of its own
+func (s *KvStore) ApplyGroup(group, index uint64, kvpair []KV, k []item) error {
+	keys, values, err := s.sealPairs(kvpair)
+	if err != nil {
+		return err
+	}
+	dels := make([][]byte, len(k))
+	for i, _k := range k {
+		dels[i] = toBytes(_k)
+	}
+	return s.applyRaw(appliedKey(group), index, keys, values, dels)
+}
+
+// applyRaw is Apply with values already encrypted, the index is written at
+// indexKey
+func (s *KvStore) applyRaw(indexKey []byte, index uint64, keys, values, dels [][]byte) error {
+	return s.write(func(wb *gorocksdb.WriteBatch) {
+		for i := range keys {
+			wb.Put(keys[i], values[i])
+		}
+		for _, byteK := range dels {
+			wb.Delete(byteK)
+		}
+		wb.Put(indexKey, encodeIndex(index))
+	})
+}
+
+// AppliedIndex return the index of the last raft log entry applied to store
+func (s *KvStore) AppliedIndex() (uint64, error) {
+	return s.GroupAppliedIndex(0)
+}
+
+// GroupAppliedIndex return the index of the last raft log entry of group
+// applied to store
+func (s *KvStore) GroupAppliedIndex(group uint64) (uint64, error) {
+	v, err := s.Get(appliedKey(group))
+	if err != nil {
+		return 0, err
 	}
-	err := s.db.Write(wo, wb)
-	return err
+	return decodeIndex(v), nil
 }
 
 // Close close the store db
-func (s *kvstore) Close() {
-	s.db.Close()
+func (s *KvStore) Close() {
+	s.closeOnce.Do(func() {
+		s.readMu.Lock()
+		close(s.closing)
+		s.readMu.Unlock()
+		s.reads.Wait()
+		s.bg.Wait()
+		<-s.stopped
+		s.ro.Destroy()
+		s.wo.Destroy()
+		s.db.Close()
+	})
+}
+
+// acquire hold the db open for a read, it must be paired with release
+// unless it returns ErrClosed
+func (s *KvStore) acquire() error {
+	s.readMu.RLock()
+	defer s.readMu.RUnlock()
+	select {
+	case <-s.closing:
+		return ErrClosed
+	default:
+	}
+	s.reads.Add(1)
+	return nil
+}
+
+func (s *KvStore) release() {
+	s.reads.Done()
+}
+
+// write hands a write to the committer and waits for it to be persisted
+func (s *KvStore) write(fill func(wb *gorocksdb.WriteBatch)) error {
+	return s.send(&writeRequest{fill: fill, done: make(chan error, 1)})
+}
+
+// writeExclusive is write in a batch of its own
+func (s *KvStore) writeExclusive(fill func(wb *gorocksdb.WriteBatch)) error {
+	return s.send(&writeRequest{fill: fill, exclusive: true, done: make(chan error, 1)})
+}
+
+func (s *KvStore) send(req *writeRequest) error {
+	// writes is unbuffered, so once the send succeeds the committer owns
+	// the request and will always answer it.
+	select {
+	case s.writes <- req:
+	case <-s.closing:
+		return ErrClosed
+	}
+	return <-req.done
+}
+
+// commitLoop is the single writer of the store. Every request that is
+// waiting while a batch is being written joins the next batch, so many
+// concurrent writers share one rocksdb write.
+func (s *KvStore) commitLoop() {
+	defer close(s.stopped)
+
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+
+	group := make([]*writeRequest, 0, maxGroupCommit)
+	var next *writeRequest
+	for {
+		if next != nil {
+			group, next = append(group[:0], next), nil
+		} else {
+			select {
+			case req := <-s.writes:
+				group = append(group[:0], req)
+			case <-s.closing:
+				return
+			}
+		}
+
+	collect:
+		for !group[0].exclusive && len(group) < maxGroupCommit {
+			select {
+			case req := <-s.writes:
+				if req.exclusive {
+					next = req
+					break collect
+				}
+				group = append(group, req)
+			default:
+				break collect
+			}
+		}
+
+		wb.Clear()
+		for _, req := range group {
+			req.fill(wb)
+		}
+		err := s.db.Write(s.wo, wb)
+		for _, req := range group {
+			req.done <- err
+		}
+	}
 }
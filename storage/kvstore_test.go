@@ -14,6 +14,8 @@
 package storage
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/tecbot/gorocksdb"
@@ -91,10 +93,10 @@ func TestBatchOperate(t *testing.T) {
 	}
 	defer store.Close()
 
-	var _item []kv
+	var _item []KV
 	// Batch test
 	for i := 0; i < 10; i++ {
-		_item = append(_item, kv{i, i})
+		_item = append(_item, KV{i, i})
 	}
 	err = store.BatchPut(_item)
 	if err != nil {
@@ -133,3 +135,104 @@ func TestBatchOperate(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentOperate(t *testing.T) {
+	opts := buildOpts()
+
+	store, err := NewKvStore(opts, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("concurrent-%d", i)
+			if err := store.Put(key, i); err != nil {
+				errs <- err
+				return
+			}
+			v, err := store.Get(key)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(v) != fmt.Sprintf("%d", i) {
+				errs <- fmt.Errorf("Get %s excepted %d but got %s", key, i, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	opts := buildOpts()
+
+	store, err := NewKvStore(opts, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	// Close twice should be safe
+	store.Close()
+
+	if err := store.Put("foo", "bar"); err != ErrClosed {
+		t.Fatal("Put on closed store, excepted ErrClosed but got ", err)
+	}
+	if _, err := store.Get("foo"); err != ErrClosed {
+		t.Fatal("Get on closed store, excepted ErrClosed but got ", err)
+	}
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	opts := buildOpts()
+
+	store, err := NewKvStore(opts, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reads racing Close either finish on the open db or get ErrClosed
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var err error
+				if i%2 == 0 {
+					_, err = store.Get("foo")
+				} else {
+					err = store.Iterate(nil, func(k, v []byte) bool { return true })
+				}
+				if err == ErrClosed {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	store.Close()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The versions of a key are stored under the key escaped, so that it sorts
+// as the key and is never the prefix of another escaped key, followed by
+// the inverted timestamp of the version: the versions of a key are next
+// to each other, the newest first, and the keys keep their order.
+const (
+	escapeByte     = 0x00
+	escapedZero    = 0xff
+	versionEndByte = 0x01
+)
+
+// EncodeVersion return the key of the version of key at ts
+func EncodeVersion(key []byte, ts uint64) []byte {
+	b := append(VersionPrefix(key), escapeByte, versionEndByte)
+	var inv [8]byte
+	binary.BigEndian.PutUint64(inv[:], ^ts)
+	return append(b, inv[:]...)
+}
+
+// VersionPrefix return the prefix of the versions of every key starting
+// with prefix
+func VersionPrefix(prefix []byte) []byte {
+	b := make([]byte, 0, len(prefix)+2+8)
+	for _, c := range prefix {
+		if c == escapeByte {
+			b = append(b, escapeByte, escapedZero)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// DecodeVersion is the reverse of EncodeVersion, ok is false when v is
+// not the key of a version
+func DecodeVersion(v []byte) (key []byte, ts uint64, ok bool) {
+	end := -1
+	for i := 0; i < len(v)-1; i++ {
+		if v[i] != escapeByte {
+			continue
+		}
+		if v[i+1] == versionEndByte {
+			end = i
+			break
+		}
+		if v[i+1] != escapedZero {
+			return nil, 0, false
+		}
+		i++
+	}
+	if end < 0 || len(v) != end+2+8 {
+		return nil, 0, false
+	}
+	key = bytes.Replace(v[:end], []byte{escapeByte, escapedZero}, []byte{escapeByte}, -1)
+	return key, ^binary.BigEndian.Uint64(v[end+2:]), true
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestEncodeVersion(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("a\x00"), []byte("a\x00b"), []byte("a\x01"), []byte("ab"), []byte("b")}
+	var encoded [][]byte
+	for _, k := range keys {
+		for _, ts := range []uint64{1, 7, 1 << 40} {
+			v := EncodeVersion(k, ts)
+			key, got, ok := DecodeVersion(v)
+			if !ok || !bytes.Equal(key, k) || got != ts {
+				t.Fatal("DecodeVersion excepted ", k, ts, " but got ", key, got, ok)
+			}
+			encoded = append(encoded, v)
+		}
+	}
+	// the keys keep their order, the versions of a key the newest first
+	sorted := append([][]byte(nil), encoded...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	for i, v := range sorted {
+		key, ts, _ := DecodeVersion(v)
+		want, wantTS, _ := DecodeVersion(encoded[i/3*3+2-i%3])
+		if !bytes.Equal(key, want) || ts != wantTS {
+			t.Fatal("excepted ", want, wantTS, " at ", i, " but got ", key, ts)
+		}
+	}
+	// the versions of the keys with a prefix share the prefix of it
+	if !bytes.HasPrefix(EncodeVersion([]byte("a\x00b"), 3), VersionPrefix([]byte("a\x00"))) {
+		t.Fatal("excepted the version to start with the prefix of its prefix")
+	}
+	if _, _, ok := DecodeVersion([]byte("a\x00\x05xxxxxxxx")); ok {
+		t.Fatal("excepted an invalid version to be rejected")
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"sync"
+
+	praft "github.com/hashicorp/raft"
+	"github.com/tecbot/gorocksdb"
+)
+
+const (
+	raftLogPrefix    = 'l'
+	raftStablePrefix = 's'
+)
+
+var (
+	// errStableNotFound is the error raft expects from a stable store
+	// missing a key, it compares the text of the error
+	errStableNotFound = errors.New("not found")
+	// errBadLog is returned for a raft log entry which does not decode
+	errBadLog = errors.New("corrupted raft log entry")
+)
+
+// RaftLog keeps the logs and the stable stores of the raft groups of a node
+// in a rocksdb of their own, apart from the store: the log survives a
+// restart and a snapshot of the store does not carry it. Its writes are
+// synced. The log entries are encrypted with the keyring of the store.
+type RaftLog struct {
+	db    *gorocksdb.DB
+	ro    *gorocksdb.ReadOptions
+	wo    *gorocksdb.WriteOptions
+	store *KvStore
+
+	// mu orders the writes of the log entries with their reseal
+	mu     sync.Mutex
+	closed bool
+}
+
+// RaftGroupLog is the praft.LogStore and praft.StableStore of a raft group
+type RaftGroupLog struct {
+	log   *RaftLog
+	group uint64
+}
+
+// OpenRaftLog open the raft log in the directory dir, it is created if
+// missing. The entries are encrypted while store has a keyring, store may
+// be nil.
+func OpenRaftLog(dir string, store *KvStore) (*RaftLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := gorocksdb.OpenDb(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	wo := gorocksdb.NewDefaultWriteOptions()
+	wo.SetSync(true)
+	l := &RaftLog{db: db, ro: gorocksdb.NewDefaultReadOptions(), wo: wo, store: store}
+	if store != nil {
+		store.setRaftLog(l)
+	}
+	return l, nil
+}
+
+// Group return the log and the stable store of the raft group group
+func (l *RaftLog) Group(group uint64) *RaftGroupLog {
+	return &RaftGroupLog{log: l, group: group}
+}
+
+// Close the raft log, the rafts using it must be shut down before
+func (l *RaftLog) Close() {
+	if l.store != nil {
+		l.store.setRaftLog(nil)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.db.Close()
+	l.ro.Destroy()
+	l.wo.Destroy()
+}
+
+func (l *RaftLog) keyring() *Keyring {
+	if l.store == nil {
+		return nil
+	}
+	return l.store.keyring()
+}
+
+// reseal encrypt with the active key of kr the log entries which are plain
+// or encrypted with another key and return how many. An entry which does
+// not open is skipped, the first such error is returned at the end.
+func (l *RaftLog) reseal(kr *Keyring) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, nil
+	}
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	n := 0
+	var err, openErr error
+	iterErr := iterate(l.db, l.ro, []byte{raftLogPrefix}, nil, func(k, v []byte) bool {
+		if !kr.stale(v) {
+			return true
+		}
+		plain, oerr := kr.open(k, v)
+		if oerr != nil {
+			if openErr == nil {
+				openErr = oerr
+			}
+			return true
+		}
+		var sealed []byte
+		if sealed, err = kr.seal(k, plain); err != nil {
+			return false
+		}
+		wb.Put(k, sealed)
+		n++
+		if wb.Count() >= loadBatchSize {
+			err = l.db.Write(l.wo, wb)
+			wb.Clear()
+		}
+		return err == nil
+	})
+	if iterErr != nil {
+		return n, iterErr
+	}
+	if err == nil && wb.Count() > 0 {
+		err = l.db.Write(l.wo, wb)
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > 0 {
+		l.db.CompactRange(gorocksdb.Range{})
+	}
+	return n, openErr
+}
+
+// DropGroup delete the log and the stable store of the raft group group,
+// it is used once its replica left the node
+func (l *RaftLog) DropGroup(group uint64) error {
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, kind := range []byte{raftLogPrefix, raftStablePrefix} {
+		wb.DeleteRange(raftGroupPrefix(kind, group), raftGroupPrefix(kind, group+1))
+	}
+	return l.db.Write(l.wo, wb)
+}
+
+// FirstIndex return the first index written, 0 for an empty log
+func (g *RaftGroupLog) FirstIndex() (uint64, error) {
+	it := g.log.db.NewIterator(g.log.ro)
+	defer it.Close()
+
+	prefix := raftGroupPrefix(raftLogPrefix, g.group)
+	it.Seek(prefix)
+	if !it.ValidForPrefix(prefix) {
+		return 0, it.Err()
+	}
+	return raftLogIndex(it), nil
+}
+
+// LastIndex return the last index written, 0 for an empty log
+func (g *RaftGroupLog) LastIndex() (uint64, error) {
+	it := g.log.db.NewIterator(g.log.ro)
+	defer it.Close()
+
+	prefix := raftGroupPrefix(raftLogPrefix, g.group)
+	it.SeekForPrev(raftLogKey(g.group, math.MaxUint64))
+	if !it.ValidForPrefix(prefix) {
+		return 0, it.Err()
+	}
+	return raftLogIndex(it), nil
+}
+
+// GetLog get the log entry at index into log
+func (g *RaftGroupLog) GetLog(index uint64, log *praft.Log) error {
+	v, err := g.log.db.GetBytes(g.log.ro, raftLogKey(g.group, index))
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return praft.ErrLogNotFound
+	}
+	if v, err = g.log.keyring().open(raftLogKey(g.group, index), v); err != nil {
+		return err
+	}
+	return decodeRaftLog(v, index, log)
+}
+
+// StoreLog write a log entry
+func (g *RaftGroupLog) StoreLog(log *praft.Log) error {
+	return g.StoreLogs([]*praft.Log{log})
+}
+
+// StoreLogs write many log entries in one batch
+func (g *RaftGroupLog) StoreLogs(logs []*praft.Log) error {
+	kr := g.log.keyring()
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, log := range logs {
+		k, v := raftLogKey(g.group, log.Index), encodeRaftLog(log)
+		if kr == nil {
+			v = escape(v)
+		} else if sealed, err := kr.seal(k, v); err != nil {
+			return err
+		} else {
+			v = sealed
+		}
+		wb.Put(k, v)
+	}
+	g.log.mu.Lock()
+	defer g.log.mu.Unlock()
+	return g.log.db.Write(g.log.wo, wb)
+}
+
+// DeleteRange delete the log entries from min to max, both included
+func (g *RaftGroupLog) DeleteRange(min, max uint64) error {
+	if min > max {
+		return nil
+	}
+	end := raftGroupPrefix(raftLogPrefix, g.group+1)
+	if max < math.MaxUint64 {
+		end = raftLogKey(g.group, max+1)
+	}
+	wb := gorocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	wb.DeleteRange(raftLogKey(g.group, min), end)
+	g.log.mu.Lock()
+	defer g.log.mu.Unlock()
+	return g.log.db.Write(g.log.wo, wb)
+}
+
+// Set a key of the stable store
+func (g *RaftGroupLog) Set(key []byte, val []byte) error {
+	return g.log.db.Put(g.log.wo, raftStableKey(g.group, key), val)
+}
+
+// Get a key of the stable store
+func (g *RaftGroupLog) Get(key []byte) ([]byte, error) {
+	v, err := g.log.db.GetBytes(g.log.ro, raftStableKey(g.group, key))
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errStableNotFound
+	}
+	return v, nil
+}
+
+// SetUint64 set a key of the stable store to a number
+func (g *RaftGroupLog) SetUint64(key []byte, val uint64) error {
+	return g.Set(key, encodeIndex(val))
+}
+
+// GetUint64 get a number of the stable store
+func (g *RaftGroupLog) GetUint64(key []byte) (uint64, error) {
+	v, err := g.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return decodeIndex(v), nil
+}
+
+// raftGroupPrefix is the prefix of the keys of kind of group
+func raftGroupPrefix(kind byte, group uint64) []byte {
+	k := make([]byte, 9)
+	k[0] = kind
+	binary.BigEndian.PutUint64(k[1:], group)
+	return k
+}
+
+// raftLogKey is the key of the log entry at index of group, big endian
+// so that the keys sort as the indexes
+func raftLogKey(group, index uint64) []byte {
+	k := make([]byte, 17)
+	copy(k, raftGroupPrefix(raftLogPrefix, group))
+	binary.BigEndian.PutUint64(k[9:], index)
+	return k
+}
+
+// raftStableKey is the key of the stable store key of group
+func raftStableKey(group uint64, key []byte) []byte {
+	return append(raftGroupPrefix(raftStablePrefix, group), key...)
+}
+
+// raftLogIndex return the index of the log key the iterator is at
+func raftLogIndex(it *gorocksdb.Iterator) uint64 {
+	k := it.Key()
+	defer k.Free()
+	return binary.BigEndian.Uint64(k.Data()[9:])
+}
+
+// encodeRaftLog encode the term, type, data and extensions of log, the
+// index is the key
+func encodeRaftLog(log *praft.Log) []byte {
+	buf := make([]byte, 0, 8+1+2*binary.MaxVarintLen64+len(log.Data)+len(log.Extensions))
+	buf = append(buf, encodeIndex(log.Term)...)
+	buf = append(buf, byte(log.Type))
+	buf = appendUvarintBytes(buf, log.Data)
+	return appendUvarintBytes(buf, log.Extensions)
+}
+
+// decodeRaftLog decode the log entry at index written by encodeRaftLog
+func decodeRaftLog(v []byte, index uint64, log *praft.Log) error {
+	if len(v) < 9 {
+		return errBadLog
+	}
+	log.Index = index
+	log.Term = decodeIndex(v[:8])
+	log.Type = praft.LogType(v[8])
+	var ok bool
+	v = v[9:]
+	if log.Data, v, ok = readUvarintBytes(v); !ok {
+		return errBadLog
+	}
+	if log.Extensions, _, ok = readUvarintBytes(v); !ok {
+		return errBadLog
+	}
+	return nil
+}
+
+func appendUvarintBytes(buf, b []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+	return append(buf, b...)
+}
+
+func readUvarintBytes(v []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(v)
+	if n <= 0 || uint64(len(v)-n) < l {
+		return nil, nil, false
+	}
+	if l == 0 {
+		return nil, v[n:], true
+	}
+	return v[n : n+int(l)], v[n+int(l):], true
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	praft "github.com/hashicorp/raft"
+)
+
+func TestRaftLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-raftlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := OpenRaftLog(dir, nil)
+	if err != nil {
+		t.Fatal("OpenRaftLog error ", err)
+	}
+
+	g1, g2 := l.Group(1), l.Group(2)
+	if first, err := g1.FirstIndex(); err != nil || first != 0 {
+		t.Fatal("FirstIndex of an empty log excepted 0 but got ", first, err)
+	}
+	var logs []*praft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &praft.Log{Index: i, Term: 2, Type: praft.LogCommand, Data: []byte{byte(i), 0xff}})
+	}
+	if err := g1.StoreLogs(logs); err != nil {
+		t.Fatal("StoreLogs error ", err)
+	}
+	if err := g2.StoreLog(&praft.Log{Index: 100, Term: 1, Type: praft.LogNoop}); err != nil {
+		t.Fatal("StoreLog error ", err)
+	}
+	if err := g1.DeleteRange(1, 3); err != nil {
+		t.Fatal("DeleteRange error ", err)
+	}
+	if first, err := g1.FirstIndex(); err != nil || first != 4 {
+		t.Fatal("FirstIndex excepted 4 but got ", first, err)
+	}
+	if last, err := g1.LastIndex(); err != nil || last != 10 {
+		t.Fatal("LastIndex excepted 10 but got ", last, err)
+	}
+	if err := g1.SetUint64([]byte("CurrentTerm"), 2); err != nil {
+		t.Fatal("SetUint64 error ", err)
+	}
+	if _, err := g2.GetUint64([]byte("CurrentTerm")); err == nil || err.Error() != "not found" {
+		t.Fatal("GetUint64 of a missing key excepted not found but got ", err)
+	}
+	l.Close()
+
+	// the log is there after reopening
+	if l, err = OpenRaftLog(dir, nil); err != nil {
+		t.Fatal("OpenRaftLog error ", err)
+	}
+	defer l.Close()
+	g1, g2 = l.Group(1), l.Group(2)
+	var log praft.Log
+	if err := g1.GetLog(7, &log); err != nil {
+		t.Fatal("GetLog error ", err)
+	}
+	if log.Index != 7 || log.Term != 2 || log.Type != praft.LogCommand || !bytes.Equal(log.Data, []byte{7, 0xff}) {
+		t.Fatal("GetLog excepted the entry 7 but got ", log)
+	}
+	if err := g1.GetLog(2, &log); err != praft.ErrLogNotFound {
+		t.Fatal("GetLog of a deleted entry excepted ErrLogNotFound but got ", err)
+	}
+	if first, err := g2.FirstIndex(); err != nil || first != 100 {
+		t.Fatal("FirstIndex of group 2 excepted 100 but got ", first, err)
+	}
+	if last, err := g2.LastIndex(); err != nil || last != 100 {
+		t.Fatal("LastIndex of group 2 excepted 100 but got ", last, err)
+	}
+	if term, err := g1.GetUint64([]byte("CurrentTerm")); err != nil || term != 2 {
+		t.Fatal("GetUint64 excepted 2 but got ", term, err)
+	}
+
+	if err := l.DropGroup(1); err != nil {
+		t.Fatal("DropGroup error ", err)
+	}
+	if last, err := g1.LastIndex(); err != nil || last != 0 {
+		t.Fatal("LastIndex of a dropped group excepted 0 but got ", last, err)
+	}
+	if last, err := g2.LastIndex(); err != nil || last != 100 {
+		t.Fatal("DropGroup excepted to keep group 2 but got ", last, err)
+	}
+}
+
+func TestRaftLogEncryption(t *testing.T) {
+	os.RemoveAll(tmpPath)
+	defer os.RemoveAll(tmpPath)
+	store, err := NewKvStore(buildOpts(), tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	k1 := bytes.Repeat([]byte{1}, DataKeySize)
+	kr1, _ := NewKeyring(map[uint32][]byte{1: k1}, 1)
+	store.SetKeyring(kr1)
+
+	dir, err := ioutil.TempDir("", "magicdb-raftlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := OpenRaftLog(dir, store)
+	if err != nil {
+		t.Fatal("OpenRaftLog error ", err)
+	}
+	defer l.Close()
+
+	secret := []byte("secret-value-of-a-put")
+	g := l.Group(0)
+	if err := g.StoreLog(&praft.Log{Index: 1, Term: 1, Type: praft.LogCommand, Data: secret}); err != nil {
+		t.Fatal("StoreLog error ", err)
+	}
+	var log praft.Log
+	if err := g.GetLog(1, &log); err != nil || !bytes.Equal(log.Data, secret) {
+		t.Fatal("GetLog excepted the written data but got ", log, err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(f)
+		if bytes.Contains(data, secret) {
+			t.Fatal("plain value found in the raft log file ", f)
+		}
+	}
+
+	// a rotation encrypts the entries again
+	kr2, _ := NewKeyring(map[uint32][]byte{1: k1, 2: bytes.Repeat([]byte{2}, DataKeySize)}, 2)
+	store.SetKeyring(kr2)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		raw, _ := l.db.GetBytes(l.ro, raftLogKey(0, 1))
+		if isSealed(raw) && sealedKey(raw) == 2 && !store.EncryptionStatus().Resealing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Raft log entry was not encrypted again with key 2")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := g.GetLog(1, &log); err != nil || !bytes.Equal(log.Data, secret) {
+		t.Fatal("GetLog after the rotation excepted the written data but got ", log, err)
+	}
+}
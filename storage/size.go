@@ -0,0 +1,144 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// middleSteps bounds the bisection of MiddleKey
+const middleSteps = 32
+
+// ApproximateSize return the approximate bytes the keys from start to end
+// excluded take in the sst files, an empty end is the end of the keyspace.
+// The memtables are not counted.
+func (s *KvStore) ApproximateSize(start, end []byte) uint64 {
+	if s.acquire() != nil {
+		return 0
+	}
+	defer s.release()
+	if end = s.limit(end); end == nil {
+		return 0
+	}
+	return s.size(start, end)
+}
+
+// MiddleKey return the key splitting the keys from start to end excluded
+// in two halves of about the same approximate size, an empty end is the
+// end of the keyspace. The keys are bisected on their approximate sizes,
+// or counted when they are all in the memtables. The key is strictly
+// after start, nil when there is none.
+func (s *KvStore) MiddleKey(start, end []byte) ([]byte, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	if end = s.limit(end); end == nil {
+		return nil, nil
+	}
+
+	if total := s.size(start, end); total > 0 {
+		lo, hi := start, end
+		for i := 0; i < middleSteps; i++ {
+			mid := midKey(lo, hi)
+			if bytes.Equal(mid, lo) || bytes.Equal(mid, hi) {
+				break
+			}
+			if s.size(start, mid) < total/2 {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		it := s.db.NewIterator(s.ro)
+		defer it.Close()
+		it.Seek(hi)
+		if it.Valid() {
+			k := append([]byte(nil), it.Key().Data()...)
+			if bytes.Compare(k, start) > 0 && bytes.Compare(k, end) < 0 {
+				return k, it.Err()
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s.medianKey(start, end)
+}
+
+// medianKey return the key in the middle of the keys from start to end
+// excluded by count
+func (s *KvStore) medianKey(start, end []byte) ([]byte, error) {
+	it := s.db.NewIterator(s.ro)
+	defer it.Close()
+
+	n := 0
+	for it.Seek(start); it.Valid() && bytes.Compare(it.Key().Data(), end) < 0; it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil || n < 2 {
+		return nil, err
+	}
+	i := 0
+	for it.Seek(start); it.Valid(); it.Next() {
+		if i == n/2 {
+			return append([]byte(nil), it.Key().Data()...), nil
+		}
+		i++
+	}
+	return nil, it.Err()
+}
+
+func (s *KvStore) size(start, end []byte) uint64 {
+	sizes := s.db.GetApproximateSizes([]gorocksdb.Range{{Start: start, Limit: end}})
+	return sizes[0]
+}
+
+// limit return end, or the key after the last key of the store for an
+// empty end. It is nil when the store is empty.
+func (s *KvStore) limit(end []byte) []byte {
+	if len(end) > 0 {
+		return end
+	}
+	it := s.db.NewIterator(s.ro)
+	defer it.Close()
+	it.SeekToLast()
+	if !it.Valid() {
+		return nil
+	}
+	return append(append([]byte(nil), it.Key().Data()...), 0)
+}
+
+// midKey return the key halfway between the keys a and b
+func midKey(a, b []byte) []byte {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	n++
+	pad := func(k []byte) *big.Int {
+		buf := make([]byte, n)
+		copy(buf, k)
+		return new(big.Int).SetBytes(buf)
+	}
+	sum := new(big.Int).Add(pad(a), pad(b))
+	mid := sum.Rsh(sum, 1).Bytes()
+
+	key := make([]byte, n)
+	copy(key[n-len(mid):], mid)
+	return bytes.TrimRight(key, "\x00")
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+func TestMidKey(t *testing.T) {
+	tests := []struct{ a, b, mid string }{
+		{"a", "c", "b"},
+		{"a", "b", "a\x80"},
+		{"", "\x02", "\x01"},
+		{"key1", "key3", "key2"},
+	}
+	for _, tt := range tests {
+		if mid := midKey([]byte(tt.a), []byte(tt.b)); string(mid) != tt.mid {
+			t.Fatalf("midKey(%q, %q) excepted %q but got %q", tt.a, tt.b, tt.mid, mid)
+		}
+	}
+}
+
+func TestMiddleKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewKvStore(NewDefaultOptions(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if k, err := store.MiddleKey(nil, nil); err != nil || k != nil {
+		t.Fatal("MiddleKey of an empty store excepted nil but got ", k, err)
+	}
+	value := bytes.Repeat([]byte("v"), 1024)
+	for i := 0; i < 1000; i++ {
+		if err := store.Put(fmt.Sprintf("key%04d", i), value); err != nil {
+			t.Fatal("Put error ", err)
+		}
+	}
+	// in the memtable the keys are counted
+	k, err := store.MiddleKey([]byte("key"), nil)
+	if err != nil || string(k) != "key0500" {
+		t.Fatal("MiddleKey excepted key0500 but got ", string(k), err)
+	}
+
+	opts := gorocksdb.NewDefaultFlushOptions()
+	defer opts.Destroy()
+	if err := store.db.Flush(opts); err != nil {
+		t.Fatal("Flush error ", err)
+	}
+	if size := store.ApproximateSize([]byte("key"), nil); size < 500*1024 {
+		t.Fatal("ApproximateSize excepted the size of the values but got ", size)
+	}
+	k, err = store.MiddleKey([]byte("key"), []byte("key0500"))
+	if err != nil || string(k) < "key0150" || string(k) > "key0350" {
+		t.Fatal("MiddleKey excepted a key near key0250 but got ", string(k), err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// loadBatchSize is the number of keys written per batch by Load and Clear
+const loadBatchSize = 1000
+
+// Snapshot is a consistent, read-only view of the store at a point in time
+type Snapshot struct {
+	store *KvStore
+	snap  *gorocksdb.Snapshot
+	ro    *gorocksdb.ReadOptions
+}
+
+// dumpHeader is the first record of a dump stream
+type dumpHeader struct {
+	AppliedIndex uint64
+}
+
+// dumpEntry is a key-value record of a dump stream
+type dumpEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// NewSnapshot create a snapshot of the store, it must be released after
+// use and holds Close back until then
+func (s *KvStore) NewSnapshot() (*Snapshot, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	snap := s.db.NewSnapshot()
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetSnapshot(snap)
+	return &Snapshot{store: s, snap: snap, ro: ro}, nil
+}
+
+// Get a key from the snapshot
+func (sn *Snapshot) Get(k item) ([]byte, error) {
+	byteK := toBytes(k)
+	v, err := sn.store.db.GetBytes(sn.ro, byteK)
+	if err != nil || v == nil {
+		return v, err
+	}
+	return sn.store.keyring().open(byteK, v)
+}
+
+// AppliedIndex return the raft index the snapshot corresponds to
+func (sn *Snapshot) AppliedIndex() (uint64, error) {
+	return sn.GroupAppliedIndex(0)
+}
+
+// GroupAppliedIndex return the raft index of group the snapshot
+// corresponds to
+func (sn *Snapshot) GroupAppliedIndex(group uint64) (uint64, error) {
+	v, err := sn.Get(appliedKey(group))
+	if err != nil {
+		return 0, err
+	}
+	return decodeIndex(v), nil
+}
+
+// Iterate calls fn in key order for every key with the prefix in the
+// snapshot, until fn returns false.
+func (sn *Snapshot) Iterate(prefix []byte, fn func(k, v []byte) bool) error {
+	return sn.store.iterateOpen(sn.ro, prefix, nil, fn)
+}
+
+// Dump write every replicated key-value pair of the snapshot to w, the
+// encrypted values stay encrypted so a dump needs the keys of the store
+func (sn *Snapshot) Dump(w io.Writer) error {
+	return sn.DumpGroup(w, 0, nil)
+}
+
+// DumpGroup is Dump of the keys of the raft group group, those for which
+// keep returns true. A nil keep keeps every key.
+func (sn *Snapshot) DumpGroup(w io.Writer, group uint64, keep func(k []byte) bool) error {
+	index, err := sn.GroupAppliedIndex(group)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(dumpHeader{AppliedIndex: index}); err != nil {
+		return err
+	}
+
+	var encErr error
+	err = iterate(sn.store.db, sn.ro, nil, nil, func(k, v []byte) bool {
+		if isLocalKey(k) || (keep != nil && !keep(k)) {
+			return true
+		}
+		encErr = enc.Encode(dumpEntry{Key: k, Value: v})
+		return encErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return encErr
+}
+
+// Release the snapshot
+func (sn *Snapshot) Release() {
+	sn.ro.Destroy()
+	sn.store.db.ReleaseSnapshot(sn.snap)
+	sn.store.release()
+}
+
+// Iterate calls fn in key order for every key with the prefix, until fn
+// returns false. Iterate does not see a consistent view of the store, use
+// a Snapshot for that.
+func (s *KvStore) Iterate(prefix []byte, fn func(k, v []byte) bool) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.iterateOpen(s.ro, prefix, nil, fn)
+}
+
+// IterateFrom is Iterate starting after the key start, it is used to page
+// through a prefix. A nil start begins at the prefix.
+func (s *KvStore) IterateFrom(prefix, start []byte, fn func(k, v []byte) bool) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.iterateOpen(s.ro, prefix, start, fn)
+}
+
+// Clear delete every replicated key from the store
+func (s *KvStore) Clear() error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.clear(nil)
+}
+
+// ClearFunc delete the replicated keys for which fn returns true, it is
+// used to drop the keys of a range which left the node
+func (s *KvStore) ClearFunc(fn func(k []byte) bool) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	if fn == nil {
+		return nil
+	}
+	return s.clear(fn)
+}
+
+// clear delete the replicated keys for which keep returns true, or every
+// one with a nil keep
+func (s *KvStore) clear(keep func(k []byte) bool) error {
+	var keys [][]byte
+	flush := func() error {
+		batch := keys
+		keys = nil
+		return s.write(func(wb *gorocksdb.WriteBatch) {
+			for _, k := range batch {
+				wb.Delete(k)
+			}
+		})
+	}
+
+	var writeErr error
+	err := iterate(s.db, s.ro, nil, nil, func(k, v []byte) bool {
+		if isLocalKey(k) || (keep != nil && !keep(k)) {
+			return true
+		}
+		keys = append(keys, k)
+		if len(keys) >= loadBatchSize {
+			writeErr = flush()
+		}
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return flush()
+}
+
+// Load replace the content of the store with a dump read from r
+func (s *KvStore) Load(r io.Reader) error {
+	return s.LoadGroup(r, 0, nil)
+}
+
+// LoadGroup replace the keys of the raft group group, those for which keep
+// returns true, with a dump of the group read from r. The other groups
+// sharing the store are left alone.
+func (s *KvStore) LoadGroup(r io.Reader, group uint64, keep func(k []byte) bool) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	dec := gob.NewDecoder(r)
+	var header dumpHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if err := s.clear(keep); err != nil {
+		return err
+	}
+
+	var keys, values [][]byte
+	for {
+		var e dumpEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		v, err := s.adoptValue(e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, e.Key)
+		values = append(values, v)
+		if len(keys) >= loadBatchSize {
+			if err := s.putRaw(keys, values); err != nil {
+				return err
+			}
+			keys, values = nil, nil
+		}
+	}
+	return s.applyRaw(appliedKey(group), header.AppliedIndex, keys, values, nil)
+}
+
+func iterate(db *gorocksdb.DB, ro *gorocksdb.ReadOptions, prefix, start []byte,
+	fn func(k, v []byte) bool) error {
+
+	it := db.NewIterator(ro)
+	defer it.Close()
+
+	seek := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		seek = start
+	}
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		k := it.Key()
+		if start != nil && bytes.Equal(k.Data(), start) {
+			k.Free()
+			continue
+		}
+		v := it.Value()
+		// The iterator owns the memory, hand out copies
+		key := append([]byte(nil), k.Data()...)
+		value := append([]byte(nil), v.Data()...)
+		k.Free()
+		v.Free()
+		if !fn(key, value) {
+			break
+		}
+	}
+	return it.Err()
+}
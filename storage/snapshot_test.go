@@ -0,0 +1,80 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+var groupPath = "/tmp/magicdb-group-test"
+
+func TestGroupDumpLoad(t *testing.T) {
+	os.RemoveAll(groupPath)
+	defer os.RemoveAll(groupPath)
+	store, err := NewKvStore(buildOpts(), groupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// group 1 owns the keys from "m" on
+	upper := func(k []byte) bool { return bytes.Compare(k, []byte("m")) >= 0 }
+	if err := store.ApplyGroup(0, 3, []KV{{"a", "1"}}, nil); err != nil {
+		t.Fatal("ApplyGroup error ", err)
+	}
+	if err := store.ApplyGroup(1, 7, []KV{{"x", "2"}}, nil); err != nil {
+		t.Fatal("ApplyGroup error ", err)
+	}
+	if index, _ := store.GroupAppliedIndex(1); index != 7 {
+		t.Fatal("GroupAppliedIndex excepted 7 but got ", index)
+	}
+	if index, _ := store.AppliedIndex(); index != 3 {
+		t.Fatal("AppliedIndex excepted 3 but got ", index)
+	}
+
+	var buf bytes.Buffer
+	snap, err := store.NewSnapshot()
+	if err != nil {
+		t.Fatal("NewSnapshot error ", err)
+	}
+	err = snap.DumpGroup(&buf, 1, upper)
+	snap.Release()
+	if err != nil {
+		t.Fatal("DumpGroup error ", err)
+	}
+
+	if err := store.ApplyGroup(1, 8, []KV{{"y", "3"}}, nil); err != nil {
+		t.Fatal("ApplyGroup error ", err)
+	}
+	if err := store.LoadGroup(&buf, 1, upper); err != nil {
+		t.Fatal("LoadGroup error ", err)
+	}
+	if v, _ := store.Get("y"); v != nil {
+		t.Fatal("LoadGroup excepted to drop 'y' but got ", string(v))
+	}
+	if v, _ := store.Get("x"); string(v) != "2" {
+		t.Fatal("LoadGroup excepted 'x' to be 2 but got ", string(v))
+	}
+	if v, _ := store.Get("a"); string(v) != "1" {
+		t.Fatal("LoadGroup excepted to keep the key of group 0 but got ", string(v))
+	}
+	if index, _ := store.GroupAppliedIndex(1); index != 7 {
+		t.Fatal("GroupAppliedIndex excepted 7 after load but got ", index)
+	}
+	if index, _ := store.AppliedIndex(); index != 3 {
+		t.Fatal("AppliedIndex excepted 3 after load but got ", index)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxLevels bounds the levels probed for their sst files
+const maxLevels = 16
+
+// Stats are the rocksdb properties and tickers of the store
+type Stats struct {
+	// MemtableBytes is the size of the active and immutable memtables
+	MemtableBytes uint64
+	// PendingCompactionBytes is the estimate of the bytes compaction has
+	// to rewrite to bring every level under its target size
+	PendingCompactionBytes uint64
+	RunningCompactions     uint64
+	LiveSSTBytes           uint64
+	EstimatedKeys          uint64
+	BlockCacheBytes        uint64
+	BlockCacheHits         uint64
+	BlockCacheMisses       uint64
+	// SSTFiles is the number of sst files of each level
+	SSTFiles []uint64
+}
+
+// Stats read the rocksdb statistics of the store
+func (s *KvStore) Stats() (Stats, error) {
+	if err := s.acquire(); err != nil {
+		return Stats{}, err
+	}
+	defer s.release()
+
+	st := Stats{
+		MemtableBytes:          s.intProperty("rocksdb.cur-size-all-mem-tables"),
+		PendingCompactionBytes: s.intProperty("rocksdb.estimate-pending-compaction-bytes"),
+		RunningCompactions:     s.intProperty("rocksdb.num-running-compactions"),
+		LiveSSTBytes:           s.intProperty("rocksdb.live-sst-files-size"),
+		EstimatedKeys:          s.intProperty("rocksdb.estimate-num-keys"),
+		BlockCacheBytes:        s.intProperty("rocksdb.block-cache-usage"),
+	}
+	for level := 0; level < maxLevels; level++ {
+		v := s.db.GetProperty(fmt.Sprintf("rocksdb.num-files-at-level%d", level))
+		if v == "" {
+			break
+		}
+		n, _ := strconv.ParseUint(v, 10, 64)
+		st.SSTFiles = append(st.SSTFiles, n)
+	}
+	tickers := parseTickers(s.opts.GetStatisticsString())
+	st.BlockCacheHits = tickers["rocksdb.block.cache.hit"]
+	st.BlockCacheMisses = tickers["rocksdb.block.cache.miss"]
+	return st, nil
+}
+
+func (s *KvStore) intProperty(name string) uint64 {
+	n, _ := strconv.ParseUint(s.db.GetProperty(name), 10, 64)
+	return n
+}
+
+// parseTickers read the counters of a rocksdb statistics dump, lines such
+// as "rocksdb.block.cache.hit COUNT : 42". Histograms are skipped.
+func parseTickers(stats string) map[string]uint64 {
+	tickers := make(map[string]uint64)
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[1] != "COUNT" || fields[2] != ":" {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[3], 10, 64); err == nil {
+			tickers[fields[0]] = n
+		}
+	}
+	return tickers
+}
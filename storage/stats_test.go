@@ -0,0 +1,68 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseTickers(t *testing.T) {
+	stats := "rocksdb.block.cache.miss COUNT : 7\n" +
+		"rocksdb.block.cache.hit COUNT : 42\n" +
+		"rocksdb.db.get.micros P50 : 1.000000 P95 : 2.000000 P99 : 3.000000 P100 : 4.000000 COUNT : 9 SUM : 10\n"
+	tickers := parseTickers(stats)
+	if tickers["rocksdb.block.cache.hit"] != 42 || tickers["rocksdb.block.cache.miss"] != 7 {
+		t.Fatal("parseTickers excepted hit 42 miss 7 but got ", tickers)
+	}
+	if _, ok := tickers["rocksdb.db.get.micros"]; ok {
+		t.Fatal("parseTickers excepted histograms to be skipped")
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magicdb-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewKvStore(NewDefaultOptions(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := store.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal("Put error ", err)
+		}
+	}
+	st, err := store.Stats()
+	if err != nil {
+		t.Fatal("Stats error ", err)
+	}
+	if st.MemtableBytes == 0 || st.EstimatedKeys == 0 {
+		t.Fatal("Stats excepted the memtable to hold the keys but got ", st)
+	}
+	if len(st.SSTFiles) == 0 {
+		t.Fatal("Stats excepted the levels of the store")
+	}
+
+	store.Close()
+	if _, err := store.Stats(); err != ErrClosed {
+		t.Fatal("Stats excepted ErrClosed but got ", err)
+	}
+}
@@ -15,10 +15,65 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"strconv"
 )
 
+// Keys beginning with systemPrefix are reserved for magicdb itself. Keys
+// under localPrefix describe the local replica and are never replicated.
+const (
+	systemPrefix = "\x00"
+	localPrefix  = systemPrefix + "local/"
+)
+
+var appliedIndexKey = []byte(localPrefix + "applied_index")
+
+// appliedKey is where the applied index of the raft group is kept, group 0
+// is the first raft group of the cluster
+func appliedKey(group uint64) []byte {
+	if group == 0 {
+		return appliedIndexKey
+	}
+	return []byte(fmt.Sprintf("%sapplied_index/%d", localPrefix, group))
+}
+
+// appliedGroup return the raft group of an applied index key k
+func appliedGroup(k []byte) (uint64, bool) {
+	if bytes.Equal(k, appliedIndexKey) {
+		return 0, true
+	}
+	prefix := []byte(string(appliedIndexKey) + "/")
+	if !bytes.HasPrefix(k, prefix) {
+		return 0, false
+	}
+	group, err := strconv.ParseUint(string(k[len(prefix):]), 10, 64)
+	return group, err == nil
+}
+
+// IsSystemKey reports whether the key belongs to the reserved keyspace
+func IsSystemKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(systemPrefix))
+}
+
+func isLocalKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(localPrefix))
+}
+
+func encodeIndex(index uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return buf
+}
+
+func decodeIndex(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
 func toBytesSlice(item interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -30,5 +85,11 @@ func toBytesSlice(item interface{}) ([]byte, error) {
 }
 
 func toBytes(item interface{}) []byte {
+	switch v := item.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
 	return []byte(fmt.Sprintf("%v", item.(interface{})))
 }
@@ -0,0 +1,165 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// record is one key-value of an export file. Keys and values are kept as
+// text when they are valid utf8 without a carriage return, which csv does
+// not keep, otherwise both are base64 encoded.
+type record struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+const encodingBase64 = "base64"
+
+func newRecord(k, v []byte) record {
+	if utf8.Valid(k) && utf8.Valid(v) && bytes.IndexByte(k, '\r') < 0 && bytes.IndexByte(v, '\r') < 0 {
+		return record{Key: string(k), Value: string(v)}
+	}
+	return record{
+		Key:      base64.StdEncoding.EncodeToString(k),
+		Value:    base64.StdEncoding.EncodeToString(v),
+		Encoding: encodingBase64,
+	}
+}
+
+func (r record) decode() ([]byte, []byte, error) {
+	switch r.Encoding {
+	case "":
+		return []byte(r.Key), []byte(r.Value), nil
+	case encodingBase64:
+		k, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := base64.StdEncoding.DecodeString(r.Value)
+		return k, v, err
+	}
+	return nil, nil, fmt.Errorf("unknown record encoding %q", r.Encoding)
+}
+
+type recordWriter interface {
+	Write(r record) error
+	Flush() error
+}
+
+type recordReader interface {
+	// Read return io.EOF at the end of input
+	Read() (record, error)
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case "jsonl":
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "value", "encoding"}); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use jsonl or csv", format)
+}
+
+func newRecordReader(format string, r io.Reader) (recordReader, error) {
+	switch format {
+	case "jsonl":
+		return &jsonlReader{dec: json.NewDecoder(r)}, nil
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		// skip the header
+		if _, err := cr.Read(); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return &csvReader{r: cr}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use jsonl or csv", format)
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(r record) error { return w.enc.Encode(r) }
+func (w *jsonlWriter) Flush() error         { return w.w.Flush() }
+
+type jsonlReader struct {
+	dec *json.Decoder
+}
+
+func (r *jsonlReader) Read() (record, error) {
+	var rec record
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvWriter) Write(r record) error {
+	return w.w.Write([]string{r.Key, r.Value, r.Encoding})
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+}
+
+func (r *csvReader) Read() (record, error) {
+	fields, err := r.r.Read()
+	if err != nil {
+		return record{}, err
+	}
+	if len(fields) < 2 {
+		return record{}, fmt.Errorf("csv record needs key and value, got %d fields", len(fields))
+	}
+	rec := record{Key: fields[0], Value: fields[1]}
+	if len(fields) > 2 {
+		rec.Encoding = fields[2]
+	}
+	return rec, nil
+}
+
+// countingReader count the bytes read for progress reporting
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
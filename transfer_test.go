@@ -0,0 +1,80 @@
+// Copyright 2019 The magicdb Authors
+//
+// Licensed under the Apache Licence, Version 2.0(the "License");
+// You may not use the file except in compliance with the Licence.
+// You may obtain a copy of the Licence at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distrubuted under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestTransferRoundTrip(t *testing.T) {
+	pairs := [][2][]byte{
+		{[]byte("user/1"), []byte("alice")},
+		{[]byte("empty"), []byte("")},
+		{[]byte("a,b \"quoted\""), []byte("line\nbreak")},
+		{[]byte("crlf"), []byte("one\r\ntwo")},
+		{[]byte("unicode/é"), []byte("ü")},
+		{[]byte{0xff, 0x00, 'k'}, []byte("text")},
+		{[]byte("bin"), []byte{0x00, 0xfe, 0xff}},
+	}
+	for _, format := range []string{"csv", "jsonl"} {
+		var buf bytes.Buffer
+		w, err := newRecordWriter(format, &buf)
+		if err != nil {
+			t.Fatal("newRecordWriter error ", err)
+		}
+		for _, p := range pairs {
+			if err := w.Write(newRecord(p[0], p[1])); err != nil {
+				t.Fatal(format, " Write error ", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(format, " Flush error ", err)
+		}
+
+		r, err := newRecordReader(format, &buf)
+		if err != nil {
+			t.Fatal("newRecordReader error ", err)
+		}
+		for _, p := range pairs {
+			rec, err := r.Read()
+			if err != nil {
+				t.Fatal(format, " Read error ", err)
+			}
+			k, v, err := rec.decode()
+			if err != nil {
+				t.Fatal(format, " decode error ", err)
+			}
+			if !bytes.Equal(k, p[0]) || !bytes.Equal(v, p[1]) {
+				t.Fatalf("%s excepted %q=%q but got %q=%q", format, p[0], p[1], k, v)
+			}
+		}
+		if _, err := r.Read(); err != io.EOF {
+			t.Fatal(format, " excepted io.EOF at the end but got ", err)
+		}
+	}
+}
+
+func TestTransferFormat(t *testing.T) {
+	if _, err := newRecordWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Fatal("newRecordWriter excepted an error for an unknown format")
+	}
+	if _, err := newRecordReader("xml", &bytes.Buffer{}); err == nil {
+		t.Fatal("newRecordReader excepted an error for an unknown format")
+	}
+	if _, _, err := (record{Key: "k", Encoding: "hex"}).decode(); err == nil {
+		t.Fatal("decode excepted an error for an unknown encoding")
+	}
+}